@@ -0,0 +1,717 @@
+package alerts
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/rminnich/go9p"
+	"hubs.net.uk/sw/nopfs"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode"
+)
+
+var readme_alerts = `
+Alerts
+======
+
+This directory evaluates rules against files elsewhere in the tree,
+sampled every 10 seconds, so that the state of everything watched may
+be read in one place.
+
+  rules       The rules in force, one per line
+  active      The rules not ok, worst first, with their value and
+              since when
+  history     Each change of state, oldest first, up to the last 1000
+  r/state     The state of the rule named r, its value, the samples it
+              is based on and whether it is flapping
+
+A rule is written as
+
+  name path metric op warn crit [window]
+
+where the path is that of a file, such as host/core1/icmp/ping or
+aflist/rxpower0, and the metric is one of
+
+  rtt         the mean of the times in ms the file gives, as ping does
+  loss        the percentage of reads that fail, as pings unanswered
+  value       the mean of the first number in the file
+
+taken over the window, by default 5m. The op is > or < and warn and
+crit are the thresholds beyond which the rule is in that state, for
+example
+
+  core1-rtt host/core1/icmp/ping rtt > 50ms 80ms 5m
+  core1-loss host/core1/icmp/ping loss > 1% 2% 5m
+  ap1-rx aflist/rxpower0 value < -70 -80 15m
+
+Rules are given to the server with -alert, one flag for each, and not
+by clients, as the files they watch are read by the server itself
+every 10 seconds, without the rate limits clients are held to.
+
+A rule changes state only once the new state has held for 3 samples
+running. A rule that has changed state 4 times or more in the last hour
+is flapping, and then must hold the new state for 12 samples.
+
+`
+var Readme nopfs.Dispatcher = nopfs.NewFile([]byte(readme_alerts))
+
+// Time between samples of each rule, and the default window
+var Interval = 10 * time.Second
+var Window = 5 * time.Minute
+
+// Samples a new state must hold for before a rule takes it, and when
+// flapping
+var Hold = 3
+var FlapHold = 12
+
+// Changes of state within FlapWindow making a rule flapping
+var FlapWindow = time.Hour
+var FlapLimit = 4
+
+// The changes of state kept, and the most rules
+var MaxHistory = 1000
+var MaxRules = 1000
+
+// The tree in which the paths of rules are looked up
+var Root nopfs.Dispatcher
+
+type Level int
+
+const (
+	OK Level = iota
+	Warn
+	Crit
+)
+
+func (l Level) String() string {
+	switch l {
+	case Warn:
+		return "warn"
+	case Crit:
+		return "crit"
+	}
+	return "ok"
+}
+
+type sample struct {
+	at    time.Time
+	value float64
+	ok    bool
+}
+
+type rule struct {
+	name   string
+	path   string
+	metric string
+	above  bool
+	warn   float64
+	crit   float64
+	window time.Duration
+
+	samples  []sample
+	value    float64
+	have     bool
+	level    Level
+	since    time.Time
+	pending  Level
+	count    int
+	changes  []time.Time
+	last     time.Time
+	err      error
+	sampling bool
+}
+
+var rules = struct {
+	sync.Mutex
+	m map[string]*rule
+}{m: make(map[string]*rule)}
+
+var history = struct {
+	sync.Mutex
+	lines []string
+}{}
+
+// Names taken by the files of the directory
+var reserved = map[string]bool{"README.txt": true, "rules": true, "active": true, "history": true}
+
+// number parses a threshold, allowing a unit such as ms, % or dBm
+func number(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimRightFunc(s, func(r rune) bool {
+		return unicode.IsLetter(r) || r == '%'
+	}), 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: bad threshold", s)
+	}
+	return v, nil
+}
+
+func parseRule(fields []string) (*rule, error) {
+	if len(fields) != 6 && len(fields) != 7 {
+		return nil, errors.New("expected name path metric op warn crit [window]")
+	}
+	r := &rule{name: fields[0], path: strings.Trim(fields[1], "/"), metric: fields[2], window: Window}
+	if reserved[r.name] || strings.Contains(r.name, "/") {
+		return nil, fmt.Errorf("%s: bad name", r.name)
+	}
+	switch r.metric {
+	case "rtt", "loss", "value":
+	default:
+		return nil, fmt.Errorf("%s: unknown metric", r.metric)
+	}
+	switch fields[3] {
+	case ">":
+		r.above = true
+	case "<":
+	default:
+		return nil, fmt.Errorf("%s: expected > or <", fields[3])
+	}
+	var err error
+	if r.warn, err = number(fields[4]); err != nil {
+		return nil, err
+	}
+	if r.crit, err = number(fields[5]); err != nil {
+		return nil, err
+	}
+	if r.beyond(r.warn, r.crit) {
+		return nil, fmt.Errorf("warn %s is beyond crit %s", fields[4], fields[5])
+	}
+	if len(fields) == 7 {
+		r.window, err = time.ParseDuration(fields[6])
+		if err != nil || r.window < Interval {
+			return nil, fmt.Errorf("%s: bad window", fields[6])
+		}
+	}
+	return r, nil
+}
+
+// beyond says whether the value is past the threshold
+func (r *rule) beyond(value, threshold float64) bool {
+	if r.above {
+		return value > threshold
+	}
+	return value < threshold
+}
+
+func (r *rule) op() string {
+	if r.above {
+		return ">"
+	}
+	return "<"
+}
+
+func (r *rule) unit() string {
+	switch r.metric {
+	case "rtt":
+		return " ms"
+	case "loss":
+		return "%"
+	}
+	return ""
+}
+
+func (r *rule) String() string {
+	return fmt.Sprintf("%s %s %s %s %g %g %s", r.name, r.path, r.metric, r.op(), r.warn, r.crit, r.window)
+}
+
+func setRule(fields []string) error {
+	if len(fields) == 1 {
+		rules.Lock()
+		delete(rules.m, fields[0])
+		rules.Unlock()
+		return nil
+	}
+	r, err := parseRule(fields)
+	if err != nil {
+		return err
+	}
+	rules.Lock()
+	defer rules.Unlock()
+	if _, ok := rules.m[r.name]; !ok && len(rules.m) >= MaxRules {
+		return fmt.Errorf("more than %d rules", MaxRules)
+	}
+	r.since = time.Now()
+	rules.m[r.name] = r
+	return nil
+}
+
+// Rules sets rules for alerts. It may be used as a flag, each value
+// being a rule as written to the rules file.
+type Rules struct{}
+
+func (Rules) Set(v string) error {
+	return setRule(strings.Fields(v))
+}
+
+func (Rules) String() string {
+	return ""
+}
+
+// sorted gives the rules in order of name, it must be called with the
+// lock.
+func sorted() []*rule {
+	list := make([]*rule, 0, len(rules.m))
+	for _, r := range rules.m {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+func listRules() []byte {
+	rules.Lock()
+	defer rules.Unlock()
+	buf := &bytes.Buffer{}
+	for _, r := range sorted() {
+		fmt.Fprintln(buf, r)
+	}
+	return buf.Bytes()
+}
+
+func rulesFile(path []string) ([]byte, error) {
+	return listRules(), nil
+}
+
+var timeRe = regexp.MustCompile(`([0-9]+(?:\.[0-9]+)?) ?ms`)
+var numberRe = regexp.MustCompile(`-?[0-9]+(?:\.[0-9]+)?`)
+
+// read walks from the root to the file and reads it as the server
+// itself, so without rate limits.
+func read(path string) ([]byte, error) {
+	if Root == nil {
+		return nil, os.ErrNotExist
+	}
+	d := Root.Clone()
+	for _, name := range strings.Split(path, "/") {
+		if !d.IsDir() {
+			return nil, os.ErrNotExist
+		}
+		n, err := d.Walk(nil, name)
+		if err != nil {
+			return nil, err
+		}
+		d = n
+	}
+	if d.IsDir() {
+		return nil, fmt.Errorf("%s: is a directory", path)
+	}
+	defer d.Close()
+	return d.Read(nil)
+}
+
+// measure reads the file of the rule for a sample
+func (r *rule) measure() (s sample, err error) {
+	s.at = time.Now()
+	data, err := read(r.path)
+	if err != nil {
+		return
+	}
+	switch r.metric {
+	case "rtt":
+		if m := timeRe.FindSubmatch(data); m != nil {
+			s.value, err = strconv.ParseFloat(string(m[1]), 64)
+			s.ok = err == nil
+		} else {
+			err = errors.New("no time given")
+		}
+	case "loss":
+		s.ok = true
+	case "value":
+		if m := numberRe.Find(data); m != nil {
+			s.value, err = strconv.ParseFloat(string(m), 64)
+			s.ok = err == nil
+		} else {
+			err = errors.New("no number given")
+		}
+	}
+	return
+}
+
+// aggregate works out the value of the rule over the window from the
+// samples in it, it must be called with the lock.
+func (r *rule) aggregate(now time.Time) {
+	keep := r.samples[:0]
+	for _, s := range r.samples {
+		if now.Sub(s.at) <= r.window {
+			keep = append(keep, s)
+		}
+	}
+	r.samples = keep
+	total, n := 0.0, 0
+	for _, s := range r.samples {
+		switch {
+		case r.metric == "loss" && !s.ok:
+			total += 100
+		case r.metric != "loss" && s.ok:
+			total += s.value
+		case r.metric != "loss":
+			continue
+		}
+		n++
+	}
+	r.have = n > 0
+	if r.have {
+		r.value = total / float64(n)
+	}
+}
+
+// flapping says whether the rule has changed state too often of late,
+// it must be called with the lock.
+func (r *rule) flapping(now time.Time) bool {
+	n := 0
+	for _, t := range r.changes {
+		if now.Sub(t) <= FlapWindow {
+			n++
+		}
+	}
+	return n >= FlapLimit
+}
+
+// evaluate takes a sample, moving the rule to a new state once that has
+// held long enough and giving the change. It must be called with the
+// lock.
+func (r *rule) evaluate(s sample, err error) *Event {
+	r.samples = append(r.samples, s)
+	r.last, r.err = s.at, err
+	r.aggregate(s.at)
+	if !r.have {
+		return nil
+	}
+	level := OK
+	switch {
+	case r.beyond(r.value, r.crit):
+		level = Crit
+	case r.beyond(r.value, r.warn):
+		level = Warn
+	}
+	switch {
+	case level == r.level:
+		r.count = 0
+		return nil
+	case level == r.pending && r.count > 0:
+		r.count++
+	default:
+		r.pending, r.count = level, 1
+	}
+	hold := Hold
+	if r.flapping(s.at) {
+		hold = FlapHold
+	}
+	if r.count < hold {
+		return nil
+	}
+	line := fmt.Sprintf("%s  %s  %s -> %s  %s %s  %s\n", s.at.UTC().Format(time.RFC3339),
+		r.name, r.level, level, r.metric, r.valueText(), r.path)
+	nopfs.Log.Info("alert", "rule", r.name, "from", r.level, "to", level, "value", r.value)
+	ev := &Event{Time: s.at, Rule: r.name, Path: r.path, Metric: r.metric,
+		From: r.level, To: level, Value: r.value, Unit: strings.TrimSpace(r.unit())}
+	r.level, r.since, r.count = level, s.at, 0
+	keep := r.changes[:0]
+	for _, t := range r.changes {
+		if s.at.Sub(t) <= FlapWindow {
+			keep = append(keep, t)
+		}
+	}
+	r.changes = append(keep, s.at)
+	history.Lock()
+	history.lines = append(history.lines, line)
+	if len(history.lines) > MaxHistory {
+		history.lines = history.lines[len(history.lines)-MaxHistory:]
+	}
+	history.Unlock()
+	return ev
+}
+
+// An Event is a rule changing state
+type Event struct {
+	Time   time.Time
+	Rule   string
+	Path   string
+	Metric string
+	From   Level
+	To     Level
+	Value  float64
+	Unit   string
+}
+
+// Severity is the worse of the states an event is between, so that a
+// rule recovering from crit is as severe as its going to crit.
+func (ev Event) Severity() Level {
+	if ev.From > ev.To {
+		return ev.From
+	}
+	return ev.To
+}
+
+func (ev Event) String() string {
+	return fmt.Sprintf("%s %s -> %s, %s %.1f%s, %s", ev.Rule, ev.From, ev.To, ev.Metric, ev.Value, ev.Unit, ev.Path)
+}
+
+var listeners = struct {
+	sync.Mutex
+	funcs []func(Event)
+}{}
+
+// Listen has the function called with every change of state
+func Listen(f func(Event)) {
+	listeners.Lock()
+	defer listeners.Unlock()
+	listeners.funcs = append(listeners.funcs, f)
+}
+
+func notify(ev Event) {
+	listeners.Lock()
+	funcs := listeners.funcs
+	listeners.Unlock()
+	for _, f := range funcs {
+		f(ev)
+	}
+}
+
+// ParseLevel parses ok, warn or crit
+func ParseLevel(s string) (Level, error) {
+	for l := OK; l <= Crit; l++ {
+		if s == l.String() {
+			return l, nil
+		}
+	}
+	return OK, fmt.Errorf("%s: expected ok, warn or crit", s)
+}
+
+// Closed to stop the sampling of rules, and the samples being taken
+var stopped = make(chan bool)
+var stopOnce sync.Once
+var inflight sync.WaitGroup
+
+// tick samples every rule not still waiting for its last sample
+func tick() {
+	rules.Lock()
+	defer rules.Unlock()
+	select {
+	case <-stopped:
+		return
+	default:
+	}
+	for _, r := range rules.m {
+		if r.sampling {
+			continue
+		}
+		r.sampling = true
+		inflight.Add(1)
+		go func(r *rule) {
+			defer inflight.Done()
+			s, err := r.measure()
+			rules.Lock()
+			r.sampling = false
+			// A rule removed or replaced while it was sampled is
+			// no longer in force, so its sample counts for nothing
+			var ev *Event
+			if rules.m[r.name] == r {
+				ev = r.evaluate(s, err)
+			}
+			rules.Unlock()
+			select {
+			case <-stopped:
+				return
+			default:
+			}
+			if ev != nil {
+				notify(*ev)
+			}
+		}(r)
+	}
+}
+
+// Start samples the rules every Interval, looking up their paths in
+// the tree from the root.
+func Start(root nopfs.Dispatcher) {
+	Root = root
+	go func() {
+		ticker := time.NewTicker(Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				tick()
+			case <-stopped:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the sampling of rules and waits for the samples being
+// taken, after which no more changes of state are sent. It is run when
+// the server shuts down.
+func Stop() {
+	stopOnce.Do(func() { close(stopped) })
+	// A tick that began before will have counted its samples by the
+	// time it lets go of the lock
+	rules.Lock()
+	rules.Unlock()
+	inflight.Wait()
+}
+
+func (r *rule) valueText() string {
+	if !r.have {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%s", r.value, r.unit())
+}
+
+func active(path []string) ([]byte, error) {
+	rules.Lock()
+	list := make([]*rule, 0)
+	for _, r := range sorted() {
+		if r.level != OK {
+			list = append(list, r)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].level > list[j].level })
+	now := time.Now()
+	buf := &bytes.Buffer{}
+	w := tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "name\tstate\tvalue\tsince\tpath")
+	for _, r := range list {
+		state := r.level.String()
+		if r.flapping(now) {
+			state += ", flapping"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.name, state, r.valueText(),
+			r.since.UTC().Format(time.RFC3339), r.path)
+	}
+	rules.Unlock()
+	w.Flush()
+	return buf.Bytes(), nil
+}
+
+func historyFile(path []string) ([]byte, error) {
+	history.Lock()
+	defer history.Unlock()
+	return []byte(strings.Join(history.lines, "")), nil
+}
+
+func state(path []string) ([]byte, error) {
+	if len(path) < 2 {
+		return nil, os.ErrInvalid
+	}
+	rules.Lock()
+	defer rules.Unlock()
+	r, ok := rules.m[path[1]]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	now := time.Now()
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "state     %s\n", r.level)
+	fmt.Fprintf(buf, "since     %s\n", r.since.UTC().Format(time.RFC3339))
+	fmt.Fprintf(buf, "rule      %s %s %s %g %g over %s\n", r.path, r.metric, r.op(), r.warn, r.crit, r.window)
+	fmt.Fprintf(buf, "value     %s from %d samples\n", r.valueText(), len(r.samples))
+	if r.count > 0 {
+		fmt.Fprintf(buf, "pending   %s for %d samples\n", r.pending, r.count)
+	}
+	flapping := "no"
+	if r.flapping(now) {
+		flapping = "yes"
+	}
+	fmt.Fprintf(buf, "flapping  %s, %d changes in %s\n", flapping, len(r.changes), FlapWindow)
+	if !r.last.IsZero() {
+		last := r.last.UTC().Format(time.RFC3339)
+		if r.err != nil {
+			last += ", " + r.err.Error()
+		}
+		fmt.Fprintf(buf, "sampled   %s\n", last)
+	}
+	return buf.Bytes(), nil
+}
+
+var RulesFile nopfs.Dispatcher = nopfs.NewFun(rulesFile)
+var Active nopfs.Dispatcher = nopfs.NewFun(active)
+var History nopfs.Dispatcher = nopfs.NewFun(historyFile)
+var State nopfs.Dispatcher = nopfs.NewFun(state)
+
+// ruleDir holds the state of a rule
+type ruleDir struct {
+	nopfs.ListDir
+}
+
+func (d *ruleDir) Clone() nopfs.Dispatcher {
+	n := &ruleDir{}
+	n.SetPath(d.GetPath())
+	n.SetParent(d.GetParent())
+	return n
+}
+
+func (d *ruleDir) Walk(req *go9p.SrvReq, name string) (nopfs.Dispatcher, error) {
+	if name != "state" {
+		return nil, os.ErrNotExist
+	}
+	return nopfs.Entry(d, State, name), nil
+}
+
+func (d *ruleDir) Read(req *go9p.SrvReq) ([]byte, error) {
+	return nopfs.PackEntries(req, []nopfs.Dispatcher{nopfs.Entry(d, State, "state")}), nil
+}
+
+// AlertsDir contains a directory for every rule besides its own
+// entries.
+type AlertsDir struct {
+	*nopfs.Dir
+}
+
+func (d *AlertsDir) Clone() nopfs.Dispatcher {
+	return &AlertsDir{d.Dir.Clone().(*nopfs.Dir)}
+}
+
+func (d *AlertsDir) Walk(req *go9p.SrvReq, name string) (nopfs.Dispatcher, error) {
+	if n, err := d.Dir.Walk(req, name); err == nil {
+		return n, nil
+	}
+	rules.Lock()
+	_, ok := rules.m[name]
+	rules.Unlock()
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	n := &ruleDir{}
+	n.SetPath(append(append([]string{}, d.GetPath()...), name))
+	n.SetParent(d)
+	return n, nil
+}
+
+func (d *AlertsDir) Read(req *go9p.SrvReq) ([]byte, error) {
+	listing, err := d.Dir.Read(req)
+	if err != nil {
+		return nil, err
+	}
+	rules.Lock()
+	names := make([]string, 0, len(rules.m))
+	for name := range rules.m {
+		names = append(names, name)
+	}
+	rules.Unlock()
+	sort.Strings(names)
+	entries := make([]nopfs.Dispatcher, 0, len(names))
+	for _, name := range names {
+		n := &ruleDir{}
+		n.SetPath(append(append([]string{}, d.GetPath()...), name))
+		entries = append(entries, n)
+	}
+	return append(append([]byte{}, listing...), nopfs.PackEntries(req, entries)...), nil
+}
+
+var Dir *AlertsDir
+
+func init() {
+	Dir = &AlertsDir{nopfs.NewDir()}
+	Dir.Append("README.txt", Readme)
+	Dir.Append("rules", RulesFile)
+	Dir.Append("active", Active)
+	Dir.Append("history", History)
+}
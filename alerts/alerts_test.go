@@ -0,0 +1,49 @@
+package alerts
+
+import (
+	"hubs.net.uk/sw/nopfs"
+	"sync"
+	"testing"
+)
+
+func TestRuleRemovedWhileSampled(t *testing.T) {
+	defer func(n int) { Hold = n }(Hold)
+	Hold = 1
+	sampling, release := make(chan bool), make(chan bool)
+	root := nopfs.NewDir()
+	root.Append("slow", nopfs.NewFun(func([]string) ([]byte, error) {
+		sampling <- true
+		<-release
+		return []byte("time=90 ms\n"), nil
+	}))
+	Root = root
+	var events struct {
+		sync.Mutex
+		n int
+	}
+	Listen(func(Event) {
+		events.Lock()
+		events.n++
+		events.Unlock()
+	})
+
+	// The sample would take the rule to crit were it still in force
+	if err := (Rules{}).Set("slow slow rtt > 50ms 80ms"); err != nil {
+		t.Fatal(err)
+	}
+	tick()
+	<-sampling
+	if err := (Rules{}).Set("slow"); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	inflight.Wait()
+	events.Lock()
+	defer events.Unlock()
+	if events.n != 0 {
+		t.Errorf("%d events sent for a removed rule", events.n)
+	}
+	if data := listRules(); len(data) != 0 {
+		t.Errorf("got rules %q", data)
+	}
+}
@@ -0,0 +1,622 @@
+package batch
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rminnich/go9p"
+	"hubs.net.uk/sw/nopfs"
+	"hubs.net.uk/sw/nopfs/dns"
+	"hubs.net.uk/sw/nopfs/icmp"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+var readme_batch = `
+Batches of probes
+=================
+
+This directory runs the same probe against many hosts at once. Write
+the probe followed by the targets, separated by spaces or newlines, to
+new. The batch starts once new is closed, and reading new gives its id,
+the name of a directory here, or that of the last batch made over the
+same connection.
+
+  % (echo icmp/ping; cat routers) > new
+  % cat new
+  % cat 1/results
+
+The probe is the path of a file below host/<name>/, such as icmp/ping,
+dns/addr, dns/@192.0.2.53/mx or icmp/pmtu, from the icmp and dns
+directories. Up to 32 targets are probed at a time and at most 1000 may
+be given. Making a batch counts against the batch rate limit, and each
+target against the rate limit of the probe, as if it had been probed
+by the client making the batch. Targets beyond the probe's limit fail
+rather than wait.
+
+  b/results   A line for each line of output of each probe, beginning
+              with the target, or its error, in the order the probes
+              finish. Reading waits for more until the batch is done,
+              so the results may be followed as they come.
+  b/status    The probe, how many targets have been done, failed and
+              are left, and the time taken
+  b/cancel    Write to stop the batch, probes not yet started are
+              skipped
+
+Batches are forgotten an hour after they finish.
+
+`
+var Readme nopfs.Dispatcher = nopfs.NewFile([]byte(readme_batch))
+
+// The probes of a batch run at once, and the most targets it may have
+var Workers = 32
+var MaxTargets = 1000
+
+// Time for which a finished batch is kept
+var Keep = time.Hour
+
+// Returned by reads of results that are flushed while they wait
+var ErrInterrupted error = syscall.EINTR
+
+// The directories under host/<name>/ whose files may be probed
+var Probes = map[string]nopfs.Dispatcher{}
+
+// lookup finds the file of the probe, a path below host/<name>/, for
+// the target.
+func lookup(probe []string, target string) (nopfs.Dispatcher, error) {
+	top, ok := Probes[probe[0]]
+	if !ok {
+		return nil, fmt.Errorf("%s: no such probe", strings.Join(probe, "/"))
+	}
+	d := top.Clone()
+	d.SetPath([]string{"host", target, probe[0]})
+	for _, name := range probe[1:] {
+		if !d.IsDir() {
+			return nil, fmt.Errorf("%s: no such probe", strings.Join(probe, "/"))
+		}
+		n, err := d.Walk(nil, name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: no such probe", strings.Join(probe, "/"))
+		}
+		d = n
+	}
+	if d.IsDir() {
+		return nil, fmt.Errorf("%s: is a directory", strings.Join(probe, "/"))
+	}
+	return d, nil
+}
+
+type batch struct {
+	sync.Mutex
+	id      int
+	probe   []string
+	targets []string
+	data    []byte
+	done    int
+	failed  int
+	running map[nopfs.Dispatcher]bool
+	stopped bool
+	start   time.Time
+	end     time.Time
+	// Closed and replaced whenever data is added or the batch ends
+	changed chan bool
+	// The client the probes are charged to, nil for the server
+	client *nopfs.ConnInfo
+}
+
+// Every batch by id, and the last made on each connection
+var batches = struct {
+	sync.Mutex
+	m    map[int]*batch
+	last map[uint64]int
+	next int
+}{m: make(map[int]*batch), last: make(map[uint64]int), next: 1}
+
+// finished says whether every target has been probed or the batch
+// stopped, it must be called with the lock.
+func (b *batch) finished() bool {
+	return !b.end.IsZero()
+}
+
+// report adds the output of a probe to the results, each line prefixed
+// with the target.
+func (b *batch) report(target string, data []byte, err error) {
+	buf := &bytes.Buffer{}
+	if err != nil {
+		fmt.Fprintf(buf, "%s  error: %s\n", target, err)
+	} else {
+		lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+		for _, line := range lines {
+			fmt.Fprintf(buf, "%s  %s\n", target, line)
+		}
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.data = append(b.data, buf.Bytes()...)
+	b.done++
+	if err != nil {
+		b.failed++
+	}
+	close(b.changed)
+	b.changed = make(chan bool)
+}
+
+// take gives the file probing the i'th target, or nil once the batch
+// has been stopped.
+func (b *batch) take(i int) (nopfs.Dispatcher, error) {
+	d, err := lookup(b.probe, b.targets[i])
+	if err != nil {
+		return nil, err
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.stopped {
+		return nil, nil
+	}
+	b.running[d] = true
+	return d, nil
+}
+
+// charge takes a probe of the target from the rate limit of the
+// probe's class for the client that made the batch, as the probe is
+// read without a request of its own.
+func (b *batch) charge(d nopfs.Dispatcher) error {
+	l, ok := d.(nopfs.Limited)
+	if !ok || b.client == nil {
+		return nil
+	}
+	return nopfs.Limits.AllowConn(l.Class(), b.client)
+}
+
+func (b *batch) run() {
+	b.Lock()
+	b.start = time.Now()
+	b.Unlock()
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < Workers && w < len(b.targets); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				d, err := b.take(i)
+				if err != nil {
+					b.report(b.targets[i], nil, err)
+					continue
+				}
+				if d == nil {
+					continue
+				}
+				if err = b.charge(d); err != nil {
+					d.Close()
+					b.Lock()
+					delete(b.running, d)
+					b.Unlock()
+					b.report(b.targets[i], nil, err)
+					continue
+				}
+				data, err := d.Read(nil)
+				d.Close()
+				b.Lock()
+				delete(b.running, d)
+				b.Unlock()
+				b.report(b.targets[i], data, err)
+			}
+		}()
+	}
+	for i := range b.targets {
+		b.Lock()
+		stopped := b.stopped
+		b.Unlock()
+		if stopped {
+			break
+		}
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	b.Lock()
+	b.end = time.Now()
+	close(b.changed)
+	b.changed = make(chan bool)
+	b.Unlock()
+	nopfs.Log.Info("batch done", "id", b.id, "probe", strings.Join(b.probe, "/"),
+		"targets", len(b.targets), "done", b.done, "failed", b.failed,
+		"duration", b.end.Sub(b.start))
+}
+
+// stop skips the targets not yet started and interrupts the probes
+// running, which only commands heed.
+func (b *batch) stop() {
+	b.Lock()
+	defer b.Unlock()
+	b.stopped = true
+	for d := range b.running {
+		d.Flush(nil)
+	}
+}
+
+// prune forgets batches that finished more than Keep ago
+func prune() {
+	batches.Lock()
+	defer batches.Unlock()
+	for id, b := range batches.m {
+		b.Lock()
+		old := b.finished() && time.Since(b.end) > Keep
+		b.Unlock()
+		if old {
+			delete(batches.m, id)
+		}
+	}
+	for conn, id := range batches.last {
+		if _, ok := batches.m[id]; !ok {
+			delete(batches.last, conn)
+		}
+	}
+}
+
+// parseProbe checks the probe is a path below host/<name>/ in one of
+// the directories of Probes
+func parseProbe(s string) ([]string, error) {
+	probe := strings.Split(strings.Trim(s, "/"), "/")
+	for _, p := range probe {
+		if p == "" || p == "." || p == ".." {
+			return nil, fmt.Errorf("%s: bad probe", s)
+		}
+	}
+	if _, ok := Probes[probe[0]]; !ok {
+		return nil, fmt.Errorf("%s: no such probe", s)
+	}
+	return probe, nil
+}
+
+// add gives the batch more targets, checking the probe can be made of
+// the first.
+func (b *batch) add(targets []string) error {
+	b.Lock()
+	defer b.Unlock()
+	if len(b.targets)+len(targets) > MaxTargets {
+		return fmt.Errorf("more than %d targets", MaxTargets)
+	}
+	for _, t := range targets {
+		if strings.Contains(t, "/") {
+			return fmt.Errorf("%s: bad target", t)
+		}
+		if len(b.targets) == 0 {
+			if _, err := lookup(b.probe, t); err != nil {
+				return err
+			}
+		}
+		b.targets = append(b.targets, t)
+	}
+	return nil
+}
+
+// register gives the batch an id and remembers it as the last made on
+// the connection
+func register(b *batch, conn uint64) {
+	prune()
+	batches.Lock()
+	defer batches.Unlock()
+	b.id = batches.next
+	batches.next++
+	batches.m[b.id] = b
+	batches.last[conn] = b.id
+}
+
+// NewFile is the new file. The probe and targets written to it may
+// take several writes, so the batch is started once it is closed.
+// Reading gives the id of the batch, or of the last one made on the
+// connection when nothing has been written.
+type NewFile struct {
+	nopfs.PseudoFile
+	lock    sync.Mutex
+	b       *batch
+	partial string
+}
+
+func (f *NewFile) Clone() nopfs.Dispatcher {
+	n := &NewFile{}
+	n.SetPath(f.GetPath())
+	n.SetParent(f.GetParent())
+	return n
+}
+
+func (f *NewFile) Perms() uint32      { return 0666 }
+func (f *NewFile) Size() uint64       { return uint64(0) }
+func (f *NewFile) Flush(*go9p.SrvReq) {}
+
+// connId identifies the connection of a request, zero for the server's
+func connId(req *go9p.SrvReq) uint64 {
+	if ci := nopfs.Conn(req); ci != nil {
+		return ci.Id
+	}
+	return 0
+}
+
+// Write adds to the batch the fields written, holding back the last if
+// it may continue in the next write. The first write is limited in the
+// batch class.
+func (f *NewFile) Write(req *go9p.SrvReq, data []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	text := f.partial + string(data)
+	fields := strings.Fields(text)
+	f.partial = ""
+	if len(fields) > 0 && strings.TrimRightFunc(text, unicode.IsSpace) == text {
+		f.partial = fields[len(fields)-1]
+		fields = fields[:len(fields)-1]
+	}
+	if f.b == nil && len(fields) > 0 {
+		if err := nopfs.Limits.Allow("batch", req); err != nil {
+			return err
+		}
+		probe, err := parseProbe(fields[0])
+		if err != nil {
+			return err
+		}
+		b := &batch{client: nopfs.Conn(req), probe: probe,
+			running: make(map[nopfs.Dispatcher]bool), changed: make(chan bool)}
+		if err = b.add(fields[1:]); err != nil {
+			return err
+		}
+		register(b, connId(req))
+		f.b = b
+		return nil
+	}
+	if f.b == nil {
+		return nil
+	}
+	return f.b.add(fields)
+}
+
+func (f *NewFile) Read(req *go9p.SrvReq) ([]byte, error) {
+	f.lock.Lock()
+	b := f.b
+	f.lock.Unlock()
+	if b != nil {
+		return []byte(strconv.Itoa(b.id) + "\n"), nil
+	}
+	batches.Lock()
+	defer batches.Unlock()
+	if id, ok := batches.last[connId(req)]; ok {
+		return []byte(strconv.Itoa(id) + "\n"), nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// Close starts the batch written, or forgets it if it has no targets
+func (f *NewFile) Close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	b := f.b
+	if b == nil {
+		return
+	}
+	f.b = nil
+	err := b.add(strings.Fields(f.partial))
+	b.Lock()
+	empty := len(b.targets) == 0
+	b.Unlock()
+	if err != nil || empty {
+		batches.Lock()
+		delete(batches.m, b.id)
+		batches.Unlock()
+		return
+	}
+	nopfs.Log.Info("batch", "id", b.id, "probe", strings.Join(b.probe, "/"), "targets", len(b.targets))
+	go b.run()
+}
+
+// get finds the batch whose directory holds the file
+func get(path []string) (*batch, error) {
+	if len(path) < 2 {
+		return nil, os.ErrInvalid
+	}
+	id, err := strconv.Atoi(path[1])
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	batches.Lock()
+	defer batches.Unlock()
+	b, ok := batches.m[id]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return b, nil
+}
+
+func status(path []string) ([]byte, error) {
+	b, err := get(path)
+	if err != nil {
+		return nil, err
+	}
+	b.Lock()
+	defer b.Unlock()
+	buf := &bytes.Buffer{}
+	state := "running"
+	end := time.Now()
+	switch {
+	case b.start.IsZero():
+		state = "waiting for the targets to be written"
+	case b.finished() && b.stopped:
+		state, end = "cancelled", b.end
+	case b.finished():
+		state, end = "done", b.end
+	case b.stopped:
+		state = "cancelling"
+	}
+	fmt.Fprintf(buf, "probe    %s\n", strings.Join(b.probe, "/"))
+	fmt.Fprintf(buf, "state    %s\n", state)
+	fmt.Fprintf(buf, "targets  %d\n", len(b.targets))
+	fmt.Fprintf(buf, "done     %d\n", b.done)
+	fmt.Fprintf(buf, "failed   %d\n", b.failed)
+	fmt.Fprintf(buf, "running  %d\n", len(b.running))
+	fmt.Fprintf(buf, "left     %d\n", len(b.targets)-b.done-len(b.running))
+	if !b.start.IsZero() {
+		fmt.Fprintf(buf, "started  %s\n", b.start.UTC().Format(time.RFC3339))
+		fmt.Fprintf(buf, "elapsed  %s\n", end.Sub(b.start).Round(time.Millisecond))
+	}
+	return buf.Bytes(), nil
+}
+
+func cancelCtl(c *nopfs.Ctl, data []byte) (resp []byte, err error) {
+	b, err := get(c.GetPath())
+	if err != nil {
+		return nil, err
+	}
+	b.stop()
+	return []byte("ok"), nil
+}
+
+// Results is a file whose reads wait for the results of the batch to
+// reach the offset read from, so that they may be followed.
+type Results struct {
+	nopfs.PseudoFile
+	lock    sync.Mutex
+	flushed chan bool
+}
+
+func (r *Results) Clone() nopfs.Dispatcher {
+	n := &Results{flushed: make(chan bool)}
+	n.SetPath(r.GetPath())
+	n.SetParent(r.GetParent())
+	return n
+}
+
+func (r *Results) Perms() uint32 { return 0444 }
+func (r *Results) Size() uint64  { return uint64(0) }
+func (r *Results) Close()        {}
+
+func (r *Results) Read(req *go9p.SrvReq) ([]byte, error) {
+	b, err := get(r.GetPath())
+	if err != nil {
+		return nil, err
+	}
+	var offset uint64
+	if req != nil && req.Tc != nil {
+		offset = req.Tc.Offset
+	}
+	r.lock.Lock()
+	flushed := r.flushed
+	r.lock.Unlock()
+	for {
+		b.Lock()
+		if uint64(len(b.data)) > offset || b.finished() || req == nil {
+			data := b.data
+			b.Unlock()
+			return data, nil
+		}
+		changed := b.changed
+		b.Unlock()
+		select {
+		case <-changed:
+		case <-flushed:
+			return nil, ErrInterrupted
+		}
+	}
+}
+
+// Flush interrupts reads waiting for results
+func (r *Results) Flush(*go9p.SrvReq) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	close(r.flushed)
+	r.flushed = make(chan bool)
+}
+
+var Status nopfs.Dispatcher = nopfs.NewFun(status)
+var Cancel nopfs.Dispatcher = &nopfs.Ctl{Writer: cancelCtl}
+var New nopfs.Dispatcher = &NewFile{}
+
+// batchDir holds the files of a batch
+type batchDir struct {
+	nopfs.ListDir
+}
+
+func (d *batchDir) Clone() nopfs.Dispatcher {
+	n := &batchDir{}
+	n.SetPath(d.GetPath())
+	n.SetParent(d.GetParent())
+	return n
+}
+
+func (d *batchDir) Walk(req *go9p.SrvReq, name string) (nopfs.Dispatcher, error) {
+	switch name {
+	case "results":
+		return nopfs.Entry(d, &Results{}, name), nil
+	case "status":
+		return nopfs.Entry(d, Status, name), nil
+	case "cancel":
+		return nopfs.Entry(d, Cancel, name), nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (d *batchDir) Read(req *go9p.SrvReq) ([]byte, error) {
+	entries := []nopfs.Dispatcher{nopfs.Entry(d, &Results{}, "results"),
+		nopfs.Entry(d, Status, "status"), nopfs.Entry(d, Cancel, "cancel")}
+	return nopfs.PackEntries(req, entries), nil
+}
+
+// BatchesDir contains a directory for every batch besides its own
+// entries.
+type BatchesDir struct {
+	*nopfs.Dir
+}
+
+func (d *BatchesDir) Clone() nopfs.Dispatcher {
+	return &BatchesDir{d.Dir.Clone().(*nopfs.Dir)}
+}
+
+func (d *BatchesDir) Walk(req *go9p.SrvReq, name string) (nopfs.Dispatcher, error) {
+	if n, err := d.Dir.Walk(req, name); err == nil {
+		return n, nil
+	}
+	path := append(append([]string{}, d.GetPath()...), name)
+	if _, err := get(path); err != nil {
+		return nil, err
+	}
+	n := &batchDir{}
+	n.SetPath(path)
+	n.SetParent(d)
+	return n, nil
+}
+
+func (d *BatchesDir) Read(req *go9p.SrvReq) ([]byte, error) {
+	listing, err := d.Dir.Read(req)
+	if err != nil {
+		return nil, err
+	}
+	prune()
+	batches.Lock()
+	ids := make([]int, 0, len(batches.m))
+	for id := range batches.m {
+		ids = append(ids, id)
+	}
+	batches.Unlock()
+	sort.Ints(ids)
+	entries := make([]nopfs.Dispatcher, 0, len(ids))
+	for _, id := range ids {
+		n := &batchDir{}
+		n.SetPath(append(append([]string{}, d.GetPath()...), strconv.Itoa(id)))
+		entries = append(entries, n)
+	}
+	return append(append([]byte{}, listing...), nopfs.PackEntries(req, entries)...), nil
+}
+
+var Dir *BatchesDir
+
+func init() {
+	Probes["icmp"] = icmp.Dir
+	Probes["dns"] = dns.Dir
+
+	Dir = &BatchesDir{nopfs.NewDir()}
+	Dir.Append("README.txt", Readme)
+	Dir.Append("new", New)
+}
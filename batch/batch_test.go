@@ -0,0 +1,44 @@
+package batch
+
+import (
+	"hubs.net.uk/sw/nopfs"
+	"strings"
+	"testing"
+)
+
+func TestChargeProbes(t *testing.T) {
+	if err := nopfs.Limits.Set("batchtest=2/1h"); err != nil {
+		t.Fatal(err)
+	}
+	defer nopfs.Limits.Set("batchtest=0")
+	dir := nopfs.NewDir()
+	dir.Append("probe", nopfs.NewFun(nopfs.HostF(func(host string) ([]byte, error) {
+		return []byte("up\n"), nil
+	})).Limit("batchtest"))
+	Probes["test"] = dir
+	defer delete(Probes, "test")
+
+	// Each target is charged to the client, the third over its limit
+	client := &nopfs.ConnInfo{Id: 1, Remote: "192.0.2.1:564", User: "glenda"}
+	b := &batch{client: client, probe: []string{"test", "probe"},
+		running: make(map[nopfs.Dispatcher]bool), changed: make(chan bool)}
+	if err := b.add([]string{"a", "b", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	b.run()
+	if b.done != 3 || b.failed != 1 || strings.Count(string(b.data), "  up\n") != 2 {
+		t.Errorf("done %d, failed %d, results\n%s", b.done, b.failed, b.data)
+	}
+	if err := nopfs.Limits.AllowConn("batchtest", client); err != nopfs.ErrRateLimited {
+		t.Errorf("got %v, budget not spent", err)
+	}
+
+	// Batches the server makes itself are not limited
+	b = &batch{probe: []string{"test", "probe"},
+		running: make(map[nopfs.Dispatcher]bool), changed: make(chan bool)}
+	b.add([]string{"a", "b", "c"})
+	b.run()
+	if b.done != 3 || b.failed != 0 {
+		t.Errorf("done %d, failed %d, results\n%s", b.done, b.failed, b.data)
+	}
+}
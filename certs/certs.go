@@ -0,0 +1,466 @@
+package certs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"hubs.net.uk/sw/nopfs"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var readme_tls = `
+TLS certificates
+================
+
+Each port is a directory named after its number, which will not appear
+in a listing until it has been descended into, for example
+
+  % cat 443/summary
+
+  p/chain      The certificates the server sends, in PEM
+  p/summary    The subject, names, issuer, validity and key of each
+               certificate, with the days left before it expires
+  p/verify     Whether the chain leads to a trusted root, whether the
+               certificate is for the host's name and whether any
+               certificate expires within 30 days
+  p/protocols  Which of TLS 1.0, 1.1, 1.2 and 1.3 the server accepts
+  p/ciphers    The cipher suites the server accepts, each tried in
+               turn, those for TLS 1.3 as negotiated
+  p/ocsp       The OCSP response stapled to the handshake, if any, with
+               the certificate's status and whether it is signed by the
+               issuer
+
+The host's name is sent in the handshake unless it is an address. On
+the mail ports 25, 587, 110 and 143 and on 21 the connection is
+upgraded with STARTTLS, or its equivalent, first. Roots are those of
+the system and any given to the server with -tlsca.
+
+Ports recently looked at appear as directories and may be forgotten by
+writing to the clear file.
+
+`
+var Readme nopfs.Dispatcher = nopfs.NewFile([]byte(readme_tls))
+
+// Time allowed to connect and complete a handshake
+var Timeout = 10 * time.Second
+
+// Certificates expiring within this are flagged
+var ExpiryWarning = 30 * 24 * time.Hour
+
+// Time for which a handshake is used again rather than made again
+var Reuse = 5 * time.Second
+
+// The roots certificates are verified against, nil for the system's
+var Roots *x509.CertPool
+
+// expect reads a reply, of several lines if the protocol continues them
+// as SMTP and FTP do, and checks that it starts as it should.
+func expect(r *bufio.Reader, prefix string, multi bool) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, prefix) {
+			return fmt.Errorf("starttls: unexpected reply: %s", strings.TrimSpace(line))
+		}
+		if !multi || len(line) < 4 || line[3] != '-' {
+			return nil
+		}
+	}
+}
+
+// starttls asks the server to begin TLS on the connection, for those
+// ports whose protocols start in the clear.
+func starttls(conn net.Conn, port int) error {
+	r := bufio.NewReader(conn)
+	send := func(s string) error {
+		_, err := conn.Write([]byte(s + "\r\n"))
+		return err
+	}
+	var err error
+	switch port {
+	case 25, 587:
+		if err = expect(r, "220", true); err == nil {
+			if err = send("EHLO nopfs"); err == nil {
+				if err = expect(r, "250", true); err == nil {
+					if err = send("STARTTLS"); err == nil {
+						err = expect(r, "220", true)
+					}
+				}
+			}
+		}
+	case 143:
+		if err = expect(r, "* OK", false); err == nil {
+			if err = send("a STARTTLS"); err == nil {
+				err = expect(r, "a OK", false)
+			}
+		}
+	case 110:
+		if err = expect(r, "+OK", false); err == nil {
+			if err = send("STLS"); err == nil {
+				err = expect(r, "+OK", false)
+			}
+		}
+	case 21:
+		if err = expect(r, "220", true); err == nil {
+			if err = send("AUTH TLS"); err == nil {
+				err = expect(r, "234", true)
+			}
+		}
+	}
+	return err
+}
+
+// dial connects to the port, ready for a handshake
+func dial(host string, port int) (net.Conn, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	conn, err := net.DialTimeout("tcp", addr, Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(Timeout))
+	if err = starttls(conn, port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// handshake completes a handshake on the connection with the
+// configuration, which is given the host's name unless it is an
+// address, and closes it. Certificates are not verified here.
+func handshake(conn net.Conn, host string, config *tls.Config) (tls.ConnectionState, error) {
+	defer conn.Close()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config.InsecureSkipVerify = true
+	if net.ParseIP(host) == nil {
+		config.ServerName = host
+	}
+	c := tls.Client(conn, config)
+	if err := c.Handshake(); err != nil {
+		return tls.ConnectionState{}, err
+	}
+	return c.ConnectionState(), nil
+}
+
+// try connects and completes a handshake with the configuration. A
+// failure to connect is returned as an error while the handshake's
+// failure is returned in failed.
+func try(host string, port int, config *tls.Config) (state tls.ConnectionState, failed, err error) {
+	conn, err := dial(host, port)
+	if err != nil {
+		return
+	}
+	state, failed = handshake(conn, host, config)
+	return
+}
+
+type result struct {
+	state tls.ConnectionState
+	made  time.Time
+}
+
+var results = struct {
+	sync.Mutex
+	m map[string]*result
+}{m: make(map[string]*result)}
+
+// get gives the state of a handshake with the port, made again if the
+// last is more than Reuse old
+func get(host string, port int) (tls.ConnectionState, error) {
+	key := strings.ToLower(host) + " " + strconv.Itoa(port)
+	results.Lock()
+	r, ok := results.m[key]
+	results.Unlock()
+	if ok && time.Since(r.made) < Reuse {
+		return r.state, nil
+	}
+	state, failed, err := try(host, port, nil)
+	if err == nil {
+		err = failed
+	}
+	if err != nil {
+		return state, err
+	}
+	results.Lock()
+	results.m[key] = &result{state: state, made: time.Now()}
+	results.Unlock()
+	return state, nil
+}
+
+func chain(path []string) ([]byte, error) {
+	host, port, err := nopfs.HostPort(path)
+	if err != nil {
+		return nil, err
+	}
+	state, err := get(host, port)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	for _, c := range state.PeerCertificates {
+		pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	}
+	return buf.Bytes(), nil
+}
+
+// daysLeft gives the whole days until the time, negative once past
+func daysLeft(t time.Time) int {
+	d := time.Until(t)
+	if d < 0 {
+		return -int(-d.Hours() / 24)
+	}
+	return int(d.Hours() / 24)
+}
+
+func keyName(c *x509.Certificate) string {
+	switch k := c.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ECDSA %s", k.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return c.PublicKeyAlgorithm.String()
+}
+
+// names gives the subject alternative names of a certificate
+func names(c *x509.Certificate) []string {
+	sans := append([]string{}, c.DNSNames...)
+	for _, ip := range c.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	sans = append(sans, c.EmailAddresses...)
+	for _, u := range c.URIs {
+		sans = append(sans, u.String())
+	}
+	return sans
+}
+
+func summary(path []string) ([]byte, error) {
+	host, port, err := nopfs.HostPort(path)
+	if err != nil {
+		return nil, err
+	}
+	state, err := get(host, port)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%s, %s\n", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	for i, c := range state.PeerCertificates {
+		fmt.Fprintf(buf, "\n%d subject     %s\n", i, c.Subject)
+		if sans := names(c); len(sans) > 0 {
+			fmt.Fprintf(buf, "  names       %s\n", strings.Join(sans, ", "))
+		}
+		fmt.Fprintf(buf, "  issuer      %s\n", c.Issuer)
+		fmt.Fprintf(buf, "  not before  %s\n", c.NotBefore.UTC().Format(time.RFC3339))
+		fmt.Fprintf(buf, "  not after   %s\n", c.NotAfter.UTC().Format(time.RFC3339))
+		fmt.Fprintf(buf, "  days left   %d\n", daysLeft(c.NotAfter))
+		fmt.Fprintf(buf, "  key         %s\n", keyName(c))
+		fmt.Fprintf(buf, "  signature   %s\n", c.SignatureAlgorithm)
+		fmt.Fprintf(buf, "  serial      %X\n", c.SerialNumber)
+	}
+	return buf.Bytes(), nil
+}
+
+func verify(path []string) ([]byte, error) {
+	host, port, err := nopfs.HostPort(path)
+	if err != nil {
+		return nil, err
+	}
+	state, err := get(host, port)
+	if err != nil {
+		return nil, err
+	}
+	certs := state.PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates")
+	}
+	leaf := certs[0]
+	opts := x509.VerifyOptions{Roots: Roots, Intermediates: x509.NewCertPool()}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	buf := &bytes.Buffer{}
+	chains, err := leaf.Verify(opts)
+	if err != nil {
+		fmt.Fprintf(buf, "chain     failed, %s\n", err)
+	} else {
+		root := chains[0][len(chains[0])-1]
+		fmt.Fprintf(buf, "chain     ok, to %s\n", root.Subject)
+	}
+	if err := leaf.VerifyHostname(host); err != nil {
+		fmt.Fprintf(buf, "hostname  failed, %s\n", err)
+	} else {
+		fmt.Fprintf(buf, "hostname  ok\n")
+	}
+	first := leaf
+	for _, c := range certs {
+		if c.NotAfter.Before(first.NotAfter) {
+			first = c
+		}
+	}
+	days := daysLeft(first.NotAfter)
+	switch {
+	case time.Now().After(first.NotAfter):
+		fmt.Fprintf(buf, "expiry    failed, %s expired %d days ago\n", first.Subject, -days)
+	case time.Now().Before(leaf.NotBefore):
+		fmt.Fprintf(buf, "expiry    failed, not valid until %s\n", leaf.NotBefore.UTC().Format(time.RFC3339))
+	case time.Until(first.NotAfter) < ExpiryWarning:
+		fmt.Fprintf(buf, "expiry    warning, %s expires in %d days\n", first.Subject, days)
+	default:
+		fmt.Fprintf(buf, "expiry    ok, %d days left\n", days)
+	}
+	return buf.Bytes(), nil
+}
+
+var versions = []uint16{tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13}
+
+func protocols(path []string) ([]byte, error) {
+	host, port, err := nopfs.HostPort(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]string, len(versions))
+	errs := make([]error, len(versions))
+	var wg sync.WaitGroup
+	for i, v := range versions {
+		wg.Add(1)
+		go func(i int, v uint16) {
+			defer wg.Done()
+			_, failed, err := try(host, port, &tls.Config{MinVersion: v, MaxVersion: v})
+			switch {
+			case err != nil:
+				errs[i] = err
+			case failed != nil:
+				lines[i] = fmt.Sprintf("%s  no, %s\n", tls.VersionName(v), failed)
+			default:
+				lines[i] = fmt.Sprintf("%s  yes\n", tls.VersionName(v))
+			}
+		}(i, v)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// The handshakes made at once in trying cipher suites
+var Concurrency = 4
+
+func ciphers(path []string) ([]byte, error) {
+	host, port, err := nopfs.HostPort(path)
+	if err != nil {
+		return nil, err
+	}
+	var suites []*tls.CipherSuite
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		for _, v := range s.SupportedVersions {
+			if v <= tls.VersionTLS12 {
+				suites = append(suites, s)
+				break
+			}
+		}
+	}
+	lines := make([]string, len(suites))
+	sem := make(chan bool, Concurrency)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var neterr error
+	// Suites the server does not accept are left out
+	for i, s := range suites {
+		wg.Add(1)
+		sem <- true
+		go func(i int, s *tls.CipherSuite) {
+			defer func() { <-sem; wg.Done() }()
+			config := &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{s.ID}}
+			state, failed, err := try(host, port, config)
+			switch {
+			case err != nil:
+				lock.Lock()
+				neterr = err
+				lock.Unlock()
+			case failed == nil:
+				note := ""
+				if s.Insecure {
+					note = "  insecure"
+				}
+				lines[i] = fmt.Sprintf("%s  %s%s\n", tls.VersionName(state.Version), s.Name, note)
+			}
+		}(i, s)
+	}
+	wg.Wait()
+	if neterr != nil {
+		return nil, neterr
+	}
+	state, failed, err := try(host, port, &tls.Config{MinVersion: tls.VersionTLS13})
+	if err != nil {
+		return nil, err
+	}
+	if failed == nil {
+		lines = append(lines, fmt.Sprintf("%s  %s\n", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite)))
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
+
+func ocsp(path []string) ([]byte, error) {
+	host, port, err := nopfs.HostPort(path)
+	if err != nil {
+		return nil, err
+	}
+	state, err := get(host, port)
+	if err != nil {
+		return nil, err
+	}
+	if len(state.OCSPResponse) == 0 {
+		return []byte("stapled      no\n"), nil
+	}
+	var issuer *x509.Certificate
+	if len(state.PeerCertificates) > 1 {
+		issuer = state.PeerCertificates[1]
+	}
+	r, err := parseOCSP(state.OCSPResponse)
+	if err != nil {
+		return nil, err
+	}
+	return r.text(state.PeerCertificates[0], issuer), nil
+}
+
+var Chain nopfs.Dispatcher = nopfs.NewFun(chain).Limit("tls")
+var Summary nopfs.Dispatcher = nopfs.NewFun(summary).Limit("tls")
+var Verify nopfs.Dispatcher = nopfs.NewFun(verify).Limit("tls")
+var Protocols nopfs.Dispatcher = nopfs.NewFun(protocols).Limit("tlsscan")
+var Ciphers nopfs.Dispatcher = nopfs.NewFun(ciphers).Limit("tlsscan")
+var OCSP nopfs.Dispatcher = nopfs.NewFun(ocsp).Limit("tls")
+
+var Dir *nopfs.AnyDir
+
+func init() {
+	Dir = nopfs.NewAnyDir()
+	Dir.Static("README.txt", Readme)
+	Dir.Static("clear", &nopfs.Ctl{Writer: nopfs.AnyDirCtlReset})
+	Dir.Append("chain", Chain)
+	Dir.Append("summary", Summary)
+	Dir.Append("verify", Verify)
+	Dir.Append("protocols", Protocols)
+	Dir.Append("ciphers", Ciphers)
+	Dir.Append("ocsp", OCSP)
+}
@@ -0,0 +1,211 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// The parts of an OCSP response, RFC 6960, needed to say what it says
+// of a certificate and who signed it
+
+type ocspResponseASN1 struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	Type     asn1.ObjectIdentifier
+	Response []byte
+}
+
+type basicOCSPResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type responseData struct {
+	Raw            asn1.RawContent
+	Version        int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID asn1.RawValue
+	ProducedAt     time.Time `asn1:"generalized"`
+	Responses      []singleResponse
+}
+
+type certID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type revokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+type singleResponse struct {
+	CertID     certID
+	Good       asn1.Flag   `asn1:"tag:0,optional"`
+	Revoked    revokedInfo `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag   `asn1:"tag:2,optional"`
+	ThisUpdate time.Time   `asn1:"generalized"`
+	NextUpdate time.Time   `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+var oidBasicResponse = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+// The signature algorithms a response may be signed with
+var signatureAlgorithms = map[string]x509.SignatureAlgorithm{
+	"1.2.840.113549.1.1.5":  x509.SHA1WithRSA,
+	"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+	"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+	"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+	"1.2.840.10045.4.1":     x509.ECDSAWithSHA1,
+	"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+	"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+	"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+	"1.3.101.112":           x509.PureEd25519,
+}
+
+var ocspStatus = []string{"successful", "malformed request", "internal error", "try later", "", "signature required", "unauthorized"}
+
+var revocationReasons = []string{"unspecified", "key compromise", "CA compromise", "affiliation changed", "superseded",
+	"cessation of operation", "certificate hold", "", "remove from CRL", "privilege withdrawn", "AA compromise"}
+
+// listed gives the name at the index, or nothing when it is not in the
+// list, as ASN.1 enumerations may be negative or beyond those known
+func listed(names []string, i int) string {
+	if i < 0 || i >= len(names) {
+		return ""
+	}
+	return names[i]
+}
+
+type ocspResponse struct {
+	status    int
+	basic     basicOCSPResponse
+	data      responseData
+	certs     []*x509.Certificate
+	algorithm x509.SignatureAlgorithm
+}
+
+func parseOCSP(b []byte) (*ocspResponse, error) {
+	var resp ocspResponseASN1
+	if _, err := asn1.Unmarshal(b, &resp); err != nil {
+		return nil, fmt.Errorf("ocsp: %s", err)
+	}
+	r := &ocspResponse{status: int(resp.Status)}
+	if r.status != 0 {
+		return r, nil
+	}
+	if !resp.Response.Type.Equal(oidBasicResponse) {
+		return nil, fmt.Errorf("ocsp: response of type %s", resp.Response.Type)
+	}
+	if _, err := asn1.Unmarshal(resp.Response.Response, &r.basic); err != nil {
+		return nil, fmt.Errorf("ocsp: %s", err)
+	}
+	if _, err := asn1.Unmarshal(r.basic.TBSResponseData.FullBytes, &r.data); err != nil {
+		return nil, fmt.Errorf("ocsp: %s", err)
+	}
+	if len(r.data.Responses) == 0 {
+		return nil, fmt.Errorf("ocsp: no responses")
+	}
+	for _, raw := range r.basic.Certificates {
+		c, err := x509.ParseCertificate(raw.FullBytes)
+		if err != nil {
+			return nil, fmt.Errorf("ocsp: %s", err)
+		}
+		r.certs = append(r.certs, c)
+	}
+	r.algorithm = signatureAlgorithms[r.basic.SignatureAlgorithm.Algorithm.String()]
+	return r, nil
+}
+
+// signer checks the response is signed by the issuer, or by a responder
+// the issuer has delegated to, which RFC 6960 section 4.2.2.2 requires
+// to have a certificate for OCSP signing.
+func (r *ocspResponse) signer(issuer *x509.Certificate) string {
+	if issuer == nil {
+		return "not checked, no issuer sent"
+	}
+	if r.algorithm == x509.UnknownSignatureAlgorithm {
+		return fmt.Sprintf("not checked, algorithm %s", r.basic.SignatureAlgorithm.Algorithm)
+	}
+	signed := r.basic.TBSResponseData.FullBytes
+	sig := r.basic.Signature.RightAlign()
+	if issuer.CheckSignature(r.algorithm, signed, sig) == nil {
+		return "ok, by the issuer"
+	}
+	for _, c := range r.certs {
+		if !ocspSigning(c) || c.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		if c.CheckSignature(r.algorithm, signed, sig) == nil {
+			return fmt.Sprintf("ok, by %s", c.Subject)
+		}
+	}
+	return "failed"
+}
+
+// ocspSigning says whether the certificate may sign OCSP responses
+func ocspSigning(c *x509.Certificate) bool {
+	for _, usage := range c.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageOCSPSigning {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ocspResponse) text(leaf, issuer *x509.Certificate) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "stapled      yes\n")
+	if r.status != 0 {
+		status := fmt.Sprintf("status %d", r.status)
+		if name := listed(ocspStatus, r.status); name != "" {
+			status = name
+		}
+		fmt.Fprintf(buf, "response     %s\n", status)
+		return buf.Bytes()
+	}
+	single := r.data.Responses[0]
+	for _, s := range r.data.Responses {
+		if s.CertID.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+			single = s
+			break
+		}
+	}
+	switch {
+	case bool(single.Good):
+		fmt.Fprintf(buf, "status       good\n")
+	case bool(single.Unknown):
+		fmt.Fprintf(buf, "status       unknown\n")
+	default:
+		why := ""
+		if name := listed(revocationReasons, int(single.Revoked.Reason)); name != "" {
+			why = ", " + name
+		}
+		fmt.Fprintf(buf, "status       revoked %s%s\n", single.Revoked.RevocationTime.UTC().Format(time.RFC3339), why)
+	}
+	if single.CertID.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		fmt.Fprintf(buf, "serial       %X, not the certificate's %X\n", single.CertID.SerialNumber, leaf.SerialNumber)
+	}
+	fmt.Fprintf(buf, "produced     %s\n", r.data.ProducedAt.UTC().Format(time.RFC3339))
+	fmt.Fprintf(buf, "this update  %s\n", single.ThisUpdate.UTC().Format(time.RFC3339))
+	if !single.NextUpdate.IsZero() {
+		next := single.NextUpdate.UTC().Format(time.RFC3339)
+		if time.Now().After(single.NextUpdate) {
+			next += ", stale"
+		}
+		fmt.Fprintf(buf, "next update  %s\n", next)
+	}
+	fmt.Fprintf(buf, "signature    %s\n", r.signer(issuer))
+	return buf.Bytes()
+}
@@ -0,0 +1,172 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+var oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+
+// mustMarshal encodes the value in DER
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	b, err := asn1.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// certificate makes a certificate for the key, signed by the parent and
+// its key, or self-signed when there is no parent
+func certificate(t *testing.T, template *x509.Certificate, key *ecdsa.PrivateKey,
+	parent *x509.Certificate, parentKey *ecdsa.PrivateKey) *x509.Certificate {
+	t.Helper()
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// serial identifies the certificate of the serial number to a response
+func serial(n int64) certID {
+	return certID{HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}},
+		SerialNumber: big.NewInt(n)}
+}
+
+// status makes an OCSP response giving only its status
+func status(t *testing.T, status asn1.Enumerated) []byte {
+	return mustMarshal(t, struct{ Status asn1.Enumerated }{status})
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// response makes a basic OCSP response of the single response, signed
+// with the key and carrying the certificates.
+func response(t *testing.T, single singleResponse, key *ecdsa.PrivateKey, certs ...*x509.Certificate) []byte {
+	t.Helper()
+	keyHash := mustMarshal(t, []byte("responder key hash"))
+	tbs := mustMarshal(t, struct {
+		ResponderID asn1.RawValue
+		ProducedAt  time.Time `asn1:"generalized"`
+		Responses   []singleResponse
+	}{
+		ResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: keyHash},
+		ProducedAt:  time.Now().UTC().Truncate(time.Second),
+		Responses:   []singleResponse{single},
+	})
+	digest := sha256.Sum256(tbs)
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	basic := basicOCSPResponse{
+		TBSResponseData:    asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256},
+		Signature:          asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)},
+	}
+	for _, c := range certs {
+		basic.Certificates = append(basic.Certificates, asn1.RawValue{FullBytes: c.Raw})
+	}
+	return mustMarshal(t, ocspResponseASN1{
+		Response: ocspResponseBytes{Type: oidBasicResponse, Response: mustMarshal(t, basic)},
+	})
+}
+
+func TestOCSPEnumerations(t *testing.T) {
+	leaf := &x509.Certificate{SerialNumber: big.NewInt(42)}
+	key := newKey(t)
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"negative status", status(t, -1), "response     status -1\n"},
+		{"unknown status", status(t, 4), "response     status 4\n"},
+		{"known status", status(t, 3), "response     try later\n"},
+		{"negative reason", response(t, singleResponse{CertID: serial(42),
+			Revoked:    revokedInfo{RevocationTime: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), Reason: -1},
+			ThisUpdate: time.Now().UTC().Truncate(time.Second)}, key),
+			"status       revoked 2026-01-02T03:04:05Z\n"},
+		{"known reason", response(t, singleResponse{CertID: serial(42),
+			Revoked:    revokedInfo{RevocationTime: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), Reason: 1},
+			ThisUpdate: time.Now().UTC().Truncate(time.Second)}, key),
+			"status       revoked 2026-01-02T03:04:05Z, key compromise\n"},
+	}
+	for _, test := range tests {
+		r, err := parseOCSP(test.b)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if text := string(r.text(leaf, nil)); !strings.Contains(text, test.want) {
+			t.Errorf("%s: no %q in\n%s", test.name, test.want, text)
+		}
+	}
+}
+
+func TestOCSPSigner(t *testing.T) {
+	caKey, responderKey := newKey(t), newKey(t)
+	ca := certificate(t, &x509.Certificate{SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "Test CA"}, NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour), IsCA: true, BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign}, caKey, nil, nil)
+	delegate := func(name string, usage ...x509.ExtKeyUsage) *x509.Certificate {
+		return certificate(t, &x509.Certificate{SerialNumber: big.NewInt(2),
+			Subject: pkix.Name{CommonName: name}, NotBefore: time.Now().Add(-time.Hour),
+			NotAfter: time.Now().Add(time.Hour), ExtKeyUsage: usage}, responderKey, ca, caKey)
+	}
+	single := singleResponse{CertID: serial(42), Good: true,
+		ThisUpdate: time.Now().UTC().Truncate(time.Second)}
+
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"issuer", response(t, single, caKey), "ok, by the issuer"},
+		{"delegated", response(t, single, responderKey, delegate("OCSP", x509.ExtKeyUsageOCSPSigning)),
+			"ok, by CN=OCSP"},
+		// A certificate the issuer signed for another purpose may
+		// not speak for it
+		{"not for ocsp", response(t, single, responderKey, delegate("Server", x509.ExtKeyUsageServerAuth)),
+			"failed"},
+		{"no usage", response(t, single, responderKey, delegate("Anything")), "failed"},
+		{"another key", response(t, single, newKey(t)), "failed"},
+	}
+	for _, test := range tests {
+		r, err := parseOCSP(test.b)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if got := r.signer(ca); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -1,15 +1,40 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"hubs.net.uk/sw/nopfs"
+	"hubs.net.uk/sw/nopfs/alerts"
+	"hubs.net.uk/sw/nopfs/batch"
+	"hubs.net.uk/sw/nopfs/certs"
 	"hubs.net.uk/sw/nopfs/dns"
 	"hubs.net.uk/sw/nopfs/icmp"
+	"hubs.net.uk/sw/nopfs/ipnet"
+	"hubs.net.uk/sw/nopfs/notify"
+	"hubs.net.uk/sw/nopfs/port"
+	"hubs.net.uk/sw/nopfs/trace"
+	"hubs.net.uk/sw/nopfs/web"
+	"hubs.net.uk/sw/nopfs/zone"
+	"io/ioutil"
 	"log"
+	"time"
 )
 
-var addr = flag.String("addr", ":5640", "network address")
+var addrs nopfs.Addrs
+var sockmode = flag.String("sockmode", "0660", "permissions of unix domain sockets")
+var sockowner = flag.String("sockowner", "", "user[:group] owning unix domain sockets")
 var debug = flag.Int("debug", 0, "print debug messages")
+var logformat = flag.String("logformat", "logfmt", "log format, logfmt or json")
+var loglevel = flag.String("loglevel", "info", "log level, error, info or debug")
+var auditlog = flag.String("audit", "", "file for the audit log instead of the server log")
+var grace = flag.Duration("grace", 10*time.Second, "time allowed for requests to finish on shutdown")
+var trustanchor = flag.String("trustanchor", "", "file of DS or DNSKEY records to use as DNSSEC trust anchors")
+var dnsca = flag.String("dnsca", "", "PEM file of extra certificate authorities for DNS over TLS and HTTPS")
+var tlsca = flag.String("tlsca", "", "PEM file of extra certificate authorities for verifying hosts' TLS certificates")
+var roothints = flag.String("roothints", "", "root hints file giving the servers where DNS traces begin")
+var responder = flag.String("responder", "", "address to answer the bufferbloat load of other servers on, loopback unless a host is given, as in 192.0.2.1:5642")
+var sigwarn = flag.Duration("sigwarn", dns.SigWarning, "warn of DNSSEC signatures expiring within this time")
 
 var readme_top = `
 Network Operations File System
@@ -19,7 +44,14 @@ This directory tree exposes live information about the network through
 the filesystem. It can be navigated and manipulated using all of the
 usual tools for working with files.
 
-  host/    information about specific hosts
+  host/       information about specific hosts
+  net/        information about whole networks
+  zone/       zones fetched by zone transfer
+  batch/      the same probe run against many hosts at once
+  alerts/     thresholds on latency, loss and other values watched
+  notify/     where changes of the alerts' state are sent
+  server/     what the server itself is doing
+  loglevel    write error, info or debug to change the log level
 
 `
 
@@ -29,8 +61,13 @@ Host operations
 
 Operations that may be done on a hostname or IP address.
 
-  h/icmp/    ping, traceroute, etc.
+  h/icmp/    ping, traceroute, jitter, MOS, bufferbloat, etc.
   h/dns/     gathering information from domain name system.
+  h/trace/   traceroute over ICMP, UDP or TCP, Paris and multipath.
+  h/tcp/     whether TCP ports accept connections, and their banners.
+  h/udp/     whether UDP ports answer probes.
+  h/http/    requests of the host's web server, with timings.
+  h/tls/     certificates, protocols and ciphers of TLS services.
 
 It suffices to change into the subdirectory named for the host or IP
 address. These subdirectories will not appear in a listing but can
@@ -39,6 +76,10 @@ nevertheless be descended into, for example,
   % cat 127.0.0.1/icmp/ping
   127.0.0.1 is alive (0.02 ms)
 
+Expensive probes are rate limited for each client. When the budget for
+a kind of probe is used up reading it fails with "resource temporarily
+unavailable" until enough time has passed, see server/ratelimit.
+
 This filesystem caches recently accessed hosts, and they will appear
 as directories. There is a control interface for clearing the cache,
 which consists of doing a write operation on the 'clear' file, as in,
@@ -47,11 +88,95 @@ which consists of doing a write operation on the 'clear' file, as in,
 
 `
 
+func init() {
+	flag.Var(&addrs, "addr", "network address, may be repeated (default :5640)")
+
+	nopfs.Limits.Set("mtr=2/1m")
+	nopfs.Limits.Set("traceroute=4/1m")
+	nopfs.Limits.Set("ping=60/1m")
+	nopfs.Limits.Set("dns=300/1m")
+	nopfs.Limits.Set("dnstrace=10/1m")
+	nopfs.Limits.Set("dnscheck=10/1m")
+	nopfs.Limits.Set("netscan=4/1m")
+	nopfs.Limits.Set("axfr=10/1m")
+	nopfs.Limits.Set("port=60/1m")
+	nopfs.Limits.Set("http=60/1m")
+	nopfs.Limits.Set("tls=30/1m")
+	nopfs.Limits.Set("tlsscan=4/1m")
+	nopfs.Limits.Set("batch=10/1m")
+	nopfs.Limits.Set("jitter=10/1m")
+	nopfs.Limits.Set("bufferbloat=2/1m")
+	nopfs.Limits.Set("notify=2/1m")
+	flag.Var(dns.Keys, "tsig", "TSIG key as [algorithm:]name:secret, may be repeated")
+	flag.Var(dns.UpdateZones{}, "tsigzones", "zones a TSIG key may update besides its own as name=zone[,zone...], may be repeated")
+	flag.Var(zone.Sources{}, "zone", "primary and TSIG key name for a zone as zone=primary[,key], may be repeated")
+	flag.Var(alerts.Rules{}, "alert", "alert rule as \"name path metric op warn crit [window]\", may be repeated")
+	flag.Var(notify.Sinks{}, "sink", "notification sink as \"name type target...\", may be repeated")
+	flag.Var(icmp.Responders{}, "loadresponder", "host[:port] of a responder bufferbloat may load links with, may be repeated (default port 5642)")
+	flag.Var(notify.Routes{}, "route", "notification route as \"name prefix severity sink,...\", may be repeated")
+	flag.Var(nopfs.Limits, "rate", "probe rate limit per client as class=count/duration, may be repeated")
+}
+
 func main() {
 	flag.Parse()
 
+	if *debug > 0 {
+		*loglevel = "debug"
+	}
+	err := nopfs.ConfigureLogs(*logformat, *loglevel, *auditlog)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	if *trustanchor != "" {
+		err = dns.LoadTrustAnchors(*trustanchor)
+		if err != nil {
+			log.Fatalf("trustanchor: %s", err)
+		}
+	}
+	dns.SigWarning = *sigwarn
+	if *dnsca != "" {
+		pem, err := ioutil.ReadFile(*dnsca)
+		if err != nil {
+			log.Fatalf("dnsca: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("dnsca: no certificates in %s", *dnsca)
+		}
+		dns.TLSConfig = &tls.Config{RootCAs: pool}
+	}
+	if *tlsca != "" {
+		pem, err := ioutil.ReadFile(*tlsca)
+		if err != nil {
+			log.Fatalf("tlsca: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("tlsca: no certificates in %s", *tlsca)
+		}
+		certs.Roots = pool
+	}
+	if *responder != "" {
+		if err = icmp.Respond(*responder); err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
+	if *roothints != "" {
+		err = dns.LoadRootHints(*roothints)
+		if err != nil {
+			log.Fatalf("roothints: %s", err)
+		}
+	}
+
 	root := nopfs.NewDir()
 	root.Append("README.txt", nopfs.NewFile([]byte(readme_top)))
+	root.Append("loglevel", &nopfs.Ctl{Writer: nopfs.LogLevelCtl})
 
 	host := nopfs.NewAnyDir()
 	root.Append("host", host)
@@ -60,12 +185,36 @@ func main() {
 
 	host.Append("icmp", icmp.Dir)
 	host.Append("dns", dns.Dir)
+	host.Append("trace", trace.Dir)
+	host.Append("tcp", port.TCP)
+	host.Append("udp", port.UDP)
+	host.Append("http", web.Dir)
+	host.Append("tls", certs.Dir)
+
+	root.Append("net", ipnet.Dir)
+	root.Append("zone", zone.Dir)
+	root.Append("batch", batch.Dir)
+	root.Append("alerts", alerts.Dir)
+	root.Append("notify", notify.Dir)
 
 	sfs := new(nopfs.NopSrv)
 	sfs.Debuglevel = *debug
+	root.Append("server", sfs.ServerDir())
 	sfs.Root = root
 	sfs.Start(sfs)
-	err := sfs.StartNetListener("tcp", *addr)
+	alerts.Start(root)
+	// Run last first at exit: alerts stop, notifications already
+	// under way are sent and then the audit log is closed
+	sfs.AtExit(nopfs.CloseLogs)
+	sfs.AtExit(notify.Flush)
+	sfs.AtExit(alerts.Stop)
+
+	listeners, err := nopfs.OpenListeners(addrs, ":5640", *sockmode, *sockowner)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	err = sfs.Run(listeners, *grace)
 	if err != nil {
 		log.Fatalf("%s", err)
 	}
@@ -3,21 +3,63 @@ package main
 import (
 	"flag"
 	"hubs.net.uk/sw/nopfs"
+	"hubs.net.uk/sw/nopfs/alerts"
+	"hubs.net.uk/sw/nopfs/notify"
 	"hubs.net.uk/sw/nopfs/ubnt"
 	"log"
+	"time"
 )
 
-var addr = flag.String("addr", ":5641", "network address")
+var addrs nopfs.Addrs
+var sockmode = flag.String("sockmode", "0660", "permissions of unix domain sockets")
+var sockowner = flag.String("sockowner", "", "user[:group] owning unix domain sockets")
 var debug = flag.Int("debug", 0, "print debug messages")
+var logformat = flag.String("logformat", "logfmt", "log format, logfmt or json")
+var loglevel = flag.String("loglevel", "info", "log level, error, info or debug")
+var auditlog = flag.String("audit", "", "file for the audit log instead of the server log")
+var grace = flag.Duration("grace", 10*time.Second, "time allowed for requests to finish on shutdown")
+
+func init() {
+	flag.Var(&addrs, "addr", "network address, may be repeated (default :5641)")
+
+	nopfs.Limits.Set("notify=2/1m")
+	flag.Var(alerts.Rules{}, "alert", "alert rule as \"name path metric op warn crit [window]\", may be repeated")
+	flag.Var(notify.Sinks{}, "sink", "notification sink as \"name type target...\", may be repeated")
+	flag.Var(notify.Routes{}, "route", "notification route as \"name prefix severity sink,...\", may be repeated")
+}
 
 func main() {
 	flag.Parse()
 
+	if *debug > 0 {
+		*loglevel = "debug"
+	}
+	err := nopfs.ConfigureLogs(*logformat, *loglevel, *auditlog)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
 	sfs := new(nopfs.NopSrv)
 	sfs.Debuglevel = *debug
+	ubnt.Dir.Append("server", sfs.ServerDir())
+	ubnt.Dir.Append("loglevel", &nopfs.Ctl{Writer: nopfs.LogLevelCtl})
+	ubnt.Dir.Append("alerts", alerts.Dir)
+	ubnt.Dir.Append("notify", notify.Dir)
 	sfs.Root = ubnt.Dir
 	sfs.Start(sfs)
-	err := sfs.StartNetListener("tcp", *addr)
+	alerts.Start(ubnt.Dir)
+	// Run last first at exit: alerts stop, notifications already
+	// under way are sent and then the audit log is closed
+	sfs.AtExit(nopfs.CloseLogs)
+	sfs.AtExit(notify.Flush)
+	sfs.AtExit(alerts.Stop)
+
+	listeners, err := nopfs.OpenListeners(addrs, ":5641", *sockmode, *sockowner)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	err = sfs.Run(listeners, *grace)
 	if err != nil {
 		log.Fatalf("%s", err)
 	}
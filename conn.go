@@ -0,0 +1,105 @@
+package nopfs
+
+import (
+	"github.com/rminnich/go9p"
+	"sync"
+	"time"
+)
+
+// Information kept about each client connection
+type ConnInfo struct {
+	Id      uint64
+	Remote  string
+	User    string
+	Opened  time.Time
+	Fids    int
+	Read    uint64
+	Written uint64
+}
+
+var connections = struct {
+	sync.Mutex
+	next  uint64
+	conns map[*go9p.Conn]*ConnInfo
+}{conns: make(map[*go9p.Conn]*ConnInfo)}
+
+func connOpened(conn *go9p.Conn) *ConnInfo {
+	connections.Lock()
+	defer connections.Unlock()
+	connections.next++
+	ci := &ConnInfo{Id: connections.next, Opened: time.Now()}
+	if addr := conn.RemoteAddr(); addr != nil {
+		ci.Remote = addr.String()
+	}
+	connections.conns[conn] = ci
+	return ci
+}
+
+func connClosed(conn *go9p.Conn) *ConnInfo {
+	connections.Lock()
+	defer connections.Unlock()
+	ci := connections.conns[conn]
+	delete(connections.conns, conn)
+	return ci
+}
+
+// Conn returns a copy of what is known about the connection a request
+// arrived on, or nil for requests made internally.
+func Conn(req *go9p.SrvReq) *ConnInfo {
+	if req == nil || req.Conn == nil {
+		return nil
+	}
+	connections.Lock()
+	defer connections.Unlock()
+	ci, ok := connections.conns[req.Conn]
+	if !ok {
+		return nil
+	}
+	c := *ci
+	return &c
+}
+
+func setConnUser(conn *go9p.Conn, user string) {
+	connections.Lock()
+	defer connections.Unlock()
+	if ci, ok := connections.conns[conn]; ok {
+		ci.User = user
+	}
+}
+
+func connFids(conn *go9p.Conn, delta int) {
+	connections.Lock()
+	defer connections.Unlock()
+	if ci, ok := connections.conns[conn]; ok {
+		ci.Fids += delta
+	}
+}
+
+func connBytes(conn *go9p.Conn, read, written int) {
+	connections.Lock()
+	defer connections.Unlock()
+	if ci, ok := connections.conns[conn]; ok {
+		ci.Read += uint64(read)
+		ci.Written += uint64(written)
+	}
+}
+
+// Connections returns a copy of what is known about every connection
+func Connections() []ConnInfo {
+	connections.Lock()
+	defer connections.Unlock()
+	conns := make([]ConnInfo, 0, len(connections.conns))
+	for _, ci := range connections.conns {
+		conns = append(conns, *ci)
+	}
+	return conns
+}
+
+// ReqFields returns log fields identifying the client making a request
+func ReqFields(req *go9p.SrvReq) []interface{} {
+	ci := Conn(req)
+	if ci == nil {
+		return nil
+	}
+	return []interface{}{"conn", ci.Id, "remote", ci.Remote, "user", ci.User}
+}
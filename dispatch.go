@@ -1,6 +1,7 @@
 package nopfs
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
 	"github.com/rminnich/go9p"
@@ -313,6 +314,36 @@ func AnyDirCtlReset(c *Ctl, data []byte) (resp []byte, err error) {
 	return
 }
 
+// ListDir is a directory whose entries are worked out when it is read.
+// It is embedded in types giving Clone, Walk and Read.
+type ListDir struct {
+	Path
+}
+
+func (d *ListDir) IsDir() bool                      { return true }
+func (d *ListDir) Perms() uint32                    { return 0555 }
+func (d *ListDir) Size() uint64                     { return uint64(0) }
+func (d *ListDir) Write(*go9p.SrvReq, []byte) error { return os.ErrInvalid }
+func (d *ListDir) Close()                           {}
+func (d *ListDir) Flush(*go9p.SrvReq)               {}
+
+// Entry makes an entry of the directory from a dispatcher
+func Entry(d Dispatcher, f Dispatcher, name string) Dispatcher {
+	n := f.Clone()
+	n.SetPath(append(append([]string{}, d.GetPath()...), name))
+	n.SetParent(d)
+	return n
+}
+
+// PackEntries gives the listing of a directory holding the entries
+func PackEntries(req *go9p.SrvReq, entries []Dispatcher) []byte {
+	var listing []byte
+	for _, e := range entries {
+		listing = append(listing, go9p.PackDir(Fstat(e), req.Conn.Dotu)...)
+	}
+	return listing
+}
+
 type PseudoFile struct {
 	Path
 }
@@ -330,10 +361,17 @@ func (f *PseudoFile) Write(*go9p.SrvReq, []byte) error {
 	return os.ErrInvalid
 }
 
+// Limited is a file whose reads are subject to the rate limit for a
+// class, so that those reading it on behalf of a client may charge it.
+type Limited interface {
+	Class() string
+}
+
 type Cmd struct {
 	PseudoFile
 
 	cfun  func([]string) *exec.Cmd
+	class string
 	clock sync.Mutex
 	cmd   *exec.Cmd
 
@@ -354,8 +392,20 @@ func (c *Cmd) Perms() uint32 {
 	return 0444
 }
 
+// Limit subjects running the command to the rate limit for the class
+func (c *Cmd) Limit(class string) *Cmd {
+	c.class = class
+	return c
+}
+
+// Class gives the rate limit class of the command
+func (c *Cmd) Class() string {
+	return c.class
+}
+
 func (c *Cmd) Clone() Dispatcher {
 	n := NewCmd(c.cfun)
+	n.class = c.class
 	n.SetPath(c.GetPath())
 	n.SetParent(c.GetParent())
 	return n
@@ -367,15 +417,28 @@ func (c *Cmd) Close() {
 	c.data, c.err = nil, nil
 }
 
-func (c *Cmd) Read(*go9p.SrvReq) ([]byte, error) {
+func (c *Cmd) Read(req *go9p.SrvReq) ([]byte, error) {
 	c.dlock.Lock()
 	defer c.dlock.Unlock()
 	if c.data == nil {
+		if err := Limits.Allow(c.class, req); err != nil {
+			return nil, err
+		}
+
 		c.clock.Lock()
 		c.cmd = c.cfun(c.GetPath())
 		c.clock.Unlock()
 
-		c.data, c.err = c.cmd.CombinedOutput()
+		start := time.Now()
+		c.data, c.err = RunCommand(c.String(), c.cmd)
+
+		var pid interface{}
+		if c.cmd.Process != nil {
+			pid = c.cmd.Process.Pid
+		}
+		Audit.Info("exec", append(ReqFields(req), "path", c,
+			"cmd", strings.Join(c.cmd.Args, " "), "pid", pid,
+			"duration", time.Since(start), "error", c.err)...)
 
 		c.clock.Lock()
 		c.cmd = nil
@@ -386,12 +449,76 @@ func (c *Cmd) Read(*go9p.SrvReq) ([]byte, error) {
 
 func (c *Cmd) Flush(*go9p.SrvReq) {
 	c.clock.Lock()
-	if c.cmd != nil {
+	if c.cmd != nil && c.cmd.Process != nil {
 		c.cmd.Process.Kill()
 	}
 	c.clock.Unlock()
 }
 
+// CmdInfo describes a command that is running
+type CmdInfo struct {
+	Path    string
+	Pid     int
+	Args    []string
+	Started time.Time
+}
+
+// Commands currently being run, whether on behalf of clients or by the
+// server itself. Once killed is set by KillCommands any command that
+// starts is killed at once.
+var running = struct {
+	sync.Mutex
+	cmds   map[*exec.Cmd]CmdInfo
+	killed bool
+}{cmds: make(map[*exec.Cmd]CmdInfo)}
+
+// RunCommand runs the command as CombinedOutput does, counting it among
+// those running from when it has started until it exits, so that it is
+// listed by Commands and killed by KillCommands. The path says what it
+// is run for.
+func RunCommand(path string, cmd *exec.Cmd) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = buf, buf
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	running.Lock()
+	if running.killed {
+		cmd.Process.Kill()
+	}
+	running.cmds[cmd] = CmdInfo{Path: path, Pid: cmd.Process.Pid, Args: cmd.Args, Started: time.Now()}
+	running.Unlock()
+
+	err := cmd.Wait()
+
+	running.Lock()
+	delete(running.cmds, cmd)
+	running.Unlock()
+	return buf.Bytes(), err
+}
+
+// KillCommands kills every command that is running, and any started
+// from then on.
+func KillCommands() {
+	running.Lock()
+	defer running.Unlock()
+	running.killed = true
+	for cmd := range running.cmds {
+		cmd.Process.Kill()
+	}
+}
+
+// Commands returns a description of every command that is running
+func Commands() []CmdInfo {
+	running.Lock()
+	defer running.Unlock()
+	cmds := make([]CmdInfo, 0, len(running.cmds))
+	for _, info := range running.cmds {
+		cmds = append(cmds, info)
+	}
+	return cmds
+}
+
 func (c *Cmd) Size() uint64 {
 	return uint64(0)
 }
@@ -399,8 +526,9 @@ func (c *Cmd) Size() uint64 {
 type Fun struct {
 	PseudoFile
 	sync.Mutex
-	fun  func([]string) ([]byte, error)
-	data []byte
+	fun   func([]string) ([]byte, error)
+	class string
+	data  []byte
 }
 
 func NewFun(fun func([]string) ([]byte, error)) *Fun {
@@ -414,19 +542,38 @@ func (f *Fun) Perms() uint32 {
 	return 0444
 }
 
+// Limit subjects calling the function to the rate limit for the class
+func (f *Fun) Limit(class string) *Fun {
+	f.class = class
+	return f
+}
+
+// Class gives the rate limit class of the function
+func (f *Fun) Class() string {
+	return f.class
+}
+
 func (f *Fun) Clone() Dispatcher {
 	n := NewFun(f.fun)
+	n.class = f.class
 	n.SetPath(f.GetPath())
 	n.SetParent(f.GetParent())
 	return n
 }
 
-func (f *Fun) Read(*go9p.SrvReq) (data []byte, err error) {
+// Read calls the function once for each open of the file and keeps
+// what it gives, so that a file read in pieces comes from one call.
+// A failure is not kept, so reading again tries again.
+func (f *Fun) Read(req *go9p.SrvReq) (data []byte, err error) {
 	f.Lock()
 	defer f.Unlock()
 	if f.data == nil {
-		data, err = f.fun(f.GetPath())
+		err = Limits.Allow(f.class, req)
 		if err != nil {
+			return
+		}
+		data, err = f.fun(f.GetPath())
+		if err == nil {
 			f.data = data
 		}
 	} else {
@@ -509,13 +656,13 @@ func (c *Ctl) Write(req *go9p.SrvReq, data []byte) (err error) {
 	return
 }
 
+// Size gives the length of the response to the last write. It must
+// let go of the lock it takes, or the next write to the file would
+// wait for ever.
 func (c *Ctl) Size() uint64 {
 	c.RLock()
-	if c.buf == nil {
-		return uint64(0)
-	} else {
-		return uint64(len(c.buf))
-	}
+	defer c.RUnlock()
+	return uint64(len(c.buf))
 }
 
 func (c *Ctl) Walk(req *go9p.SrvReq, name string) (d Dispatcher, err error) {
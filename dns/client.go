@@ -0,0 +1,406 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"time"
+)
+
+var ErrNoServers = errors.New("dns: no name servers")
+var ErrIdMismatch = errors.New("dns: response does not match query")
+
+// A Client sends queries to name servers. The zero Client uses UDP,
+// retrying over TCP when the response is truncated. Net may also be
+// tcp, tls for DNS over TLS or https for DNS over HTTPS, in which case
+// the details of the secure connection used by the last exchange are
+// kept in TLS.
+type Client struct {
+	Net       string
+	Timeout   time.Duration
+	UDPSize   uint16
+	TLSConfig *tls.Config
+	TLS       *TLSInfo
+}
+
+// TLSInfo describes the secure connection used for an exchange
+type TLSInfo struct {
+	State     tls.ConnectionState
+	Handshake time.Duration
+}
+
+// Configuration for DNS over TLS and HTTPS, such as the certificate
+// authorities to trust, used by Send and the files in the tree
+var TLSConfig *tls.Config
+
+// The path queried on DNS over HTTPS servers
+var DoHPath = "/dns-query"
+
+var defaultPorts = map[string]string{
+	"": "53", "udp": "53", "tcp": "53", "tls": "853", "https": "443",
+}
+
+const defaultTimeout = 5 * time.Second
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultTimeout
+}
+
+// HostPort adds the default port to a server address that lacks one
+func HostPort(server string) string {
+	return joinPort(server, "53")
+}
+
+func joinPort(server, port string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), port)
+}
+
+// ParseServer interprets a server given as an address, which is asked
+// over UDP and then TCP if need be, or as a dial string such as
+// tls!192.0.2.53, https!dns.example!8443 or tcp!192.0.2.53!5353. It
+// returns a client using that transport and the address to send
+// queries to, with the default port for the transport if none is
+// given.
+func ParseServer(server string) (c *Client, addr string, err error) {
+	c = &Client{TLSConfig: TLSConfig}
+	parts := strings.Split(server, "!")
+	switch len(parts) {
+	case 1:
+		return c, HostPort(server), nil
+	case 2:
+		addr = joinPort(parts[1], defaultPorts[parts[0]])
+	case 3:
+		addr = net.JoinHostPort(strings.Trim(parts[1], "[]"), parts[2])
+	default:
+		err = fmt.Errorf("dns: bad server %s", server)
+		return
+	}
+	c.Net = parts[0]
+	if _, ok := defaultPorts[c.Net]; !ok || c.Net == "" {
+		err = fmt.Errorf("dns: unknown transport %s", c.Net)
+	}
+	return
+}
+
+func newId() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// NewQuery returns a recursive query for the name and type with EDNS0
+// enabled and a random message id.
+func NewQuery(name string, qtype uint16) *Msg {
+	m := &Msg{}
+	m.Id = newId()
+	m.RecursionDesired = true
+	m.Question = []Question{{Name: Fqdn(name), Type: qtype, Class: ClassINET}}
+	m.SetEdns0(4096, false)
+	return m
+}
+
+// Exchange sends the query to the server and waits for the response,
+// returning it along with the round trip time.
+func (c *Client) Exchange(m *Msg, server string) (r *Msg, rtt time.Duration, err error) {
+	port, ok := defaultPorts[c.Net]
+	if !ok {
+		err = fmt.Errorf("dns: unknown transport %s", c.Net)
+		return
+	}
+	server = joinPort(server, port)
+	c.TLS = nil
+	switch c.Net {
+	case "", "udp":
+		r, rtt, err = c.exchangeUDP(m, server)
+		if err == nil && r.Truncated {
+			r, rtt, err = c.exchangeTCP(m, server)
+		}
+	case "tcp":
+		r, rtt, err = c.exchangeTCP(m, server)
+	case "tls":
+		r, rtt, err = c.exchangeTLS(m, server)
+	case "https":
+		r, rtt, err = c.exchangeHTTPS(m, server)
+	}
+	return
+}
+
+func matches(m, r *Msg) bool {
+	if r.Id != m.Id || !r.Response {
+		return false
+	}
+	if len(m.Question) == 0 {
+		return true
+	}
+	if len(r.Question) == 0 {
+		// Some servers omit the question from error responses
+		return r.Rcode != RcodeSuccess
+	}
+	q, rq := m.Question[0], r.Question[0]
+	return q.Type == rq.Type && q.Class == rq.Class && strings.EqualFold(q.Name, rq.Name)
+}
+
+func (c *Client) exchangeUDP(m *Msg, server string) (r *Msg, rtt time.Duration, err error) {
+	query, err := m.Pack()
+	if err != nil {
+		return
+	}
+	conn, err := net.DialTimeout("udp", server, c.timeout())
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	conn.SetDeadline(start.Add(c.timeout()))
+	if _, err = conn.Write(query); err != nil {
+		return
+	}
+
+	size := c.UDPSize
+	if size < 512 {
+		size = 4096
+	}
+	buf := make([]byte, size)
+	for {
+		var n int
+		n, err = conn.Read(buf)
+		if err != nil {
+			return
+		}
+		rtt = time.Since(start)
+		r, err = Unpack(buf[:n])
+		if err != nil || !matches(m, r) {
+			// Ignore stray or forged responses, wait for the real one
+			continue
+		}
+		return
+	}
+}
+
+// exchangeStream sends a query over a stream connection, each message
+// being preceded by its length.
+func exchangeStream(conn net.Conn, m *Msg) (r *Msg, err error) {
+	query, err := m.Pack()
+	if err != nil {
+		return
+	}
+	err = writeStream(conn, query)
+	if err != nil {
+		return
+	}
+	for {
+		r, err = readStream(conn)
+		if err != nil {
+			return
+		}
+		if matches(m, r) {
+			return
+		}
+	}
+}
+
+func writeStream(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2, len(msg)+2)
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+func readStream(r io.Reader) (*Msg, error) {
+	buf, err := readStreamWire(r)
+	if err != nil {
+		return nil, err
+	}
+	return Unpack(buf)
+}
+
+// readStreamWire reads a message from a stream without unpacking it
+func readStreamWire(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (c *Client) exchangeTCP(m *Msg, server string) (r *Msg, rtt time.Duration, err error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", server, c.timeout())
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(start.Add(c.timeout()))
+	r, err = exchangeStream(conn, m)
+	rtt = time.Since(start)
+	return
+}
+
+// tlsConfig returns the configuration for a secure connection to the
+// server, checking its certificate against the host named in the
+// address.
+func (c *Client) tlsConfig(server string) *tls.Config {
+	cfg := &tls.Config{}
+	if c.TLSConfig != nil {
+		cfg = c.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(server)
+	}
+	return cfg
+}
+
+func (c *Client) exchangeTLS(m *Msg, server string) (r *Msg, rtt time.Duration, err error) {
+	start := time.Now()
+	dialer := &net.Dialer{Timeout: c.timeout()}
+	raw, err := dialer.Dial("tcp", server)
+	if err != nil {
+		return
+	}
+	raw.SetDeadline(start.Add(c.timeout()))
+	conn := tls.Client(raw, c.tlsConfig(server))
+	defer conn.Close()
+	handshake := time.Now()
+	if err = conn.Handshake(); err != nil {
+		return
+	}
+	c.TLS = &TLSInfo{State: conn.ConnectionState(), Handshake: time.Since(handshake)}
+	r, err = exchangeStream(conn, m)
+	rtt = time.Since(start)
+	return
+}
+
+// exchangeHTTPS posts the query to the server as in RFC 8484, with a
+// message id of zero so that responses may be cached.
+func (c *Client) exchangeHTTPS(m *Msg, server string) (r *Msg, rtt time.Duration, err error) {
+	q := *m
+	q.Id = 0
+	query, err := q.Pack()
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest("POST", "https://"+server+DoHPath, bytes.NewReader(query))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	var handshake time.Time
+	var handshakeTime time.Duration
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeStart: func() { handshake = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { handshakeTime = time.Since(handshake) },
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	// Each query has its own connection, so that the handshake is
+	// timed, which is closed when done with rather than kept idle
+	transport := &http.Transport{
+		TLSClientConfig:   c.tlsConfig(server),
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Timeout:   c.timeout(),
+		Transport: transport,
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.TLS != nil {
+		c.TLS = &TLSInfo{State: *resp.TLS, Handshake: handshakeTime}
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("dns: %s", resp.Status)
+		return
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/dns-message" {
+		err = fmt.Errorf("dns: unexpected content type %s", ct)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return
+	}
+	rtt = time.Since(start)
+	r, err = Unpack(body)
+	if err != nil {
+		return
+	}
+	if !matches(&q, r) {
+		err = ErrIdMismatch
+		return
+	}
+	r.Id = m.Id
+	return
+}
+
+// SystemServers returns the name servers configured in resolv.conf
+func SystemServers() (servers []string) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, HostPort(fields[1]))
+		}
+	}
+	return
+}
+
+// Send sends the message to the server or, if none is given, to each
+// of the system's name servers in turn until one answers.
+func Send(server string, m *Msg) (r *Msg, rtt time.Duration, err error) {
+	servers := []string{server}
+	if server == "" {
+		servers = SystemServers()
+	}
+	err = ErrNoServers
+	for _, s := range servers {
+		var c *Client
+		c, s, err = ParseServer(s)
+		if err != nil {
+			return
+		}
+		r, rtt, err = c.Exchange(m, s)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+// Query asks the server, or if none is given each of the system's name
+// servers in turn, about the name and type.
+func Query(server, name string, qtype uint16) (r *Msg, rtt time.Duration, err error) {
+	return Send(server, NewQuery(name, qtype))
+}
@@ -0,0 +1,234 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseServer(t *testing.T) {
+	tests := []struct {
+		server string
+		net    string
+		addr   string
+		ok     bool
+	}{
+		{"192.0.2.53", "", "192.0.2.53:53", true},
+		{"192.0.2.53:5353", "", "192.0.2.53:5353", true},
+		{"2001:db8::53", "", "[2001:db8::53]:53", true},
+		{"udp!192.0.2.53", "udp", "192.0.2.53:53", true},
+		{"tcp!192.0.2.53!5353", "tcp", "192.0.2.53:5353", true},
+		{"tcp![2001:db8::53]!5353", "tcp", "[2001:db8::53]:5353", true},
+		{"tls!192.0.2.53", "tls", "192.0.2.53:853", true},
+		{"tls!2001:db8::53", "tls", "[2001:db8::53]:853", true},
+		{"https!dns.example", "https", "dns.example:443", true},
+		{"https!dns.example!8443", "https", "dns.example:8443", true},
+		{"quic!192.0.2.53", "", "", false},
+		{"!192.0.2.53", "", "", false},
+		{"tcp!192.0.2.53!53!53", "", "", false},
+	}
+	for _, test := range tests {
+		c, addr, err := ParseServer(test.server)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.server, err)
+			continue
+		}
+		if test.ok && (c.Net != test.net || addr != test.addr) {
+			t.Errorf("%s: got %q %s, want %q %s", test.server, c.Net, addr, test.net, test.addr)
+		}
+	}
+}
+
+// answerA answers every query with an address
+func answerA(t *testing.T) handler {
+	answer := mustRR(t, "example.com. 300 IN A 192.0.2.1")
+	return func(q *Msg, tcp bool) *Msg {
+		return &Msg{Answer: []RR{answer}}
+	}
+}
+
+// trust gives a configuration trusting the certificate of a test server
+func trust(s *httptest.Server) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+	return &tls.Config{RootCAs: pool}
+}
+
+// standInTLS runs a DNS over TLS server on loopback using the
+// certificate of the HTTPS test server until the test ends.
+func standInTLS(t *testing.T, s *httptest.Server, h handler) string {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: s.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go serveStream(l, h)
+	return l.Addr().String()
+}
+
+// standInHTTPS runs a DNS over HTTPS server, which responds with the
+// content type given, until the test ends.
+func standInHTTPS(t *testing.T, contentType string, h handler) *httptest.Server {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != DoHPath || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := ioutil.ReadAll(r.Body)
+		if q, err := Unpack(query); err != nil || q.Id != 0 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		wire := respond(query, h, true)
+		if wire == nil {
+			http.Error(w, "no answer", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(wire)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestExchangeTLS(t *testing.T) {
+	s := standInHTTPS(t, "application/dns-message", answerA(t))
+	addr := standInTLS(t, s, answerA(t))
+
+	c := &Client{Net: "tls", TLSConfig: trust(s)}
+	m := NewQuery("example.com", TypeA)
+	r, _, err := c.Exchange(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != m.Id || len(r.Answer) != 1 {
+		t.Errorf("got %v", r)
+	}
+	if c.TLS == nil || c.TLS.State.Version < tls.VersionTLS12 || len(c.TLS.State.PeerCertificates) == 0 {
+		t.Errorf("got TLS state %+v", c.TLS)
+	}
+
+	// The test certificate is not trusted by default
+	c = &Client{Net: "tls"}
+	if _, _, err := c.Exchange(NewQuery("example.com", TypeA), addr); err == nil {
+		t.Error("untrusted certificate accepted")
+	}
+	// Nor does it name other hosts
+	c = &Client{Net: "tls", TLSConfig: trust(s)}
+	c.TLSConfig.ServerName = "dns.example"
+	if _, _, err := c.Exchange(NewQuery("example.com", TypeA), addr); err == nil {
+		t.Error("certificate for another name accepted")
+	}
+}
+
+func TestExchangeHTTPS(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		h           handler
+		ok          bool
+	}{
+		{"answer", "application/dns-message", answerA(t), true},
+		{"content type", "text/plain", answerA(t), false},
+		{"status", "application/dns-message", func(*Msg, bool) *Msg { return nil }, false},
+	}
+	for _, test := range tests {
+		s := standInHTTPS(t, test.contentType, test.h)
+		c := &Client{Net: "https", TLSConfig: trust(s)}
+		m := NewQuery("example.com", TypeA)
+		r, _, err := c.Exchange(m, strings.TrimPrefix(s.URL, "https://"))
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		// The id of zero sent is put back to that of the query
+		if r.Id != m.Id || len(r.Answer) != 1 {
+			t.Errorf("%s: got %v", test.name, r)
+		}
+		if c.TLS == nil || len(c.TLS.State.PeerCertificates) == 0 {
+			t.Errorf("%s: got TLS state %+v", test.name, c.TLS)
+		}
+	}
+}
+
+func TestExchangeHTTPSCloses(t *testing.T) {
+	s := standInHTTPS(t, "application/dns-message", answerA(t))
+	c := &Client{Net: "https", TLSConfig: trust(s)}
+	exchange := func() {
+		if _, _, err := c.Exchange(NewQuery("example.com", TypeA), strings.TrimPrefix(s.URL, "https://")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exchange()
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		exchange()
+	}
+	// The connections of the queries, and the goroutines reading and
+	// writing them, are not left behind
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before+2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before+2 {
+		t.Errorf("%d goroutines after 20 queries, %d before", n, before)
+	}
+}
+
+func TestDigTLS(t *testing.T) {
+	s := standInHTTPS(t, "application/dns-message", answerA(t))
+	addr := standInTLS(t, s, answerA(t))
+	defer func(cfg *tls.Config) { TLSConfig = cfg }(TLSConfig)
+	TLSConfig = trust(s)
+
+	host, port, _ := net.SplitHostPort(addr)
+	data, err := dig("example.com", "tls!"+host+"!"+port, TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(data)
+	for _, want := range []string{
+		";; server: " + addr + ", transport: tls, time: ",
+		";; tls: TLS 1.",
+		";; certificate 0: O=Acme Co",
+		";;   names: example.com ",
+		" 127.0.0.1 ::1\n",
+		"example.com.\t300\tIN\tA\t192.0.2.1",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("no %q in\n%s", want, out)
+		}
+	}
+}
+
+func TestWriteTLS(t *testing.T) {
+	tests := []struct {
+		state tls.ConnectionState
+		want  string
+	}{
+		{tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			";; tls: TLS 1.2, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, handshake: 1ms\n"},
+		{tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256},
+			";; tls: TLS 1.3, TLS_AES_128_GCM_SHA256, handshake: 1ms\n"},
+		{tls.ConnectionState{Version: 0x0300},
+			";; tls: 0x0300, 0x0000, handshake: 1ms\n"},
+	}
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		writeTLS(buf, &TLSInfo{State: test.state, Handshake: 1e6})
+		if buf.String() != test.want {
+			t.Errorf("got %q, want %q", buf, test.want)
+		}
+	}
+}
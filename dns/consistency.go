@@ -0,0 +1,201 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// zoneOf finds the zone containing the name from the SOA record given
+// in the answer or, for names below the apex, the authority section.
+func zoneOf(server, name string) (string, error) {
+	r, _, err := Query(server, name, TypeSOA)
+	if err != nil {
+		return "", err
+	}
+	if rcode := r.ExtendedRcode(); rcode != RcodeSuccess && rcode != RcodeNXDomain {
+		return "", errors.New(RcodeName(rcode))
+	}
+	for _, section := range [][]RR{r.Answer, r.Authority} {
+		for _, rr := range section {
+			if rr.Type == TypeSOA {
+				return rr.Name, nil
+			}
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// authorities looks up the addresses, both IPv4 and IPv6, of each of
+// the servers named in the zone's NS records. They are asked on the
+// same port as the server used to find them, if it is a plain one.
+func authorities(server, zone string) (servers []nameServer, err error) {
+	port := "53"
+	if c, addr, err := ParseServer(server); server != "" && err == nil && c.Net == "" {
+		_, port, _ = net.SplitHostPort(addr)
+	}
+	nss, err := answers(server, zone, TypeNS)
+	if err != nil {
+		return
+	}
+	var names []string
+	for _, rr := range nss {
+		names = append(names, strings.ToLower(rr.Target()))
+	}
+	sort.Strings(names)
+	for _, ns := range names {
+		found := false
+		for _, qtype := range []uint16{TypeA, TypeAAAA} {
+			rrs, _ := answers(server, ns, qtype)
+			for _, rr := range rrs {
+				if rr.Type == qtype {
+					servers = append(servers, nameServer{ns, net.JoinHostPort(rr.IP().String(), port)})
+					found = true
+				}
+			}
+		}
+		if !found {
+			servers = append(servers, nameServer{name: ns})
+		}
+	}
+	return
+}
+
+// answerSet gives the records of the type for the name, and any alias,
+// in a form that may be compared between servers.
+func answerSet(r *Msg, name string, qtype uint16) string {
+	var lines []string
+	for i := range r.Answer {
+		rr := &r.Answer[i]
+		if !strings.EqualFold(rr.Name, name) || (rr.Type != qtype && rr.Type != TypeCNAME && qtype != TypeANY) {
+			continue
+		}
+		lines = append(lines, rr.String())
+	}
+	if len(lines) == 0 {
+		return fmt.Sprintf(";; %s, no records", RcodeName(r.ExtendedRcode()))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// consistency asks every authoritative server for the zone containing
+// the host for the zone's SOA and the records of the type, comparing
+// the serials and answers they give.
+func consistency(host, server string, qtype uint16) (data []byte, err error) {
+	name := Fqdn(host)
+	if net.ParseIP(host) != nil {
+		name, _ = ReverseName(host)
+	}
+	zone, err := zoneOf(server, name)
+	if err != nil {
+		return
+	}
+	servers, err := authorities(server, zone)
+	if err != nil {
+		return
+	}
+
+	var reachable []nameServer
+	for _, s := range servers {
+		if s.addr != "" {
+			reachable = append(reachable, s)
+		}
+	}
+	soas := ask(reachable, zone, TypeSOA)
+	results := ask(reachable, name, qtype)
+
+	// The newest serial and the answer given by most servers are taken
+	// to be correct
+	var newest uint32
+	haveSerial := false
+	serials := make([]string, len(reachable))
+	for i, t := range soas {
+		if t.err != nil {
+			continue
+		}
+		set, _ := rrset(t.r.Answer, zone, TypeSOA)
+		if len(set) == 0 {
+			continue
+		}
+		soa, e := set[0].SOA()
+		if e != nil {
+			continue
+		}
+		serials[i] = fmt.Sprint(soa.Serial)
+		if !haveSerial || int32(soa.Serial-newest) > 0 {
+			newest, haveSerial = soa.Serial, true
+		}
+	}
+	var sets []string
+	count := map[string]int{}
+	for _, t := range results {
+		if t.err != nil {
+			continue
+		}
+		set := answerSet(t.r, name, qtype)
+		if count[set] == 0 {
+			sets = append(sets, set)
+		}
+		count[set]++
+	}
+	common := ""
+	for _, set := range sets {
+		if count[set] > count[common] {
+			common = set
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, ";; zone %s, %d servers, %s %s\n\n", zone, len(servers), name, TypeName(qtype))
+	w := tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "server\taddress\ttime\tserial\tanswer\tstatus\t")
+	i := 0
+	for _, s := range servers {
+		if s.addr == "" {
+			fmt.Fprintf(w, "%s\t\t\t\t\tno address\t\n", s.name)
+			continue
+		}
+		soa, t := soas[i], results[i]
+		serial := serials[i]
+		i++
+		if t.err != nil {
+			fmt.Fprintf(w, "%s\t%s\t\t%s\t\tunreachable, %s\t\n", s.name, s.addr, serial, t.err)
+			continue
+		}
+		var status []string
+		if !t.r.Authoritative || (soa.err == nil && !soa.r.Authoritative) {
+			status = append(status, "not authoritative")
+		}
+		if serial == "" {
+			status = append(status, "no serial")
+		} else if serial != fmt.Sprint(newest) {
+			status = append(status, "serial behind")
+		}
+		set := answerSet(t.r, name, qtype)
+		if set != common {
+			status = append(status, "answer differs")
+		}
+		n := 0
+		for j := range sets {
+			if sets[j] == set {
+				n = j + 1
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t\n", s.name, s.addr,
+			t.rtt.Round(10*time.Microsecond), serial, n, strings.Join(status, ", "))
+	}
+	w.Flush()
+
+	for j, set := range sets {
+		fmt.Fprintf(buf, "\n;; answer %d, from %d servers\n%s\n", j+1, count[set], set)
+	}
+	data = buf.Bytes()
+	return
+}
@@ -0,0 +1,111 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// standInAuthority serves example.com from the address with the serial
+// and address for www given, answering authoritatively if asked to
+func standInAuthority(t *testing.T, addr string, serial, www string, authoritative bool) string {
+	rrs := []RR{
+		mustRR(t, "example.com. 3600 IN SOA ns1.example.com. admin.example.com. "+serial+" 3600 600 86400 300"),
+		mustRR(t, "example.com. 3600 IN NS ns1.example.com."),
+		mustRR(t, "example.com. 3600 IN NS ns2.example.com."),
+		mustRR(t, "example.com. 3600 IN NS ns3.example.com."),
+		mustRR(t, "example.com. 3600 IN NS ns4.example.com."),
+		mustRR(t, "example.com. 3600 IN NS ns5.example.com."),
+		mustRR(t, "ns1.example.com. 3600 IN A 127.0.0.1"),
+		mustRR(t, "ns2.example.com. 3600 IN A 127.0.0.2"),
+		mustRR(t, "ns3.example.com. 3600 IN A 127.0.0.3"),
+		mustRR(t, "ns4.example.com. 3600 IN A 127.0.0.4"),
+		mustRR(t, "www.example.com. 300 IN A "+www),
+	}
+	return standIn(t, addr, func(q *Msg, tcp bool) *Msg {
+		r := &Msg{Header: Header{Authoritative: authoritative}}
+		for _, rr := range rrs {
+			if strings.EqualFold(rr.Name, q.Question[0].Name) && rr.Type == q.Question[0].Type {
+				r.Answer = append(r.Answer, rr)
+			}
+		}
+		if len(r.Answer) == 0 {
+			r.Authority = rrs[:1]
+		}
+		return r
+	})
+}
+
+func TestConsistency(t *testing.T) {
+	// ns1 and ns2 agree, ns3 is behind and gives an older answer without
+	// authority, nothing listens on ns4 and ns5 has no address
+	server := standInAuthority(t, "127.0.0.1:0", "7", "192.0.2.1", true)
+	_, port, _ := net.SplitHostPort(server)
+	standInAuthority(t, "127.0.0.2:"+port, "7", "192.0.2.1", true)
+	standInAuthority(t, "127.0.0.3:"+port, "6", "192.0.2.99", false)
+
+	data, err := consistency("www.example.com", server, TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(data), "\n")
+	if want := ";; zone example.com., 5 servers, www.example.com. A"; lines[0] != want {
+		t.Errorf("got %q, want %q", lines[0], want)
+	}
+	rows := map[string]string{}
+	for _, line := range lines {
+		if f := strings.Fields(line); len(f) > 0 {
+			rows[f[0]] = strings.Join(f[1:], " ")
+		}
+	}
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"ns1.example.com.", []string{"127.0.0.1:" + port, " 7 1"}},
+		{"ns2.example.com.", []string{"127.0.0.2:" + port, " 7 1"}},
+		{"ns3.example.com.", []string{" 6 2 not authoritative, serial behind, answer differs"}},
+		{"ns4.example.com.", []string{"unreachable"}},
+		{"ns5.example.com.", []string{"no address"}},
+	}
+	for _, test := range tests {
+		row, ok := rows[test.name]
+		if !ok {
+			t.Errorf("no row for %s in\n%s", test.name, data)
+			continue
+		}
+		for _, want := range test.want {
+			if !strings.Contains(row, want) {
+				t.Errorf("%s: no %q in %q", test.name, want, row)
+			}
+		}
+		if test.name < "ns3" && strings.Contains(row, "differs") {
+			t.Errorf("%s: %q", test.name, row)
+		}
+	}
+	for _, want := range []string{
+		";; answer 1, from 2 servers\nwww.example.com.\t300\tIN\tA\t192.0.2.1",
+		";; answer 2, from 1 servers\nwww.example.com.\t300\tIN\tA\t192.0.2.99",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("no %q in\n%s", want, data)
+		}
+	}
+}
+
+func TestAnswerSet(t *testing.T) {
+	r := &Msg{Answer: []RR{
+		mustRR(t, "www.example.com. 300 IN A 192.0.2.2"),
+		mustRR(t, "other.example.com. 300 IN A 192.0.2.3"),
+		mustRR(t, "WWW.example.com. 300 IN A 192.0.2.1"),
+		mustRR(t, "www.example.com. 300 IN TXT \"text\""),
+	}}
+	set := answerSet(r, "www.example.com.", TypeA)
+	if lines := strings.Split(set, "\n"); len(lines) != 2 || !strings.HasSuffix(lines[0], "192.0.2.1") {
+		t.Errorf("got %q", set)
+	}
+	r = &Msg{Header: Header{Rcode: RcodeNXDomain}}
+	if set := answerSet(r, "www.example.com.", TypeA); set != ";; NXDOMAIN, no records" {
+		t.Errorf("got %q", set)
+	}
+}
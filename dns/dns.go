@@ -6,6 +6,7 @@ import (
 	"hubs.net.uk/sw/nopfs"
 	"net"
 	"os"
+	"sort"
 )
 
 var readme_dns = `
@@ -23,14 +24,139 @@ usually /etc/hosts followed by DNS.
   - mx      Look up the mail exchanger corresponding for a domain
   - ns      Look up the DNS servers for a domain
   - txt     Look up any text records for a name
+  - dig/    Full responses, with flags, response code and TTLs, to
+            queries for any record type, as in dig/mx or dig/TYPE65
+  - params  Write "server 192.0.2.53" to direct this host's queries
+            to a particular name server, or "server" to go back to
+            the local mechanism
+  - update  Write lines changing the zone holding this name, which
+            are sent to its primary as a dynamic update signed with
+            TSIG, then read back the response code. See below.
+
+The following give the records found, including any aliases that
+were followed, in zone file format with their TTLs. They are always
+looked up in the DNS, bypassing /etc/hosts.
+
+  - a       IPv4 addresses
+  - aaaa    IPv6 addresses
+  - soa     Start of authority for a zone
+  - caa     Certification authorities allowed to issue certificates
+  - ptr     Pointer records, for an address these are its names
+  - ds      Delegation signer records held by the parent zone
+  - dnskey  DNSSEC keys for a zone
+  - tlsa    DANE certificate associations, kept at names such as
+            _443._tcp.example.com
+  - any     Whatever the server is willing to give for an ANY query
+  - srv/    Service records, as in srv/_sip._tcp for the records of
+            _sip._tcp at this name. These files are not listed.
+
+  - dnssec  Validation of the chain of trust from the trust anchor,
+            by default the root zone keys, down to this name, then
+            of each of its RRsets. Every zone and RRset is shown as
+            secure, insecure or bogus along with the keys and when
+            the signatures expire, with a warning for those that
+            expire soon.
+  - trace   Resolution of the name starting from the root servers,
+            as dig +trace does, asking every server for each zone on
+            the way down. Shows where each referral leads, how long
+            each server took to answer, lame servers and where the
+            NS records in a zone differ from its delegation.
+  - consistency/
+            Checks of the authoritative servers for the zone holding
+            the name, as in consistency/a or consistency/mx. Every
+            server, over both IPv4 and IPv6, is asked for the zone's
+            SOA and the records at once, showing the time it took,
+            its serial and which answer it gave, and flagging those
+            that are unreachable, not authoritative, behind on the
+            serial or give a different answer to the others. These
+            files are not listed.
+  - mail/   Checks of the records a domain publishes for mail,
+            each giving the records found and any problems with
+            them, in text or, as in mail/spf.json, in JSON:
+
+              spf        The SPF record with every include and
+                         redirect expanded, counting the lookups
+                         needed against the limit of 10
+              dmarc      The DMARC policy, or the one inherited from
+                         the parent domain, and whether its report
+                         addresses have agreed to take reports
+              dkim/s/key The DKIM key for the selector s, as in
+                         dkim/google/key. These are not listed.
+              mta-sts    The MTA-STS record and policy, which is
+                         fetched over HTTPS, and whether the MX
+                         hosts are covered by it
+              tls-rpt    Where failures to use TLS are reported
+
+A particular name server may also be chosen by descending into a
+subdirectory named after it, which contains the same files. These
+are not listed. For example,
+
+  % cat @192.0.2.53/addr
+  % cat @[2001:db8::53]:5353/dig/soa
+
+The server may also be given as a dial string choosing the transport,
+udp, tcp, tls for DNS over TLS or https for DNS over HTTPS, with an
+optional port, here or in params. Reading dig/ through a secure
+transport shows the TLS version, cipher, handshake time and the
+certificates presented, so that answers may be compared, as in
+
+  % cat @tls!192.0.2.53/a @https!dns.example!443/a @192.0.2.53/a
+  % cat @tls!dns.example/dig/a
+
+Updates are made of lines of the following forms, with names relative
+to this one and @ for the name itself. Each write is sent as a single
+update, so either all the changes are made or none are.
+
+  add rr                 Add the record, given as in a zone file,
+                         with a TTL of an hour unless it says
+  del name               Delete every record owned by the name
+  del name type          Delete the records of the type
+  del name type rdata    Delete the one record
+  key name               Sign with this key
+
+The update is signed with the key given, or else the one named after
+the zone, from those given to the server with -tsig. A key may only
+update the zone it is named after and those given for it with
+-tsigzones, others being refused. For example,
+
+  % echo 'add @ 300 A 192.0.2.1
+  del www AAAA' > update
+  % cat update
+  NOERROR
 
 `
 var Readme nopfs.Dispatcher = nopfs.NewFile([]byte(readme_dns))
 
-func addr(host string) (data []byte, err error) {
-	addrs, err := net.LookupHost(host)
-	if err != nil {
+// LookupHost returns the addresses of the host, from the local
+// mechanism if no server is given or else from the server's A and AAAA
+// records.
+func LookupHost(host, server string) (addrs []string, err error) {
+	if server == "" {
+		addrs, err = net.LookupHost(host)
+		if err != nil {
+			err = os.ErrNotExist
+		}
+		return
+	}
+	for _, qtype := range []uint16{TypeA, TypeAAAA} {
+		rrs, e := answers(server, host, qtype)
+		if e != nil && e != os.ErrNotExist {
+			err = e
+			return
+		}
+		for _, rr := range rrs {
+			addrs = append(addrs, rr.IP().String())
+		}
+	}
+	if len(addrs) == 0 {
 		err = os.ErrNotExist
+	}
+	return
+}
+
+func addr(host, server string) (data []byte, err error) {
+	addrs, err := LookupHost(host, server)
+	if err != nil {
 		return
 	}
 
@@ -42,13 +168,27 @@ func addr(host string) (data []byte, err error) {
 	data = buf.Bytes()
 	return
 }
-var Addr nopfs.Dispatcher = nopfs.NewFun(nopfs.HostF(addr))
+var Addr nopfs.Dispatcher = nopfs.NewFun(ResolveF(addr)).Limit("dns")
 
-func cname(host string) (data []byte, err error) {
-	cname, err := net.LookupCNAME(host)
-	if err != nil {
-		err = os.ErrNotExist
-		return
+func cname(host, server string) (data []byte, err error) {
+	var cname string
+	if server == "" {
+		cname, err = net.LookupCNAME(host)
+		if err != nil {
+			err = os.ErrNotExist
+			return
+		}
+	} else {
+		var rrs []RR
+		rrs, err = answers(server, host, TypeCNAME)
+		switch {
+		case err == os.ErrNotExist:
+			cname, err = Fqdn(host), nil
+		case err != nil:
+			return
+		default:
+			cname = rrs[0].Target()
+		}
 	}
 
 	buf := bytes.NewBuffer(make([]byte, 0, len(cname)+1))
@@ -57,12 +197,61 @@ func cname(host string) (data []byte, err error) {
 	data = buf.Bytes()
 	return
 }
-var CName nopfs.Dispatcher = nopfs.NewFun(nopfs.HostF(cname))
+var CName nopfs.Dispatcher = nopfs.NewFun(ResolveF(cname)).Limit("dns")
 
-func name(addr string) (data []byte, err error) {
-	names, err := net.LookupAddr(addr)
+// ReverseName returns the in-addr.arpa or ip6.arpa name for an address
+func ReverseName(addr string) (string, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", os.ErrInvalid
+	}
+	buf := &bytes.Buffer{}
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			fmt.Fprintf(buf, "%d.", ip4[i])
+		}
+		buf.WriteString("in-addr.arpa.")
+	} else {
+		const hexDigits = "0123456789abcdef"
+		for i := len(ip) - 1; i >= 0; i-- {
+			buf.WriteByte(hexDigits[ip[i]&0xF])
+			buf.WriteByte('.')
+			buf.WriteByte(hexDigits[ip[i]>>4])
+			buf.WriteByte('.')
+		}
+		buf.WriteString("ip6.arpa.")
+	}
+	return buf.String(), nil
+}
+
+// LookupAddr returns the names for the address, from the local
+// mechanism if no server is given or else from the server's PTR
+// records.
+func LookupAddr(addr, server string) (names []string, err error) {
+	if server == "" {
+		names, err = net.LookupAddr(addr)
+		if err != nil {
+			err = os.ErrNotExist
+		}
+		return
+	}
+	rev, err := ReverseName(addr)
+	if err != nil {
+		return
+	}
+	rrs, err := answers(server, rev, TypePTR)
+	if err != nil {
+		return
+	}
+	for _, rr := range rrs {
+		names = append(names, rr.Target())
+	}
+	return
+}
+
+func name(addr, server string) (data []byte, err error) {
+	names, err := LookupAddr(addr, server)
 	if err != nil {
-		err = os.ErrNotExist
 		return
 	}
 
@@ -74,13 +263,27 @@ func name(addr string) (data []byte, err error) {
 	data = buf.Bytes()
 	return
 }
-var Name nopfs.Dispatcher = nopfs.NewFun(nopfs.HostF(name))
+var Name nopfs.Dispatcher = nopfs.NewFun(ResolveF(name)).Limit("dns")
 
-func mx(host string) (data []byte, err error) {
-	mxs, err := net.LookupMX(host)
-	if err != nil {
-		err = os.ErrNotExist
-		return
+func mx(host, server string) (data []byte, err error) {
+	var mxs []*net.MX
+	if server == "" {
+		mxs, err = net.LookupMX(host)
+		if err != nil {
+			err = os.ErrNotExist
+			return
+		}
+	} else {
+		var rrs []RR
+		rrs, err = answers(server, host, TypeMX)
+		if err != nil {
+			return
+		}
+		for _, rr := range rrs {
+			pref, host := rr.MX()
+			mxs = append(mxs, &net.MX{Host: host, Pref: pref})
+		}
+		sort.Slice(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
 	}
 
 	buf := bytes.NewBuffer(make([]byte, 0, len(mxs)*20))
@@ -91,31 +294,63 @@ func mx(host string) (data []byte, err error) {
 	data = buf.Bytes()
 	return
 }
-var MX nopfs.Dispatcher = nopfs.NewFun(nopfs.HostF(mx))
+var MX nopfs.Dispatcher = nopfs.NewFun(ResolveF(mx)).Limit("dns")
 
-func ns(domain string) (data []byte, err error) {
-	nss, err := net.LookupNS(domain)
-	if err != nil {
-		err = os.ErrNotExist
-		return
+func ns(domain, server string) (data []byte, err error) {
+	var hosts []string
+	if server == "" {
+		var nss []*net.NS
+		nss, err = net.LookupNS(domain)
+		if err != nil {
+			err = os.ErrNotExist
+			return
+		}
+		for _, ns := range nss {
+			hosts = append(hosts, ns.Host)
+		}
+	} else {
+		var rrs []RR
+		rrs, err = answers(server, domain, TypeNS)
+		if err != nil {
+			return
+		}
+		for _, rr := range rrs {
+			hosts = append(hosts, rr.Target())
+		}
 	}
 
-	buf := bytes.NewBuffer(make([]byte, 0, len(nss)*16))
+	buf := bytes.NewBuffer(make([]byte, 0, len(hosts)*16))
 
-	for _, ns := range nss {
-		buf.WriteString(ns.Host)
+	for _, host := range hosts {
+		buf.WriteString(host)
 		buf.WriteByte('\n')
 	}
 	data = buf.Bytes()
 	return
 }
-var NS nopfs.Dispatcher = nopfs.NewFun(nopfs.HostF(ns))
+var NS nopfs.Dispatcher = nopfs.NewFun(ResolveF(ns)).Limit("dns")
 
-func txt(host string) (data []byte, err error) {
-	txts, err := net.LookupTXT(host)
-	if err != nil {
-		err = os.ErrNotExist
-		return
+func txt(host, server string) (data []byte, err error) {
+	var txts []string
+	if server == "" {
+		txts, err = net.LookupTXT(host)
+		if err != nil {
+			err = os.ErrNotExist
+			return
+		}
+	} else {
+		var rrs []RR
+		rrs, err = answers(server, host, TypeTXT)
+		if err != nil {
+			return
+		}
+		for _, rr := range rrs {
+			txt := ""
+			for _, s := range rr.TXT() {
+				txt += s
+			}
+			txts = append(txts, txt)
+		}
 	}
 
 	buf := bytes.NewBuffer(make([]byte, 0, len(txts)*80))
@@ -127,11 +362,11 @@ func txt(host string) (data []byte, err error) {
 	data = buf.Bytes()
 	return
 }
-var TXT nopfs.Dispatcher = nopfs.NewFun(nopfs.HostF(txt))
+var TXT nopfs.Dispatcher = nopfs.NewFun(ResolveF(txt)).Limit("dns")
 
-var Dir *nopfs.Dir
+var Dir *ResolverDir
 func init() {
-	Dir = nopfs.NewDir()
+	Dir = NewResolverDir()
 	Dir.Append("README.txt", Readme)
 	Dir.Append("addr", Addr)
 	Dir.Append("cname", CName)
@@ -139,5 +374,22 @@ func init() {
 	Dir.Append("mx", MX)
 	Dir.Append("ns", NS)
 	Dir.Append("txt", TXT)
+	Dir.Append("a", A)
+	Dir.Append("aaaa", AAAA)
+	Dir.Append("soa", SOA)
+	Dir.Append("caa", CAA)
+	Dir.Append("ptr", PTR)
+	Dir.Append("ds", DS)
+	Dir.Append("dnskey", DNSKEY)
+	Dir.Append("tlsa", TLSA)
+	Dir.Append("any", ANY)
+	Dir.Append("srv", SRV)
+	Dir.Append("dnssec", DNSSEC)
+	Dir.Append("trace", Trace)
+	Dir.Append("mail", Mail)
+	Dir.Append("consistency", &digDir{query: consistency, class: "dnscheck"})
+	Dir.Append("dig", &digDir{query: dig, class: "dns"})
+	Dir.Append("params", &nopfs.Ctl{Writer: paramsCtl})
+	Dir.Append("update", &nopfs.Ctl{Writer: updateCtl})
 
-}
\ No newline at end of file
+}
@@ -0,0 +1,671 @@
+package dns
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hubs.net.uk/sw/nopfs"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// The root zone key signing keys
+var defaultTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+var trustAnchors = struct {
+	sync.RWMutex
+	rrs []RR
+}{}
+
+// Signatures expiring sooner than this are flagged in the dnssec file
+var SigWarning = 7 * 24 * time.Hour
+
+func init() {
+	if err := SetTrustAnchors(defaultTrustAnchors); err != nil {
+		panic(err)
+	}
+}
+
+// SetTrustAnchors replaces the trust anchors with DS or DNSKEY records
+// in presentation format. Anchors need not be for the root, allowing
+// validation of private hierarchies.
+func SetTrustAnchors(lines []string) error {
+	var rrs []RR
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), ";") {
+			continue
+		}
+		rr, err := ParseRR(line, ".", 0)
+		if err != nil {
+			return err
+		}
+		if rr.Type != TypeDS && rr.Type != TypeDNSKEY {
+			return fmt.Errorf("trust anchor must be DS or DNSKEY: %s", line)
+		}
+		rrs = append(rrs, rr)
+	}
+	if len(rrs) == 0 {
+		return errors.New("no trust anchors")
+	}
+	trustAnchors.Lock()
+	defer trustAnchors.Unlock()
+	trustAnchors.rrs = rrs
+	return nil
+}
+
+// LoadTrustAnchors reads trust anchors from a file with one record per
+// line.
+func LoadTrustAnchors(path string) error {
+	lines, err := readLines(path)
+	if err != nil {
+		return err
+	}
+	return SetTrustAnchors(lines)
+}
+
+// anchorFor returns the trust anchors for the closest zone enclosing
+// the name
+func anchorFor(name string) (zone string, rrs []RR) {
+	trustAnchors.RLock()
+	defer trustAnchors.RUnlock()
+	best := -1
+	for _, rr := range trustAnchors.rrs {
+		if !isSubdomain(name, rr.Name) {
+			continue
+		}
+		n := countLabels(rr.Name)
+		switch {
+		case n > best:
+			best = n
+			zone = rr.Name
+			rrs = []RR{rr}
+		case n == best:
+			rrs = append(rrs, rr)
+		}
+	}
+	return
+}
+
+func countLabels(name string) int {
+	labels, _ := splitName(name)
+	return len(labels)
+}
+
+// isSubdomain reports whether name is at or below zone
+func isSubdomain(name, zone string) bool {
+	name, zone = strings.ToLower(Fqdn(name)), strings.ToLower(Fqdn(zone))
+	if zone == "." || name == zone {
+		return true
+	}
+	return strings.HasSuffix(name, "."+zone)
+}
+
+// canonicalName returns the name in wire format with ASCII letters in
+// lower case, which length octets never are.
+func canonicalName(name string) []byte {
+	b, _ := packName(nil, name)
+	return lower(b)
+}
+
+func lower(b []byte) []byte {
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return b
+}
+
+// Types whose names in the record data are lower cased in canonical
+// form, RFC 4034 section 6.2 as amended by RFC 6840
+var canonicalTypes = map[uint16]bool{
+	TypeNS: true, TypeCNAME: true, TypeSOA: true, TypePTR: true,
+	TypeMX: true, TypeSRV: true, TypeDNAME: true, TypeRRSIG: true,
+}
+
+func canonicalRdata(rr *RR) []byte {
+	data := append([]byte{}, rr.Data...)
+	if !canonicalTypes[rr.Type] {
+		return data
+	}
+	off := 0
+	for _, field := range rdataLayout[rr.Type] {
+		switch {
+		case field > 0:
+			off += field
+		case field == 0:
+			for off < len(data) && data[off] != 0 {
+				n := int(data[off])
+				lower(data[off+1 : off+1+n])
+				off += 1 + n
+			}
+			off++
+		}
+	}
+	return data
+}
+
+// signedData returns the data covered by a signature over the RRset
+func signedData(sig RRSIGData, rrset []RR) []byte {
+	buf := append([]byte{}, sig.signed...)
+	lower(buf[18:])
+
+	owner := rrset[0].Name
+	if labels, _ := splitName(owner); int(sig.Labels) < len(labels) {
+		// Expanded from a wildcard
+		wild := [][]byte{[]byte("*")}
+		wild = append(wild, labels[len(labels)-int(sig.Labels):]...)
+		parts := make([]string, len(wild))
+		for i, l := range wild {
+			b := &bytes.Buffer{}
+			escapeLabel(b, l)
+			parts[i] = b.String()
+		}
+		owner = strings.Join(parts, ".") + "."
+	}
+	ownerWire := canonicalName(owner)
+
+	rdatas := make([][]byte, 0, len(rrset))
+	for i := range rrset {
+		rdatas = append(rdatas, canonicalRdata(&rrset[i]))
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return bytes.Compare(rdatas[i], rdatas[j]) < 0 })
+
+	for i, rdata := range rdatas {
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue
+		}
+		buf = append(buf, ownerWire...)
+		buf = packUint16(buf, rrset[0].Type)
+		buf = packUint16(buf, rrset[0].Class)
+		buf = packUint32(buf, sig.OrigTTL)
+		buf = packUint16(buf, uint16(len(rdata)))
+		buf = append(buf, rdata...)
+	}
+	return buf
+}
+
+var ErrUnsupportedAlgorithm = errors.New("unsupported algorithm")
+var ErrBadSignature = errors.New("signature does not verify")
+
+func verifySignature(key DNSKEYData, data, sig []byte) error {
+	switch key.Algorithm {
+	case 5, 7, 8, 10:
+		k := key.PublicKey
+		if len(k) < 3 {
+			return ErrShortMsg
+		}
+		elen, off := int(k[0]), 1
+		if elen == 0 {
+			elen, off = int(k[1])<<8|int(k[2]), 3
+		}
+		if off+elen >= len(k) {
+			return ErrShortMsg
+		}
+		e := new(big.Int).SetBytes(k[off : off+elen])
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return ErrUnsupportedAlgorithm
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(k[off+elen:]), E: int(e.Int64())}
+		var h crypto.Hash
+		var digest []byte
+		switch key.Algorithm {
+		case 5, 7:
+			d := sha1.Sum(data)
+			h, digest = crypto.SHA1, d[:]
+		case 8:
+			d := sha256.Sum256(data)
+			h, digest = crypto.SHA256, d[:]
+		case 10:
+			d := sha512.Sum512(data)
+			h, digest = crypto.SHA512, d[:]
+		}
+		if rsa.VerifyPKCS1v15(pub, h, digest, sig) != nil {
+			return ErrBadSignature
+		}
+		return nil
+	case 13, 14:
+		curve, size := elliptic.P256(), 32
+		var digest []byte
+		if key.Algorithm == 13 {
+			d := sha256.Sum256(data)
+			digest = d[:]
+		} else {
+			curve, size = elliptic.P384(), 48
+			d := sha512.Sum384(data)
+			digest = d[:]
+		}
+		if len(key.PublicKey) != 2*size || len(sig) != 2*size {
+			return ErrBadSignature
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(key.PublicKey[:size]),
+			Y:     new(big.Int).SetBytes(key.PublicKey[size:]),
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return ErrBadSignature
+		}
+		return nil
+	case 15:
+		if len(key.PublicKey) != ed25519.PublicKeySize {
+			return ErrBadSignature
+		}
+		if !ed25519.Verify(ed25519.PublicKey(key.PublicKey), data, sig) {
+			return ErrBadSignature
+		}
+		return nil
+	}
+	return ErrUnsupportedAlgorithm
+}
+
+// verifyRRset checks the RRset against its signatures, returning the
+// first signature made by one of the keys for the zone that verifies.
+func verifyRRset(rrset, sigs, keys []RR, zone string, now time.Time) (sig RRSIGData, err error) {
+	if len(rrset) == 0 {
+		err = errors.New("no records")
+		return
+	}
+	if len(sigs) == 0 {
+		err = errors.New("not signed")
+		return
+	}
+	err = errors.New("no signature from a zone key")
+	for i := range sigs {
+		s, e := sigs[i].RRSIG()
+		if e != nil || s.TypeCovered != rrset[0].Type {
+			continue
+		}
+		if !strings.EqualFold(s.SignerName, zone) {
+			continue
+		}
+		if now.After(SigTime(s.Expiration)) {
+			err = fmt.Errorf("signature expired %s", SigTime(s.Expiration).Format(time.RFC3339))
+			continue
+		}
+		if now.Before(SigTime(s.Inception)) {
+			err = fmt.Errorf("signature not valid until %s", SigTime(s.Inception).Format(time.RFC3339))
+			continue
+		}
+		for j := range keys {
+			key, e := keys[j].DNSKEY()
+			if e != nil || key.Flags&FlagZone == 0 || key.Protocol != 3 ||
+				key.Algorithm != s.Algorithm || keys[j].KeyTag() != s.KeyTag {
+				continue
+			}
+			e = verifySignature(key, signedData(s, rrset), s.Signature)
+			if e == nil {
+				return s, nil
+			}
+			err = fmt.Errorf("key %d/%d: %s", s.KeyTag, s.Algorithm, e)
+		}
+	}
+	return
+}
+
+// dsMatches reports whether the DS record refers to the DNSKEY record
+func dsMatches(dsrr, keyrr *RR) bool {
+	ds, err := dsrr.DS()
+	if err != nil {
+		return false
+	}
+	key, err := keyrr.DNSKEY()
+	if err != nil || key.Algorithm != ds.Algorithm || keyrr.KeyTag() != ds.KeyTag {
+		return false
+	}
+	data := append(canonicalName(keyrr.Name), keyrr.Data...)
+	var digest []byte
+	switch ds.DigestType {
+	case 1:
+		d := sha1.Sum(data)
+		digest = d[:]
+	case 2:
+		d := sha256.Sum256(data)
+		digest = d[:]
+	case 4:
+		d := sha512.Sum384(data)
+		digest = d[:]
+	default:
+		return false
+	}
+	return bytes.Equal(digest, ds.Digest)
+}
+
+// rrset picks the records of a type owned by the name out of a section
+// along with the signatures covering them.
+func rrset(section []RR, name string, t uint16) (set, sigs []RR) {
+	for _, rr := range section {
+		if !strings.EqualFold(rr.Name, name) {
+			continue
+		}
+		if rr.Type == t {
+			set = append(set, rr)
+		} else if rr.Type == TypeRRSIG {
+			if s, err := rr.RRSIG(); err == nil && s.TypeCovered == t {
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+	return
+}
+
+// DNSSEC security status
+const (
+	Secure   = "secure"
+	Insecure = "insecure"
+	Bogus    = "bogus"
+)
+
+type validator struct {
+	server string
+	now    time.Time
+}
+
+// query asks for DNSSEC records, with checking disabled so that a
+// validating resolver passes on data even if it is bogus.
+func (v *validator) query(name string, t uint16) (*Msg, error) {
+	m := NewQuery(name, t)
+	m.CheckingDisabled = true
+	m.Additional = nil
+	m.SetEdns0(4096, true)
+	r, _, err := Send(v.server, m)
+	return r, err
+}
+
+func keyList(keys []RR) string {
+	tags := make([]string, 0, len(keys))
+	for i := range keys {
+		key, err := keys[i].DNSKEY()
+		if err != nil {
+			continue
+		}
+		role := "ZSK"
+		if key.Flags&FlagSEP != 0 {
+			role = "KSK"
+		}
+		tags = append(tags, fmt.Sprintf("%d/%d %s", keys[i].KeyTag(), key.Algorithm, role))
+	}
+	return strings.Join(tags, ", ")
+}
+
+// zoneKeys fetches the zone's DNSKEY RRset and checks that it is signed
+// by a key matching one of the trusted DS or DNSKEY records.
+func (v *validator) zoneKeys(zone string, trusted []RR) (keys []RR, sig RRSIGData, err error) {
+	r, err := v.query(zone, TypeDNSKEY)
+	if err != nil {
+		return
+	}
+	keys, sigs := rrset(r.Answer, zone, TypeDNSKEY)
+	if len(keys) == 0 {
+		err = errors.New("no DNSKEY records")
+		return
+	}
+	var entry []RR
+	for i := range keys {
+		for j := range trusted {
+			t := &trusted[j]
+			if (t.Type == TypeDS && dsMatches(t, &keys[i])) ||
+				(t.Type == TypeDNSKEY && bytes.Equal(t.Data, keys[i].Data)) {
+				entry = append(entry, keys[i])
+				break
+			}
+		}
+	}
+	if len(entry) == 0 {
+		err = errors.New("no DNSKEY matches the trusted DS records")
+		return
+	}
+	sig, err = verifyRRset(keys, sigs, entry, zone, v.now)
+	return
+}
+
+// nsec3Hash computes the hashed owner name of RFC 5155
+func nsec3Hash(name string, iterations uint16, salt []byte) []byte {
+	h := sha1.New()
+	h.Write(canonicalName(name))
+	h.Write(salt)
+	digest := h.Sum(nil)
+	for i := 0; i < int(iterations); i++ {
+		h.Reset()
+		h.Write(digest)
+		h.Write(salt)
+		digest = h.Sum(nil)
+	}
+	return digest
+}
+
+func hasType(types []uint16, t uint16) bool {
+	for _, x := range types {
+		if x == t {
+			return true
+		}
+	}
+	return false
+}
+
+// noDS checks that a response proves the name has no DS records, with
+// NSEC or NSEC3 records signed by the parent zone, making the
+// delegation to it insecure.
+func (v *validator) noDS(name string, r *Msg, keys []RR, zone string) (string, error) {
+	for i := range r.Authority {
+		rr := &r.Authority[i]
+		switch rr.Type {
+		case TypeNSEC:
+			nsec, err := rr.NSEC()
+			if err != nil || !strings.EqualFold(rr.Name, name) {
+				continue
+			}
+			if hasType(nsec.Types, TypeDS) || !hasType(nsec.Types, TypeNS) {
+				continue
+			}
+			set, sigs := rrset(r.Authority, rr.Name, TypeNSEC)
+			if _, err := verifyRRset(set, sigs, keys, zone, v.now); err != nil {
+				return "", fmt.Errorf("NSEC: %s", err)
+			}
+			return "NSEC proves no DS", nil
+		case TypeNSEC3:
+			nsec3, err := rr.NSEC3()
+			if err != nil || nsec3.Hash != 1 {
+				continue
+			}
+			labels, _ := splitName(rr.Name)
+			if len(labels) == 0 {
+				continue
+			}
+			owner, err := base32Hex.DecodeString(strings.ToUpper(string(labels[0])))
+			if err != nil {
+				continue
+			}
+			hash := nsec3Hash(name, nsec3.Iterations, nsec3.Salt)
+			how := ""
+			switch {
+			case bytes.Equal(owner, hash):
+				if hasType(nsec3.Types, TypeDS) {
+					continue
+				}
+				how = "NSEC3 proves no DS"
+			case nsec3.Flags&1 != 0 && covers(owner, nsec3.NextHashed, hash):
+				how = "NSEC3 opt-out covers delegation"
+			default:
+				continue
+			}
+			set, sigs := rrset(r.Authority, rr.Name, TypeNSEC3)
+			if _, err := verifyRRset(set, sigs, keys, zone, v.now); err != nil {
+				return "", fmt.Errorf("NSEC3: %s", err)
+			}
+			return how, nil
+		}
+	}
+	return "", errors.New("unsigned delegation without proof of no DS")
+}
+
+// covers reports whether hash falls between owner and next, allowing
+// for the last NSEC3 record wrapping around to the first
+func covers(owner, next, hash []byte) bool {
+	if bytes.Compare(owner, next) < 0 {
+		return bytes.Compare(owner, hash) < 0 && bytes.Compare(hash, next) < 0
+	}
+	return bytes.Compare(owner, hash) < 0 || bytes.Compare(hash, next) < 0
+}
+
+func (v *validator) expiry(sig RRSIGData) string {
+	exp := SigTime(sig.Expiration)
+	left := exp.Sub(v.now)
+	return fmt.Sprintf("%s (%dd%dh)", exp.Format("2006-01-02 15:04:05"),
+		int(left.Hours())/24, int(left.Hours())%24)
+}
+
+func (v *validator) warning(sig RRSIGData) string {
+	if SigTime(sig.Expiration).Sub(v.now) < SigWarning {
+		return "WARNING expires soon"
+	}
+	return ""
+}
+
+// ancestors lists the names from just below zone down to name
+func ancestors(name, zone string) (names []string) {
+	labels, _ := splitName(name)
+	for i := len(labels) - countLabels(zone) - 1; i >= 0; i-- {
+		b := &bytes.Buffer{}
+		for _, l := range labels[i:] {
+			escapeLabel(b, l)
+			b.WriteByte('.')
+		}
+		names = append(names, b.String())
+	}
+	return
+}
+
+// Types whose RRsets are checked at the host
+var dnssecTypes = []uint16{TypeSOA, TypeNS, TypeDNSKEY, TypeCNAME, TypeA,
+	TypeAAAA, TypeMX, TypeTXT, TypeCAA, TypeSRV, TypeTLSA}
+
+func dnssec(host, server string) (data []byte, err error) {
+	host = Fqdn(host)
+	v := &validator{server: server, now: time.Now()}
+	buf := &bytes.Buffer{}
+	w := tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+
+	zone, trusted := anchorFor(host)
+	status := Secure
+	var keys []RR
+
+	fmt.Fprintln(w, "zone\tstatus\tkeys\texpires\t")
+	if zone == "" {
+		status = Insecure
+		fmt.Fprintf(w, "%s\t%s\tno trust anchor\t\t\n", host, status)
+	} else {
+		var sig RRSIGData
+		keys, sig, err = v.zoneKeys(zone, trusted)
+		if err != nil {
+			status = Bogus
+			fmt.Fprintf(w, "%s\t%s\t%s\t\t\n", zone, status, err)
+		} else {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", zone, status, keyList(keys),
+				v.expiry(sig), v.warning(sig))
+		}
+	}
+
+	for _, name := range ancestors(host, zone) {
+		if status != Secure {
+			break
+		}
+		var r *Msg
+		r, err = v.query(name, TypeDS)
+		if err != nil {
+			return
+		}
+		if r.Rcode == RcodeNXDomain {
+			fmt.Fprintf(w, "%s\t%s\tname does not exist\t\t\n", name, RcodeName(r.Rcode))
+			break
+		}
+		ds, sigs := rrset(r.Answer, name, TypeDS)
+		if len(ds) > 0 {
+			_, err = verifyRRset(ds, sigs, keys, zone, v.now)
+			if err != nil {
+				status = Bogus
+				fmt.Fprintf(w, "%s\t%s\tDS: %s\t\t\n", name, status, err)
+				break
+			}
+			var sig RRSIGData
+			keys, sig, err = v.zoneKeys(name, ds)
+			zone = name
+			if err != nil {
+				status = Bogus
+				fmt.Fprintf(w, "%s\t%s\t%s\t\t\n", name, status, err)
+				break
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, status, keyList(keys),
+				v.expiry(sig), v.warning(sig))
+			continue
+		}
+
+		// Without a DS the name is either inside the zone or an
+		// insecure delegation, which only a zone apex has an SOA
+		var soa *Msg
+		soa, err = v.query(name, TypeSOA)
+		if err != nil {
+			return
+		}
+		if set, _ := rrset(soa.Answer, name, TypeSOA); len(set) == 0 {
+			continue
+		}
+		how, e := v.noDS(name, r, keys, zone)
+		zone = name
+		if e != nil {
+			status = Bogus
+			fmt.Fprintf(w, "%s\t%s\t%s\t\t\n", name, status, e)
+		} else {
+			status = Insecure
+			fmt.Fprintf(w, "%s\t%s\t%s\t\t\n", name, status, how)
+		}
+	}
+	err = nil
+
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "rrset\tstatus\tsigned by\texpires\t\n")
+	for _, t := range dnssecTypes {
+		r, e := v.query(host, t)
+		if e != nil {
+			fmt.Fprintf(w, "%s\terror\t%s\t\t\n", TypeName(t), e)
+			continue
+		}
+		set, sigs := rrset(r.Answer, host, t)
+		if len(set) == 0 {
+			continue
+		}
+		if status != Secure {
+			fmt.Fprintf(w, "%s\t%s\t\t\t\n", TypeName(t), status)
+			continue
+		}
+		sig, e := verifyRRset(set, sigs, keys, zone, v.now)
+		if e != nil {
+			fmt.Fprintf(w, "%s\t%s\t%s\t\t\n", TypeName(t), Bogus, e)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d/%d %s\t%s\t%s\n", TypeName(t), Secure,
+			sig.KeyTag, sig.Algorithm, sig.SignerName, v.expiry(sig), v.warning(sig))
+	}
+	w.Flush()
+	data = buf.Bytes()
+	return
+}
+
+var DNSSEC nopfs.Dispatcher = nopfs.NewFun(ResolveF(dnssec)).Limit("dns")
@@ -0,0 +1,297 @@
+package dns
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A zoneKey signs the records of a test zone
+type zoneKey struct {
+	zone   string
+	rr     RR
+	signer crypto.Signer
+	hash   crypto.Hash
+}
+
+// newZoneKey makes a key signing entry point for the zone with the
+// algorithm, one of 8, 13 or 15, and gives its DNSKEY record.
+func newZoneKey(t *testing.T, zone string, algorithm uint8) *zoneKey {
+	t.Helper()
+	k := &zoneKey{zone: zone}
+	var public []byte
+	switch algorithm {
+	case 8:
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := big.NewInt(int64(key.E)).Bytes()
+		public = append(append([]byte{byte(len(e))}, e...), key.N.Bytes()...)
+		k.signer, k.hash = key, crypto.SHA256
+	case 13:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		public = append(key.X.FillBytes(make([]byte, 32)), key.Y.FillBytes(make([]byte, 32))...)
+		k.signer, k.hash = key, crypto.SHA256
+	case 15:
+		pub, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		public = pub
+		k.signer = key
+	}
+	data := packUint16(nil, FlagZone|FlagSEP)
+	data = append(data, 3, algorithm)
+	k.rr = RR{Name: zone, Type: TypeDNSKEY, Class: ClassINET, TTL: 3600, Data: append(data, public...)}
+	return k
+}
+
+// ds gives the DS record for the key
+func (k *zoneKey) ds() RR {
+	digest := sha256.Sum256(append(canonicalName(k.rr.Name), k.rr.Data...))
+	data := packUint16(nil, k.rr.KeyTag())
+	data = append(data, k.rr.Data[3], 2)
+	return RR{Name: k.zone, Type: TypeDS, Class: ClassINET, TTL: 3600, Data: append(data, digest[:]...)}
+}
+
+// sign gives the signature of the key over the RRset, valid from the
+// inception until the expiration
+func (k *zoneKey) sign(t *testing.T, set []RR, inception, expiration time.Time) RR {
+	t.Helper()
+	labels, _ := splitName(set[0].Name)
+	data := packUint16(nil, set[0].Type)
+	data = append(data, k.rr.Data[3], byte(len(labels)))
+	data = packUint32(data, set[0].TTL)
+	data = packUint32(data, uint32(expiration.Unix()))
+	data = packUint32(data, uint32(inception.Unix()))
+	data = packUint16(data, k.rr.KeyTag())
+	data = append(data, canonicalName(k.zone)...)
+	rr := RR{Name: set[0].Name, Type: TypeRRSIG, Class: ClassINET, TTL: set[0].TTL, Data: data}
+	s, err := rr.RRSIG()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := signedData(s, set)
+	digest := signed
+	if k.hash != 0 {
+		h := k.hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+	sig, err := k.signer.Sign(rand.Reader, digest, k.hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, ok := k.signer.(*ecdsa.PrivateKey); ok {
+		// DNSSEC has the two integers side by side, not in ASN.1
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	rr.Data = append(rr.Data, sig...)
+	return rr
+}
+
+// signed gives the RRset followed by its signature, valid for a month
+func (k *zoneKey) signed(t *testing.T, set ...RR) []RR {
+	now := time.Now()
+	return append(set, k.sign(t, set, now.Add(-time.Hour), now.Add(30*24*time.Hour)))
+}
+
+// typeBits encodes the types, which must be below 256, as the bitmap of
+// NSEC and NSEC3 records
+func typeBits(types ...uint16) []byte {
+	bits := make([]byte, 32)
+	n := 0
+	for _, t := range types {
+		bits[t/8] |= 0x80 >> (t % 8)
+		if int(t/8)+1 > n {
+			n = int(t/8) + 1
+		}
+	}
+	return append([]byte{0, byte(n)}, bits[:n]...)
+}
+
+// standInSigned answers from the responses given for each name and type,
+// with an empty answer for the rest
+func standInSigned(t *testing.T, responses map[string]*Msg) string {
+	return standIn(t, "127.0.0.1:0", func(q *Msg, tcp bool) *Msg {
+		key := strings.ToLower(q.Question[0].Name) + " " + TypeName(q.Question[0].Type)
+		if r, ok := responses[key]; ok {
+			c := *r
+			return &c
+		}
+		return &Msg{}
+	})
+}
+
+func TestDNSSEC(t *testing.T) {
+	defer func(rrs []RR) { trustAnchors.rrs = rrs }(trustAnchors.rrs)
+	defer func(d time.Duration) { SigWarning = d }(SigWarning)
+	SigWarning = 7 * 24 * time.Hour
+
+	// test. signs with RSA, secure.test. with ECDSA and ed.test. with
+	// Ed25519, while insecure.test. and opt.test. are not signed
+	root := newZoneKey(t, "test.", 8)
+	secure := newZoneKey(t, "secure.test.", 13)
+	ed := newZoneKey(t, "ed.test.", 15)
+	trustAnchors.rrs = []RR{root.ds()}
+
+	a := func(name, addr string) RR { return mustRR(t, name+" 300 IN A "+addr) }
+	soa := func(zone string) RR {
+		return mustRR(t, zone+" 3600 IN SOA ns."+zone+" admin."+zone+" 1 3600 600 86400 300")
+	}
+	now := time.Now()
+	www := a("www.secure.test.", "192.0.2.1")
+	// The address is changed after signing
+	bad := secure.signed(t, a("bad.secure.test.", "192.0.2.2"))
+	bad[0] = a("bad.secure.test.", "192.0.2.3")
+	old := a("old.secure.test.", "192.0.2.4")
+	soon := a("soon.secure.test.", "192.0.2.5")
+
+	nsec := RR{Name: "insecure.test.", Type: TypeNSEC, Class: ClassINET, TTL: 300,
+		Data: append(canonicalName("zz.test."), typeBits(TypeNS, TypeRRSIG, TypeNSEC)...)}
+	// An opt-out NSEC3 record whose span covers the hash of opt.test.
+	hash := nsec3Hash("opt.test.", 0, nil)
+	before, after := append([]byte{}, hash...), append([]byte{}, hash...)
+	before[len(before)-1]--
+	after[len(after)-1]++
+	nsec3Data := append([]byte{1, 1, 0, 0, 0, byte(len(after))}, after...)
+	nsec3 := RR{Name: strings.ToLower(base32Hex.EncodeToString(before)) + ".test.", Type: TypeNSEC3,
+		Class: ClassINET, TTL: 300, Data: append(nsec3Data, typeBits(TypeNS)...)}
+
+	responses := map[string]*Msg{
+		"test. DNSKEY":                   {Answer: root.signed(t, root.rr)},
+		"secure.test. DS":                {Answer: root.signed(t, secure.ds())},
+		"secure.test. DNSKEY":            {Answer: secure.signed(t, secure.rr)},
+		"secure.test. SOA":               {Answer: secure.signed(t, soa("secure.test."))},
+		"www.secure.test. A":             {Answer: secure.signed(t, www)},
+		"bad.secure.test. A":             {Answer: bad},
+		"old.secure.test. A":             {Answer: []RR{old, secure.sign(t, []RR{old}, now.Add(-48*time.Hour), now.Add(-time.Hour))}},
+		"soon.secure.test. A":            {Answer: []RR{soon, secure.sign(t, []RR{soon}, now.Add(-time.Hour), now.Add(48*time.Hour))}},
+		"ed.test. DS":                    {Answer: root.signed(t, ed.ds())},
+		"ed.test. DNSKEY":                {Answer: ed.signed(t, ed.rr)},
+		"ed.test. SOA":                   {Answer: ed.signed(t, soa("ed.test."))},
+		"www.ed.test. A":                 {Answer: ed.signed(t, a("www.ed.test.", "192.0.2.6"))},
+		"insecure.test. DS":              {Authority: root.signed(t, nsec)},
+		"insecure.test. SOA":             {Answer: []RR{soa("insecure.test.")}},
+		"www.insecure.test. A":           {Answer: []RR{a("www.insecure.test.", "192.0.2.7")}},
+		"opt.test. DS":                   {Authority: root.signed(t, nsec3)},
+		"opt.test. SOA":                  {Answer: []RR{soa("opt.test.")}},
+		"www.opt.test. A":                {Answer: []RR{a("www.opt.test.", "192.0.2.8")}},
+		"unproven.test. SOA":             {Answer: []RR{soa("unproven.test.")}},
+		"www.unproven.test. A":           {Answer: []RR{a("www.unproven.test.", "192.0.2.9")}},
+		"forged.secure.test. DNSKEY":     {Answer: secure.signed(t, secure.rr)},
+		"www.forged.secure.test. A":      {Answer: secure.signed(t, a("www.forged.secure.test.", "192.0.2.10"))},
+		"forged.secure.test. DS":         {Answer: root.signed(t, RR{Name: "forged.secure.test.", Type: TypeDS, Class: ClassINET, TTL: 3600, Data: secure.ds().Data})},
+		"www.secure.test. SOA":           {},
+		"www.insecure.test. SOA":         {},
+		"bad.secure.test. SOA":           {},
+		"www.forged.secure.test. SOA":    {},
+		"www.forged.secure.test. DNSKEY": {},
+	}
+	server := standInSigned(t, responses)
+
+	tests := []struct {
+		host string
+		want []string
+	}{
+		{"www.secure.test", []string{
+			"test.              secure  ",
+			"secure.test.       secure  " + keyList([]RR{secure.rr}),
+			"A      secure  ",
+			" secure.test.  ",
+		}},
+		{"www.ed.test", []string{
+			"ed.test.  secure  " + keyList([]RR{ed.rr}),
+			"A      secure  ",
+		}},
+		{"www.insecure.test", []string{
+			"insecure.test.      insecure  NSEC proves no DS",
+			"A      insecure",
+		}},
+		{"www.opt.test", []string{
+			"opt.test.      insecure  NSEC3 opt-out covers delegation",
+			"A      insecure",
+		}},
+		{"www.unproven.test", []string{
+			"unproven.test.      bogus   unsigned delegation without proof of no DS",
+			"A      bogus",
+		}},
+		// Signed with the key of another zone
+		{"www.forged.secure.test", []string{"forged.secure.test.", "DS: no signature from a zone key"}},
+		{"bad.secure.test", []string{"A      bogus   key ", "signature does not verify"}},
+		{"old.secure.test", []string{"A      bogus   signature expired "}},
+		{"soon.secure.test", []string{"A      secure  ", "WARNING expires soon"}},
+	}
+	for _, test := range tests {
+		data, err := dnssec(test.host, server)
+		if err != nil {
+			t.Errorf("%s: %s", test.host, err)
+			continue
+		}
+		out := squeeze(string(data))
+		for _, want := range test.want {
+			if !strings.Contains(out, squeeze(want)) {
+				t.Errorf("%s: no %q in\n%s", test.host, want, data)
+			}
+		}
+	}
+}
+
+// squeeze collapses runs of spaces, so that the columns of a table may
+// be matched whatever their width
+func squeeze(s string) string {
+	return strings.Join(strings.Fields(strings.Replace(s, "\n", " | ", -1)), " ")
+}
+
+func TestDSMatches(t *testing.T) {
+	k := newZoneKey(t, "example.", 13)
+	other := newZoneKey(t, "example.", 13)
+	ds := k.ds()
+	if !dsMatches(&ds, &k.rr) {
+		t.Error("DS does not match its key")
+	}
+	if dsMatches(&ds, &other.rr) {
+		t.Error("DS matches another key")
+	}
+	sha1DS := mustRR(t, "example. 3600 IN DS 1 13 3 00")
+	if dsMatches(&sha1DS, &k.rr) {
+		t.Error("DS of an unknown digest type matches")
+	}
+}
+
+func TestCovers(t *testing.T) {
+	tests := []struct {
+		owner, next, hash byte
+		covered           bool
+	}{
+		{1, 5, 3, true},
+		{1, 5, 1, false},
+		{1, 5, 5, false},
+		{1, 5, 7, false},
+		// The last record wraps around to the first
+		{9, 2, 10, true},
+		{9, 2, 1, true},
+		{9, 2, 5, false},
+	}
+	for _, test := range tests {
+		if c := covers([]byte{test.owner}, []byte{test.next}, []byte{test.hash}); c != test.covered {
+			t.Errorf("%d..%d %d: got %v", test.owner, test.next, test.hash, c)
+		}
+	}
+}
@@ -0,0 +1,887 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/rminnich/go9p"
+	"hubs.net.uk/sw/nopfs"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Problem found with the records a domain publishes for mail. Errors
+// are those that may get mail rejected or leave it unprotected.
+type Problem struct {
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+type problems []Problem
+
+func (p *problems) errorf(format string, a ...interface{}) {
+	*p = append(*p, Problem{"error", fmt.Sprintf(format, a...)})
+}
+
+func (p *problems) warnf(format string, a ...interface{}) {
+	*p = append(*p, Problem{"warning", fmt.Sprintf(format, a...)})
+}
+
+func (p problems) text(w io.Writer) {
+	if len(p) == 0 {
+		fmt.Fprintln(w, "no problems found")
+	}
+	for _, pr := range p {
+		fmt.Fprintf(w, "%s: %s\n", pr.Severity, pr.Message)
+	}
+}
+
+// A Tag from a record made of a list of tags, such as v=DMARC1; p=none
+type Tag struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func parseTags(s string) (tags []Tag, err error) {
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.Index(part, "=")
+		if i <= 0 {
+			err = fmt.Errorf("bad tag %q", part)
+			return
+		}
+		tags = append(tags, Tag{strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+1:])})
+	}
+	return
+}
+
+func tagValue(tags []Tag, name string) (string, bool) {
+	for _, t := range tags {
+		if t.Name == name {
+			return t.Value, true
+		}
+	}
+	return "", false
+}
+
+func writeRecord(w io.Writer, name, record string) {
+	if record == "" {
+		record = "no record"
+	}
+	fmt.Fprintf(w, "%s: %s\n", name, record)
+}
+
+func writeTags(w io.Writer, tags []Tag) {
+	for _, t := range tags {
+		fmt.Fprintf(w, "  %s\t%s\n", t.Name, t.Value)
+	}
+}
+
+// versionRecords returns the TXT records at the name that begin with
+// the version tag, such as v=spf1, each made of its strings joined.
+// Having none is not an error.
+func versionRecords(server, name, version string) (found []string, err error) {
+	rrs, err := answers(server, name, TypeTXT)
+	if err == os.ErrNotExist {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	version = strings.ToLower(version)
+	for i := range rrs {
+		txt := strings.Join(rrs[i].TXT(), "")
+		lower := strings.ToLower(txt)
+		if lower == version || strings.HasPrefix(lower, version+" ") || strings.HasPrefix(lower, version+";") {
+			found = append(found, txt)
+		}
+	}
+	return
+}
+
+// orgDomain approximates the organizational domain of a name by its
+// last two labels.
+func orgDomain(name string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(name), "."), ".")
+	if len(labels) > 2 {
+		labels = labels[len(labels)-2:]
+	}
+	return strings.Join(labels, ".") + "."
+}
+
+// The limits on DNS lookups made while evaluating SPF
+const (
+	maxSPFLookups = 10
+	maxSPFVoid    = 2
+)
+
+// A SPFRecord and those it includes
+type SPFRecord struct {
+	Domain string    `json:"domain"`
+	Record string    `json:"record,omitempty"`
+	Terms  []SPFTerm `json:"terms,omitempty"`
+}
+
+type SPFTerm struct {
+	Term    string     `json:"term"`
+	Lookups int        `json:"lookups,omitempty"`
+	Include *SPFRecord `json:"include,omitempty"`
+}
+
+type SPFReport struct {
+	SPFRecord
+	Lookups     int      `json:"lookups"`
+	VoidLookups int      `json:"void_lookups"`
+	Problems    problems `json:"problems"`
+}
+
+func (r *SPFRecord) text(w io.Writer, indent string) {
+	if r.Record == "" {
+		fmt.Fprintf(w, "%s%s: no record\n", indent, r.Domain)
+		return
+	}
+	fmt.Fprintf(w, "%s%s: %s\n", indent, r.Domain, r.Record)
+	for _, t := range r.Terms {
+		fmt.Fprintf(w, "%s  %s\n", indent, t.Term)
+		if t.Include != nil {
+			t.Include.text(w, indent+"    ")
+		}
+	}
+}
+
+func (r *SPFReport) text(w io.Writer) {
+	r.SPFRecord.text(w, "")
+	fmt.Fprintf(w, "\nlookups %d of %d, void lookups %d of %d\n\n",
+		r.Lookups, maxSPFLookups, r.VoidLookups, maxSPFVoid)
+	r.Problems.text(w)
+}
+
+// An spfChecker expands a domain's SPF record, following includes and
+// redirects, counting the lookups they need as a receiver would.
+type spfChecker struct {
+	server string
+	report *SPFReport
+	// Domains being expanded, to find loops
+	seen map[string]bool
+}
+
+// splitSPFTerm splits a term into its qualifier, name and value,
+// saying whether it is a modifier such as redirect=example.com rather
+// than a mechanism such as -ip4:192.0.2.0/24.
+func splitSPFTerm(term string) (qualifier, name, value string, modifier bool) {
+	if i := strings.IndexAny(term, "=:/"); i > 0 && term[i] == '=' {
+		return "", strings.ToLower(term[:i]), term[i+1:], true
+	}
+	if strings.ContainsRune("+-~?", rune(term[0])) {
+		qualifier, term = term[:1], term[1:]
+	}
+	name = term
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name = term[:i]
+		value = strings.TrimPrefix(term[i:], ":")
+	}
+	return qualifier, strings.ToLower(name), value, false
+}
+
+// target gives the domain a mechanism applies to, its value without
+// any prefix length or the domain being checked.
+func target(value, domain string) string {
+	if i := strings.Index(value, "/"); i >= 0 {
+		value = value[:i]
+	}
+	if value == "" {
+		return domain
+	}
+	return value
+}
+
+// void counts a lookup void if none of the types have any records
+func (c *spfChecker) void(name string, qtypes ...uint16) {
+	if strings.Contains(name, "%") {
+		return
+	}
+	for _, t := range qtypes {
+		if _, err := answers(c.server, name, t); err == nil {
+			return
+		}
+	}
+	c.report.VoidLookups++
+}
+
+func (c *spfChecker) check(domain string, depth int) *SPFRecord {
+	rec := &SPFRecord{Domain: domain}
+	p := &c.report.Problems
+	key := strings.ToLower(Fqdn(domain))
+	if c.seen[key] {
+		p.errorf("%s is included within itself, making a loop", domain)
+		return rec
+	}
+	if depth > 2*maxSPFLookups {
+		return rec
+	}
+	c.seen[key] = true
+	defer delete(c.seen, key)
+
+	records, err := versionRecords(c.server, domain, "v=spf1")
+	if err != nil {
+		p.errorf("looking up SPF for %s: %s", domain, err)
+		return rec
+	}
+	switch len(records) {
+	case 0:
+		p.errorf("%s has no SPF record", domain)
+		if depth > 0 {
+			c.report.VoidLookups++
+		}
+		return rec
+	case 1:
+	default:
+		p.errorf("%s has %d SPF records, only one is allowed", domain, len(records))
+		return rec
+	}
+	rec.Record = records[0]
+
+	terms := strings.Fields(records[0])[1:]
+	all, redirect := false, ""
+	for _, term := range terms {
+		t := SPFTerm{Term: term}
+		qualifier, name, value, modifier := splitSPFTerm(term)
+		if modifier {
+			switch name {
+			case "redirect":
+				if redirect != "" {
+					p.errorf("%s has more than one redirect", domain)
+				}
+				redirect = value
+				continue
+			case "exp":
+			default:
+				p.warnf("%s has an unknown modifier %s", domain, term)
+			}
+			rec.Terms = append(rec.Terms, t)
+			continue
+		}
+		if all {
+			p.warnf("%s has %s after all, which is ignored", domain, term)
+		}
+		if strings.Contains(value, "%") {
+			p.warnf("%s uses a macro in %s, which is not expanded here", domain, term)
+		}
+		switch name {
+		case "all":
+			all = true
+			switch qualifier {
+			case "", "+":
+				p.errorf("%s ends with %s, letting anyone send mail as it", domain, term)
+			case "?":
+				p.warnf("%s ends with ?all, so mail from others is neutral", domain)
+			}
+		case "include":
+			t.Lookups = 1
+			if value == "" {
+				p.errorf("%s has include without a domain", domain)
+			} else if !strings.Contains(value, "%") {
+				t.Include = c.check(value, depth+1)
+			}
+		case "a":
+			t.Lookups = 1
+			c.void(target(value, domain), TypeA, TypeAAAA)
+		case "mx":
+			t.Lookups = 1
+			name := target(value, domain)
+			if rrs, err := answers(c.server, name, TypeMX); err != nil {
+				c.void(name, TypeMX)
+			} else if len(rrs) > maxSPFLookups {
+				p.errorf("%s has %s with %d MX records, more than the %d allowed", domain, term, len(rrs), maxSPFLookups)
+			}
+		case "ptr":
+			t.Lookups = 1
+			p.warnf("%s uses %s, which should not be used", domain, term)
+		case "exists":
+			t.Lookups = 1
+			if value == "" {
+				p.errorf("%s has exists without a domain", domain)
+			}
+		case "ip4", "ip6":
+			ip := net.ParseIP(value)
+			if _, network, err := net.ParseCIDR(value); err == nil {
+				ip = network.IP
+			}
+			if ip == nil || (ip.To4() != nil) != (name == "ip4") {
+				p.errorf("%s has a bad address in %s", domain, term)
+			}
+		default:
+			p.errorf("%s has an unknown mechanism %s", domain, term)
+		}
+		c.report.Lookups += t.Lookups
+		rec.Terms = append(rec.Terms, t)
+	}
+
+	switch {
+	case redirect != "" && all:
+		p.warnf("%s has both all and a redirect, which is ignored", domain)
+		rec.Terms = append(rec.Terms, SPFTerm{Term: "redirect=" + redirect})
+	case redirect != "":
+		c.report.Lookups++
+		t := SPFTerm{Term: "redirect=" + redirect, Lookups: 1}
+		if !strings.Contains(redirect, "%") {
+			t.Include = c.check(redirect, depth+1)
+		}
+		rec.Terms = append(rec.Terms, t)
+	case depth == 0 && !all:
+		p.warnf("%s has no all, so mail from others is neutral", domain)
+	}
+	return rec
+}
+
+func spf(domain, server string) mailReport {
+	r := &SPFReport{Problems: problems{}}
+	c := &spfChecker{server: server, report: r, seen: map[string]bool{}}
+	r.SPFRecord = *c.check(domain, 0)
+	if r.Lookups > maxSPFLookups {
+		r.Problems.errorf("%d lookups are needed, more than the %d allowed, so SPF fails", r.Lookups, maxSPFLookups)
+	}
+	if r.VoidLookups > maxSPFVoid {
+		r.Problems.errorf("%d lookups find nothing, more than the %d allowed, so SPF fails", r.VoidLookups, maxSPFVoid)
+	}
+	return r
+}
+
+type DMARCReport struct {
+	Domain    string   `json:"domain"`
+	Name      string   `json:"name"`
+	Inherited bool     `json:"inherited,omitempty"`
+	Record    string   `json:"record,omitempty"`
+	Tags      []Tag    `json:"tags,omitempty"`
+	Problems  problems `json:"problems"`
+}
+
+func (r *DMARCReport) text(w io.Writer) {
+	writeRecord(w, r.Name, r.Record)
+	if r.Inherited {
+		fmt.Fprintf(w, "  (the policy for %s, inherited by %s)\n", strings.TrimSuffix(orgDomain(r.Domain), "."), r.Domain)
+	}
+	writeTags(w, r.Tags)
+	fmt.Fprintln(w)
+	r.Problems.text(w)
+}
+
+// checkURIs checks the report destinations given in a rua or ruf tag.
+// Those outside the domain must agree to take its reports.
+func (r *DMARCReport) checkURIs(server, tag, value string) {
+	for _, uri := range strings.Split(value, ",") {
+		uri = strings.TrimSpace(uri)
+		// A size limit may follow, as in mailto:d@example.com!10m
+		if i := strings.LastIndex(uri, "!"); i > 0 {
+			uri = uri[:i]
+		}
+		if !strings.HasPrefix(strings.ToLower(uri), "mailto:") {
+			r.Problems.errorf("%s destination %s is not a mailto: address", tag, uri)
+			continue
+		}
+		addr := uri[len("mailto:"):]
+		at := strings.LastIndex(addr, "@")
+		if at < 0 {
+			r.Problems.errorf("%s destination %s has no domain", tag, uri)
+			continue
+		}
+		dest := strings.ToLower(Fqdn(addr[at+1:]))
+		if orgDomain(dest) == orgDomain(r.Domain) {
+			continue
+		}
+		name := strings.TrimPrefix(r.Name, "_dmarc.") + "_report._dmarc." + dest
+		records, err := versionRecords(server, name, "v=DMARC1")
+		if err == nil && len(records) == 0 {
+			r.Problems.errorf("%s destination %s has not agreed to take reports, there is no record at %s", tag, uri, name)
+		}
+	}
+}
+
+// dmarc checks the DMARC policy for the domain, or the one it inherits
+// from its organizational domain.
+func dmarc(domain, server string) mailReport {
+	r := &DMARCReport{Domain: domain, Problems: problems{}}
+	r.Name = "_dmarc." + strings.ToLower(Fqdn(domain))
+	records, err := versionRecords(server, r.Name, "v=DMARC1")
+	if org := orgDomain(domain); err == nil && len(records) == 0 && org != strings.ToLower(Fqdn(domain)) {
+		if found, e := versionRecords(server, "_dmarc."+org, "v=DMARC1"); e == nil && len(found) > 0 {
+			r.Name, records, r.Inherited = "_dmarc."+org, found, true
+		}
+	}
+	switch {
+	case err != nil:
+		r.Problems.errorf("looking up %s: %s", r.Name, err)
+		return r
+	case len(records) == 0:
+		r.Problems.errorf("there is no DMARC record at %s", r.Name)
+		return r
+	case len(records) > 1:
+		r.Problems.errorf("%s has %d DMARC records, so none applies", r.Name, len(records))
+		return r
+	}
+	r.Record = records[0]
+	if r.Tags, err = parseTags(r.Record); err != nil {
+		r.Problems.errorf("%s", err)
+		return r
+	}
+	if r.Tags[0].Name != "v" {
+		r.Problems.errorf("the record must begin with v=DMARC1")
+	}
+
+	policy, ok := tagValue(r.Tags, "p")
+	if sp, ok := tagValue(r.Tags, "sp"); ok && r.Inherited {
+		policy = sp
+	}
+	switch {
+	case !ok:
+		r.Problems.errorf("there is no policy, p= is required")
+	case policy == "none":
+		r.Problems.warnf("the policy is none, so mail failing DMARC is only reported")
+	case policy != "quarantine" && policy != "reject":
+		r.Problems.errorf("unknown policy %s", policy)
+	}
+	for _, t := range r.Tags {
+		switch t.Name {
+		case "v", "p", "rf", "ri":
+		case "sp":
+			if t.Value != "none" && t.Value != "quarantine" && t.Value != "reject" {
+				r.Problems.errorf("unknown subdomain policy %s", t.Value)
+			}
+		case "pct":
+			pct, err := strconv.Atoi(t.Value)
+			if err != nil || pct < 0 || pct > 100 {
+				r.Problems.errorf("pct=%s is not a percentage", t.Value)
+			} else if pct < 100 {
+				r.Problems.warnf("pct=%d applies the policy to only part of the mail", pct)
+			}
+		case "adkim", "aspf":
+			if t.Value != "r" && t.Value != "s" {
+				r.Problems.errorf("%s=%s should be r or s", t.Name, t.Value)
+			}
+		case "fo":
+			for _, o := range strings.Split(t.Value, ":") {
+				if o != "0" && o != "1" && o != "d" && o != "s" {
+					r.Problems.errorf("unknown failure reporting option %s", o)
+				}
+			}
+		case "rua", "ruf":
+			r.checkURIs(server, t.Name, t.Value)
+		default:
+			r.Problems.warnf("unknown tag %s", t.Name)
+		}
+	}
+	if _, ok := tagValue(r.Tags, "rua"); !ok {
+		r.Problems.warnf("there is no rua, so no aggregate reports are sent")
+	}
+	return r
+}
+
+type DKIMReport struct {
+	Domain   string   `json:"domain"`
+	Selector string   `json:"selector"`
+	Name     string   `json:"name"`
+	Record   string   `json:"record,omitempty"`
+	Tags     []Tag    `json:"tags,omitempty"`
+	KeyType  string   `json:"key_type,omitempty"`
+	KeyBits  int      `json:"key_bits,omitempty"`
+	Problems problems `json:"problems"`
+}
+
+func (r *DKIMReport) text(w io.Writer) {
+	writeRecord(w, r.Name, r.Record)
+	writeTags(w, r.Tags)
+	if r.KeyType != "" {
+		fmt.Fprintf(w, "  (%s key, %d bits)\n", r.KeyType, r.KeyBits)
+	}
+	fmt.Fprintln(w)
+	r.Problems.text(w)
+}
+
+// dkim checks the DKIM key published for the selector
+func dkim(domain, selector, server string) mailReport {
+	r := &DKIMReport{Domain: domain, Selector: selector, Problems: problems{}}
+	r.Name = selector + "._domainkey." + strings.ToLower(Fqdn(domain))
+	rrs, err := answers(server, r.Name, TypeTXT)
+	switch {
+	case err == os.ErrNotExist:
+		r.Problems.errorf("there is no DKIM key at %s", r.Name)
+		return r
+	case err != nil:
+		r.Problems.errorf("looking up %s: %s", r.Name, err)
+		return r
+	case len(rrs) > 1:
+		r.Problems.errorf("%s has %d records, only one is allowed", r.Name, len(rrs))
+		return r
+	}
+	r.Record = strings.Join(rrs[0].TXT(), "")
+	if r.Tags, err = parseTags(r.Record); err != nil {
+		r.Problems.errorf("%s", err)
+		return r
+	}
+	if v, ok := tagValue(r.Tags, "v"); ok && (v != "DKIM1" || r.Tags[0].Name != "v") {
+		r.Problems.errorf("the record must begin with v=DKIM1 if it has a version")
+	}
+	if h, ok := tagValue(r.Tags, "h"); ok && !strings.Contains(h, "sha256") {
+		r.Problems.warnf("only %s may be used, sha1 is no longer safe", h)
+	}
+	if t, ok := tagValue(r.Tags, "t"); ok {
+		for _, flag := range strings.Split(t, ":") {
+			if strings.TrimSpace(flag) == "y" {
+				r.Problems.warnf("the key is marked as being tested, t=y")
+			}
+		}
+	}
+
+	p, ok := tagValue(r.Tags, "p")
+	switch {
+	case !ok:
+		r.Problems.errorf("there is no key, p= is required")
+		return r
+	case p == "":
+		r.Problems.errorf("the key has been revoked")
+		return r
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(p), ""))
+	if err != nil {
+		r.Problems.errorf("the key is not valid base64")
+		return r
+	}
+	r.KeyType, _ = tagValue(r.Tags, "k")
+	if r.KeyType == "" {
+		r.KeyType = "rsa"
+	}
+	switch r.KeyType {
+	case "rsa":
+		pub, err := x509.ParsePKIXPublicKey(key)
+		if err != nil {
+			// Some publish the bare key rather than SubjectPublicKeyInfo
+			pub, err = x509.ParsePKCS1PublicKey(key)
+		}
+		rsaKey, ok := pub.(*rsa.PublicKey)
+		if err != nil || !ok {
+			r.Problems.errorf("the key is not an RSA public key")
+			return r
+		}
+		r.KeyBits = rsaKey.N.BitLen()
+		if r.KeyBits < 1024 {
+			r.Problems.errorf("the key has only %d bits, receivers will not accept it", r.KeyBits)
+		} else if r.KeyBits < 2048 {
+			r.Problems.warnf("the key has only %d bits, 2048 are recommended", r.KeyBits)
+		}
+	case "ed25519":
+		r.KeyBits = 8 * len(key)
+		if len(key) != 32 {
+			r.Problems.errorf("the key is %d bytes long rather than 32", len(key))
+		}
+	default:
+		r.Problems.errorf("unknown key type %s", r.KeyType)
+	}
+	return r
+}
+
+// Time allowed for fetching an MTA-STS policy
+var MailHTTPTimeout = 10 * time.Second
+
+type MTASTSPolicy struct {
+	Version string   `json:"version"`
+	Mode    string   `json:"mode"`
+	MX      []string `json:"mx"`
+	MaxAge  int      `json:"max_age"`
+}
+
+type MXMatch struct {
+	Host    string `json:"host"`
+	Matches bool   `json:"matches"`
+}
+
+type MTASTSReport struct {
+	Domain    string        `json:"domain"`
+	Name      string        `json:"name"`
+	Record    string        `json:"record,omitempty"`
+	ID        string        `json:"id,omitempty"`
+	PolicyURL string        `json:"policy_url,omitempty"`
+	Policy    *MTASTSPolicy `json:"policy,omitempty"`
+	MX        []MXMatch     `json:"mx,omitempty"`
+	Problems  problems      `json:"problems"`
+}
+
+func (r *MTASTSReport) text(w io.Writer) {
+	writeRecord(w, r.Name, r.Record)
+	if r.Policy != nil {
+		fmt.Fprintf(w, "\n%s\n  version\t%s\n  mode\t%s\n", r.PolicyURL, r.Policy.Version, r.Policy.Mode)
+		for _, mx := range r.Policy.MX {
+			fmt.Fprintf(w, "  mx\t%s\n", mx)
+		}
+		fmt.Fprintf(w, "  max_age\t%d\n", r.Policy.MaxAge)
+	}
+	if len(r.MX) > 0 {
+		fmt.Fprintln(w)
+	}
+	for _, mx := range r.MX {
+		status := "matches the policy"
+		if !mx.Matches {
+			status = "does not match the policy"
+		}
+		fmt.Fprintf(w, "MX %s %s\n", mx.Host, status)
+	}
+	fmt.Fprintln(w)
+	r.Problems.text(w)
+}
+
+// stsMatch reports whether the MX host matches the pattern from a
+// policy, which may begin with a wildcard standing for one label.
+func stsMatch(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if strings.HasPrefix(pattern, "*.") {
+		i := strings.Index(host, ".")
+		return i > 0 && host[i+1:] == pattern[2:]
+	}
+	return host == pattern
+}
+
+// fetchPolicy gets the MTA-STS policy over HTTPS, not following any
+// redirects as they are not allowed.
+func fetchPolicy(url string) (body string, err error) {
+	client := &http.Client{
+		Timeout: MailHTTPTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s gives %s", url, resp.Status)
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	return string(data), err
+}
+
+// mtasts checks the domain's MTA-STS record and policy and that its MX
+// hosts are covered by the policy.
+func mtasts(domain, server string) mailReport {
+	r := &MTASTSReport{Domain: domain, Problems: problems{}}
+	r.Name = "_mta-sts." + strings.ToLower(Fqdn(domain))
+	records, err := versionRecords(server, r.Name, "v=STSv1")
+	switch {
+	case err != nil:
+		r.Problems.errorf("looking up %s: %s", r.Name, err)
+		return r
+	case len(records) == 0:
+		r.Problems.warnf("there is no MTA-STS record at %s, so mail may be sent without TLS", r.Name)
+		return r
+	case len(records) > 1:
+		r.Problems.errorf("%s has %d MTA-STS records, so none applies", r.Name, len(records))
+		return r
+	}
+	r.Record = records[0]
+	tags, err := parseTags(r.Record)
+	if err != nil {
+		r.Problems.errorf("%s", err)
+		return r
+	}
+	r.ID, _ = tagValue(tags, "id")
+	if len(r.ID) < 1 || len(r.ID) > 32 || strings.Trim(r.ID, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789") != "" {
+		r.Problems.errorf("id=%s should be 1 to 32 letters and digits", r.ID)
+	}
+
+	r.PolicyURL = "https://mta-sts." + strings.TrimSuffix(strings.ToLower(domain), ".") + "/.well-known/mta-sts.txt"
+	body, err := fetchPolicy(r.PolicyURL)
+	if err != nil {
+		r.Problems.errorf("fetching the policy: %s", err)
+		return r
+	}
+	policy := &MTASTSPolicy{MaxAge: -1}
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		value := strings.TrimSpace(line[i+1:])
+		switch strings.TrimSpace(line[:i]) {
+		case "version":
+			policy.Version = value
+		case "mode":
+			policy.Mode = value
+		case "mx":
+			policy.MX = append(policy.MX, value)
+		case "max_age":
+			if policy.MaxAge, err = strconv.Atoi(value); err != nil {
+				policy.MaxAge = -1
+			}
+		}
+	}
+	r.Policy = policy
+	if policy.Version != "STSv1" {
+		r.Problems.errorf("the policy should have version: STSv1")
+	}
+	switch policy.Mode {
+	case "enforce":
+	case "testing":
+		r.Problems.warnf("the policy is in testing mode, so it is not enforced")
+	case "none":
+		r.Problems.warnf("the policy mode is none, so it has been withdrawn")
+	default:
+		r.Problems.errorf("the policy has an unknown mode %q", policy.Mode)
+	}
+	switch {
+	case policy.MaxAge < 0 || policy.MaxAge > 31557600:
+		r.Problems.errorf("the policy should have a max_age of up to 31557600 seconds")
+	case policy.MaxAge < 86400:
+		r.Problems.warnf("the policy max_age is under a day")
+	}
+	if len(policy.MX) == 0 && policy.Mode != "none" {
+		r.Problems.errorf("the policy names no MX hosts")
+	}
+
+	mxs, err := answers(server, domain, TypeMX)
+	if err != nil {
+		r.Problems.warnf("%s has no MX records", domain)
+	}
+	for i := range mxs {
+		_, host := mxs[i].MX()
+		m := MXMatch{Host: host}
+		for _, pattern := range policy.MX {
+			m.Matches = m.Matches || stsMatch(pattern, host)
+		}
+		if !m.Matches && policy.Mode == "enforce" {
+			r.Problems.errorf("MX %s is not in the policy, so mail to it will not be delivered", host)
+		} else if !m.Matches {
+			r.Problems.warnf("MX %s is not in the policy", host)
+		}
+		r.MX = append(r.MX, m)
+	}
+	return r
+}
+
+type TLSRPTReport struct {
+	Domain   string   `json:"domain"`
+	Name     string   `json:"name"`
+	Record   string   `json:"record,omitempty"`
+	Tags     []Tag    `json:"tags,omitempty"`
+	Problems problems `json:"problems"`
+}
+
+func (r *TLSRPTReport) text(w io.Writer) {
+	writeRecord(w, r.Name, r.Record)
+	writeTags(w, r.Tags)
+	fmt.Fprintln(w)
+	r.Problems.text(w)
+}
+
+// tlsrpt checks where reports of failures to use TLS are sent
+func tlsrpt(domain, server string) mailReport {
+	r := &TLSRPTReport{Domain: domain, Problems: problems{}}
+	r.Name = "_smtp._tls." + strings.ToLower(Fqdn(domain))
+	records, err := versionRecords(server, r.Name, "v=TLSRPTv1")
+	switch {
+	case err != nil:
+		r.Problems.errorf("looking up %s: %s", r.Name, err)
+		return r
+	case len(records) == 0:
+		r.Problems.warnf("there is no TLS-RPT record at %s, so failures to use TLS are not reported", r.Name)
+		return r
+	case len(records) > 1:
+		r.Problems.errorf("%s has %d TLS-RPT records, so none applies", r.Name, len(records))
+		return r
+	}
+	r.Record = records[0]
+	if r.Tags, err = parseTags(r.Record); err != nil {
+		r.Problems.errorf("%s", err)
+		return r
+	}
+	rua, ok := tagValue(r.Tags, "rua")
+	if !ok || rua == "" {
+		r.Problems.errorf("there is no rua giving where reports go")
+	}
+	for _, uri := range strings.Split(rua, ",") {
+		uri = strings.TrimSpace(uri)
+		if uri != "" && !strings.HasPrefix(uri, "mailto:") && !strings.HasPrefix(uri, "https:") {
+			r.Problems.errorf("rua destination %s is not a mailto: or https: address", uri)
+		}
+	}
+	return r
+}
+
+// A mailReport is the result of a check, which may be shown as text or
+// marshalled to JSON
+type mailReport interface {
+	text(w io.Writer)
+}
+
+// mailFiles returns files giving the report from the check for a
+// domain as text and as JSON.
+func mailFiles(check func(domain, server string) mailReport) (text, js *nopfs.Fun) {
+	text = nopfs.NewFun(ResolveF(func(domain, server string) ([]byte, error) {
+		buf := &bytes.Buffer{}
+		check(domain, server).text(buf)
+		return buf.Bytes(), nil
+	})).Limit("dnscheck")
+	js = nopfs.NewFun(ResolveF(func(domain, server string) ([]byte, error) {
+		data, err := json.MarshalIndent(check(domain, server), "", "  ")
+		return append(data, '\n'), err
+	})).Limit("dnscheck")
+	return
+}
+
+func appendMail(d *nopfs.Dir, name string, check func(domain, server string) mailReport) {
+	text, js := mailFiles(check)
+	d.Append(name, text)
+	d.Append(name+".json", js)
+}
+
+// dkimDir contains a directory for each selector, holding the checks
+// of its key. These are not listed.
+type dkimDir struct {
+	digDir
+}
+
+func (d *dkimDir) Clone() nopfs.Dispatcher {
+	n := &dkimDir{}
+	n.SetPath(d.GetPath())
+	n.SetParent(d.GetParent())
+	return n
+}
+
+func (d *dkimDir) Walk(req *go9p.SrvReq, name string) (nopfs.Dispatcher, error) {
+	if name == "" || strings.HasPrefix(name, ".") || strings.Contains(name, "..") {
+		return nil, os.ErrNotExist
+	}
+	n := nopfs.NewDir()
+	appendMail(n, "key", func(domain, server string) mailReport {
+		return dkim(domain, name, server)
+	})
+	n.SetPath(append(append([]string{}, d.GetPath()...), name))
+	n.SetParent(d)
+	return n, nil
+}
+
+func newMailDir() *nopfs.Dir {
+	d := nopfs.NewDir()
+	appendMail(d, "spf", spf)
+	appendMail(d, "dmarc", dmarc)
+	appendMail(d, "mta-sts", mtasts)
+	appendMail(d, "tls-rpt", tlsrpt)
+	d.Append("dkim", &dkimDir{})
+	return d
+}
+
+var Mail = newMailDir()
@@ -0,0 +1,163 @@
+package dns
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitSPFTerm(t *testing.T) {
+	tests := []struct {
+		term                   string
+		qualifier, name, value string
+		modifier               bool
+	}{
+		{"all", "", "all", "", false},
+		{"-all", "-", "all", "", false},
+		{"~ALL", "~", "all", "", false},
+		{"+ip4:192.0.2.0/24", "+", "ip4", "192.0.2.0/24", false},
+		{"ip6:2001:db8::/32", "", "ip6", "2001:db8::/32", false},
+		{"include:_spf.example.com", "", "include", "_spf.example.com", false},
+		{"?mx/24", "?", "mx", "/24", false},
+		{"a:mail.example.com/28", "", "a", "mail.example.com/28", false},
+		{"redirect=_spf.example.com", "", "redirect", "_spf.example.com", true},
+		{"exp=explain.%{d}", "", "exp", "explain.%{d}", true},
+		// An equals sign after a colon belongs to the value
+		{"exists:%{i}.x=y.example.com", "", "exists", "%{i}.x=y.example.com", false},
+	}
+	for _, test := range tests {
+		qualifier, name, value, modifier := splitSPFTerm(test.term)
+		if qualifier != test.qualifier || name != test.name || value != test.value || modifier != test.modifier {
+			t.Errorf("%s: got %q %q %q %v", test.term, qualifier, name, value, modifier)
+		}
+	}
+}
+
+func TestSTSMatch(t *testing.T) {
+	tests := []struct {
+		pattern, host string
+		match         bool
+	}{
+		{"mx.example.com", "mx.example.com", true},
+		{"mx.example.com", "MX.Example.COM.", true},
+		{"mx.example.com", "mx2.example.com", false},
+		{"*.example.com", "mx.example.com", true},
+		// The wildcard stands for exactly one label
+		{"*.example.com", "a.mx.example.com", false},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", ".example.com", false},
+	}
+	for _, test := range tests {
+		if m := stsMatch(test.pattern, test.host); m != test.match {
+			t.Errorf("%s %s: got %v", test.pattern, test.host, m)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		s    string
+		tags []Tag
+		err  bool
+	}{
+		{"v=DMARC1; p=none", []Tag{{"v", "DMARC1"}, {"p", "none"}}, false},
+		{" v = DKIM1 ;k=rsa; p=MIIB ; ", []Tag{{"v", "DKIM1"}, {"k", "rsa"}, {"p", "MIIB"}}, false},
+		{"rua=mailto:a@example.com,mailto:b@example.com", []Tag{{"rua", "mailto:a@example.com,mailto:b@example.com"}}, false},
+		{"p=", []Tag{{"p", ""}}, false},
+		{"", nil, false},
+		{"v=DMARC1; none", nil, true},
+		{"=none", nil, true},
+	}
+	for _, test := range tests {
+		tags, err := parseTags(test.s)
+		if (err != nil) != test.err {
+			t.Errorf("%q: got error %v", test.s, err)
+			continue
+		}
+		if !test.err && !reflect.DeepEqual(tags, test.tags) {
+			t.Errorf("%q: got %v, want %v", test.s, tags, test.tags)
+		}
+	}
+}
+
+// standInRecords answers with the records given in zone file form whose
+// name and type match the question
+func standInRecords(t *testing.T, lines ...string) string {
+	var rrs []RR
+	for _, line := range lines {
+		rrs = append(rrs, mustRR(t, line))
+	}
+	return standIn(t, "127.0.0.1:0", func(q *Msg, tcp bool) *Msg {
+		r := &Msg{}
+		for _, rr := range rrs {
+			if strings.EqualFold(rr.Name, q.Question[0].Name) && rr.Type == q.Question[0].Type {
+				r.Answer = append(r.Answer, rr)
+			}
+		}
+		return r
+	})
+}
+
+func TestSPF(t *testing.T) {
+	var many, manyIncludes []string
+	for i := 0; i < maxSPFLookups+1; i++ {
+		many = append(many, fmt.Sprintf(`i%d.example. 300 IN TXT "v=spf1 -all"`, i))
+		manyIncludes = append(manyIncludes, fmt.Sprintf("include:i%d.example", i))
+	}
+	server := standInRecords(t, append(many,
+		`example.com. 300 IN TXT "v=spf1 include:_spf.example.com mx -all"`,
+		`example.com. 300 IN MX 10 mx.example.com.`,
+		`_spf.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 include:_spf2.example.com ~all"`,
+		`_spf2.example.com. 300 IN TXT "v=spf1 a:mail.example.com -all"`,
+		`mail.example.com. 300 IN A 192.0.2.25`,
+		`many.example. 300 IN TXT "v=spf1 `+strings.Join(manyIncludes, " ")+` -all"`,
+		`void.example. 300 IN TXT "v=spf1 a:none1.example mx:none2.example include:none3.example -all"`,
+		`loop.example. 300 IN TXT "v=spf1 include:loop2.example -all"`,
+		`loop2.example. 300 IN TXT "v=spf1 redirect=loop.example"`,
+		`open.example. 300 IN TXT "v=spf1 +all"`,
+	)...)
+
+	tests := []struct {
+		domain        string
+		lookups, void int
+		problems      []string
+	}{
+		{"example.com", 4, 0, nil},
+		{"many.example", maxSPFLookups + 1, 0, []string{"11 lookups are needed, more than the 10 allowed"}},
+		{"void.example", 3, 3, []string{"none3.example has no SPF record",
+			"3 lookups find nothing, more than the 2 allowed"}},
+		{"loop.example", 2, 0, []string{"loop.example is included within itself"}},
+		{"open.example", 0, 0, []string{"open.example ends with +all"}},
+	}
+	for _, test := range tests {
+		r := spf(test.domain, server).(*SPFReport)
+		if r.Lookups != test.lookups || r.VoidLookups != test.void {
+			t.Errorf("%s: got %d lookups and %d void, want %d and %d", test.domain,
+				r.Lookups, r.VoidLookups, test.lookups, test.void)
+		}
+		var got []string
+		for _, p := range r.Problems {
+			if p.Severity == "error" {
+				got = append(got, p.Message)
+			}
+		}
+		if len(got) != len(test.problems) {
+			t.Errorf("%s: got problems %q", test.domain, got)
+			continue
+		}
+		for i, want := range test.problems {
+			if !strings.HasPrefix(got[i], want) {
+				t.Errorf("%s: got %q, want %q", test.domain, got[i], want)
+			}
+		}
+	}
+
+	// The includes are walked into a tree
+	r := spf("example.com", server).(*SPFReport)
+	inc := r.Terms[0].Include
+	if inc == nil || inc.Domain != "_spf.example.com" || len(inc.Terms) != 3 ||
+		inc.Terms[1].Include == nil || inc.Terms[1].Include.Record != "v=spf1 a:mail.example.com -all" {
+		t.Errorf("include tree %+v", r.SPFRecord)
+	}
+}
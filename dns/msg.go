@@ -0,0 +1,780 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Resource record types
+const (
+	TypeA      uint16 = 1
+	TypeNS     uint16 = 2
+	TypeCNAME  uint16 = 5
+	TypeSOA    uint16 = 6
+	TypePTR    uint16 = 12
+	TypeMX     uint16 = 15
+	TypeTXT    uint16 = 16
+	TypeAAAA   uint16 = 28
+	TypeSRV    uint16 = 33
+	TypeDNAME  uint16 = 39
+	TypeOPT    uint16 = 41
+	TypeDS     uint16 = 43
+	TypeRRSIG  uint16 = 46
+	TypeNSEC   uint16 = 47
+	TypeDNSKEY uint16 = 48
+	TypeNSEC3  uint16 = 50
+	TypeTLSA   uint16 = 52
+	TypeTSIG   uint16 = 250
+	TypeIXFR   uint16 = 251
+	TypeAXFR   uint16 = 252
+	TypeANY    uint16 = 255
+	TypeCAA    uint16 = 257
+)
+
+// Classes
+const (
+	ClassINET uint16 = 1
+	ClassNONE uint16 = 254
+	ClassANY  uint16 = 255
+)
+
+// Response codes
+const (
+	RcodeSuccess  = 0
+	RcodeFormErr  = 1
+	RcodeServFail = 2
+	RcodeNXDomain = 3
+	RcodeNotImp   = 4
+	RcodeRefused  = 5
+)
+
+// Opcodes
+const (
+	OpcodeQuery  = 0
+	OpcodeUpdate = 5
+)
+
+var typeNames = map[uint16]string{
+	TypeA:      "A",
+	TypeNS:     "NS",
+	TypeCNAME:  "CNAME",
+	TypeSOA:    "SOA",
+	TypePTR:    "PTR",
+	TypeMX:     "MX",
+	TypeTXT:    "TXT",
+	TypeAAAA:   "AAAA",
+	TypeSRV:    "SRV",
+	TypeDNAME:  "DNAME",
+	TypeOPT:    "OPT",
+	TypeDS:     "DS",
+	TypeRRSIG:  "RRSIG",
+	TypeNSEC:   "NSEC",
+	TypeDNSKEY: "DNSKEY",
+	TypeNSEC3:  "NSEC3",
+	TypeTLSA:   "TLSA",
+	TypeTSIG:   "TSIG",
+	TypeIXFR:   "IXFR",
+	TypeAXFR:   "AXFR",
+	TypeANY:    "ANY",
+	TypeCAA:    "CAA",
+}
+
+var classNames = map[uint16]string{
+	ClassINET: "IN",
+	ClassNONE: "NONE",
+	ClassANY:  "ANY",
+}
+
+var rcodeNames = map[int]string{
+	RcodeSuccess:  "NOERROR",
+	RcodeFormErr:  "FORMERR",
+	RcodeServFail: "SERVFAIL",
+	RcodeNXDomain: "NXDOMAIN",
+	RcodeNotImp:   "NOTIMP",
+	RcodeRefused:  "REFUSED",
+	6:             "YXDOMAIN",
+	7:             "YXRRSET",
+	8:             "NXRRSET",
+	9:             "NOTAUTH",
+	10:            "NOTZONE",
+	16:            "BADSIG",
+	17:            "BADKEY",
+	18:            "BADTIME",
+}
+
+func TypeName(t uint16) string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+// TypeValue looks up a record type by name, ignoring case. Types
+// without a name may be given in the generic TYPEnnn form.
+func TypeValue(name string) (uint16, bool) {
+	name = strings.ToUpper(name)
+	for t, n := range typeNames {
+		if n == name {
+			return t, true
+		}
+	}
+	if strings.HasPrefix(name, "TYPE") {
+		t, err := strconv.ParseUint(name[4:], 10, 16)
+		if err == nil {
+			return uint16(t), true
+		}
+	}
+	return 0, false
+}
+
+func ClassName(c uint16) string {
+	if name, ok := classNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("CLASS%d", c)
+}
+
+func RcodeName(rcode int) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+var ErrShortMsg = errors.New("dns: message too short")
+var ErrLabel = errors.New("dns: bad label")
+var ErrPointer = errors.New("dns: bad compression pointer")
+
+type Header struct {
+	Id                 uint16
+	Response           bool
+	Opcode             int
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	AuthenticData      bool
+	CheckingDisabled   bool
+	Rcode              int
+}
+
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+func (q Question) String() string {
+	return fmt.Sprintf(";%s\t\t%s\t%s", q.Name, ClassName(q.Class), TypeName(q.Type))
+}
+
+// A resource record. The record data is kept in wire format with any
+// names it contains uncompressed so that it stands on its own.
+type RR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+type Msg struct {
+	Header
+	Question   []Question
+	Answer     []RR
+	Authority  []RR
+	Additional []RR
+}
+
+// Fqdn returns the name with a trailing dot
+func Fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// splitName splits a name in presentation format into its labels,
+// undoing escapes.
+func splitName(name string) (labels [][]byte, err error) {
+	if name == "." || name == "" {
+		return
+	}
+	label := make([]byte, 0, 63)
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '\\' && i+3 < len(name) && isDigit(name[i+1]) && isDigit(name[i+2]) && isDigit(name[i+3]):
+			v, _ := strconv.Atoi(name[i+1 : i+4])
+			if v > 255 {
+				return nil, ErrLabel
+			}
+			label = append(label, byte(v))
+			i += 3
+		case c == '\\' && i+1 < len(name):
+			label = append(label, name[i+1])
+			i++
+		case c == '.':
+			if len(label) == 0 {
+				return nil, ErrLabel
+			}
+			labels = append(labels, label)
+			label = make([]byte, 0, 63)
+		default:
+			label = append(label, c)
+		}
+	}
+	if len(label) > 0 {
+		labels = append(labels, label)
+	}
+	for _, l := range labels {
+		if len(l) > 63 {
+			return nil, ErrLabel
+		}
+	}
+	return
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// escapeLabel writes a label in presentation format
+func escapeLabel(buf *bytes.Buffer, label []byte) {
+	for _, c := range label {
+		switch {
+		case c == '.' || c == '\\' || c == '"' || c == '(' || c == ')' ||
+			c == ';' || c == '@' || c == '$':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c < '!' || c > '~':
+			fmt.Fprintf(buf, "\\%03d", c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+}
+
+func packName(buf []byte, name string) ([]byte, error) {
+	labels, err := splitName(name)
+	if err != nil {
+		return buf, err
+	}
+	n := 1
+	for _, l := range labels {
+		buf = append(buf, byte(len(l)))
+		buf = append(buf, l...)
+		n += len(l) + 1
+	}
+	if n > 255 {
+		return buf, ErrLabel
+	}
+	return append(buf, 0), nil
+}
+
+// unpackName reads a possibly compressed name at off returning it in
+// presentation format along with the offset following it.
+func unpackName(msg []byte, off int) (string, int, error) {
+	buf := &bytes.Buffer{}
+	end := -1
+	hops := 0
+	for {
+		if off >= len(msg) {
+			return "", 0, ErrShortMsg
+		}
+		c := int(msg[off])
+		switch c & 0xC0 {
+		case 0x00:
+			if c == 0 {
+				if end < 0 {
+					end = off + 1
+				}
+				if buf.Len() == 0 {
+					buf.WriteByte('.')
+				}
+				return buf.String(), end, nil
+			}
+			if off+1+c > len(msg) {
+				return "", 0, ErrShortMsg
+			}
+			escapeLabel(buf, msg[off+1:off+1+c])
+			buf.WriteByte('.')
+			off += 1 + c
+		case 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, ErrShortMsg
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			hops++
+			if hops > 126 {
+				return "", 0, ErrPointer
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		default:
+			return "", 0, ErrLabel
+		}
+	}
+}
+
+// The layout of record data for types that contain names, which may be
+// compressed on the wire. A positive number is a count of fixed bytes,
+// zero is a name and -1 is the remainder of the data.
+var rdataLayout = map[uint16][]int{
+	TypeNS:    {0},
+	TypeCNAME: {0},
+	TypePTR:   {0},
+	TypeDNAME: {0},
+	TypeMX:    {2, 0},
+	TypeSOA:   {0, 0, 20},
+	TypeSRV:   {6, 0},
+	TypeRRSIG: {18, 0, -1},
+	TypeNSEC:  {0, -1},
+}
+
+// unpackRdata copies record data out of the message, expanding any
+// compressed names.
+func unpackRdata(msg []byte, off, length int, rrtype uint16) ([]byte, error) {
+	end := off + length
+	if end > len(msg) {
+		return nil, ErrShortMsg
+	}
+	layout, ok := rdataLayout[rrtype]
+	if !ok {
+		return append([]byte{}, msg[off:end]...), nil
+	}
+	data := make([]byte, 0, length)
+	for _, field := range layout {
+		switch {
+		case field > 0:
+			if off+field > end {
+				return nil, ErrShortMsg
+			}
+			data = append(data, msg[off:off+field]...)
+			off += field
+		case field == 0:
+			name, next, err := unpackName(msg, off)
+			if err != nil {
+				return nil, err
+			}
+			if next > end {
+				return nil, ErrShortMsg
+			}
+			if data, err = packName(data, name); err != nil {
+				return nil, err
+			}
+			off = next
+		default:
+			data = append(data, msg[off:end]...)
+			off = end
+		}
+	}
+	if off != end {
+		return nil, fmt.Errorf("dns: bad %s record data", TypeName(rrtype))
+	}
+	return data, nil
+}
+
+func (h *Header) pack(buf []byte) []byte {
+	var flags uint16
+	if h.Response {
+		flags |= 1 << 15
+	}
+	flags |= uint16(h.Opcode&0xF) << 11
+	if h.Authoritative {
+		flags |= 1 << 10
+	}
+	if h.Truncated {
+		flags |= 1 << 9
+	}
+	if h.RecursionDesired {
+		flags |= 1 << 8
+	}
+	if h.RecursionAvailable {
+		flags |= 1 << 7
+	}
+	if h.AuthenticData {
+		flags |= 1 << 5
+	}
+	if h.CheckingDisabled {
+		flags |= 1 << 4
+	}
+	flags |= uint16(h.Rcode & 0xF)
+	buf = append(buf, byte(h.Id>>8), byte(h.Id))
+	return append(buf, byte(flags>>8), byte(flags))
+}
+
+func (h *Header) unpack(msg []byte) {
+	h.Id = binary.BigEndian.Uint16(msg)
+	flags := binary.BigEndian.Uint16(msg[2:])
+	h.Response = flags&(1<<15) != 0
+	h.Opcode = int(flags>>11) & 0xF
+	h.Authoritative = flags&(1<<10) != 0
+	h.Truncated = flags&(1<<9) != 0
+	h.RecursionDesired = flags&(1<<8) != 0
+	h.RecursionAvailable = flags&(1<<7) != 0
+	h.AuthenticData = flags&(1<<5) != 0
+	h.CheckingDisabled = flags&(1<<4) != 0
+	h.Rcode = int(flags & 0xF)
+}
+
+func packUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func packUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (rr *RR) pack(buf []byte) ([]byte, error) {
+	buf, err := packName(buf, rr.Name)
+	if err != nil {
+		return buf, err
+	}
+	buf = packUint16(buf, rr.Type)
+	buf = packUint16(buf, rr.Class)
+	buf = packUint32(buf, rr.TTL)
+	if len(rr.Data) > 0xFFFF {
+		return buf, errors.New("dns: record data too long")
+	}
+	buf = packUint16(buf, uint16(len(rr.Data)))
+	return append(buf, rr.Data...), nil
+}
+
+// Pack returns the message in wire format. Names are not compressed.
+func (m *Msg) Pack() ([]byte, error) {
+	buf := make([]byte, 0, 512)
+	buf = m.Header.pack(buf)
+	buf = packUint16(buf, uint16(len(m.Question)))
+	buf = packUint16(buf, uint16(len(m.Answer)))
+	buf = packUint16(buf, uint16(len(m.Authority)))
+	buf = packUint16(buf, uint16(len(m.Additional)))
+
+	var err error
+	for _, q := range m.Question {
+		buf, err = packName(buf, q.Name)
+		if err != nil {
+			return nil, err
+		}
+		buf = packUint16(buf, q.Type)
+		buf = packUint16(buf, q.Class)
+	}
+	for _, section := range [][]RR{m.Answer, m.Authority, m.Additional} {
+		for i := range section {
+			buf, err = section[i].pack(buf)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf, nil
+}
+
+// Unpack parses a message in wire format
+func Unpack(msg []byte) (*Msg, error) {
+	if len(msg) < 12 {
+		return nil, ErrShortMsg
+	}
+	m := &Msg{}
+	m.Header.unpack(msg)
+	counts := []int{
+		int(binary.BigEndian.Uint16(msg[4:])),
+		int(binary.BigEndian.Uint16(msg[6:])),
+		int(binary.BigEndian.Uint16(msg[8:])),
+		int(binary.BigEndian.Uint16(msg[10:])),
+	}
+
+	off := 12
+	for i := 0; i < counts[0]; i++ {
+		name, next, err := unpackName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(msg) {
+			return nil, ErrShortMsg
+		}
+		q := Question{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(msg[next:]),
+			Class: binary.BigEndian.Uint16(msg[next+2:]),
+		}
+		m.Question = append(m.Question, q)
+		off = next + 4
+	}
+
+	sections := []*[]RR{&m.Answer, &m.Authority, &m.Additional}
+	for s, section := range sections {
+		for i := 0; i < counts[s+1]; i++ {
+			name, next, err := unpackName(msg, off)
+			if err != nil {
+				return nil, err
+			}
+			if next+10 > len(msg) {
+				return nil, ErrShortMsg
+			}
+			rr := RR{
+				Name:  name,
+				Type:  binary.BigEndian.Uint16(msg[next:]),
+				Class: binary.BigEndian.Uint16(msg[next+2:]),
+				TTL:   binary.BigEndian.Uint32(msg[next+4:]),
+			}
+			length := int(binary.BigEndian.Uint16(msg[next+8:]))
+			rr.Data, err = unpackRdata(msg, next+10, length, rr.Type)
+			if err != nil {
+				return nil, err
+			}
+			*section = append(*section, rr)
+			off = next + 10 + length
+		}
+	}
+	return m, nil
+}
+
+// SetEdns0 adds an OPT record advertising the UDP payload size and
+// whether DNSSEC records are wanted.
+func (m *Msg) SetEdns0(size uint16, do bool) {
+	opt := RR{Name: ".", Type: TypeOPT, Class: size}
+	if do {
+		opt.TTL = 1 << 15
+	}
+	m.Additional = append(m.Additional, opt)
+}
+
+// Edns0 returns the OPT record, if there is one
+func (m *Msg) Edns0() *RR {
+	for i := range m.Additional {
+		if m.Additional[i].Type == TypeOPT {
+			return &m.Additional[i]
+		}
+	}
+	return nil
+}
+
+// ExtendedRcode combines the header response code with the upper bits
+// carried in the OPT record.
+func (m *Msg) ExtendedRcode() int {
+	rcode := m.Rcode
+	if opt := m.Edns0(); opt != nil {
+		rcode |= int(opt.TTL>>24) << 4
+	}
+	return rcode
+}
+
+// readName reads an uncompressed name from record data
+func readName(data []byte, off int) (string, int, error) {
+	name, next, err := unpackName(data, off)
+	if err != nil {
+		return "", 0, err
+	}
+	return name, next, nil
+}
+
+// Target returns the name held by NS, CNAME, PTR and DNAME records
+func (rr *RR) Target() string {
+	name, _, err := readName(rr.Data, 0)
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// IP returns the address held by A and AAAA records
+func (rr *RR) IP() net.IP {
+	if (rr.Type == TypeA && len(rr.Data) == 4) || (rr.Type == TypeAAAA && len(rr.Data) == 16) {
+		return net.IP(rr.Data)
+	}
+	return nil
+}
+
+// MX returns the preference and exchange of an MX record
+func (rr *RR) MX() (pref uint16, host string) {
+	if len(rr.Data) < 3 {
+		return
+	}
+	pref = binary.BigEndian.Uint16(rr.Data)
+	host, _, _ = readName(rr.Data, 2)
+	return
+}
+
+// TXT returns the strings making up a TXT record
+func (rr *RR) TXT() (txts []string) {
+	for off := 0; off < len(rr.Data); {
+		n := int(rr.Data[off])
+		if off+1+n > len(rr.Data) {
+			break
+		}
+		txts = append(txts, string(rr.Data[off+1:off+1+n]))
+		off += 1 + n
+	}
+	return
+}
+
+// A decoded SOA record
+type SOAData struct {
+	Mname   string
+	Rname   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+func (rr *RR) SOA() (soa SOAData, err error) {
+	var off int
+	soa.Mname, off, err = readName(rr.Data, 0)
+	if err != nil {
+		return
+	}
+	soa.Rname, off, err = readName(rr.Data, off)
+	if err != nil {
+		return
+	}
+	if off+20 != len(rr.Data) {
+		err = ErrShortMsg
+		return
+	}
+	soa.Serial = binary.BigEndian.Uint32(rr.Data[off:])
+	soa.Refresh = binary.BigEndian.Uint32(rr.Data[off+4:])
+	soa.Retry = binary.BigEndian.Uint32(rr.Data[off+8:])
+	soa.Expire = binary.BigEndian.Uint32(rr.Data[off+12:])
+	soa.Minimum = binary.BigEndian.Uint32(rr.Data[off+16:])
+	return
+}
+
+func quoteTXT(s string) string {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(buf, "\\%03d", c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// RdataString returns the record data in presentation format, using the
+// generic RFC 3597 form for types that are not understood.
+func (rr *RR) RdataString() string {
+	switch rr.Type {
+	case TypeA, TypeAAAA:
+		if ip := rr.IP(); ip != nil {
+			return ip.String()
+		}
+	case TypeNS, TypeCNAME, TypePTR, TypeDNAME:
+		if name := rr.Target(); name != "" {
+			return name
+		}
+	case TypeMX:
+		pref, host := rr.MX()
+		if host != "" {
+			return fmt.Sprintf("%d %s", pref, host)
+		}
+	case TypeSOA:
+		soa, err := rr.SOA()
+		if err == nil {
+			return fmt.Sprintf("%s %s %d %d %d %d %d", soa.Mname, soa.Rname,
+				soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minimum)
+		}
+	case TypeTXT:
+		txts := rr.TXT()
+		quoted := make([]string, len(txts))
+		for i, txt := range txts {
+			quoted[i] = quoteTXT(txt)
+		}
+		return strings.Join(quoted, " ")
+	default:
+		if s, ok := rr.rdataString(); ok {
+			return s
+		}
+	}
+	return fmt.Sprintf("\\# %d %s", len(rr.Data), strings.ToUpper(hex.EncodeToString(rr.Data)))
+}
+
+// String returns the record in zone file presentation format
+func (rr *RR) String() string {
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", rr.Name, rr.TTL,
+		ClassName(rr.Class), TypeName(rr.Type), rr.RdataString())
+}
+
+// String returns the message in a form similar to the output of dig
+func (m *Msg) String() string {
+	buf := &bytes.Buffer{}
+	opcode := "QUERY"
+	if m.Opcode == OpcodeUpdate {
+		opcode = "UPDATE"
+	} else if m.Opcode != OpcodeQuery {
+		opcode = strconv.Itoa(m.Opcode)
+	}
+	fmt.Fprintf(buf, ";; opcode: %s, status: %s, id: %d\n", opcode,
+		RcodeName(m.ExtendedRcode()), m.Id)
+
+	flags := []string{}
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{m.Response, "qr"}, {m.Authoritative, "aa"}, {m.Truncated, "tc"},
+		{m.RecursionDesired, "rd"}, {m.RecursionAvailable, "ra"},
+		{m.AuthenticData, "ad"}, {m.CheckingDisabled, "cd"},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	fmt.Fprintf(buf, ";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		strings.Join(flags, " "), len(m.Question), len(m.Answer),
+		len(m.Authority), len(m.Additional))
+
+	if opt := m.Edns0(); opt != nil {
+		do := ""
+		if opt.TTL&(1<<15) != 0 {
+			do = " do"
+		}
+		fmt.Fprintf(buf, ";; EDNS: version: %d, flags:%s; udp: %d\n",
+			(opt.TTL>>16)&0xFF, do, opt.Class)
+	}
+
+	if len(m.Question) > 0 {
+		buf.WriteString("\n;; QUESTION SECTION:\n")
+		for _, q := range m.Question {
+			buf.WriteString(q.String())
+			buf.WriteByte('\n')
+		}
+	}
+	for _, section := range []struct {
+		name string
+		rrs  []RR
+	}{
+		{"ANSWER", m.Answer}, {"AUTHORITY", m.Authority}, {"ADDITIONAL", m.Additional},
+	} {
+		n := 0
+		for i := range section.rrs {
+			if section.rrs[i].Type == TypeOPT {
+				continue
+			}
+			if n == 0 {
+				fmt.Fprintf(buf, "\n;; %s SECTION:\n", section.name)
+			}
+			buf.WriteString(section.rrs[i].String())
+			buf.WriteByte('\n')
+			n++
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,262 @@
+package dns
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPackUnpack(t *testing.T) {
+	tests := []struct {
+		name string
+		rrs  []string
+	}{
+		{"a", []string{"example.com. 300 IN A 192.0.2.1"}},
+		{"aaaa", []string{"example.com. 300 IN AAAA 2001:db8::1"}},
+		{"mx", []string{"example.com. 300 IN MX 10 mail.example.com."}},
+		{"ns", []string{"example.com. 86400 IN NS a.iana-servers.net.", "example.com. 86400 IN NS b.iana-servers.net."}},
+		{"soa", []string{"example.com. 3600 IN SOA ns.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 3600"}},
+		{"txt", []string{`example.com. 300 IN TXT "v=spf1 -all" "second string"`}},
+		{"srv", []string{"_sip._tcp.example.com. 300 IN SRV 10 60 5060 sip.example.com."}},
+		{"caa", []string{`example.com. 300 IN CAA 0 issue "letsencrypt.org"`}},
+		{"escaped", []string{`a\.b.example.com. 300 IN A 192.0.2.2`}},
+		{"binary label", []string{`\255\000.example.com. 300 IN A 192.0.2.3`}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewQuery("example.com", TypeANY)
+			m.Response, m.Authoritative, m.Rcode = true, true, RcodeNXDomain
+			for _, line := range test.rrs {
+				m.Answer = append(m.Answer, mustRR(t, line))
+			}
+			wire, err := m.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Unpack(wire)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameMsg(got, m) {
+				t.Errorf("got %v\nwant %v", got, m)
+			}
+			for i, line := range test.rrs {
+				want := strings.Join(strings.Fields(line), " ")
+				if s := strings.Join(strings.Fields(got.Answer[i].String()), " "); s != want {
+					t.Errorf("got %q, want %q", s, want)
+				}
+			}
+		})
+	}
+}
+
+// sameMsg reports whether two messages are the same, taking empty
+// record data as equal to none
+func sameMsg(a, b *Msg) bool {
+	if a.Header != b.Header || !reflect.DeepEqual(a.Question, b.Question) {
+		return false
+	}
+	sections := [][2][]RR{{a.Answer, b.Answer}, {a.Authority, b.Authority}, {a.Additional, b.Additional}}
+	for _, s := range sections {
+		if len(s[0]) != len(s[1]) {
+			return false
+		}
+		for i, rr := range s[0] {
+			other := s[1][i]
+			if rr.Name != other.Name || rr.Type != other.Type || rr.Class != other.Class ||
+				rr.TTL != other.TTL || !bytes.Equal(rr.Data, other.Data) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// A response to a query for example.com A, whose answers point back
+// to the name in the question
+var compressed = []byte{
+	0x12, 0x34, 0x81, 0x80, 0, 1, 0, 2, 0, 0, 0, 0,
+	// example.com. A IN at 12
+	7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1,
+	// example.com. 60 IN A 192.0.2.1
+	0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 192, 0, 2, 1,
+	// www.example.com. 60 IN MX 10 mail.example.com.
+	3, 'w', 'w', 'w', 0xc0, 12, 0, 15, 0, 1, 0, 0, 0, 60, 0, 9,
+	0, 10, 4, 'm', 'a', 'i', 'l', 0xc0, 12,
+}
+
+func TestUnpackCompressed(t *testing.T) {
+	m, err := Unpack(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Id != 0x1234 || !m.Response || !m.RecursionAvailable || len(m.Answer) != 2 {
+		t.Fatalf("bad message %v", m)
+	}
+	if m.Answer[0].Name != "example.com." || m.Answer[0].IP().String() != "192.0.2.1" {
+		t.Errorf("got %s", m.Answer[0].String())
+	}
+	if m.Answer[1].Name != "www.example.com." {
+		t.Errorf("got name %s", m.Answer[1].Name)
+	}
+	if pref, host := m.Answer[1].MX(); pref != 10 || host != "mail.example.com." {
+		t.Errorf("got MX %d %s", pref, host)
+	}
+	// The name in the record data is expanded so that it stands alone
+	want := append([]byte{0, 10}, "\x04mail\x07example\x03com\x00"...)
+	if !bytes.Equal(m.Answer[1].Data, want) {
+		t.Errorf("got data %q, want %q", m.Answer[1].Data, want)
+	}
+}
+
+// header gives a message header with the counts of each section
+func header(qd, an int) []byte {
+	return []byte{0, 1, 0x81, 0x80, 0, byte(qd), 0, byte(an), 0, 0, 0, 0}
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestUnpackMalformed(t *testing.T) {
+	question := []byte{3, 'f', 'o', 'o', 0, 0, 1, 0, 1}
+	tests := []struct {
+		name string
+		msg  []byte
+		err  error
+	}{
+		{"short header", header(0, 0)[:11], ErrShortMsg},
+		{"missing question", header(1, 0), ErrShortMsg},
+		{"label past end", join(header(1, 0), []byte{7, 'e', 'x'}), ErrShortMsg},
+		{"no type", join(header(1, 0), []byte{3, 'f', 'o', 'o', 0, 0}), ErrShortMsg},
+		{"pointer to itself", join(header(1, 0), []byte{0xc0, 12, 0, 1, 0, 1}), ErrPointer},
+		{"pointer loop", join(header(1, 0), []byte{0xc0, 14, 0xc0, 12, 0, 1, 0, 1}), ErrPointer},
+		{"pointer past end", join(header(1, 0), []byte{0xc0, 0xff, 0, 1, 0, 1}), ErrShortMsg},
+		{"half a pointer", join(header(1, 0), []byte{0xc0}), ErrShortMsg},
+		{"reserved label type", join(header(1, 0), []byte{0x40, 0, 0, 1, 0, 1}), ErrLabel},
+		{"missing answer", join(header(1, 1), question), ErrShortMsg},
+		{"data past end", join(header(1, 1), question,
+			[]byte{0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 10, 192, 0, 2, 1}), ErrShortMsg},
+		{"data loops", join(header(1, 1), question,
+			[]byte{0xc0, 12, 0, 2, 0, 1, 0, 0, 0, 60, 0, 2, 0xc0, 33}), ErrPointer},
+		{"name past data", join(header(1, 1), question,
+			[]byte{0xc0, 12, 0, 15, 0, 1, 0, 0, 0, 60, 0, 3, 0, 10, 0xc0, 12}), ErrShortMsg},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := Unpack(test.msg)
+			if err != test.err {
+				t.Errorf("got %v, %v, want %v", m, err, test.err)
+			}
+		})
+	}
+}
+
+func TestNames(t *testing.T) {
+	long := strings.Repeat("a", 63)
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{".", true},
+		{"example.com.", true},
+		{long + ".com.", true},
+		{long + "a.com.", false},
+		{"a..b.", false},
+		{`\256.com.`, false},
+		{strings.Repeat(long+".", 4), false},
+		{strings.Repeat(long+".", 3) + strings.Repeat("a", 61) + ".", true},
+	}
+	for _, test := range tests {
+		buf, err := packName(nil, test.name)
+		if (err == nil) != test.ok {
+			t.Errorf("%.20s: got error %v", test.name, err)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		name, end, err := unpackName(buf, 0)
+		if err != nil || name != test.name || end != len(buf) {
+			t.Errorf("%.20s: got %.20s, %d, %v", test.name, name, end, err)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	q := NewQuery("example.com", TypeA)
+	tests := []struct {
+		name  string
+		edit  func(r *Msg)
+		match bool
+	}{
+		{"same", func(r *Msg) {}, true},
+		{"other id", func(r *Msg) { r.Id++ }, false},
+		{"not a response", func(r *Msg) { r.Response = false }, false},
+		{"other type", func(r *Msg) { r.Question[0].Type = TypeAAAA }, false},
+		{"other name", func(r *Msg) { r.Question[0].Name = "example.net." }, false},
+		{"name case", func(r *Msg) { r.Question[0].Name = "EXAMPLE.com." }, true},
+		{"error without question", func(r *Msg) { r.Question, r.Rcode = nil, RcodeServFail }, true},
+		{"success without question", func(r *Msg) { r.Question = nil }, false},
+	}
+	for _, test := range tests {
+		r := &Msg{Header: q.Header, Question: append([]Question{}, q.Question...)}
+		r.Response = true
+		test.edit(r)
+		if got := matches(q, r); got != test.match {
+			t.Errorf("%s: got %v", test.name, got)
+		}
+	}
+}
+
+func TestExchange(t *testing.T) {
+	answer := mustRR(t, "example.com. 300 IN A 192.0.2.1")
+	var answered struct {
+		sync.Mutex
+		tcp bool
+	}
+	server := standIn(t, "127.0.0.1:0", func(q *Msg, tcp bool) *Msg {
+		r := &Msg{}
+		if q.Question[0].Name == "big.example.com." && !tcp {
+			r.Truncated = true
+			return r
+		}
+		answered.Lock()
+		answered.tcp = tcp
+		answered.Unlock()
+		r.Answer = []RR{answer}
+		return r
+	})
+	tests := []struct {
+		client *Client
+		name   string
+		tcp    bool
+	}{
+		{&Client{}, "example.com", false},
+		{&Client{}, "big.example.com", true},
+		{&Client{Net: "tcp"}, "example.com", true},
+	}
+	for _, test := range tests {
+		r, rtt, err := test.client.Exchange(NewQuery(test.name, TypeA), server)
+		if err != nil {
+			t.Errorf("%s over %q: %v", test.name, test.client.Net, err)
+			continue
+		}
+		answered.Lock()
+		tcp := answered.tcp
+		answered.Unlock()
+		if len(r.Answer) != 1 || r.Truncated || rtt <= 0 || tcp != test.tcp {
+			t.Errorf("%s over %q: got %v, tcp %v", test.name, test.client.Net, r, tcp)
+		}
+	}
+}
+
+func TestExchangeTimeout(t *testing.T) {
+	server := standIn(t, "127.0.0.1:0", func(q *Msg, tcp bool) *Msg { return nil })
+	c := &Client{Timeout: 100 * 1e6}
+	if _, _, err := c.Exchange(NewQuery("example.com", TypeA), server); err == nil {
+		t.Error("no error without a response")
+	}
+}
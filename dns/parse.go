@@ -0,0 +1,264 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tokenize splits a line of a zone file into fields, keeping quoted
+// strings together, undoing escapes inside them and dropping comments.
+func tokenize(line string) (tokens []string, quoted []bool, err error) {
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '(' || c == ')':
+			i++
+		case c == ';':
+			return
+		case c == '"':
+			var tok []byte
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					if i+3 < len(line) && isDigit(line[i+1]) && isDigit(line[i+2]) && isDigit(line[i+3]) {
+						v, _ := strconv.Atoi(line[i+1 : i+4])
+						tok = append(tok, byte(v))
+						i += 3
+						continue
+					}
+					i++
+				}
+				tok = append(tok, line[i])
+			}
+			if i >= len(line) {
+				err = fmt.Errorf("unterminated string: %s", line)
+				return
+			}
+			i++
+			tokens = append(tokens, string(tok))
+			quoted = append(quoted, true)
+		default:
+			start := i
+			for ; i < len(line) && !strings.ContainsRune(" \t\r\n;()\"", rune(line[i])); i++ {
+				if line[i] == '\\' {
+					i++
+				}
+			}
+			if i > len(line) {
+				i = len(line)
+			}
+			tokens = append(tokens, line[start:i])
+			quoted = append(quoted, false)
+		}
+	}
+	return
+}
+
+// ParseRR parses a record in zone file presentation format. The TTL
+// and class may be left out, in which case they are ttl and IN. The
+// owner name is taken relative to origin unless it ends with a dot.
+func ParseRR(line, origin string, ttl uint32) (rr RR, err error) {
+	tokens, quoted, err := tokenize(line)
+	if err != nil {
+		return
+	}
+	if len(tokens) < 2 {
+		err = fmt.Errorf("too few fields: %s", line)
+		return
+	}
+	rr.Name = absName(tokens[0], origin)
+	rr.TTL = ttl
+	rr.Class = ClassINET
+
+	i := 1
+fields:
+	for ; i < len(tokens); i++ {
+		if t, e := strconv.ParseUint(tokens[i], 10, 32); e == nil {
+			rr.TTL = uint32(t)
+			continue
+		}
+		switch strings.ToUpper(tokens[i]) {
+		case "IN":
+			rr.Class = ClassINET
+			continue
+		case "NONE":
+			rr.Class = ClassNONE
+			continue
+		case "ANY":
+			if i+1 < len(tokens) {
+				if _, ok := TypeValue(tokens[i+1]); ok {
+					rr.Class = ClassANY
+					continue
+				}
+			}
+		}
+		break fields
+	}
+	if i >= len(tokens) {
+		err = fmt.Errorf("missing type: %s", line)
+		return
+	}
+	t, ok := TypeValue(tokens[i])
+	if !ok {
+		err = fmt.Errorf("unknown type %s: %s", tokens[i], line)
+		return
+	}
+	rr.Type = t
+	rr.Data, err = parseRdata(t, tokens[i+1:], quoted[i+1:], origin)
+	if err != nil {
+		err = fmt.Errorf("%s: %s", err, line)
+	}
+	return
+}
+
+func absName(name, origin string) string {
+	if name == "@" {
+		return Fqdn(origin)
+	}
+	if strings.HasSuffix(name, ".") && !strings.HasSuffix(name, "\\.") {
+		return name
+	}
+	if origin == "" || origin == "." {
+		return name + "."
+	}
+	return name + "." + Fqdn(origin)
+}
+
+func parseUint(s string, bits int) (uint64, error) {
+	v, err := strconv.ParseUint(s, 10, bits)
+	if err != nil {
+		return 0, fmt.Errorf("bad number %s", s)
+	}
+	return v, nil
+}
+
+// parseRdata converts the fields following the type to record data.
+// An empty list gives empty record data, as used by dynamic updates.
+func parseRdata(t uint16, f []string, quoted []bool, origin string) (data []byte, err error) {
+	if len(f) == 0 {
+		return
+	}
+	if f[0] == "\\#" && !quoted[0] {
+		if len(f) < 2 {
+			return nil, fmt.Errorf("bad generic record data")
+		}
+		data, err = hex.DecodeString(strings.Join(f[2:], ""))
+		if err == nil && strconv.Itoa(len(data)) != f[1] {
+			err = fmt.Errorf("record data length mismatch")
+		}
+		return
+	}
+
+	// Layout of the fields, n for an n bit number, name, ip4, ip6,
+	// str for a character string, str* for one or more, hex*,
+	// b64* and rest for the remaining fields as a single string
+	layouts := map[uint16][]string{
+		TypeA:      {"ip4"},
+		TypeAAAA:   {"ip6"},
+		TypeNS:     {"name"},
+		TypeCNAME:  {"name"},
+		TypePTR:    {"name"},
+		TypeDNAME:  {"name"},
+		TypeMX:     {"16", "name"},
+		TypeSOA:    {"name", "name", "32", "32", "32", "32", "32"},
+		TypeTXT:    {"str*"},
+		TypeSRV:    {"16", "16", "16", "name"},
+		TypeCAA:    {"8", "str", "rest"},
+		TypeDS:     {"16", "8", "8", "hex*"},
+		TypeDNSKEY: {"16", "8", "8", "b64*"},
+		TypeTLSA:   {"8", "8", "8", "hex*"},
+	}
+	layout, ok := layouts[t]
+	if !ok {
+		return nil, fmt.Errorf("cannot parse %s records, use \\# form", TypeName(t))
+	}
+
+	for i, field := range layout {
+		if i >= len(f) {
+			return nil, fmt.Errorf("too few fields")
+		}
+		switch field {
+		case "8", "16", "32":
+			bits, _ := strconv.Atoi(field)
+			var v uint64
+			v, err = parseUint(f[i], bits)
+			if err != nil {
+				return
+			}
+			for b := bits - 8; b >= 0; b -= 8 {
+				data = append(data, byte(v>>uint(b)))
+			}
+		case "name":
+			data, err = packName(data, absName(f[i], origin))
+			if err != nil {
+				return
+			}
+		case "ip4", "ip6":
+			ip := net.ParseIP(f[i])
+			if ip == nil || (field == "ip4") != (ip.To4() != nil) {
+				return nil, fmt.Errorf("bad address %s", f[i])
+			}
+			if field == "ip4" {
+				ip = ip.To4()
+			}
+			data = append(data, ip...)
+		case "str":
+			if len(f[i]) > 255 {
+				return nil, fmt.Errorf("string too long")
+			}
+			data = append(data, byte(len(f[i])))
+			data = append(data, f[i]...)
+		case "str*":
+			for _, s := range f[i:] {
+				if len(s) > 255 {
+					return nil, fmt.Errorf("string too long")
+				}
+				data = append(data, byte(len(s)))
+				data = append(data, s...)
+			}
+			return
+		case "rest":
+			data = append(data, strings.Join(f[i:], " ")...)
+			return
+		case "hex*":
+			var b []byte
+			b, err = hex.DecodeString(strings.Join(f[i:], ""))
+			if err != nil {
+				return
+			}
+			return append(data, b...), nil
+		case "b64*":
+			var b []byte
+			b, err = base64.StdEncoding.DecodeString(strings.Join(f[i:], ""))
+			if err != nil {
+				return
+			}
+			return append(data, b...), nil
+		}
+	}
+	if len(f) > len(layout) {
+		return nil, fmt.Errorf("too many fields")
+	}
+	return
+}
+
+// readLines reads a file of records, one per line
+func readLines(path string) (lines []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	err = scanner.Err()
+	return
+}
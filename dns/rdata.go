@@ -0,0 +1,314 @@
+package dns
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type SRVData struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+func (rr *RR) SRV() (srv SRVData, err error) {
+	if len(rr.Data) < 7 {
+		err = ErrShortMsg
+		return
+	}
+	srv.Priority = binary.BigEndian.Uint16(rr.Data)
+	srv.Weight = binary.BigEndian.Uint16(rr.Data[2:])
+	srv.Port = binary.BigEndian.Uint16(rr.Data[4:])
+	srv.Target, _, err = readName(rr.Data, 6)
+	return
+}
+
+type CAAData struct {
+	Flags uint8
+	Tag   string
+	Value string
+}
+
+func (rr *RR) CAA() (caa CAAData, err error) {
+	if len(rr.Data) < 2 || len(rr.Data) < 2+int(rr.Data[1]) {
+		err = ErrShortMsg
+		return
+	}
+	caa.Flags = rr.Data[0]
+	n := int(rr.Data[1])
+	caa.Tag = string(rr.Data[2 : 2+n])
+	caa.Value = string(rr.Data[2+n:])
+	return
+}
+
+type DSData struct {
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+func (rr *RR) DS() (ds DSData, err error) {
+	if len(rr.Data) < 5 {
+		err = ErrShortMsg
+		return
+	}
+	ds.KeyTag = binary.BigEndian.Uint16(rr.Data)
+	ds.Algorithm = rr.Data[2]
+	ds.DigestType = rr.Data[3]
+	ds.Digest = rr.Data[4:]
+	return
+}
+
+type DNSKEYData struct {
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+}
+
+// Flags in DNSKEY records
+const (
+	FlagZone = 1 << 8
+	FlagSEP  = 1
+)
+
+func (rr *RR) DNSKEY() (key DNSKEYData, err error) {
+	if len(rr.Data) < 5 {
+		err = ErrShortMsg
+		return
+	}
+	key.Flags = binary.BigEndian.Uint16(rr.Data)
+	key.Protocol = rr.Data[2]
+	key.Algorithm = rr.Data[3]
+	key.PublicKey = rr.Data[4:]
+	return
+}
+
+// KeyTag computes the key tag of a DNSKEY record as in RFC 4034
+// appendix B.
+func (rr *RR) KeyTag() uint16 {
+	var ac uint32
+	for i, b := range rr.Data {
+		if i&1 == 1 {
+			ac += uint32(b)
+		} else {
+			ac += uint32(b) << 8
+		}
+	}
+	ac += ac >> 16
+	return uint16(ac)
+}
+
+type TLSAData struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+func (rr *RR) TLSA() (tlsa TLSAData, err error) {
+	if len(rr.Data) < 3 {
+		err = ErrShortMsg
+		return
+	}
+	tlsa.Usage = rr.Data[0]
+	tlsa.Selector = rr.Data[1]
+	tlsa.MatchingType = rr.Data[2]
+	tlsa.Data = rr.Data[3:]
+	return
+}
+
+type RRSIGData struct {
+	TypeCovered uint16
+	Algorithm   uint8
+	Labels      uint8
+	OrigTTL     uint32
+	Expiration  uint32
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  string
+	Signature   []byte
+	signed      []byte
+}
+
+func (rr *RR) RRSIG() (sig RRSIGData, err error) {
+	if len(rr.Data) < 19 {
+		err = ErrShortMsg
+		return
+	}
+	d := rr.Data
+	sig.TypeCovered = binary.BigEndian.Uint16(d)
+	sig.Algorithm = d[2]
+	sig.Labels = d[3]
+	sig.OrigTTL = binary.BigEndian.Uint32(d[4:])
+	sig.Expiration = binary.BigEndian.Uint32(d[8:])
+	sig.Inception = binary.BigEndian.Uint32(d[12:])
+	sig.KeyTag = binary.BigEndian.Uint16(d[16:])
+	var off int
+	sig.SignerName, off, err = readName(d, 18)
+	if err != nil {
+		return
+	}
+	sig.Signature = d[off:]
+	sig.signed = d[:off]
+	return
+}
+
+// SigTime converts an RRSIG timestamp, which is serial number
+// arithmetic modulo 2^32, to the time closest to now.
+func SigTime(t uint32) time.Time {
+	now := time.Now().Unix()
+	base := now - int64(int32(uint32(now)-t))
+	return time.Unix(base, 0).UTC()
+}
+
+func sigTimeString(t uint32) string {
+	return SigTime(t).Format("20060102150405")
+}
+
+// typeBitmap decodes the type bitmaps of NSEC and NSEC3 records
+func typeBitmap(data []byte) (types []uint16, err error) {
+	for off := 0; off < len(data); {
+		if off+2 > len(data) {
+			return nil, ErrShortMsg
+		}
+		window := int(data[off])
+		n := int(data[off+1])
+		if n > 32 || off+2+n > len(data) {
+			return nil, ErrShortMsg
+		}
+		for i, b := range data[off+2 : off+2+n] {
+			for bit := 0; bit < 8; bit++ {
+				if b&(0x80>>uint(bit)) != 0 {
+					types = append(types, uint16(window<<8|i*8+bit))
+				}
+			}
+		}
+		off += 2 + n
+	}
+	return
+}
+
+func typeList(types []uint16) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = TypeName(t)
+	}
+	return strings.Join(names, " ")
+}
+
+type NSECData struct {
+	NextDomain string
+	Types      []uint16
+}
+
+func (rr *RR) NSEC() (nsec NSECData, err error) {
+	var off int
+	nsec.NextDomain, off, err = readName(rr.Data, 0)
+	if err != nil {
+		return
+	}
+	nsec.Types, err = typeBitmap(rr.Data[off:])
+	return
+}
+
+type NSEC3Data struct {
+	Hash       uint8
+	Flags      uint8
+	Iterations uint16
+	Salt       []byte
+	NextHashed []byte
+	Types      []uint16
+}
+
+func (rr *RR) NSEC3() (nsec3 NSEC3Data, err error) {
+	d := rr.Data
+	if len(d) < 5 || len(d) < 5+int(d[4]) {
+		err = ErrShortMsg
+		return
+	}
+	nsec3.Hash = d[0]
+	nsec3.Flags = d[1]
+	nsec3.Iterations = binary.BigEndian.Uint16(d[2:])
+	off := 5 + int(d[4])
+	nsec3.Salt = d[5:off]
+	if off >= len(d) || off+1+int(d[off]) > len(d) {
+		err = ErrShortMsg
+		return
+	}
+	nsec3.NextHashed = d[off+1 : off+1+int(d[off])]
+	nsec3.Types, err = typeBitmap(d[off+1+int(d[off]):])
+	return
+}
+
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+func hexString(b []byte) string {
+	if len(b) == 0 {
+		return "-"
+	}
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+// rdataString formats the record data of the types defined here,
+// returning false if the type is not one of them or is malformed.
+func (rr *RR) rdataString() (string, bool) {
+	switch rr.Type {
+	case TypeSRV:
+		srv, err := rr.SRV()
+		if err == nil {
+			return fmt.Sprintf("%d %d %d %s", srv.Priority, srv.Weight, srv.Port, srv.Target), true
+		}
+	case TypeCAA:
+		caa, err := rr.CAA()
+		if err == nil {
+			return fmt.Sprintf("%d %s %s", caa.Flags, caa.Tag, quoteTXT(caa.Value)), true
+		}
+	case TypeDS:
+		ds, err := rr.DS()
+		if err == nil {
+			return fmt.Sprintf("%d %d %d %s", ds.KeyTag, ds.Algorithm, ds.DigestType,
+				hexString(ds.Digest)), true
+		}
+	case TypeDNSKEY:
+		key, err := rr.DNSKEY()
+		if err == nil {
+			return fmt.Sprintf("%d %d %d %s", key.Flags, key.Protocol, key.Algorithm,
+				base64.StdEncoding.EncodeToString(key.PublicKey)), true
+		}
+	case TypeTLSA:
+		tlsa, err := rr.TLSA()
+		if err == nil {
+			return fmt.Sprintf("%d %d %d %s", tlsa.Usage, tlsa.Selector, tlsa.MatchingType,
+				hexString(tlsa.Data)), true
+		}
+	case TypeRRSIG:
+		sig, err := rr.RRSIG()
+		if err == nil {
+			return fmt.Sprintf("%s %d %d %d %s %s %d %s %s", TypeName(sig.TypeCovered),
+				sig.Algorithm, sig.Labels, sig.OrigTTL, sigTimeString(sig.Expiration),
+				sigTimeString(sig.Inception), sig.KeyTag, sig.SignerName,
+				base64.StdEncoding.EncodeToString(sig.Signature)), true
+		}
+	case TypeNSEC:
+		nsec, err := rr.NSEC()
+		if err == nil {
+			return fmt.Sprintf("%s %s", nsec.NextDomain, typeList(nsec.Types)), true
+		}
+	case TypeNSEC3:
+		nsec3, err := rr.NSEC3()
+		if err == nil {
+			return fmt.Sprintf("%d %d %d %s %s %s", nsec3.Hash, nsec3.Flags,
+				nsec3.Iterations, hexString(nsec3.Salt),
+				base32Hex.EncodeToString(nsec3.NextHashed), typeList(nsec3.Types)), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,113 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"github.com/rminnich/go9p"
+	"hubs.net.uk/sw/nopfs"
+	"net"
+	"os"
+	"strings"
+)
+
+// records queries for the name and type, returning the answer section,
+// which includes any aliases followed to reach the records.
+func records(server, name string, qtype uint16) (rrs []RR, err error) {
+	r, _, err := Query(server, name, qtype)
+	if err != nil {
+		return
+	}
+	switch rcode := r.ExtendedRcode(); rcode {
+	case RcodeSuccess:
+	case RcodeNXDomain:
+		err = os.ErrNotExist
+		return
+	default:
+		err = errors.New(RcodeName(rcode))
+		return
+	}
+	if len(r.Answer) == 0 {
+		err = os.ErrNotExist
+	}
+	return r.Answer, err
+}
+
+func zoneFormat(rrs []RR) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, len(rrs)*64))
+	for i := range rrs {
+		if rrs[i].Type == TypeOPT {
+			continue
+		}
+		buf.WriteString(rrs[i].String())
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// RecordsF returns a function giving the records of a type for a host
+// in zone file format.
+func RecordsF(qtype uint16) func(host, server string) ([]byte, error) {
+	return func(host, server string) (data []byte, err error) {
+		rrs, err := records(server, host, qtype)
+		if err != nil {
+			return
+		}
+		data = zoneFormat(rrs)
+		return
+	}
+}
+
+func recordFile(qtype uint16) *nopfs.Fun {
+	return nopfs.NewFun(ResolveF(RecordsF(qtype))).Limit("dns")
+}
+
+// ptr looks up pointer records for the host, using the reverse name if
+// it is an address.
+func ptr(host, server string) ([]byte, error) {
+	if net.ParseIP(host) != nil {
+		rev, err := ReverseName(host)
+		if err != nil {
+			return nil, err
+		}
+		host = rev
+	}
+	return RecordsF(TypePTR)(host, server)
+}
+
+var A nopfs.Dispatcher = recordFile(TypeA)
+var AAAA nopfs.Dispatcher = recordFile(TypeAAAA)
+var SOA nopfs.Dispatcher = recordFile(TypeSOA)
+var CAA nopfs.Dispatcher = recordFile(TypeCAA)
+var PTR nopfs.Dispatcher = nopfs.NewFun(ResolveF(ptr)).Limit("dns")
+var DS nopfs.Dispatcher = recordFile(TypeDS)
+var DNSKEY nopfs.Dispatcher = recordFile(TypeDNSKEY)
+var TLSA nopfs.Dispatcher = recordFile(TypeTLSA)
+var ANY nopfs.Dispatcher = recordFile(TypeANY)
+var SRV nopfs.Dispatcher = &srvDir{}
+
+// srvDir contains a file for each service, named _service._proto, that
+// lists the SRV records for that service at the host. The files are
+// not listed.
+type srvDir struct {
+	digDir
+}
+
+func (d *srvDir) Clone() nopfs.Dispatcher {
+	n := &srvDir{}
+	n.SetPath(d.GetPath())
+	n.SetParent(d.GetParent())
+	return n
+}
+
+func (d *srvDir) Walk(req *go9p.SrvReq, name string) (nopfs.Dispatcher, error) {
+	labels := strings.Split(name, ".")
+	if len(labels) != 2 || !strings.HasPrefix(labels[0], "_") || !strings.HasPrefix(labels[1], "_") {
+		return nil, os.ErrNotExist
+	}
+	f := nopfs.NewFun(ResolveF(func(host, server string) ([]byte, error) {
+		return RecordsF(TypeSRV)(name+"."+host, server)
+	})).Limit("dns")
+	f.SetPath(append(append([]string{}, d.GetPath()...), name))
+	f.SetParent(d)
+	return f, nil
+}
@@ -0,0 +1,265 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/rminnich/go9p"
+	"hubs.net.uk/sw/nopfs"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Query parameters set for a host through its params file
+type params struct {
+	server string
+}
+
+var hostParams = struct {
+	sync.RWMutex
+	hosts map[string]*params
+}{hosts: make(map[string]*params)}
+
+func getParams(host string) params {
+	hostParams.RLock()
+	defer hostParams.RUnlock()
+	if p, ok := hostParams.hosts[host]; ok {
+		return *p
+	}
+	return params{}
+}
+
+func (p params) String() string {
+	return fmt.Sprintf("server %s\n", p.server)
+}
+
+// paramsCtl sets query parameters for the host, one per line as
+// "key value". Leaving out the value restores the default.
+func paramsCtl(c *nopfs.Ctl, data []byte) (resp []byte, err error) {
+	path := c.GetPath()
+	if len(path) < 2 {
+		err = os.ErrInvalid
+		return
+	}
+	host := path[1]
+
+	hostParams.Lock()
+	defer hostParams.Unlock()
+	p, ok := hostParams.hosts[host]
+	if !ok {
+		p = &params{}
+	}
+	n := *p
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		value := ""
+		if len(fields) > 1 {
+			value = fields[1]
+		}
+		switch fields[0] {
+		case "server":
+			if value != "" {
+				if _, _, err = ParseServer(value); err != nil {
+					return
+				}
+			}
+			n.server = value
+		default:
+			err = fmt.Errorf("unknown parameter: %s", fields[0])
+			return
+		}
+	}
+	if n == (params{}) {
+		delete(hostParams.hosts, host)
+	} else {
+		hostParams.hosts[host] = &n
+	}
+	resp = []byte(n.String())
+	return
+}
+
+// ServerOf returns the server named by an @server element of the path
+// if there is one, otherwise the server set in the host's parameters.
+// An empty result means the system resolver.
+func ServerOf(path []string) string {
+	for _, p := range path {
+		if strings.HasPrefix(p, "@") && len(p) > 1 {
+			return p[1:]
+		}
+	}
+	if len(path) > 1 {
+		return getParams(path[1]).server
+	}
+	return ""
+}
+
+// ResolveF adapts a function taking the host name and the server to
+// query to one that takes the path of a file.
+func ResolveF(f func(host, server string) ([]byte, error)) func([]string) ([]byte, error) {
+	return func(path []string) ([]byte, error) {
+		return f(path[1], ServerOf(path))
+	}
+}
+
+// answers queries the server for records of the given type, failing
+// with os.ErrNotExist if there are none.
+func answers(server, name string, qtype uint16) (rrs []RR, err error) {
+	r, _, err := Query(server, name, qtype)
+	if err != nil {
+		return
+	}
+	switch rcode := r.ExtendedRcode(); rcode {
+	case RcodeSuccess:
+	case RcodeNXDomain:
+		err = os.ErrNotExist
+		return
+	default:
+		err = errors.New(RcodeName(rcode))
+		return
+	}
+	for _, rr := range r.Answer {
+		if rr.Type == qtype || qtype == TypeANY {
+			rrs = append(rrs, rr)
+		}
+	}
+	if len(rrs) == 0 {
+		err = os.ErrNotExist
+	}
+	return
+}
+
+// ResolverDir is a directory whose subdirectories named @server, for
+// example @192.0.2.53 or @[2001:db8::53]:5353, contain the same files
+// but send queries to that server.
+type ResolverDir struct {
+	*nopfs.Dir
+}
+
+func NewResolverDir() *ResolverDir {
+	return &ResolverDir{nopfs.NewDir()}
+}
+
+func (d *ResolverDir) Clone() nopfs.Dispatcher {
+	return &ResolverDir{d.Dir.Clone().(*nopfs.Dir)}
+}
+
+func (d *ResolverDir) Walk(req *go9p.SrvReq, name string) (nopfs.Dispatcher, error) {
+	if !strings.HasPrefix(name, "@") {
+		return d.Dir.Walk(req, name)
+	}
+	for _, p := range d.GetPath() {
+		if strings.HasPrefix(p, "@") {
+			return nil, os.ErrNotExist
+		}
+	}
+	n := d.Clone()
+	path := append(append([]string{}, d.GetPath()...), name)
+	n.SetPath(path)
+	n.SetParent(d)
+	return n, nil
+}
+
+// digDir contains a file for every record type, named in either case
+// or as TYPEnnn, giving the result of the query function for that
+// type, such as dig which shows the full response. The files are not
+// listed and are rate limited in the given class.
+type digDir struct {
+	nopfs.Path
+	query func(host, server string, qtype uint16) ([]byte, error)
+	class string
+}
+
+func (d *digDir) IsDir() bool                       { return true }
+func (d *digDir) Perms() uint32                     { return 0555 }
+func (d *digDir) Size() uint64                      { return uint64(0) }
+func (d *digDir) Write(*go9p.SrvReq, []byte) error  { return os.ErrInvalid }
+func (d *digDir) Read(*go9p.SrvReq) ([]byte, error) { return []byte{}, nil }
+func (d *digDir) Close()                            {}
+func (d *digDir) Flush(*go9p.SrvReq)                {}
+
+func (d *digDir) Clone() nopfs.Dispatcher {
+	n := &digDir{query: d.query, class: d.class}
+	n.SetPath(d.GetPath())
+	n.SetParent(d.GetParent())
+	return n
+}
+
+func (d *digDir) Walk(req *go9p.SrvReq, name string) (nopfs.Dispatcher, error) {
+	qtype, ok := TypeValue(name)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	f := nopfs.NewFun(ResolveF(func(host, server string) ([]byte, error) {
+		return d.query(host, server, qtype)
+	})).Limit(d.class)
+	f.SetPath(append(append([]string{}, d.GetPath()...), name))
+	f.SetParent(d)
+	return f, nil
+}
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// writeTLS describes the secure connection and the certificates the
+// server presented
+func writeTLS(buf *bytes.Buffer, info *TLSInfo) {
+	version, ok := tlsVersions[info.State.Version]
+	if !ok {
+		version = fmt.Sprintf("0x%04x", info.State.Version)
+	}
+	fmt.Fprintf(buf, ";; tls: %s, %s, handshake: %s\n", version,
+		tls.CipherSuiteName(info.State.CipherSuite), info.Handshake)
+	for i, cert := range info.State.PeerCertificates {
+		fmt.Fprintf(buf, ";; certificate %d: %s\n", i, cert.Subject)
+		fmt.Fprintf(buf, ";;   issuer: %s\n", cert.Issuer)
+		fmt.Fprintf(buf, ";;   valid: %s to %s\n", cert.NotBefore.Format(time.RFC3339),
+			cert.NotAfter.Format(time.RFC3339))
+		if names := append([]string{}, cert.DNSNames...); len(names) > 0 || len(cert.IPAddresses) > 0 {
+			for _, ip := range cert.IPAddresses {
+				names = append(names, ip.String())
+			}
+			fmt.Fprintf(buf, ";;   names: %s\n", strings.Join(names, " "))
+		}
+	}
+}
+
+func dig(host, server string, qtype uint16) (data []byte, err error) {
+	servers := []string{server}
+	if server == "" {
+		servers = SystemServers()
+	}
+	err = ErrNoServers
+	for _, s := range servers {
+		c, addr, e := ParseServer(s)
+		if e != nil {
+			return nil, e
+		}
+		r, rtt, e := c.Exchange(NewQuery(host, qtype), addr)
+		if e != nil {
+			err = e
+			continue
+		}
+		buf := &bytes.Buffer{}
+		if c.Net != "" {
+			fmt.Fprintf(buf, ";; server: %s, transport: %s, time: %s\n", addr, c.Net, rtt)
+		} else {
+			fmt.Fprintf(buf, ";; server: %s, time: %s\n", addr, rtt)
+		}
+		if c.TLS != nil {
+			writeTLS(buf, c.TLS)
+		}
+		buf.WriteString(r.String())
+		return buf.Bytes(), nil
+	}
+	return
+}
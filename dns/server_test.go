@@ -0,0 +1,100 @@
+package dns
+
+import (
+	"net"
+	"testing"
+)
+
+// A handler gives the response of a stand-in server to a query, which
+// came over TCP if tcp is set. A nil response is not sent.
+type handler func(q *Msg, tcp bool) *Msg
+
+// standIn runs a name server on the address, as in 127.0.0.1:0, over
+// UDP and TCP on the same port until the test ends, returning the
+// address it listens on.
+func standIn(t *testing.T, addr string, h handler) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		l.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if wire := respond(buf[:n], h, false); wire != nil {
+				pc.WriteTo(wire, from)
+			}
+		}
+	}()
+	go serveStream(l, h)
+	return pc.LocalAddr().String()
+}
+
+// serveStream answers the queries sent over each connection accepted
+// from the listener, which may be over TCP or TLS, until it is closed.
+func serveStream(l net.Listener, h handler) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				query, err := readStreamWire(conn)
+				if err != nil {
+					return
+				}
+				if wire := respond(query, h, true); wire != nil {
+					writeStream(conn, wire)
+				}
+			}
+		}()
+	}
+}
+
+// respond unpacks the query and packs the handler's response to it,
+// filling in its id, flags and question.
+func respond(query []byte, h handler, tcp bool) []byte {
+	q, err := Unpack(query)
+	if err != nil {
+		return nil
+	}
+	r := h(q, tcp)
+	if r == nil {
+		return nil
+	}
+	r.Id, r.Response, r.Opcode = q.Id, true, q.Opcode
+	if r.Question == nil {
+		r.Question = q.Question
+	}
+	wire, err := r.Pack()
+	if err != nil {
+		return nil
+	}
+	return wire
+}
+
+// mustRR parses a record in presentation format
+func mustRR(t *testing.T, line string) RR {
+	t.Helper()
+	rr, err := ParseRR(line, ".", 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
@@ -0,0 +1,416 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hubs.net.uk/sw/nopfs"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// A name server to ask, by name, which may be empty, and address
+type nameServer struct {
+	name string
+	addr string
+}
+
+// The root servers, from the root hints file published by IANA
+var defaultRootHints = []string{
+	"a.root-servers.net. A 198.41.0.4",
+	"a.root-servers.net. AAAA 2001:503:ba3e::2:30",
+	"b.root-servers.net. A 170.247.170.2",
+	"b.root-servers.net. AAAA 2801:1b8:10::b",
+	"c.root-servers.net. A 192.33.4.12",
+	"c.root-servers.net. AAAA 2001:500:2::c",
+	"d.root-servers.net. A 199.7.91.13",
+	"d.root-servers.net. AAAA 2001:500:2d::d",
+	"e.root-servers.net. A 192.203.230.10",
+	"e.root-servers.net. AAAA 2001:500:a8::e",
+	"f.root-servers.net. A 192.5.5.241",
+	"f.root-servers.net. AAAA 2001:500:2f::f",
+	"g.root-servers.net. A 192.112.36.4",
+	"g.root-servers.net. AAAA 2001:500:12::d0d",
+	"h.root-servers.net. A 198.97.190.53",
+	"h.root-servers.net. AAAA 2001:500:1::53",
+	"i.root-servers.net. A 192.36.148.17",
+	"i.root-servers.net. AAAA 2001:7fe::53",
+	"j.root-servers.net. A 192.58.128.30",
+	"j.root-servers.net. AAAA 2001:503:c27::2:30",
+	"k.root-servers.net. A 193.0.14.129",
+	"k.root-servers.net. AAAA 2001:7fd::1",
+	"l.root-servers.net. A 199.7.83.42",
+	"l.root-servers.net. AAAA 2001:500:9f::42",
+	"m.root-servers.net. A 202.12.27.33",
+	"m.root-servers.net. AAAA 2001:dc3::35",
+}
+
+var rootHints = struct {
+	sync.RWMutex
+	servers []nameServer
+}{}
+
+// Time allowed for each server to answer during a trace or a check of
+// the servers for a zone
+var TraceTimeout = 3 * time.Second
+
+// Limits on the number of referrals and aliases followed by a trace
+const (
+	maxReferrals = 32
+	maxAliases   = 8
+)
+
+func init() {
+	if err := SetRootHints(defaultRootHints); err != nil {
+		panic(err)
+	}
+}
+
+// SetRootHints replaces the servers where traces begin. Each line is an
+// A or AAAA record as found in a root hints file, any other records
+// being ignored, or an address with an optional port. Servers found by
+// following referrals are asked on the same port as the hint they are
+// reached from, so a stand-in hierarchy may be run on another port.
+func SetRootHints(lines []string) error {
+	var servers []nameServer
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if net.ParseIP(strings.Trim(line, "[]")) != nil {
+			servers = append(servers, nameServer{addr: HostPort(line)})
+			continue
+		}
+		if _, _, err := net.SplitHostPort(line); err == nil {
+			servers = append(servers, nameServer{addr: line})
+			continue
+		}
+		rr, err := ParseRR(line, ".", 0)
+		if err != nil {
+			return err
+		}
+		if rr.Type == TypeA || rr.Type == TypeAAAA {
+			servers = append(servers, nameServer{rr.Name, HostPort(rr.IP().String())})
+		}
+	}
+	if len(servers) == 0 {
+		return errors.New("no root hints")
+	}
+	rootHints.Lock()
+	defer rootHints.Unlock()
+	rootHints.servers = servers
+	return nil
+}
+
+// LoadRootHints reads the servers where traces begin from a file, such
+// as the named.root file published by IANA.
+func LoadRootHints(path string) error {
+	lines, err := readLines(path)
+	if err != nil {
+		return err
+	}
+	return SetRootHints(lines)
+}
+
+func getRootHints() []nameServer {
+	rootHints.RLock()
+	defer rootHints.RUnlock()
+	return append([]nameServer{}, rootHints.servers...)
+}
+
+// The outcome of asking one server during a trace
+type traceResult struct {
+	server  nameServer
+	r       *Msg
+	rtt     time.Duration
+	err     error
+	kind    string
+	zone    string
+	nsNames []string
+}
+
+// Kinds of response
+const (
+	traceAnswer   = "answer"
+	traceNoData   = "no data"
+	traceNXDomain = "NXDOMAIN"
+	traceReferral = "referral"
+	traceLame     = "lame"
+	traceError    = "error"
+)
+
+// classify decides what kind of response the server gave when asked,
+// as an authority for zone, about name.
+func (t *traceResult) classify(name, zone string) {
+	if t.err != nil {
+		t.kind = traceError
+		return
+	}
+	r := t.r
+	switch rcode := r.ExtendedRcode(); {
+	case rcode == RcodeNXDomain && r.Authoritative:
+		t.kind = traceNXDomain
+		return
+	case rcode != RcodeSuccess:
+		t.kind = traceLame
+		return
+	}
+	if len(r.Answer) > 0 {
+		t.kind = traceAnswer
+		return
+	}
+	for _, rr := range r.Authority {
+		if rr.Type != TypeNS {
+			continue
+		}
+		// Only referrals down the tree towards the name are of use,
+		// anything else is a server that does not know the zone
+		if !isSubdomain(name, rr.Name) || isSubdomain(zone, rr.Name) {
+			continue
+		}
+		t.zone = rr.Name
+		t.nsNames = append(t.nsNames, strings.ToLower(rr.Target()))
+	}
+	if len(t.nsNames) > 0 {
+		sort.Strings(t.nsNames)
+		t.kind = traceReferral
+		return
+	}
+	if r.Authoritative {
+		t.kind = traceNoData
+		return
+	}
+	t.kind = traceLame
+}
+
+func (t *traceResult) String() string {
+	switch t.kind {
+	case traceError:
+		return t.err.Error()
+	case traceReferral:
+		return fmt.Sprintf("referral to %s", t.zone)
+	case traceLame:
+		if rcode := t.r.ExtendedRcode(); rcode != RcodeSuccess {
+			return fmt.Sprintf("lame, %s", RcodeName(rcode))
+		}
+		return "lame, not authoritative"
+	}
+	return t.kind
+}
+
+// ask sends the query to each of the servers at once
+func ask(servers []nameServer, name string, qtype uint16) []*traceResult {
+	results := make([]*traceResult, len(servers))
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func(i int, s nameServer) {
+			defer wg.Done()
+			// Each query has its own client, as Exchange keeps the
+			// TLS state of the last exchange in it
+			c := &Client{Timeout: TraceTimeout}
+			m := NewQuery(name, qtype)
+			m.RecursionDesired = false
+			t := &traceResult{server: s}
+			t.r, t.rtt, t.err = c.Exchange(m, s.addr)
+			results[i] = t
+		}(i, s)
+	}
+	wg.Wait()
+	return results
+}
+
+// delegation finds addresses for the servers named in a referral,
+// using the glue in the response and otherwise looking them up through
+// the resolver given for the host.
+func delegation(t *traceResult, port, resolver string) (servers []nameServer) {
+	for _, ns := range t.nsNames {
+		found := false
+		for _, rr := range t.r.Additional {
+			if (rr.Type == TypeA || rr.Type == TypeAAAA) && strings.EqualFold(rr.Name, ns) {
+				servers = append(servers, nameServer{ns, net.JoinHostPort(rr.IP().String(), port)})
+				found = true
+			}
+		}
+		if found {
+			continue
+		}
+		for _, qtype := range []uint16{TypeA, TypeAAAA} {
+			rrs, _ := answers(resolver, ns, qtype)
+			for _, rr := range rrs {
+				if rr.Type == qtype {
+					servers = append(servers, nameServer{ns, net.JoinHostPort(rr.IP().String(), port)})
+				}
+			}
+		}
+	}
+	return
+}
+
+// difference lists the names in a that are not in b
+func difference(a, b []string) (d []string) {
+	for _, x := range a {
+		found := false
+		for _, y := range b {
+			if x == y {
+				found = true
+				break
+			}
+		}
+		if !found {
+			d = append(d, x)
+		}
+	}
+	return
+}
+
+// zoneNS asks the servers for a zone for its NS records, returning the
+// first authoritative set given
+func zoneNS(servers []nameServer, zone string) (names []string) {
+	for _, t := range ask(servers, zone, TypeNS) {
+		if t.err != nil || !t.r.Authoritative {
+			continue
+		}
+		for _, rr := range t.r.Answer {
+			if rr.Type == TypeNS && strings.EqualFold(rr.Name, zone) {
+				names = append(names, strings.ToLower(rr.Target()))
+			}
+		}
+		if len(names) > 0 {
+			sort.Strings(names)
+			return
+		}
+	}
+	return
+}
+
+// unanswered follows any aliases for the name in the answer, returning
+// the last if the answer has no records of the type for it.
+func unanswered(answer []RR, name string, qtype uint16) string {
+	start := name
+	for i := 0; i <= maxAliases; i++ {
+		rrs, _ := rrset(answer, name, qtype)
+		if len(rrs) > 0 || qtype == TypeCNAME {
+			return ""
+		}
+		cname, _ := rrset(answer, name, TypeCNAME)
+		if len(cname) == 0 {
+			break
+		}
+		name = cname[0].Target()
+	}
+	if name == start {
+		return ""
+	}
+	return name
+}
+
+func trace(host, server string) (data []byte, err error) {
+	return traceType(host, server, TypeA)
+}
+
+// traceType follows referrals from the root hints to the servers that
+// answer for the name, showing each server asked on the way.
+func traceType(host, resolver string, qtype uint16) (data []byte, err error) {
+	name := Fqdn(host)
+	if net.ParseIP(host) != nil {
+		name, _ = ReverseName(host)
+		qtype = TypePTR
+	}
+	servers := getRootHints()
+	zone := "."
+	aliases := 0
+	var parentNS []string
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, ";; tracing %s %s\n", name, TypeName(qtype))
+	for step := 0; ; step++ {
+		if step == maxReferrals {
+			fmt.Fprintf(buf, "\n;; too many referrals\n")
+			break
+		}
+		if len(servers) == 0 {
+			fmt.Fprintf(buf, "\n;; no addresses for the servers of %s\n", zone)
+			break
+		}
+		results := ask(servers, name, qtype)
+
+		fmt.Fprintf(buf, "\n%s\n", zone)
+		w := tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+		var next *traceResult
+		for _, t := range results {
+			t.classify(name, zone)
+			if next == nil && t.kind != traceError && t.kind != traceLame {
+				next = t
+			}
+		}
+		for _, t := range results {
+			note := ""
+			if t.kind == traceReferral && next.kind == traceReferral &&
+				(t.zone != next.zone || strings.Join(t.nsNames, " ") != strings.Join(next.nsNames, " ")) {
+				note = "NS set differs"
+			}
+			rtt := ""
+			if t.err == nil {
+				rtt = t.rtt.Round(10 * time.Microsecond).String()
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", t.server.addr, t.server.name, rtt, t, note)
+		}
+		w.Flush()
+
+		// Compare the delegation in the parent with the zone's own NS
+		// records, now that its servers are known
+		if parentNS != nil {
+			if childNS := zoneNS(servers, zone); childNS != nil {
+				if d := difference(parentNS, childNS); d != nil {
+					fmt.Fprintf(buf, ";; delegation lists %s not in the zone\n", strings.Join(d, " "))
+				}
+				if d := difference(childNS, parentNS); d != nil {
+					fmt.Fprintf(buf, ";; zone lists %s not in the delegation\n", strings.Join(d, " "))
+				}
+			}
+		}
+
+		if next == nil {
+			fmt.Fprintf(buf, "\n;; no usable response from the servers of %s\n", zone)
+			break
+		}
+		if next.kind != traceReferral {
+			fmt.Fprintf(buf, "\n;; %s from %s (%s)\n", next.kind, next.server.addr, next.server.name)
+			if next.kind == traceNXDomain || next.kind == traceNoData {
+				for i := range next.r.Authority {
+					fmt.Fprintf(buf, "%s\n", next.r.Authority[i].String())
+				}
+				break
+			}
+			for i := range next.r.Answer {
+				fmt.Fprintf(buf, "%s\n", next.r.Answer[i].String())
+			}
+			target := unanswered(next.r.Answer, name, qtype)
+			if target == "" {
+				break
+			}
+			if aliases++; aliases > maxAliases {
+				fmt.Fprintf(buf, "\n;; too many aliases\n")
+				break
+			}
+			// Follow the alias from the top
+			name, zone, servers, parentNS = target, ".", getRootHints(), nil
+			fmt.Fprintf(buf, "\n;; tracing %s %s\n", name, TypeName(qtype))
+			continue
+		}
+
+		_, port, _ := net.SplitHostPort(next.server.addr)
+		zone, parentNS = next.zone, next.nsNames
+		servers = delegation(next, port, resolver)
+	}
+	data = buf.Bytes()
+	return
+}
+
+var Trace nopfs.Dispatcher = nopfs.NewFun(ResolveF(trace)).Limit("dnstrace")
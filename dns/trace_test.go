@@ -0,0 +1,279 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// restoreRootHints puts back the default root hints when the test ends
+func restoreRootHints(t *testing.T) {
+	t.Cleanup(func() { SetRootHints(defaultRootHints) })
+}
+
+func TestSetRootHints(t *testing.T) {
+	restoreRootHints(t)
+	tests := []struct {
+		name    string
+		lines   []string
+		servers []nameServer
+	}{
+		{"address", []string{"192.0.2.1"}, []nameServer{{"", "192.0.2.1:53"}}},
+		{"v6 address", []string{"[2001:db8::1]"}, []nameServer{{"", "[2001:db8::1]:53"}}},
+		{"with port", []string{"127.0.0.1:5300", "[::1]:5300"}, []nameServer{{"", "127.0.0.1:5300"}, {"", "[::1]:5300"}}},
+		{"hints file", []string{
+			"; formerly NS.INTERNIC.NET",
+			"",
+			".                        3600000      NS    A.ROOT-SERVERS.NET.",
+			"A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4",
+			"A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30",
+		}, []nameServer{{"A.ROOT-SERVERS.NET.", "198.41.0.4:53"}, {"A.ROOT-SERVERS.NET.", "[2001:503:ba3e::2:30]:53"}}},
+		{"empty", []string{"; nothing", ""}, nil},
+		{"no addresses", []string{". NS a.root-servers.net."}, nil},
+		{"bad record", []string{"a.root-servers.net. A 198.41.0"}, nil},
+	}
+	for _, test := range tests {
+		err := SetRootHints(test.lines)
+		if test.servers == nil {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := getRootHints(); !reflect.DeepEqual(got, test.servers) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.servers)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	referral := func(r *Msg, ns ...string) {
+		for _, line := range ns {
+			r.Authority = append(r.Authority, mustRR(t, line))
+		}
+	}
+	tests := []struct {
+		name    string
+		zone    string
+		t       *traceResult
+		kind    string
+		text    string
+		nsNames []string
+	}{
+		{"error", ".", &traceResult{err: errors.New("i/o timeout")}, traceError, "i/o timeout", nil},
+		{"answer", "example.com.", &traceResult{r: &Msg{
+			Answer: []RR{mustRR(t, "www.example.com. 300 IN A 192.0.2.1")},
+		}}, traceAnswer, "answer", nil},
+		{"nxdomain", "example.com.", &traceResult{r: &Msg{
+			Header: Header{Authoritative: true, Rcode: RcodeNXDomain},
+		}}, traceNXDomain, "NXDOMAIN", nil},
+		{"nxdomain not authoritative", "example.com.", &traceResult{r: &Msg{
+			Header: Header{Rcode: RcodeNXDomain},
+		}}, traceLame, "lame, NXDOMAIN", nil},
+		{"refused", "example.com.", &traceResult{r: &Msg{
+			Header: Header{Rcode: RcodeRefused},
+		}}, traceLame, "lame, REFUSED", nil},
+		{"no data", "example.com.", &traceResult{r: &Msg{
+			Header: Header{Authoritative: true},
+		}}, traceNoData, "no data", nil},
+		{"not authoritative", "example.com.", &traceResult{r: &Msg{}}, traceLame, "lame, not authoritative", nil},
+		{"referral", "com.", &traceResult{r: &Msg{}}, traceReferral, "referral to example.com.",
+			[]string{"a.iana-servers.net.", "b.iana-servers.net."}},
+		{"upward referral", "example.com.", &traceResult{r: &Msg{}}, traceLame, "lame, not authoritative", nil},
+	}
+	for _, test := range tests {
+		switch test.name {
+		case "referral":
+			referral(test.t.r, "example.com. 3600 IN NS B.iana-servers.net.", "example.com. 3600 IN NS a.iana-servers.net.")
+		case "upward referral":
+			referral(test.t.r, ". 3600 IN NS a.root-servers.net.", "com. 3600 IN NS a.gtld-servers.net.")
+		}
+		test.t.classify("www.example.com.", test.zone)
+		if test.t.kind != test.kind || test.t.String() != test.text || !reflect.DeepEqual(test.t.nsNames, test.nsNames) {
+			t.Errorf("%s: got %s, %q, %v", test.name, test.t.kind, test.t, test.t.nsNames)
+		}
+	}
+}
+
+func TestDifference(t *testing.T) {
+	tests := []struct {
+		a, b, d []string
+	}{
+		{nil, nil, nil},
+		{[]string{"a."}, nil, []string{"a."}},
+		{nil, []string{"a."}, nil},
+		{[]string{"a.", "b."}, []string{"b.", "a."}, nil},
+		{[]string{"a.", "b.", "c."}, []string{"b."}, []string{"a.", "c."}},
+	}
+	for _, test := range tests {
+		if d := difference(test.a, test.b); !reflect.DeepEqual(d, test.d) {
+			t.Errorf("%v - %v: got %v, want %v", test.a, test.b, d, test.d)
+		}
+	}
+}
+
+func TestUnanswered(t *testing.T) {
+	records := func(lines ...string) (rrs []RR) {
+		for _, line := range lines {
+			rrs = append(rrs, mustRR(t, line))
+		}
+		return
+	}
+	alias := "alias.example.com. 300 IN CNAME www.example.com."
+	tests := []struct {
+		name   string
+		answer []RR
+		qtype  uint16
+		want   string
+	}{
+		{"answered", records("alias.example.com. 300 IN A 192.0.2.1"), TypeA, ""},
+		{"alias answered", records(alias, "www.example.com. 300 IN A 192.0.2.1"), TypeA, ""},
+		{"alias", records(alias), TypeA, "www.example.com."},
+		{"chain", records(alias, "www.example.com. 300 IN CNAME web.example.net."), TypeA, "web.example.net."},
+		{"asked for the alias", records(alias), TypeCNAME, ""},
+		{"other type", records("alias.example.com. 300 IN MX 10 mail.example.com."), TypeA, ""},
+		// A loop is given up on after maxAliases, leaving traceType to stop
+		{"loop", records(alias, "www.example.com. 300 IN CNAME alias.example.com."), TypeA, "www.example.com."},
+	}
+	for _, test := range tests {
+		if got := unanswered(test.answer, "alias.example.com.", test.qtype); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// A stand-in zone answers for the names it holds, refers queries for
+// names in its delegations and gives NXDOMAIN for the rest.
+type standInZone struct {
+	origin      string
+	records     []string
+	delegations map[string][]string
+}
+
+func (z *standInZone) handle(t *testing.T) handler {
+	rrs := make([]RR, len(z.records))
+	for i, line := range z.records {
+		rrs[i] = mustRR(t, line)
+	}
+	return func(q *Msg, tcp bool) *Msg {
+		name, qtype := q.Question[0].Name, q.Question[0].Type
+		r := &Msg{}
+		for child, lines := range z.delegations {
+			if !isSubdomain(name, child) {
+				continue
+			}
+			for _, line := range lines {
+				rr, _ := ParseRR(line, ".", 3600)
+				if rr.Type == TypeNS {
+					r.Authority = append(r.Authority, rr)
+				} else {
+					r.Additional = append(r.Additional, rr)
+				}
+			}
+			return r
+		}
+		r.Authoritative = true
+		found := false
+		for _, rr := range rrs {
+			if !strings.EqualFold(rr.Name, name) {
+				continue
+			}
+			found = true
+			if rr.Type == qtype || rr.Type == TypeCNAME {
+				r.Answer = append(r.Answer, rr)
+			}
+		}
+		if !found {
+			r.Rcode = RcodeNXDomain
+		}
+		if len(r.Answer) == 0 {
+			r.Authority, _ = rrset(rrs, z.origin, TypeSOA)
+		}
+		return r
+	}
+}
+
+func TestTrace(t *testing.T) {
+	restoreRootHints(t)
+	root := &standInZone{".", []string{
+		". 3600 IN SOA a.root. nstld.example. 1 1800 900 604800 86400",
+	}, map[string][]string{
+		"com.": {"com. 3600 IN NS a.gtld.", "a.gtld. 3600 IN A 127.0.0.2"},
+	}}
+	// A second root server with another delegation for com.
+	otherRoot := &standInZone{".", nil, map[string][]string{
+		"com.": {"com. 3600 IN NS b.gtld.", "b.gtld. 3600 IN A 127.0.0.2"},
+	}}
+	com := &standInZone{"com.", []string{
+		"com. 3600 IN SOA a.gtld. nstld.example. 1 1800 900 604800 86400",
+		"com. 3600 IN NS a.gtld.",
+	}, map[string][]string{
+		"example.com.": {"example.com. 3600 IN NS ns1.example.com.", "ns1.example.com. 3600 IN A 127.0.0.3"},
+	}}
+	example := &standInZone{"example.com.", []string{
+		"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 3600",
+		"example.com. 3600 IN NS ns1.example.com.",
+		"example.com. 3600 IN NS ns2.example.com.",
+		"www.example.com. 300 IN A 192.0.2.1",
+		"alias.example.com. 300 IN CNAME www.example.com.",
+	}, nil}
+
+	addr := standIn(t, "127.0.0.1:0", root.handle(t))
+	_, port, _ := net.SplitHostPort(addr)
+	standIn(t, net.JoinHostPort("127.0.0.4", port), otherRoot.handle(t))
+	standIn(t, net.JoinHostPort("127.0.0.2", port), com.handle(t))
+	standIn(t, net.JoinHostPort("127.0.0.3", port), example.handle(t))
+	if err := SetRootHints([]string{addr, net.JoinHostPort("127.0.0.4", port)}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  []string
+	}{
+		{"www.example.com", TypeA, []string{
+			";; tracing www.example.com. A",
+			"referral to com.  NS set differs",
+			"127.0.0.2:" + port + "  a.gtld.",
+			"referral to example.com.",
+			";; zone lists ns2.example.com. not in the delegation",
+			";; answer from 127.0.0.3:" + port + " (ns1.example.com.)",
+			"www.example.com.\t300\tIN\tA\t192.0.2.1",
+		}},
+		{"alias.example.com", TypeA, []string{
+			"alias.example.com.\t300\tIN\tCNAME\twww.example.com.",
+			";; tracing www.example.com. A",
+			"www.example.com.\t300\tIN\tA\t192.0.2.1",
+		}},
+		{"nx.example.com", TypeA, []string{
+			";; NXDOMAIN from 127.0.0.3:" + port,
+			"example.com.\t3600\tIN\tSOA\tns1.example.com.",
+		}},
+		{"www.example.com", TypeMX, []string{
+			";; no data from 127.0.0.3:" + port,
+		}},
+		{"www.example.org", TypeA, []string{
+			";; NXDOMAIN from 127.0.0.1:" + port,
+		}},
+	}
+	for _, test := range tests {
+		data, err := traceType(test.name, "", test.qtype)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		out := string(data)
+		for _, want := range test.want {
+			if !strings.Contains(out, want) {
+				t.Errorf("%s %s: no %q in\n%s", test.name, TypeName(test.qtype), want, out)
+			}
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package dns
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// The changes between two versions of a zone given by an incremental
+// transfer
+type Delta struct {
+	From, To uint32
+	Del, Add []RR
+}
+
+var ErrBadTransfer = errors.New("dns: malformed zone transfer")
+
+// Time allowed for a whole zone transfer
+var TransferTimeout = 2 * time.Minute
+
+// SOASerial gives the serial of an SOA record, or false if the record
+// is not one
+func SOASerial(rr *RR) (uint32, bool) {
+	if rr.Type != TypeSOA {
+		return 0, false
+	}
+	soa, err := rr.SOA()
+	if err != nil {
+		return 0, false
+	}
+	return soa.Serial, true
+}
+
+// An ixfrParser follows the records of an IXFR response to see where it
+// ends and whether it is incremental or a whole zone.
+type ixfrParser struct {
+	serial uint32
+	rrs    []RR
+	deltas []Delta
+	// 0 for whole zone, 1 in deletions, 2 in additions
+	state int
+	done  bool
+}
+
+func (p *ixfrParser) add(rr RR) error {
+	if p.done {
+		return ErrBadTransfer
+	}
+	if len(p.rrs) == 0 && len(p.deltas) == 0 && p.state == 0 {
+		serial, ok := SOASerial(&rr)
+		if !ok {
+			return ErrBadTransfer
+		}
+		p.serial = serial
+		p.rrs = append(p.rrs, rr)
+		return nil
+	}
+	serial, isSOA := SOASerial(&rr)
+	if len(p.rrs) == 1 && len(p.deltas) == 0 && p.state == 0 && isSOA && serial != p.serial {
+		// A second SOA begins the first set of deletions
+		p.state = 1
+		p.deltas = append(p.deltas, Delta{From: serial, Del: []RR{rr}})
+		return nil
+	}
+	switch p.state {
+	case 0:
+		p.rrs = append(p.rrs, rr)
+		if isSOA && serial == p.serial {
+			p.done = true
+		}
+	case 1:
+		d := &p.deltas[len(p.deltas)-1]
+		if isSOA {
+			d.To = serial
+			d.Add = append(d.Add, rr)
+			p.state = 2
+		} else {
+			d.Del = append(d.Del, rr)
+		}
+	case 2:
+		d := &p.deltas[len(p.deltas)-1]
+		switch {
+		case isSOA && serial == p.serial && d.To == p.serial:
+			p.done = true
+		case isSOA:
+			p.deltas = append(p.deltas, Delta{From: serial, Del: []RR{rr}})
+			p.state = 1
+		default:
+			d.Add = append(d.Add, rr)
+		}
+	}
+	return nil
+}
+
+// dialStream connects to the server over TCP, or over TLS if it is
+// given as a dial string such as tls!192.0.2.53.
+func dialStream(server string) (conn net.Conn, err error) {
+	c, addr, err := ParseServer(server)
+	if err != nil {
+		return
+	}
+	dialer := &net.Dialer{Timeout: c.timeout()}
+	switch c.Net {
+	case "", "udp", "tcp":
+		conn, err = dialer.Dial("tcp", addr)
+	case "tls":
+		var raw net.Conn
+		raw, err = dialer.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		tc := tls.Client(raw, c.tlsConfig(addr))
+		raw.SetDeadline(time.Now().Add(c.timeout()))
+		if err = tc.Handshake(); err != nil {
+			raw.Close()
+			return
+		}
+		conn = tc
+	default:
+		err = fmt.Errorf("dns: no stream connections over %s", c.Net)
+	}
+	return
+}
+
+// Transfer fetches a zone from the server with AXFR or, if a serial is
+// given, IXFR, signing the request if there is a key. A whole zone is
+// returned in rrs, beginning with its SOA and without the repeat at the
+// end, while an incremental transfer gives the deltas to apply in order.
+// If the zone has not changed both are empty. The server may be a dial
+// string to use TLS.
+func Transfer(server, zone string, serial uint32, key *TSIGKey) (rrs []RR, deltas []Delta, err error) {
+	conn, err := dialStream(server)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(TransferTimeout))
+
+	m := NewQuery(zone, TypeAXFR)
+	m.RecursionDesired = false
+	m.Additional = nil
+	if serial != 0 {
+		m.Question[0].Type = TypeIXFR
+		var data []byte
+		if data, err = packName(nil, "."); err != nil {
+			return
+		}
+		if data, err = packName(data, "."); err != nil {
+			return
+		}
+		data = packUint32(data, serial)
+		data = append(data, make([]byte, 16)...)
+		m.Authority = []RR{{Name: Fqdn(zone), Type: TypeSOA, Class: ClassINET, Data: data}}
+	}
+	var query []byte
+	var v *tsigVerifier
+	if key != nil {
+		var mac []byte
+		query, mac, err = key.Sign(m)
+		v = &tsigVerifier{key: key, prior: mac}
+	} else {
+		query, err = m.Pack()
+	}
+	if err != nil {
+		return
+	}
+	if err = writeStream(conn, query); err != nil {
+		return
+	}
+
+	p := &ixfrParser{}
+	for !p.done {
+		var wire []byte
+		wire, err = readStreamWire(conn)
+		if err != nil {
+			return
+		}
+		var r *Msg
+		r, err = Unpack(wire)
+		if err != nil {
+			return
+		}
+		if !matches(m, r) && !(len(r.Question) == 0 && r.Id == m.Id) {
+			continue
+		}
+		if v != nil {
+			if err = v.verify(wire); err != nil {
+				return
+			}
+		}
+		if rcode := r.ExtendedRcode(); rcode != RcodeSuccess {
+			err = fmt.Errorf("dns: transfer refused, %s", RcodeName(rcode))
+			return
+		}
+		for _, rr := range r.Answer {
+			if err = p.add(rr); err != nil {
+				return
+			}
+		}
+		// A lone SOA in reply to IXFR means there is nothing newer
+		if serial != 0 && len(p.rrs) == 1 && len(p.deltas) == 0 {
+			if int32(p.serial-serial) <= 0 {
+				return nil, nil, nil
+			}
+		}
+	}
+	// The last message of a signed transfer must itself be signed
+	if v != nil && len(v.pending) > 0 {
+		err = ErrNotSigned
+		return
+	}
+	if len(p.deltas) > 0 {
+		return nil, p.deltas, nil
+	}
+	return p.rrs[:len(p.rrs)-1], nil, nil
+}
@@ -0,0 +1,121 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// signResponse adds a TSIG record to the message in wire format, the
+// MAC covering the prior MAC, the unsigned messages since and the
+// message as RFC 8945 section 5.3.1 has it, and gives the new MAC.
+func signResponse(t *testing.T, k *TSIGKey, wire, prior []byte, unsigned [][]byte, timersOnly bool) ([]byte, []byte) {
+	t.Helper()
+	signed := uint64(time.Now().Unix())
+	h := hmac.New(tsigAlgorithms[k.Algorithm], k.Secret)
+	h.Write(packUint16(nil, uint16(len(prior))))
+	h.Write(prior)
+	for _, u := range unsigned {
+		h.Write(u)
+	}
+	h.Write(wire)
+	h.Write(k.tsigVariables(signed, tsigFudge, 0, nil, timersOnly))
+	mac := h.Sum(nil)
+
+	data, _ := packName(nil, k.Algorithm)
+	data = packUint16(data, uint16(signed>>32))
+	data = packUint32(data, uint32(signed))
+	data = packUint16(data, tsigFudge)
+	data = packUint16(data, uint16(len(mac)))
+	data = append(data, mac...)
+	data = append(data, wire[:2]...)
+	data = packUint16(data, 0)
+	data = packUint16(data, 0)
+	rr := RR{Name: k.Name, Type: TypeTSIG, Class: ClassANY, Data: data}
+	out, err := rr.pack(append([]byte{}, wire...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint16(out[10:], binary.BigEndian.Uint16(out[10:])+1)
+	return out, mac
+}
+
+// standInTransfer answers one zone transfer with a message for each
+// set of records given, signing those whose sign is set.
+func standInTransfer(t *testing.T, k *TSIGKey, envelopes [][]RR, sign []bool) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		query, err := readStreamWire(conn)
+		if err != nil {
+			return
+		}
+		q, _ := Unpack(query)
+		_, rr, err := splitTSIG(query)
+		if err != nil || rr == nil {
+			return
+		}
+		tsig, _ := parseTSIG(rr.Data)
+		prior, verified := tsig.mac, false
+		var unsigned [][]byte
+		for i, answer := range envelopes {
+			r := &Msg{Header: Header{Id: q.Id, Response: true}, Question: q.Question, Answer: answer}
+			wire, err := r.Pack()
+			if err != nil {
+				return
+			}
+			if sign[i] {
+				wire, prior = signResponse(t, k, wire, prior, unsigned, verified)
+				unsigned, verified = nil, true
+			} else {
+				unsigned = append(unsigned, wire)
+			}
+			writeStream(conn, wire)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestTransferSigned(t *testing.T) {
+	k, err := ParseTSIGKey("hmac-sha256:xfr.example:c2VjcmV0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	soa := mustRR(t, "example.com. 3600 IN SOA ns.example.com. admin.example.com. 7 3600 600 86400 300")
+	a := mustRR(t, "www.example.com. 3600 IN A 192.0.2.1")
+	aaaa := mustRR(t, "www.example.com. 3600 IN AAAA 2001:db8::1")
+	envelopes := [][]RR{{soa, a}, {aaaa}, {soa}}
+
+	tests := []struct {
+		name string
+		sign []bool
+		err  error
+	}{
+		{"every message signed", []bool{true, true, true}, nil},
+		{"a message between left unsigned", []bool{true, false, true}, nil},
+		{"last message unsigned", []bool{true, true, false}, ErrNotSigned},
+		{"last two unsigned", []bool{true, false, false}, ErrNotSigned},
+		{"first message unsigned", []bool{false, true, true}, ErrNotSigned},
+	}
+	for _, test := range tests {
+		server := standInTransfer(t, k, envelopes, test.sign)
+		rrs, _, err := Transfer(server, "example.com", 0, k)
+		if err != test.err {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err == nil && len(rrs) != 3 {
+			t.Errorf("%s: got %d records", test.name, len(rrs))
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A TSIG key for signing messages as in RFC 8945
+type TSIGKey struct {
+	Name      string
+	Algorithm string
+	Secret    []byte
+}
+
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-md5.sig-alg.reg.int.": md5.New,
+	"hmac-sha1.":                sha1.New,
+	"hmac-sha256.":              sha256.New,
+	"hmac-sha512.":              sha512.New,
+}
+
+// Fudge allowed between the time a message was signed and now
+const tsigFudge = 300
+
+// TSIG error codes
+var tsigErrors = map[int]string{
+	16: "BADSIG",
+	17: "BADKEY",
+	18: "BADTIME",
+	22: "BADTRUNC",
+}
+
+var ErrNotSigned = errors.New("dns: response not signed")
+
+// ParseTSIGKey parses a key given as [algorithm:]name:secret, as for
+// dig -y, with the secret in base64. The algorithm defaults to
+// hmac-sha256.
+func ParseTSIGKey(s string) (*TSIGKey, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) == 2 {
+		parts = append([]string{"hmac-sha256"}, parts...)
+	}
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("dns: bad key %s", s)
+	}
+	k := &TSIGKey{Name: strings.ToLower(Fqdn(parts[1])), Algorithm: strings.ToLower(Fqdn(parts[0]))}
+	if k.Algorithm == "hmac-md5." {
+		k.Algorithm = "hmac-md5.sig-alg.reg.int."
+	}
+	if _, ok := tsigAlgorithms[k.Algorithm]; !ok {
+		return nil, fmt.Errorf("dns: unknown algorithm %s", parts[0])
+	}
+	secret, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("dns: bad secret for key %s", parts[1])
+	}
+	k.Secret = secret
+	return k, nil
+}
+
+func (k *TSIGKey) String() string {
+	return strings.TrimSuffix(k.Algorithm, ".") + ":" + strings.TrimSuffix(k.Name, ".") + ":" +
+		base64.StdEncoding.EncodeToString(k.Secret)
+}
+
+// KeyRing holds the TSIG keys known to the server by name. It may be
+// used as a flag, each value being a key as for ParseTSIGKey.
+type KeyRing struct {
+	lock sync.RWMutex
+	keys map[string]*TSIGKey
+	// The zones each key may update besides the one it is named after
+	zones map[string]map[string]bool
+}
+
+var Keys = &KeyRing{keys: make(map[string]*TSIGKey), zones: make(map[string]map[string]bool)}
+
+func (kr *KeyRing) Set(s string) error {
+	k, err := ParseTSIGKey(s)
+	if err != nil {
+		return err
+	}
+	kr.Add(k)
+	return nil
+}
+
+func (kr *KeyRing) Add(k *TSIGKey) {
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	kr.keys[k.Name] = k
+}
+
+// Get returns the key with the name, or nil if there is none
+func (kr *KeyRing) Get(name string) *TSIGKey {
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+	return kr.keys[strings.ToLower(Fqdn(name))]
+}
+
+// Allow lets the key named sign updates to the zones
+func (kr *KeyRing) Allow(name string, zones []string) error {
+	name = strings.ToLower(Fqdn(name))
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	if kr.keys[name] == nil {
+		return fmt.Errorf("dns: unknown key %s", name)
+	}
+	if kr.zones[name] == nil {
+		kr.zones[name] = make(map[string]bool)
+	}
+	for _, zone := range zones {
+		kr.zones[name][strings.ToLower(Fqdn(zone))] = true
+	}
+	return nil
+}
+
+// MayUpdate reports whether the key may sign updates to the zone, as it
+// may if it is named after the zone or was allowed it.
+func (kr *KeyRing) MayUpdate(k *TSIGKey, zone string) bool {
+	zone = strings.ToLower(Fqdn(zone))
+	if k.Name == zone {
+		return true
+	}
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+	return kr.zones[k.Name][zone]
+}
+
+// UpdateZones gives the zones keys may update. It may be used as a
+// flag, each value being name=zone[,zone...].
+type UpdateZones struct{}
+
+func (UpdateZones) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return fmt.Errorf("dns: expected name=zone[,zone...]: %s", v)
+	}
+	return Keys.Allow(parts[0], strings.Split(parts[1], ","))
+}
+
+func (UpdateZones) String() string {
+	return ""
+}
+
+// String lists the names of the keys, but not their secrets
+func (kr *KeyRing) String() string {
+	if kr == nil {
+		return ""
+	}
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+	names := make([]string, 0, len(kr.keys))
+	for name := range kr.keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// tsigVariables are the fields of the TSIG record covered by the MAC.
+// Later messages of a multi-message response cover only the timers.
+func (k *TSIGKey) tsigVariables(signed uint64, fudge, tsigErr uint16, other []byte, timersOnly bool) []byte {
+	var buf []byte
+	if !timersOnly {
+		buf = append(buf, canonicalName(k.Name)...)
+		buf = packUint16(buf, ClassANY)
+		buf = packUint32(buf, 0)
+		buf = append(buf, canonicalName(k.Algorithm)...)
+	}
+	buf = packUint16(buf, uint16(signed>>32))
+	buf = packUint32(buf, uint32(signed))
+	buf = packUint16(buf, fudge)
+	if !timersOnly {
+		buf = packUint16(buf, tsigErr)
+		buf = packUint16(buf, uint16(len(other)))
+		buf = append(buf, other...)
+	}
+	return buf
+}
+
+// Sign returns the message in wire format with a TSIG record added,
+// along with the MAC for checking the response.
+func (k *TSIGKey) Sign(m *Msg) (wire, mac []byte, err error) {
+	alg, ok := tsigAlgorithms[k.Algorithm]
+	if !ok {
+		return nil, nil, fmt.Errorf("dns: unknown algorithm %s", k.Algorithm)
+	}
+	wire, err = m.Pack()
+	if err != nil {
+		return
+	}
+	signed := uint64(time.Now().Unix())
+	h := hmac.New(alg, k.Secret)
+	h.Write(wire)
+	h.Write(k.tsigVariables(signed, tsigFudge, 0, nil, false))
+	mac = h.Sum(nil)
+
+	data, err := packName(nil, k.Algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+	data = packUint16(data, uint16(signed>>32))
+	data = packUint32(data, uint32(signed))
+	data = packUint16(data, tsigFudge)
+	data = packUint16(data, uint16(len(mac)))
+	data = append(data, mac...)
+	data = packUint16(data, m.Id)
+	data = packUint16(data, 0)
+	data = packUint16(data, 0)
+	rr := RR{Name: k.Name, Type: TypeTSIG, Class: ClassANY, Data: data}
+	if wire, err = rr.pack(wire); err != nil {
+		return nil, nil, err
+	}
+	binary.BigEndian.PutUint16(wire[10:], binary.BigEndian.Uint16(wire[10:])+1)
+	return
+}
+
+// A decoded TSIG record
+type tsigRecord struct {
+	algorithm string
+	signed    uint64
+	fudge     uint16
+	mac       []byte
+	origId    uint16
+	err       uint16
+	other     []byte
+}
+
+func parseTSIG(data []byte) (t tsigRecord, err error) {
+	var off int
+	t.algorithm, off, err = readName(data, 0)
+	if err != nil {
+		return
+	}
+	if off+10 > len(data) {
+		err = ErrShortMsg
+		return
+	}
+	t.signed = uint64(binary.BigEndian.Uint16(data[off:]))<<32 | uint64(binary.BigEndian.Uint32(data[off+2:]))
+	t.fudge = binary.BigEndian.Uint16(data[off+6:])
+	n := int(binary.BigEndian.Uint16(data[off+8:]))
+	off += 10
+	if off+n+6 > len(data) {
+		err = ErrShortMsg
+		return
+	}
+	t.mac = data[off : off+n]
+	off += n
+	t.origId = binary.BigEndian.Uint16(data[off:])
+	t.err = binary.BigEndian.Uint16(data[off+2:])
+	n = int(binary.BigEndian.Uint16(data[off+4:]))
+	off += 6
+	if off+n > len(data) {
+		err = ErrShortMsg
+		return
+	}
+	t.other = data[off : off+n]
+	return
+}
+
+// splitTSIG separates a message in wire format into the message as it
+// was before being signed and its TSIG record, if it has one.
+func splitTSIG(wire []byte) (body []byte, tsig *RR, err error) {
+	m, err := Unpack(wire)
+	if err != nil {
+		return
+	}
+	if n := len(m.Additional); n == 0 || m.Additional[n-1].Type != TypeTSIG {
+		return wire, nil, nil
+	}
+	tsig = &m.Additional[len(m.Additional)-1]
+
+	// Find where the last record starts by skipping over the others
+	off := 12
+	for i := 0; i < len(m.Question); i++ {
+		_, off, err = unpackName(wire, off)
+		if err != nil {
+			return
+		}
+		off += 4
+	}
+	rrs := len(m.Answer) + len(m.Authority) + len(m.Additional) - 1
+	for i := 0; i < rrs; i++ {
+		_, off, err = unpackName(wire, off)
+		if err != nil {
+			return
+		}
+		if off+10 > len(wire) {
+			err = ErrShortMsg
+			return
+		}
+		off += 10 + int(binary.BigEndian.Uint16(wire[off+8:]))
+	}
+	body = append([]byte{}, wire[:off]...)
+	binary.BigEndian.PutUint16(body[10:], uint16(len(m.Additional)-1))
+	return
+}
+
+// A tsigVerifier checks the signatures on the messages of a response
+// to a signed request
+type tsigVerifier struct {
+	key      *TSIGKey
+	prior    []byte
+	pending  [][]byte
+	verified bool
+}
+
+// Responses to zone transfers may leave out the signature on up to 99
+// messages in a row
+const maxUnsigned = 99
+
+func (v *tsigVerifier) verify(wire []byte) error {
+	body, rr, err := splitTSIG(wire)
+	if err != nil {
+		return err
+	}
+	if rr == nil {
+		if !v.verified || len(v.pending) >= maxUnsigned {
+			return ErrNotSigned
+		}
+		v.pending = append(v.pending, body)
+		return nil
+	}
+	t, err := parseTSIG(rr.Data)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(rr.Name, v.key.Name) || !strings.EqualFold(t.algorithm, v.key.Algorithm) {
+		return errors.New("dns: response signed with another key")
+	}
+	if t.err != 0 {
+		name, ok := tsigErrors[int(t.err)]
+		if !ok {
+			name = fmt.Sprintf("TSIG error %d", t.err)
+		}
+		return fmt.Errorf("dns: %s", name)
+	}
+
+	binary.BigEndian.PutUint16(body, t.origId)
+	h := hmac.New(tsigAlgorithms[v.key.Algorithm], v.key.Secret)
+	h.Write(packUint16(nil, uint16(len(v.prior))))
+	h.Write(v.prior)
+	for _, p := range v.pending {
+		h.Write(p)
+	}
+	h.Write(body)
+	h.Write(v.key.tsigVariables(t.signed, t.fudge, t.err, t.other, v.verified))
+	if !hmac.Equal(h.Sum(nil), t.mac) {
+		return errors.New("dns: response signature does not verify")
+	}
+	now := time.Now().Unix()
+	if d := now - int64(t.signed); d > int64(t.fudge) || -d > int64(t.fudge) {
+		return errors.New("dns: response signed at the wrong time")
+	}
+	v.prior = t.mac
+	v.pending = nil
+	v.verified = true
+	return nil
+}
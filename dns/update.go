@@ -0,0 +1,251 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"hubs.net.uk/sw/nopfs"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// The TTL given to added records that do not have one
+var UpdateTTL uint32 = 3600
+
+var ErrNoKey = errors.New("dns: no key to sign the update with")
+
+// PrimaryOf returns the primary server for the zone, the one named in
+// its SOA record, asking the given server.
+func PrimaryOf(server, zone string) (string, error) {
+	rrs, err := answers(server, zone, TypeSOA)
+	if err != nil {
+		return "", err
+	}
+	for i := range rrs {
+		if rrs[i].Type == TypeSOA && strings.EqualFold(rrs[i].Name, Fqdn(zone)) {
+			soa, err := rrs[i].SOA()
+			if err != nil {
+				return "", err
+			}
+			return soa.Mname, nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// UpdateSource gives the server to send updates for a zone to and the
+// key to sign them with. By default these are the primary named in the
+// zone's SOA record and the key named after the zone, if there is one.
+var UpdateSource = func(zone string) (primary string, key *TSIGKey, err error) {
+	primary, err = PrimaryOf("", zone)
+	return primary, Keys.Get(zone), err
+}
+
+// inZone reports whether the name is the zone or below it
+func inZone(name, zone string) bool {
+	name, zone = strings.ToLower(Fqdn(name)), strings.ToLower(Fqdn(zone))
+	return name == zone || zone == "." || strings.HasSuffix(name, "."+zone)
+}
+
+// ParseUpdate builds an UPDATE message for the zone from lines of the
+// form
+//
+//	add rr                     add the record
+//	del name                   delete every record owned by the name
+//	del name type              delete the records of the type
+//	del name type rdata        delete the one record
+//	key name                   sign with this key
+//
+// with records in zone file format and names relative to the origin.
+// It returns the name of any key asked for.
+func ParseUpdate(zone, origin string, data []byte) (m *Msg, key string, err error) {
+	zone = Fqdn(zone)
+	m = &Msg{}
+	m.Id = newId()
+	m.Opcode = OpcodeUpdate
+	m.Question = []Question{{Name: zone, Type: TypeSOA, Class: ClassINET}}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), fields[0]))
+		var rr RR
+		switch fields[0] {
+		case "add":
+			rr, err = ParseRR(rest, origin, UpdateTTL)
+			if err == nil && (rr.Class != ClassINET || rr.Type == TypeANY) {
+				err = fmt.Errorf("cannot add %s", rest)
+			}
+		case "del", "delete":
+			rr, err = parseDelete(rest, origin)
+		case "key":
+			if len(fields) != 2 || Keys.Get(fields[1]) == nil {
+				err = fmt.Errorf("unknown key: %s", rest)
+				return
+			}
+			key = fields[1]
+			continue
+		default:
+			err = fmt.Errorf("expected add, del or key: %s", line)
+		}
+		if err != nil {
+			return
+		}
+		if !inZone(rr.Name, zone) {
+			err = fmt.Errorf("%s is not in %s", rr.Name, zone)
+			return
+		}
+		m.Authority = append(m.Authority, rr)
+	}
+	if len(m.Authority) == 0 {
+		err = errors.New("no changes")
+	}
+	return
+}
+
+// parseDelete gives the record standing for a deletion as in RFC 2136,
+// of class ANY to delete a whole RRset or every record for the name,
+// or of class NONE with the data to delete a single record.
+func parseDelete(s, origin string) (rr RR, err error) {
+	tokens, _, err := tokenize(s)
+	if err != nil {
+		return
+	}
+	switch len(tokens) {
+	case 0:
+		err = errors.New("del needs a name")
+		return
+	case 1:
+		return RR{Name: absName(tokens[0], origin), Type: TypeANY, Class: ClassANY}, nil
+	case 2:
+		t, ok := TypeValue(tokens[1])
+		if !ok {
+			err = fmt.Errorf("unknown type %s: %s", tokens[1], s)
+			return
+		}
+		return RR{Name: absName(tokens[0], origin), Type: t, Class: ClassANY}, nil
+	}
+	rr, err = ParseRR(s, origin, 0)
+	rr.Class = ClassNONE
+	rr.TTL = 0
+	return
+}
+
+// SendUpdate sends the update to the server over TCP, or TLS if the
+// server is given as such, signed with the key if there is one, and
+// returns the response.
+func SendUpdate(server string, m *Msg, key *TSIGKey) (r *Msg, err error) {
+	conn, err := dialStream(server)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(defaultTimeout))
+
+	var wire []byte
+	var v *tsigVerifier
+	if key != nil {
+		var mac []byte
+		wire, mac, err = key.Sign(m)
+		v = &tsigVerifier{key: key, prior: mac}
+	} else {
+		wire, err = m.Pack()
+	}
+	if err != nil {
+		return
+	}
+	if err = writeStream(conn, wire); err != nil {
+		return
+	}
+	for {
+		wire, err = readStreamWire(conn)
+		if err != nil {
+			return
+		}
+		r, err = Unpack(wire)
+		if err != nil {
+			return
+		}
+		if r.Id != m.Id || !r.Response {
+			continue
+		}
+		if v != nil {
+			// Errors may be given unsigned
+			e := v.verify(wire)
+			if e != nil && !(e == ErrNotSigned && r.ExtendedRcode() != RcodeSuccess) {
+				err = e
+			}
+		}
+		return
+	}
+}
+
+// Update makes the changes given as for ParseUpdate to the zone, on
+// its primary, returning the response code.
+func Update(zone, origin string, data []byte) (rcode int, err error) {
+	m, name, err := ParseUpdate(zone, origin, data)
+	if err != nil {
+		return
+	}
+	primary, key, err := UpdateSource(zone)
+	if err != nil {
+		return
+	}
+	if name != "" {
+		key = Keys.Get(name)
+	}
+	if key == nil {
+		err = ErrNoKey
+		return
+	}
+	// Whoever may write the update file chooses the key, so it must be
+	// one the server was told may update the zone
+	if !Keys.MayUpdate(key, zone) {
+		err = fmt.Errorf("dns: key %s may not update %s", key.Name, Fqdn(zone))
+		nopfs.Log.Error("update", "zone", zone, "key", key.Name, "error", err)
+		return
+	}
+	r, err := SendUpdate(primary, m, key)
+	if err != nil {
+		nopfs.Log.Error("update", "zone", zone, "primary", primary, "error", err)
+		return
+	}
+	rcode = r.ExtendedRcode()
+	nopfs.Log.Info("update", "zone", zone, "primary", primary, "key", key.Name,
+		"changes", len(m.Authority), "rcode", RcodeName(rcode))
+	return
+}
+
+// updateCtl applies the update written to it to the zone holding the
+// host, or the zone itself if the host is one, giving the response code.
+func updateCtl(c *nopfs.Ctl, data []byte) (resp []byte, err error) {
+	path := c.GetPath()
+	if len(path) < 2 {
+		err = os.ErrInvalid
+		return
+	}
+	name := Fqdn(path[1])
+	if net.ParseIP(path[1]) != nil {
+		name, _ = ReverseName(path[1])
+	}
+	zone, err := zoneOf(ServerOf(path), name)
+	if err != nil {
+		return
+	}
+	return UpdateResult(Update(zone, name, data))
+}
+
+// UpdateResult gives the response code as read back from an update
+// file, failing the write unless the update succeeded.
+func UpdateResult(rcode int, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	resp := []byte(RcodeName(rcode) + "\n")
+	if rcode != RcodeSuccess {
+		return resp, fmt.Errorf("update failed: %s", RcodeName(rcode))
+	}
+	return resp, nil
+}
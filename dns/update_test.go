@@ -0,0 +1,86 @@
+package dns
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestMayUpdate(t *testing.T) {
+	for _, key := range []string{"example.com:c2VjcmV0", "hmac-sha1:ops-key:c2VjcmV0"} {
+		if err := Keys.Set(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := (UpdateZones{}).Set("ops-key=example.net,Example.ORG."); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"ops-key", "ops-key=", "no-such-key=example.com"} {
+		if err := (UpdateZones{}).Set(v); err == nil {
+			t.Errorf("%s: no error", v)
+		}
+	}
+	tests := []struct {
+		key, zone string
+		ok        bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "EXAMPLE.com.", true},
+		{"example.com", "sub.example.com", false},
+		{"example.com", "example.net", false},
+		{"ops-key", "example.net", true},
+		{"ops-key", "example.org", true},
+		{"ops-key", "example.com", false},
+		{"ops-key", "ops-key", true},
+	}
+	for _, test := range tests {
+		if ok := Keys.MayUpdate(Keys.Get(test.key), test.zone); ok != test.ok {
+			t.Errorf("%s for %s: got %v", test.key, test.zone, ok)
+		}
+	}
+}
+
+func TestUpdateRefused(t *testing.T) {
+	for _, key := range []string{"refused.example:c2VjcmV0", "other.example:c2VjcmV0"} {
+		if err := Keys.Set(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var sent int32
+	server := standIn(t, "127.0.0.1:0", func(q *Msg, tcp bool) *Msg {
+		atomic.AddInt32(&sent, 1)
+		return &Msg{Header: Header{Rcode: RcodeRefused}}
+	})
+	defer func(f func(string) (string, *TSIGKey, error)) { UpdateSource = f }(UpdateSource)
+	var source *TSIGKey
+	UpdateSource = func(zone string) (string, *TSIGKey, error) {
+		return server, source, nil
+	}
+
+	tests := []struct {
+		name   string
+		source *TSIGKey
+		update string
+	}{
+		{"no key", nil, "add @ A 192.0.2.1"},
+		{"key for another zone", nil, "add @ A 192.0.2.1\nkey other.example"},
+		{"source key for another zone", Keys.Get("other.example"), "add @ A 192.0.2.1"},
+	}
+	for _, test := range tests {
+		source = test.source
+		if _, err := Update("refused.example", "refused.example.", []byte(test.update)); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+	if n := atomic.LoadInt32(&sent); n != 0 {
+		t.Errorf("%d refused updates sent", n)
+	}
+
+	// The zone's own key is used, and the update sent
+	source = Keys.Get("refused.example")
+	if rcode, err := Update("refused.example", "refused.example.", []byte("add @ A 192.0.2.1")); err != nil || rcode != RcodeRefused {
+		t.Errorf("got %s, %v", RcodeName(rcode), err)
+	}
+	if n := atomic.LoadInt32(&sent); n != 1 {
+		t.Errorf("%d updates sent", n)
+	}
+}
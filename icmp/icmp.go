@@ -13,6 +13,56 @@ This directory contains tests that use ICMP to measure characteristics
 of the host. Chiefly this means ping(1) and traceroute(1) as well as
 the more advanced mtr(1).
 
+  pmtu        The path MTU to the host, found with echo requests that
+              may not be fragmented, from the local MTU or 65535 bytes
+              if that is less. When routers do not send back
+              fragmentation needed, as where tunnels black-hole large
+              packets, a size whose requests are all lost is taken to
+              be too big, and the range between the sizes answered and
+              lost is halved until they meet. This is a plain binary
+              search on echo loss, not the packetization layer path
+              MTU discovery of RFC 4821 or RFC 8899, so requests lost
+              for other reasons may give too small an MTU. When the
+              path MTU is less than the local MTU, the last hop larger
+              packets reach is also given.
+  pmtu6       The same over IPv6.
+  jitter      A stream of echo requests sent as a call would send voice,
+              by default 250 of 160 bytes every 20ms, with the loss,
+              runs of loss, reordering, round trip times, the
+              interarrival jitter of RFC 3550 and the difference in
+              delay of successive replies
+  jitter6     The same over IPv6.
+  mos         The mean opinion score a call like the stream would
+              have, estimated by the E-model of ITU-T G.107 from its
+              delay, jitter and loss
+  mos6        The same over IPv6.
+  bufferbloat The latency to the host when idle and then under load
+              made by TCP transfers to and from a cooperating
+              responder, another nopfs started with -responder, with
+              the rise graded from A+ to F. The load is only sent to
+              the responders given to this server with -loadresponder,
+              by default the first of them.
+  bufferbloat6
+              The same over IPv6.
+  stream      Write to change the stream and load, one setting per
+              line, giving back the settings in force
+
+The settings are
+
+  count n          echo requests sent, up to 65535
+  interval d       time between them, as in 20ms
+  size n           bytes of data each carries
+  codec c          g711 or g729, for the MOS estimate
+  responder addr   host[:port] of the responder for bufferbloat,
+                   one of those given with -loadresponder
+  streams n        transfers each way making the load, up to 16
+  load up|down|both  the direction of the load
+  reset            go back to the defaults
+
+The jitter and mos files describe the same stream when read within 5
+seconds of each other. The pmtu, jitter, mos and bufferbloat files
+need CAP_NET_RAW to send and listen for ICMP.
+
 `
 var Readme nopfs.Dispatcher = nopfs.NewFile([]byte(readme_icmp))
 
@@ -41,7 +91,7 @@ func init() {
 		fping = false
 	}
 	if err == nil {
-		Ping = nopfs.NewCmd(nopfs.HostC(ping))
+		Ping = nopfs.NewCmd(nopfs.HostC(ping)).Limit("ping")
 	}
 
 	ping6_prog, err = exec.LookPath("fping6")
@@ -50,23 +100,23 @@ func init() {
 		fping6 = false
 	}
 	if err == nil {
-		Ping6 = nopfs.NewCmd(nopfs.HostC(ping6))
+		Ping6 = nopfs.NewCmd(nopfs.HostC(ping6)).Limit("ping")
 	}
 
 	trace_prog, err = exec.LookPath("traceroute")
 	if err == nil {
-		Trace = nopfs.NewCmd(nopfs.HostC(trace))
+		Trace = nopfs.NewCmd(nopfs.HostC(trace)).Limit("traceroute")
 	}
 
 	trace6_prog, err = exec.LookPath("traceroute6")
 	if err == nil {
-		Trace6 = nopfs.NewCmd(nopfs.HostC(trace6))
+		Trace6 = nopfs.NewCmd(nopfs.HostC(trace6)).Limit("traceroute")
 	}
 
 	mtr_prog, err = exec.LookPath("mtr")
 	if err == nil {
-		Mtr = nopfs.NewCmd(nopfs.HostC(mtr))
-		MtrT = nopfs.NewCmd(nopfs.HostC(mtrt))
+		Mtr = nopfs.NewCmd(nopfs.HostC(mtr)).Limit("mtr")
+		MtrT = nopfs.NewCmd(nopfs.HostC(mtrt)).Limit("mtr")
 	}
 
 	Dir = nopfs.NewDir()
@@ -88,6 +138,15 @@ func init() {
 		Dir.Append("mtr", Mtr)
 		Dir.Append("mtrt", MtrT)
 	}
+	Dir.Append("pmtu", PMTU)
+	Dir.Append("pmtu6", PMTU6)
+	Dir.Append("jitter", Jitter)
+	Dir.Append("jitter6", Jitter6)
+	Dir.Append("mos", MOS)
+	Dir.Append("mos6", MOS6)
+	Dir.Append("bufferbloat", Bufferbloat)
+	Dir.Append("bufferbloat6", Bufferbloat6)
+	Dir.Append("stream", Stream)
 }
 
 func ping(host string) *exec.Cmd {
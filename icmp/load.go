@@ -0,0 +1,172 @@
+package icmp
+
+import (
+	"fmt"
+	"hubs.net.uk/sw/nopfs"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The longest a responder keeps up a transfer, and the time allowed to
+// connect to one
+var MaxLoad = time.Minute
+var LoadDialTimeout = 5 * time.Second
+
+// The most transfers a responder serves at once, enough for one load
+// of 16 streams each way
+var MaxResponses = 32
+
+// A connection to a responder begins with one byte asking it to take
+// data and throw it away or to send data until the connection is
+// closed.
+const (
+	loadUp   = 'u'
+	loadDown = 'd'
+)
+
+// A load is a set of transfers to and from a responder
+type load struct {
+	// Bytes sent and received, kept first for atomic access
+	up, down int64
+	conns    []net.Conn
+	start    time.Time
+	wg       sync.WaitGroup
+}
+
+// startLoad opens the number of transfers in each direction asked for,
+// up, down or both, with the responder at the address.
+func startLoad(addr string, n int, direction string) (l *load, err error) {
+	l = &load{}
+	var kinds []byte
+	if direction != "down" {
+		kinds = append(kinds, loadUp)
+	}
+	if direction != "up" {
+		kinds = append(kinds, loadDown)
+	}
+	for i := 0; i < n; i++ {
+		for _, kind := range kinds {
+			var conn net.Conn
+			conn, err = net.DialTimeout("tcp", addr, LoadDialTimeout)
+			if err == nil {
+				_, err = conn.Write([]byte{kind})
+			}
+			if err != nil {
+				l.stop()
+				return
+			}
+			l.conns = append(l.conns, conn)
+		}
+	}
+	l.start = time.Now()
+	for i, conn := range l.conns {
+		l.wg.Add(1)
+		go l.run(conn, kinds[i%len(kinds)])
+	}
+	return
+}
+
+// run keeps a transfer going until its connection is closed
+func (l *load) run(conn net.Conn, kind byte) {
+	defer l.wg.Done()
+	buf := make([]byte, 64*1024)
+	for {
+		var n int
+		var err error
+		if kind == loadUp {
+			n, err = conn.Write(buf)
+			atomic.AddInt64(&l.up, int64(n))
+		} else {
+			n, err = conn.Read(buf)
+			atomic.AddInt64(&l.down, int64(n))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// stop ends the transfers, giving the bytes each way and how long they
+// ran
+func (l *load) stop() (up, down int64, elapsed time.Duration) {
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.wg.Wait()
+	if !l.start.IsZero() {
+		elapsed = time.Since(l.start)
+	}
+	return atomic.LoadInt64(&l.up), atomic.LoadInt64(&l.down), elapsed
+}
+
+// respond serves one transfer asked for by a client measuring
+// bufferbloat
+func respond(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(MaxLoad))
+	kind := make([]byte, 1)
+	if _, err := io.ReadFull(conn, kind); err != nil {
+		return
+	}
+	switch kind[0] {
+	case loadUp:
+		io.Copy(ioutil.Discard, conn)
+	case loadDown:
+		buf := make([]byte, 64*1024)
+		for {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Respond listens at the address, as in 192.0.2.1:5642, for the
+// transfers made by the bufferbloat files of another server, so that
+// this one may be the cooperating responder at the far end of the link
+// they load. An address without a host listens on loopback alone, and
+// a port alone is taken as one. Connections beyond MaxResponses at
+// once are closed unanswered.
+func Respond(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = "", addr
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return fmt.Errorf("responder: %s", err)
+	}
+	nopfs.Log.Info("responder", "addr", l.Addr())
+	go serveLoad(l)
+	return nil
+}
+
+// serveLoad answers transfers accepted from the listener, up to
+// MaxResponses at once, until it is closed
+func serveLoad(l net.Listener) {
+	sessions := make(chan bool, MaxResponses)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			nopfs.Log.Error("responder", "error", err)
+			return
+		}
+		select {
+		case sessions <- true:
+			go func() {
+				respond(conn)
+				<-sessions
+			}()
+		default:
+			nopfs.Log.Debug("responder busy", "remote", conn.RemoteAddr())
+			conn.Close()
+		}
+	}
+}
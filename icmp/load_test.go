@@ -0,0 +1,78 @@
+package icmp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServeLoad(t *testing.T) {
+	defer func(n int) { MaxResponses = n }(MaxResponses)
+	MaxResponses = 2
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveLoad(l)
+
+	// One transfer each way fills the responder
+	ld, err := startLoad(l.Addr().String(), 1, "both")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{loadDown})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("busy responder sent %d bytes", n)
+	}
+	conn.Close()
+
+	up, down, elapsed := ld.stop()
+	if up == 0 || down == 0 || elapsed <= 0 {
+		t.Errorf("got up %d, down %d in %s", up, down, elapsed)
+	}
+}
+
+func TestChosenResponder(t *testing.T) {
+	defer func(addrs []string) { responders.addrs = addrs }(responders.addrs)
+	responders.addrs = nil
+	if _, err := chosenResponder(""); err == nil {
+		t.Error("load sent with no responder configured")
+	}
+	p := streamDefaults()
+	if err := p.set("responder 192.0.2.2"); err == nil {
+		t.Error("client chose a responder")
+	}
+
+	for _, v := range []string{"192.0.2.2", "[2001:db8::2]:6000"} {
+		if err := (Responders{}).Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		chosen, addr string
+		ok           bool
+	}{
+		{"", "192.0.2.2:5642", true},
+		{"[2001:db8::2]:6000", "[2001:db8::2]:6000", true},
+		{"192.0.2.3:5642", "", false},
+	}
+	for _, test := range tests {
+		addr, err := chosenResponder(test.chosen)
+		if (err == nil) != test.ok || addr != test.addr {
+			t.Errorf("%q: got %s, %v", test.chosen, addr, err)
+		}
+	}
+	if err := p.set("responder 2001:db8::2"); err == nil {
+		t.Error("responder on another port accepted")
+	}
+	if err := p.set("responder [2001:db8::2]:6000"); err != nil || p.responder != "[2001:db8::2]:6000" {
+		t.Errorf("got %s, %v", p.responder, err)
+	}
+}
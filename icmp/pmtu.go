@@ -0,0 +1,21 @@
+package icmp
+
+import (
+	"hubs.net.uk/sw/nopfs"
+	native "hubs.net.uk/sw/nopfs/trace"
+)
+
+// pmtuF gives the function for a file finding the path MTU to the host
+// over IPv4 or IPv6
+func pmtuF(v6 bool) func(string) ([]byte, error) {
+	return func(host string) ([]byte, error) {
+		res, err := native.PathMTU(host, v6)
+		if err != nil {
+			return nil, err
+		}
+		return res.Format(host), nil
+	}
+}
+
+var PMTU nopfs.Dispatcher = nopfs.NewFun(nopfs.HostF(pmtuF(false))).Limit("traceroute")
+var PMTU6 nopfs.Dispatcher = nopfs.NewFun(nopfs.HostF(pmtuF(true))).Limit("traceroute")
@@ -0,0 +1,550 @@
+package icmp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hubs.net.uk/sw/nopfs"
+	native "hubs.net.uk/sw/nopfs/trace"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Time for which a stream is used again rather than sent again, so
+// that jitter and mos describe the same one
+var Reuse = 5 * time.Second
+
+// The port a cooperating responder listens on unless its address
+// names another, clear of the 5640 and 5641 the servers listen on
+var ResponderPort = 5642
+
+// Time the load runs before latency under it is measured
+var LoadWarmup = 2 * time.Second
+
+// A codec as the E-model of ITU-T G.107 sees it, with its equipment
+// impairment and robustness to loss from G.113 and the delay of
+// packetization and look ahead
+type codec struct {
+	ie    float64
+	bpl   float64
+	delay time.Duration
+}
+
+var codecs = map[string]codec{
+	"g711": {ie: 0, bpl: 25.1, delay: 20 * time.Millisecond},
+	"g729": {ie: 11, bpl: 19, delay: 25 * time.Millisecond},
+}
+
+// streamParams describe the echo requests sent to a host, and the load
+// made to measure bufferbloat
+type streamParams struct {
+	count     int
+	interval  time.Duration
+	size      int
+	codec     string
+	responder string
+	streams   int
+	load      string
+}
+
+func streamDefaults() streamParams {
+	return streamParams{
+		count:    250,
+		interval: 20 * time.Millisecond,
+		size:     160,
+		codec:    "g711",
+		streams:  4,
+		load:     "both",
+	}
+}
+
+// The responders the bufferbloat files may load links with, given by
+// the operator, as the load would otherwise go wherever clients asked
+var responders = struct {
+	sync.RWMutex
+	addrs []string
+}{}
+
+// responderAddr gives the host:port of a responder, with the port
+// being ResponderPort unless one is given
+func responderAddr(s string) string {
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return net.JoinHostPort(s, strconv.Itoa(ResponderPort))
+	}
+	return s
+}
+
+// Responders sets the responders bufferbloat is measured with, the
+// first being used unless the stream settings choose another. It may
+// be used as a flag, each value being a host[:port].
+type Responders struct{}
+
+func (Responders) Set(v string) error {
+	if v == "" {
+		return fmt.Errorf("expected host[:port]")
+	}
+	responders.Lock()
+	defer responders.Unlock()
+	responders.addrs = append(responders.addrs, responderAddr(v))
+	return nil
+}
+
+func (Responders) String() string {
+	return ""
+}
+
+// chosenResponder gives the address of the responder chosen, or the
+// first if none is, as long as it is one the operator gave
+func chosenResponder(chosen string) (string, error) {
+	responders.RLock()
+	defer responders.RUnlock()
+	if len(responders.addrs) == 0 {
+		return "", errors.New("no responder configured")
+	}
+	if chosen == "" {
+		return responders.addrs[0], nil
+	}
+	for _, addr := range responders.addrs {
+		if addr == chosen {
+			return addr, nil
+		}
+	}
+	return "", fmt.Errorf("%s: not a configured responder", chosen)
+}
+
+var streamHosts = struct {
+	sync.RWMutex
+	params map[string]streamParams
+}{params: make(map[string]streamParams)}
+
+func getStreamParams(host string) streamParams {
+	streamHosts.RLock()
+	defer streamHosts.RUnlock()
+	if p, ok := streamHosts.params[host]; ok {
+		return p
+	}
+	return streamDefaults()
+}
+
+// set changes the setting named on the line
+func (p *streamParams) set(line string) (err error) {
+	fields := strings.Fields(line)
+	name, value := fields[0], ""
+	if len(fields) > 1 {
+		value = fields[1]
+	}
+	switch name {
+	case "count":
+		p.count, err = strconv.Atoi(value)
+		if err != nil || p.count < 1 || p.count > native.MaxStream {
+			err = fmt.Errorf("bad count: %s", value)
+		}
+	case "interval":
+		p.interval, err = time.ParseDuration(value)
+		if err == nil && p.interval < time.Millisecond {
+			err = fmt.Errorf("bad interval: %s", value)
+		}
+	case "size":
+		p.size, err = strconv.Atoi(value)
+		if err != nil || p.size < 0 || p.size > 1400 {
+			err = fmt.Errorf("bad size: %s", value)
+		}
+	case "codec":
+		if _, ok := codecs[value]; !ok {
+			err = fmt.Errorf("unknown codec: %s", value)
+		}
+		p.codec = value
+	case "responder":
+		if value != "" {
+			value = responderAddr(value)
+			_, err = chosenResponder(value)
+		}
+		p.responder = value
+	case "streams":
+		p.streams, err = strconv.Atoi(value)
+		if err != nil || p.streams < 1 || p.streams > 16 {
+			err = fmt.Errorf("bad streams: %s", value)
+		}
+	case "load":
+		if value != "up" && value != "down" && value != "both" {
+			err = fmt.Errorf("expected up, down or both: %s", value)
+		}
+		p.load = value
+	case "reset":
+		*p = streamDefaults()
+	default:
+		err = fmt.Errorf("unknown setting: %s", line)
+	}
+	return
+}
+
+func (p *streamParams) text() []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "count %d\ninterval %s\nsize %d\ncodec %s\n", p.count, p.interval, p.size, p.codec)
+	if p.responder != "" {
+		fmt.Fprintf(buf, "responder %s\n", p.responder)
+	}
+	fmt.Fprintf(buf, "streams %d\nload %s\n", p.streams, p.load)
+	return buf.Bytes()
+}
+
+// streamCtl changes the host's stream, one setting per line
+func streamCtl(c *nopfs.Ctl, data []byte) (resp []byte, err error) {
+	path := c.GetPath()
+	if len(path) < 2 {
+		err = os.ErrInvalid
+		return
+	}
+	host := path[1]
+	streamHosts.Lock()
+	defer streamHosts.Unlock()
+	p, ok := streamHosts.params[host]
+	if !ok {
+		p = streamDefaults()
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if err = p.set(line); err != nil {
+			return
+		}
+	}
+	streamHosts.params[host] = p
+	return p.text(), nil
+}
+
+type streamResult struct {
+	stream *native.Stream
+	params streamParams
+	made   time.Time
+}
+
+var streams = struct {
+	sync.Mutex
+	m map[string]*streamResult
+}{m: make(map[string]*streamResult)}
+
+// getStream gives a stream sent to the host with its settings, sent
+// again if the last is more than Reuse old or they have changed
+func getStream(host string, v6 bool) (*native.Stream, streamParams, error) {
+	p := getStreamParams(host)
+	key := strings.ToLower(host) + " " + strconv.FormatBool(v6)
+	streams.Lock()
+	r, ok := streams.m[key]
+	streams.Unlock()
+	if ok && r.params == p && time.Since(r.made) < Reuse {
+		return r.stream, p, nil
+	}
+	st, err := native.EchoStream(host, v6, p.count, p.interval, p.size)
+	if err != nil {
+		return nil, p, err
+	}
+	streams.Lock()
+	streams.m[key] = &streamResult{stream: st, params: p, made: time.Now()}
+	streams.Unlock()
+	return st, p, nil
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// quality describes a stream, with times in milliseconds
+type quality struct {
+	sent, received, dups, reordered int
+	min, avg, max, mdev             float64
+	// Interarrival jitter as RFC 3550 estimates it, and the mean and
+	// largest difference in transit time of successive replies
+	jitter, ipdv, maxIPDV float64
+	// Runs of requests lost one after another
+	bursts, longest int
+	rtts            []float64
+}
+
+func (q *quality) loss() float64 {
+	if q.sent == 0 {
+		return 0
+	}
+	return 100 * float64(q.sent-q.received) / float64(q.sent)
+}
+
+func (q *quality) meanBurst() float64 {
+	if q.bursts == 0 {
+		return 0
+	}
+	return float64(q.sent-q.received) / float64(q.bursts)
+}
+
+// burstRatio gives BurstR of G.107, how much more lost packets bunch
+// together than they would if lost at random, from the chances of
+// going from received to lost and back again.
+func (q *quality) burstRatio() float64 {
+	lost := q.sent - q.received
+	if lost == 0 || q.received == 0 {
+		return 1
+	}
+	p := float64(q.bursts) / float64(q.received)
+	r := float64(q.bursts) / float64(lost)
+	return math.Max(1, 1/(p+r))
+}
+
+// percentile gives the smallest round trip time at least the fraction
+// of the others are no more than
+func (q *quality) percentile(f float64) float64 {
+	if len(q.rtts) == 0 {
+		return 0
+	}
+	return q.rtts[int(math.Ceil(f*float64(len(q.rtts))))-1]
+}
+
+func analyse(st *native.Stream) *quality {
+	q := &quality{sent: len(st.Echoes)}
+	var arrived []*native.Echo
+	run := 0
+	for i := range st.Echoes {
+		e := &st.Echoes[i]
+		q.dups += e.Dups
+		if e.Arrival == 0 {
+			if run == 0 {
+				q.bursts++
+			}
+			run++
+			if run > q.longest {
+				q.longest = run
+			}
+			continue
+		}
+		run = 0
+		arrived = append(arrived, e)
+		q.rtts = append(q.rtts, ms(e.RTT()))
+	}
+	q.received = len(arrived)
+	if q.received == 0 {
+		return q
+	}
+	sort.Float64s(q.rtts)
+	q.min, q.max = q.rtts[0], q.rtts[len(q.rtts)-1]
+	for _, r := range q.rtts {
+		q.avg += r
+	}
+	q.avg /= float64(q.received)
+	for _, r := range q.rtts {
+		q.mdev += math.Abs(r - q.avg)
+	}
+	q.mdev /= float64(q.received)
+
+	// The sender and receiver are the same, so the difference in
+	// transit time of two packets is that of their round trips.
+	sort.Slice(arrived, func(i, j int) bool { return arrived[i].Arrival < arrived[j].Arrival })
+	highest := -1
+	for i, e := range arrived {
+		if e.Seq < highest {
+			q.reordered++
+		} else {
+			highest = e.Seq
+		}
+		if i == 0 {
+			continue
+		}
+		d := math.Abs(ms(e.RTT()) - ms(arrived[i-1].RTT()))
+		q.jitter += (d - q.jitter) / 16
+		q.ipdv += d
+		if d > q.maxIPDV {
+			q.maxIPDV = d
+		}
+	}
+	if q.received > 1 {
+		q.ipdv /= float64(q.received - 1)
+	}
+	return q
+}
+
+// jitterF gives the function for a file describing the variation in
+// delay, loss and reordering of a stream sent to the host over IPv4 or
+// IPv6
+func jitterF(v6 bool) func(string) ([]byte, error) {
+	return func(host string) ([]byte, error) {
+		st, p, err := getStream(host, v6)
+		if err != nil {
+			return nil, err
+		}
+		q := analyse(st)
+		buf := &bytes.Buffer{}
+		fmt.Fprintf(buf, "target      %s\n", st.Target)
+		fmt.Fprintf(buf, "sent        %d of %d bytes every %s\n", q.sent, p.size, p.interval)
+		fmt.Fprintf(buf, "received    %d, %d duplicates\n", q.received, q.dups)
+		fmt.Fprintf(buf, "lost        %d (%.1f%%)\n", q.sent-q.received, q.loss())
+		if q.received == 0 {
+			return buf.Bytes(), nil
+		}
+		fmt.Fprintf(buf, "bursts      %d, longest %d, mean %.1f\n", q.bursts, q.longest, q.meanBurst())
+		fmt.Fprintf(buf, "reordered   %d (%.1f%%)\n", q.reordered, 100*float64(q.reordered)/float64(q.received))
+		fmt.Fprintf(buf, "rtt         min/avg/max/mdev %.3f/%.3f/%.3f/%.3f ms\n", q.min, q.avg, q.max, q.mdev)
+		fmt.Fprintf(buf, "jitter      %.3f ms\n", q.jitter)
+		fmt.Fprintf(buf, "ipdv        mean %.3f ms, max %.3f ms\n", q.ipdv, q.maxIPDV)
+		return buf.Bytes(), nil
+	}
+}
+
+// rating gives the user satisfaction G.107 gives for the R factor
+func rating(r float64) string {
+	switch {
+	case r >= 90:
+		return "very satisfied"
+	case r >= 80:
+		return "satisfied"
+	case r >= 70:
+		return "some users dissatisfied"
+	case r >= 60:
+		return "many users dissatisfied"
+	case r >= 50:
+		return "nearly all users dissatisfied"
+	}
+	return "not recommended"
+}
+
+// mosF gives the function for a file estimating the mean opinion score
+// of a call carried like the stream sent to the host, by the E-model
+// of ITU-T G.107 with default values for all but the delay, loss and
+// codec.
+func mosF(v6 bool) func(string) ([]byte, error) {
+	return func(host string) ([]byte, error) {
+		st, p, err := getStream(host, v6)
+		if err != nil {
+			return nil, err
+		}
+		q := analyse(st)
+		if q.received == 0 {
+			return nil, fmt.Errorf("no echo replies from %s", st.Target)
+		}
+		c := codecs[p.codec]
+		// The jitter buffer is taken to hold twice the jitter
+		buffer := 2 * q.jitter
+		delay := q.avg/2 + buffer + ms(c.delay)
+		id := 0.024 * delay
+		if delay > 177.3 {
+			id += 0.11 * (delay - 177.3)
+		}
+		ppl, burstR := q.loss(), q.burstRatio()
+		ie := c.ie + (95-c.ie)*ppl/(ppl/burstR+c.bpl)
+		r := 93.2 - id - ie
+		mos := 1.0
+		switch {
+		case r >= 100:
+			mos = 4.5
+		case r > 0:
+			mos = 1 + 0.035*r + 7e-6*r*(r-60)*(100-r)
+		}
+		buf := &bytes.Buffer{}
+		fmt.Fprintf(buf, "mos         %.2f\n", mos)
+		fmt.Fprintf(buf, "r           %.1f, %s\n", r, rating(r))
+		fmt.Fprintf(buf, "codec       %s\n", p.codec)
+		fmt.Fprintf(buf, "delay       %.1f ms one way, with %.1f ms network, %.1f ms jitter buffer and %.1f ms codec\n",
+			delay, q.avg/2, buffer, ms(c.delay))
+		fmt.Fprintf(buf, "loss        %.1f%%, burst ratio %.2f\n", ppl, burstR)
+		fmt.Fprintf(buf, "impairment  delay %.1f, equipment %.1f\n", id, ie)
+		return buf.Bytes(), nil
+	}
+}
+
+// grade marks the rise in latency under load as the DSLReports
+// bufferbloat test does
+func grade(rise float64) string {
+	switch {
+	case rise < 5:
+		return "A+"
+	case rise < 30:
+		return "A"
+	case rise < 60:
+		return "B"
+	case rise < 200:
+		return "C"
+	case rise < 400:
+		return "D"
+	}
+	return "F"
+}
+
+// rate gives bytes moved over the time as a bit rate
+func rate(n int64, d time.Duration) string {
+	bits := 8 * float64(n) / d.Seconds()
+	switch {
+	case bits >= 1e9:
+		return fmt.Sprintf("%.2f Gbit/s", bits/1e9)
+	case bits >= 1e6:
+		return fmt.Sprintf("%.2f Mbit/s", bits/1e6)
+	}
+	return fmt.Sprintf("%.0f kbit/s", bits/1e3)
+}
+
+// bufferbloatF gives the function for a file comparing the latency to
+// the host when the link is idle with that while it is loaded by
+// transfers to and from a cooperating responder.
+func bufferbloatF(v6 bool) func(string) ([]byte, error) {
+	return func(host string) ([]byte, error) {
+		p := getStreamParams(host)
+		responder, err := chosenResponder(p.responder)
+		if err != nil {
+			return nil, fmt.Errorf("load: %s", err)
+		}
+		idle, err := native.EchoStream(host, v6, p.count, p.interval, p.size)
+		if err != nil {
+			return nil, err
+		}
+		l, err := startLoad(responder, p.streams, p.load)
+		if err != nil {
+			return nil, fmt.Errorf("load: %s", err)
+		}
+		time.Sleep(LoadWarmup)
+		loaded, err := native.EchoStream(host, v6, p.count, p.interval, p.size)
+		up, down, elapsed := l.stop()
+		if err != nil {
+			return nil, err
+		}
+		qi, ql := analyse(idle), analyse(loaded)
+		if qi.received == 0 {
+			return nil, fmt.Errorf("no echo replies from %s", idle.Target)
+		}
+		if ql.received == 0 && up+down == 0 {
+			return nil, errors.New("load: nothing sent or received")
+		}
+		buf := &bytes.Buffer{}
+		fmt.Fprintf(buf, "target      %s\n", idle.Target)
+		fmt.Fprintf(buf, "responder   %s, %d streams %s\n", responder, p.streams, p.load)
+		line := func(name string, q *quality) {
+			fmt.Fprintf(buf, "%-11s rtt median %.3f ms, p95 %.3f ms, loss %.1f%%\n",
+				name, q.percentile(0.5), q.percentile(0.95), q.loss())
+		}
+		line("idle", qi)
+		line("loaded", ql)
+		if p.load != "down" {
+			fmt.Fprintf(buf, "upload      %s\n", rate(up, elapsed))
+		}
+		if p.load != "up" {
+			fmt.Fprintf(buf, "download    %s\n", rate(down, elapsed))
+		}
+		if ql.received == 0 {
+			fmt.Fprintf(buf, "grade       F, all echo requests lost under load\n")
+			return buf.Bytes(), nil
+		}
+		rise := ql.percentile(0.5) - qi.percentile(0.5)
+		fmt.Fprintf(buf, "increase    %.3f ms\n", rise)
+		fmt.Fprintf(buf, "grade       %s\n", grade(rise))
+		return buf.Bytes(), nil
+	}
+}
+
+var Jitter nopfs.Dispatcher = nopfs.NewFun(nopfs.HostF(jitterF(false))).Limit("jitter")
+var Jitter6 nopfs.Dispatcher = nopfs.NewFun(nopfs.HostF(jitterF(true))).Limit("jitter")
+var MOS nopfs.Dispatcher = nopfs.NewFun(nopfs.HostF(mosF(false))).Limit("jitter")
+var MOS6 nopfs.Dispatcher = nopfs.NewFun(nopfs.HostF(mosF(true))).Limit("jitter")
+var Bufferbloat nopfs.Dispatcher = nopfs.NewFun(nopfs.HostF(bufferbloatF(false))).Limit("bufferbloat")
+var Bufferbloat6 nopfs.Dispatcher = nopfs.NewFun(nopfs.HostF(bufferbloatF(true))).Limit("bufferbloat")
+var Stream nopfs.Dispatcher = &nopfs.Ctl{Writer: streamCtl}
@@ -0,0 +1,242 @@
+package ipnet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/rminnich/go9p"
+	"hubs.net.uk/sw/nopfs"
+	"hubs.net.uk/sw/nopfs/dns"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+var readme_net = `
+Network operations
+==================
+
+Operations that may be done on a whole network, named by its address
+and prefix length. As with hosts, it suffices to change into the
+subdirectory for the network, which will not appear in a listing,
+for example
+
+  % cat 192.0.2.0/24/ptr
+  % cat 2001:db8::/120/fcrdns
+
+  n/p/ptr      The names of every address in the network that has
+               one, found by reverse look up
+  n/p/fcrdns   Forward-confirmed reverse DNS, looking up each of the
+               names found and checking that it resolves back to the
+               address, flagging any that do not
+
+Networks of at most 4096 addresses may be looked up, with up to 32
+queries at a time. A particular name server may be used by descending
+into a directory named after it, as in 192.0.2.0/24/@192.0.2.53/ptr.
+
+`
+var Readme nopfs.Dispatcher = nopfs.NewFile([]byte(readme_net))
+
+// The largest network that may be looked up
+var MaxAddrs = 4096
+
+// The number of look ups done at a time
+var Concurrency = 32
+
+var ErrTooLarge = errors.New("network too large")
+
+// NetDir contains a directory for every network address besides its
+// own entries. These are not listed.
+type NetDir struct {
+	*nopfs.Dir
+}
+
+func (d *NetDir) Clone() nopfs.Dispatcher {
+	return &NetDir{d.Dir.Clone().(*nopfs.Dir)}
+}
+
+func (d *NetDir) Walk(req *go9p.SrvReq, name string) (nopfs.Dispatcher, error) {
+	if net.ParseIP(name) == nil {
+		return d.Dir.Walk(req, name)
+	}
+	n := &prefixDir{}
+	n.SetPath(append(append([]string{}, d.GetPath()...), name))
+	n.SetParent(d)
+	return n, nil
+}
+
+// prefixDir is the directory for a network address, containing a
+// directory for each valid prefix length. These are not listed.
+type prefixDir struct {
+	nopfs.Path
+}
+
+func (d *prefixDir) IsDir() bool                       { return true }
+func (d *prefixDir) Perms() uint32                     { return 0555 }
+func (d *prefixDir) Size() uint64                      { return uint64(0) }
+func (d *prefixDir) Write(*go9p.SrvReq, []byte) error  { return os.ErrInvalid }
+func (d *prefixDir) Read(*go9p.SrvReq) ([]byte, error) { return []byte{}, nil }
+func (d *prefixDir) Close()                            {}
+func (d *prefixDir) Flush(*go9p.SrvReq)                {}
+
+func (d *prefixDir) Clone() nopfs.Dispatcher {
+	n := &prefixDir{}
+	n.SetPath(d.GetPath())
+	n.SetParent(d.GetParent())
+	return n
+}
+
+func (d *prefixDir) Walk(req *go9p.SrvReq, name string) (nopfs.Dispatcher, error) {
+	path := d.GetPath()
+	if len(path) < 2 {
+		return nil, os.ErrNotExist
+	}
+	if _, _, err := net.ParseCIDR(path[1] + "/" + name); err != nil {
+		return nil, os.ErrNotExist
+	}
+	n := Prefix.Clone()
+	n.SetPath(append(append([]string{}, path...), name))
+	n.SetParent(d)
+	return n, nil
+}
+
+// NetF adapts a function taking a network and the name server to use
+// to one that takes the path of a file.
+func NetF(f func(network *net.IPNet, server string) ([]byte, error)) func([]string) ([]byte, error) {
+	return func(path []string) ([]byte, error) {
+		_, network, err := net.ParseCIDR(path[1] + "/" + path[2])
+		if err != nil {
+			return nil, os.ErrNotExist
+		}
+		return f(network, dns.ServerOf(path))
+	}
+}
+
+// addrs lists the addresses in the network
+func addrs(network *net.IPNet) (ips []net.IP, err error) {
+	ones, bits := network.Mask.Size()
+	if bits-ones >= 31 || 1<<uint(bits-ones) > MaxAddrs {
+		err = fmt.Errorf("%s: %d addresses at most", ErrTooLarge, MaxAddrs)
+		return
+	}
+	ip := network.IP.Mask(network.Mask)
+	for i := 0; i < 1<<uint(bits-ones); i++ {
+		ips = append(ips, ip)
+		next := make(net.IP, len(ip))
+		copy(next, ip)
+		for j := len(next) - 1; j >= 0; j-- {
+			next[j]++
+			if next[j] != 0 {
+				break
+			}
+		}
+		ip = next
+	}
+	return
+}
+
+// forEach calls the function for each address in the network, a few
+// at a time, giving the results in the order of the addresses.
+func forEach(network *net.IPNet, f func(ip string) []string) (results [][]string, ips []net.IP, err error) {
+	ips, err = addrs(network)
+	if err != nil {
+		return
+	}
+	results = make([][]string, len(ips))
+	sem := make(chan bool, Concurrency)
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		wg.Add(1)
+		sem <- true
+		go func(i int, ip string) {
+			defer wg.Done()
+			results[i] = f(ip)
+			<-sem
+		}(i, ip.String())
+	}
+	wg.Wait()
+	return
+}
+
+func ptr(network *net.IPNet, server string) (data []byte, err error) {
+	names, ips, err := forEach(network, func(ip string) []string {
+		names, _ := dns.LookupAddr(ip, server)
+		return names
+	})
+	if err != nil {
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	w := tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+	for i := range ips {
+		for _, name := range names[i] {
+			fmt.Fprintf(w, "%s\t%s\n", ips[i], name)
+		}
+	}
+	w.Flush()
+	data = buf.Bytes()
+	return
+}
+
+var PTR nopfs.Dispatcher = nopfs.NewFun(NetF(ptr)).Limit("netscan")
+
+// fcrdns looks up the names of each address and then the addresses of
+// each name, giving a line for each name with its status.
+func fcrdns(network *net.IPNet, server string) (data []byte, err error) {
+	lines, ips, err := forEach(network, func(ip string) (lines []string) {
+		names, _ := dns.LookupAddr(ip, server)
+		for _, name := range names {
+			addrs, e := dns.LookupHost(name, server)
+			status := "mismatch, resolves to " + strings.Join(addrs, " ")
+			switch {
+			case e != nil:
+				status = "mismatch, does not resolve"
+			case confirms(ip, addrs):
+				status = "ok"
+			}
+			lines = append(lines, fmt.Sprintf("%s\t%s\t%s", ip, name, status))
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	w := tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+	for i := range ips {
+		for _, line := range lines[i] {
+			fmt.Fprintln(w, line)
+		}
+	}
+	w.Flush()
+	data = buf.Bytes()
+	return
+}
+
+func confirms(ip string, addrs []string) bool {
+	want := net.ParseIP(ip)
+	for _, a := range addrs {
+		if want.Equal(net.ParseIP(a)) {
+			return true
+		}
+	}
+	return false
+}
+
+var FCrDNS nopfs.Dispatcher = nopfs.NewFun(NetF(fcrdns)).Limit("netscan")
+
+var Prefix *dns.ResolverDir
+var Dir *NetDir
+
+func init() {
+	Prefix = dns.NewResolverDir()
+	Prefix.Append("ptr", PTR)
+	Prefix.Append("fcrdns", FCrDNS)
+
+	Dir = &NetDir{nopfs.NewDir()}
+	Dir.Append("README.txt", Readme)
+}
@@ -0,0 +1,160 @@
+package ipnet
+
+import (
+	"fmt"
+	"hubs.net.uk/sw/nopfs/dns"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func mustNet(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return network
+}
+
+func TestAddrs(t *testing.T) {
+	tests := []struct {
+		cidr        string
+		n           int
+		first, last string
+		err         bool
+	}{
+		{"192.0.2.0/30", 4, "192.0.2.0", "192.0.2.3", false},
+		{"192.0.2.77/32", 1, "192.0.2.77", "192.0.2.77", false},
+		// The host part is cleared and the count carries between octets
+		{"192.0.2.130/23", 512, "192.0.2.0", "192.0.3.255", false},
+		{"2001:db8::ff/120", 256, "2001:db8::", "2001:db8::ff", false},
+		{"10.0.0.0/19", 0, "", "", true},
+		{"2001:db8::/64", 0, "", "", true},
+	}
+	for _, test := range tests {
+		ips, err := addrs(mustNet(t, test.cidr))
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.cidr, err)
+			continue
+		}
+		if test.err {
+			continue
+		}
+		if len(ips) != test.n || ips[0].String() != test.first || ips[len(ips)-1].String() != test.last {
+			t.Errorf("%s: got %d addresses, %s to %s", test.cidr, len(ips), ips[0], ips[len(ips)-1])
+		}
+	}
+}
+
+func TestForEach(t *testing.T) {
+	defer func(n int) { Concurrency = n }(Concurrency)
+	Concurrency = 4
+	var running, most int32
+	results, ips, err := forEach(mustNet(t, "192.0.2.0/26"), func(ip string) []string {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return []string{ip}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if most > int32(Concurrency) {
+		t.Errorf("%d run at once, more than %d", most, Concurrency)
+	}
+	for i := range ips {
+		if len(results[i]) != 1 || results[i][0] != ips[i].String() {
+			t.Errorf("result %d for %s is %v", i, ips[i], results[i])
+		}
+	}
+}
+
+// standIn answers queries over UDP with the records given in zone file
+// form whose name and type match the question
+func standIn(t *testing.T, lines ...string) string {
+	t.Helper()
+	var rrs []dns.RR
+	for _, line := range lines {
+		rr, err := dns.ParseRR(line, ".", 300)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q, err := dns.Unpack(buf[:n])
+			if err != nil || len(q.Question) != 1 {
+				continue
+			}
+			r := &dns.Msg{Header: dns.Header{Id: q.Id, Response: true}, Question: q.Question}
+			for _, rr := range rrs {
+				if strings.EqualFold(rr.Name, q.Question[0].Name) && rr.Type == q.Question[0].Type {
+					r.Answer = append(r.Answer, rr)
+				}
+			}
+			if wire, err := r.Pack(); err == nil {
+				pc.WriteTo(wire, from)
+			}
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestPTRAndFCrDNS(t *testing.T) {
+	server := standIn(t,
+		"0.2.0.192.in-addr.arpa. 300 IN PTR net.example.com.",
+		"1.2.0.192.in-addr.arpa. 300 IN PTR ok.example.com.",
+		"1.2.0.192.in-addr.arpa. 300 IN PTR other.example.com.",
+		"2.2.0.192.in-addr.arpa. 300 IN PTR gone.example.com.",
+		"ok.example.com. 300 IN A 192.0.2.1",
+		"other.example.com. 300 IN A 192.0.2.9",
+		"net.example.com. 300 IN AAAA 2001:db8::1",
+	)
+	network := mustNet(t, "192.0.2.0/30")
+
+	data, err := ptr(network, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "192.0.2.0  net.example.com.\n" +
+		"192.0.2.1  ok.example.com.\n" +
+		"192.0.2.1  other.example.com.\n" +
+		"192.0.2.2  gone.example.com.\n"
+	if string(data) != want {
+		t.Errorf("ptr: got\n%s\nwant\n%s", data, want)
+	}
+
+	data, err = fcrdns(network, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = fmt.Sprint(
+		"192.0.2.0  net.example.com.    mismatch, resolves to 2001:db8::1\n",
+		"192.0.2.1  ok.example.com.     ok\n",
+		"192.0.2.1  other.example.com.  mismatch, resolves to 192.0.2.9\n",
+		"192.0.2.2  gone.example.com.   mismatch, does not resolve\n",
+	)
+	if string(data) != want {
+		t.Errorf("fcrdns: got\n%s\nwant\n%s", data, want)
+	}
+}
@@ -0,0 +1,205 @@
+package nopfs
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Addrs is a list of listen addresses that may be given more than once
+// on the command line. Each is either a Go style host:port for TCP or
+// a Plan 9 style dial string such as tcp!*!5640, tcp6!::1!5640 or
+// unix!/run/nopfs.sock.
+type Addrs []string
+
+func (a *Addrs) String() string {
+	return strings.Join(*a, ",")
+}
+
+func (a *Addrs) Set(addr string) error {
+	*a = append(*a, addr)
+	return nil
+}
+
+// Ownership and permissions given to unix domain sockets
+type SocketConfig struct {
+	Mode os.FileMode
+	Uid  int
+	Gid  int
+}
+
+// ParseOwner parses user[:group] into numeric ids, where either may be
+// given by name or number. An empty string leaves ownership unchanged.
+func ParseOwner(owner string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if owner == "" {
+		return
+	}
+	parts := strings.SplitN(owner, ":", 2)
+	if parts[0] != "" {
+		uid, err = strconv.Atoi(parts[0])
+		if err != nil {
+			var u *user.User
+			u, err = user.Lookup(parts[0])
+			if err != nil {
+				return
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+			gid, _ = strconv.Atoi(u.Gid)
+		}
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		gid, err = strconv.Atoi(parts[1])
+		if err != nil {
+			var g *user.Group
+			g, err = user.LookupGroup(parts[1])
+			if err != nil {
+				return
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return
+}
+
+// SplitAddr converts a dial string such as tcp!192.0.2.1!5640, or a
+// plain host:port for TCP, into the network and address expected by
+// net.Listen and net.Dial.
+func SplitAddr(addr string) (network, address string, err error) {
+	if !strings.Contains(addr, "!") {
+		return "tcp", addr, nil
+	}
+	parts := strings.Split(addr, "!")
+	network = parts[0]
+	switch network {
+	case "unix":
+		if len(parts) != 2 || parts[1] == "" {
+			err = fmt.Errorf("%s: expected unix!path", addr)
+			return
+		}
+		address = parts[1]
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+		if len(parts) != 3 {
+			err = fmt.Errorf("%s: expected %s!host!port", addr, network)
+			return
+		}
+		host := parts[1]
+		if host == "*" {
+			host = ""
+		}
+		address = net.JoinHostPort(host, parts[2])
+	default:
+		err = fmt.Errorf("%s: unsupported network %s", addr, network)
+	}
+	return
+}
+
+// removeStale removes a unix domain socket left behind by a previous
+// run, refusing if anything is still listening on it or if the path is
+// not a socket.
+func removeStale(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s: exists and is not a socket", path)
+	}
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		c.Close()
+		return fmt.Errorf("%s: already in use", path)
+	}
+	return os.Remove(path)
+}
+
+// Listen opens a listener for the address. Unix domain sockets are
+// given the ownership and mode in cfg, and a stale socket left behind
+// by a previous run is removed first.
+func Listen(addr string, cfg *SocketConfig) (l net.Listener, err error) {
+	network, address, err := SplitAddr(addr)
+	if err != nil {
+		return
+	}
+	if strings.HasPrefix(network, "udp") {
+		err = fmt.Errorf("%s: unsupported network %s", addr, network)
+		return
+	}
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	if err = removeStale(address); err != nil {
+		return
+	}
+	// The socket is made accessible to its owner alone until it has
+	// been given its ownership and mode. The umask is that of the
+	// whole process, but listeners are opened before any requests are
+	// served.
+	old := syscall.Umask(0177)
+	l, err = net.Listen(network, address)
+	syscall.Umask(old)
+	if err != nil || cfg == nil {
+		return
+	}
+	if cfg.Uid != -1 || cfg.Gid != -1 {
+		err = os.Chown(address, cfg.Uid, cfg.Gid)
+	}
+	if err == nil && cfg.Mode != 0 {
+		err = os.Chmod(address, cfg.Mode)
+	}
+	if err != nil {
+		l.Close()
+		l = nil
+	}
+	return
+}
+
+// ListenAll opens listeners for all of the addresses, closing any that
+// were opened if one of them fails.
+func ListenAll(addrs []string, cfg *SocketConfig) (listeners []net.Listener, err error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no listen addresses")
+	}
+	for _, addr := range addrs {
+		var l net.Listener
+		l, err = Listen(addr, cfg)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return
+}
+
+// OpenListeners gives the listeners passed by systemd or, failing
+// those, listeners for the addresses, or for def if none were given.
+// Unix domain sockets are given the mode, in octal, and the owner, as
+// user[:group].
+func OpenListeners(addrs []string, def, mode, owner string) ([]net.Listener, error) {
+	listeners, err := SdListeners()
+	if err != nil || len(listeners) > 0 {
+		return listeners, err
+	}
+	if len(addrs) == 0 {
+		addrs = []string{def}
+	}
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("sockmode: %s", err)
+	}
+	cfg := &SocketConfig{Mode: os.FileMode(m)}
+	cfg.Uid, cfg.Gid, err = ParseOwner(owner)
+	if err != nil {
+		return nil, fmt.Errorf("sockowner: %s", err)
+	}
+	return ListenAll(addrs, cfg)
+}
@@ -0,0 +1,237 @@
+package nopfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelError Level = iota
+	LevelInfo
+	LevelDebug
+)
+
+var levelNames = []string{"error", "info", "debug"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(name string) (Level, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for i, n := range levelNames {
+		if n == name {
+			return Level(i), nil
+		}
+	}
+	return LevelError, fmt.Errorf("unknown log level: %q", name)
+}
+
+// Logger writes structured records, one per line, either as logfmt
+// key=value pairs or as JSON objects. Each record carries the time,
+// level and message followed by the key/value pairs given by the
+// caller.
+type Logger struct {
+	lock  sync.Mutex
+	out   io.Writer
+	json  bool
+	level Level
+}
+
+func NewLogger(out io.Writer, format string) (*Logger, error) {
+	l := &Logger{out: out, level: LevelInfo}
+	switch format {
+	case "", "logfmt":
+	case "json":
+		l.json = true
+	default:
+		return nil, fmt.Errorf("unknown log format: %q", format)
+	}
+	return l, nil
+}
+
+// The server log, for requests and errors
+var Log = &Logger{out: os.Stderr, level: LevelInfo}
+
+// The audit log, recording changes made through Ctl files and commands
+// run on behalf of clients. By default this is the server log.
+var Audit = Log
+
+func (l *Logger) Level() Level {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.level
+}
+
+func (l *Logger) SetLevel(level Level) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.level = level
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level <= l.Level()
+}
+
+func (l *Logger) Error(msg string, kv ...interface{}) { l.Log(LevelError, msg, kv...) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.Log(LevelInfo, msg, kv...) }
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.Log(LevelDebug, msg, kv...) }
+
+// Log writes a record if the level is enabled. The arguments after the
+// message are alternating keys and values. Values that are nil are
+// omitted.
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	fields := make([]interface{}, 0, len(kv)+6)
+	fields = append(fields, "time", time.Now().UTC().Format(time.RFC3339Nano))
+	fields = append(fields, "level", level.String(), "msg", msg)
+	fields = append(fields, kv...)
+
+	buf := &bytes.Buffer{}
+	if l.json {
+		buf.WriteByte('{')
+	}
+	first := true
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i+1] == nil {
+			continue
+		}
+		key := fmt.Sprint(fields[i])
+		val := logValue(fields[i+1])
+		if !first {
+			if l.json {
+				buf.WriteByte(',')
+			} else {
+				buf.WriteByte(' ')
+			}
+		}
+		first = false
+		if l.json {
+			k, _ := json.Marshal(key)
+			buf.Write(k)
+			buf.WriteByte(':')
+			buf.Write(jsonValue(val))
+		} else {
+			buf.WriteString(key)
+			buf.WriteByte('=')
+			buf.WriteString(logfmtValue(val))
+		}
+	}
+	if l.json {
+		buf.WriteByte('}')
+	}
+	buf.WriteByte('\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.out.Write(buf.Bytes())
+}
+
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	case []byte:
+		return string(v)
+	}
+	return v
+}
+
+func jsonValue(v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return b
+}
+
+func logfmtValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n\\") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// LogLevelCtl is the writer for a Ctl file that changes the level of
+// the server log. Writing a level name sets it and writing nothing
+// reports the current level.
+func LogLevelCtl(c *Ctl, data []byte) (resp []byte, err error) {
+	name := strings.TrimSpace(string(data))
+	if name != "" {
+		var level Level
+		level, err = ParseLevel(name)
+		if err != nil {
+			return
+		}
+		Log.SetLevel(level)
+	}
+	resp = []byte(Log.Level().String() + "\n")
+	return
+}
+
+// The file the audit log is kept in, if not the server log
+var auditFile *os.File
+
+// ConfigureLogs sets up the server and audit logs from command line
+// options. Audit records go to the named file, opened for appending,
+// or to the server log if the name is empty.
+func ConfigureLogs(format, level, audit string) (err error) {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return
+	}
+	Log, err = NewLogger(os.Stderr, format)
+	if err != nil {
+		return
+	}
+	Log.SetLevel(lvl)
+	Audit = Log
+
+	if audit != "" {
+		var f *os.File
+		f, err = os.OpenFile(audit, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return
+		}
+		Audit, _ = NewLogger(f, format)
+		auditFile = f
+	}
+	return
+}
+
+// CloseLogs writes the audit log out to disk and closes its file,
+// sending any later records to the server log. It is run once the
+// server has shut down.
+func CloseLogs() {
+	if auditFile == nil {
+		return
+	}
+	Audit.lock.Lock()
+	defer Audit.lock.Unlock()
+	if err := auditFile.Sync(); err != nil {
+		Log.Error("audit", "error", err)
+	}
+	auditFile.Close()
+	auditFile = nil
+	Audit.out = os.Stderr
+}
@@ -2,58 +2,109 @@ package nopfs
 
 import (
 	"errors"
+	"fmt"
 	"github.com/rminnich/go9p"
-	"log"
 	"syscall"
+	"time"
 )
 
 type NopSrv struct {
 	go9p.Srv
 	DebugLevel int
 	Root       Dispatcher
+	life       lifecycle
+}
+
+// A request being handled, recorded for the access log
+type request struct {
+	req   *go9p.SrvReq
+	op    string
+	path  string
+	start time.Time
+	err   error
+}
+
+// fail records the error against the request and responds with it
+func (r *request) fail(err error) {
+	r.err = err
+	r.req.RespondError(toError(err))
+}
+
+// Reads and writes are logged at info level, the rest only when
+// debugging.
+func (r *request) level() Level {
+	if r.op == "read" || r.op == "write" || r.err != nil {
+		return LevelInfo
+	}
+	return LevelDebug
+}
+
+func fidPath(fid *go9p.SrvFid) string {
+	if fid == nil {
+		return ""
+	}
+	if d, ok := fid.Aux.(Dispatcher); ok {
+		return fmt.Sprint(d)
+	}
+	return ""
 }
 
 func (sfs *NopSrv) Attach(req *go9p.SrvReq) {
+	r, err := sfs.enter(req, "attach")
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+	defer sfs.leave(r)
+
 	if req.Afid != nil {
+		r.err = go9p.Enoauth
 		req.RespondError(go9p.Enoauth)
 		return
 	}
 
+	setConnUser(req.Conn, req.Tc.Uname)
+	connFids(req.Conn, 1)
 	req.Fid.Aux = sfs.Root
-	if sfs.Debuglevel > 0 {
-		log.Printf("attach")
-	}
-
 	req.RespondRattach(Qid(sfs.Root))
 }
 
 func (sfs *NopSrv) Stat(req *go9p.SrvReq) {
-	fid := req.Fid.Aux.(Dispatcher)
-	if sfs.Debuglevel > 0 {
-		log.Printf("stat %s", fid)
+	r, err := sfs.enter(req, "stat")
+	if err != nil {
+		req.RespondError(toError(err))
+		return
 	}
+	defer sfs.leave(r)
+
+	fid := req.Fid.Aux.(Dispatcher)
 	req.RespondRstat(Fstat(fid))
 }
 
 func (sfs *NopSrv) Walk(req *go9p.SrvReq) {
+	r, err := sfs.enter(req, "walk")
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+	defer sfs.leave(r)
+
 	fid := req.Fid.Aux.(Dispatcher)
 	tc := req.Tc
 
-	if sfs.Debuglevel > 0 {
-		log.Printf("walk %s %s", fid, tc.Wname)
-	}
-
 	if req.Newfid.Aux == nil {
 		req.Newfid.Aux = fid.Clone()
+		connFids(req.Conn, 1)
 	}
 
 	if len(tc.Wname) == 0 {
 		w := make([]go9p.Qid, 0)
 		req.RespondRwalk(w)
 	} else {
+		r.path = fmt.Sprintf("%s/%s", fid, tc.Wname[0])
 		nfid, err := fid.Walk(req, tc.Wname[0])
 		if err != nil {
-			req.RespondError(toError(err))
+			r.fail(err)
 			return
 		}
 		req.Newfid.Aux = nfid
@@ -63,25 +114,32 @@ func (sfs *NopSrv) Walk(req *go9p.SrvReq) {
 }
 
 func (sfs *NopSrv) Open(req *go9p.SrvReq) {
-	fid := req.Fid.Aux.(Dispatcher)
-	if sfs.Debuglevel > 0 {
-		log.Printf("open %s", fid)
+	r, err := sfs.enter(req, "open")
+	if err != nil {
+		req.RespondError(toError(err))
+		return
 	}
+	defer sfs.leave(r)
+
+	fid := req.Fid.Aux.(Dispatcher)
 	req.RespondRopen(Qid(fid), 0)
 }
 
 func (sfs *NopSrv) Read(req *go9p.SrvReq) {
+	r, err := sfs.enter(req, "read")
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+	defer sfs.leave(r)
+
 	fid := req.Fid.Aux.(Dispatcher)
 	tc := req.Tc
 	rc := req.Rc
 
-	if sfs.Debuglevel > 0 {
-		log.Printf("read %T %s %d:%d", fid, fid, tc.Offset, tc.Count)
-	}
-
 	buf, err := fid.Read(req)
 	if err != nil {
-		req.RespondError(toError(err))
+		r.fail(err)
 		return
 	}
 
@@ -98,6 +156,7 @@ func (sfs *NopSrv) Read(req *go9p.SrvReq) {
 
 	copy(rc.Data, buf[tc.Offset:int(tc.Offset)+count])
 	go9p.SetRreadCount(rc, uint32(count))
+	connBytes(req.Conn, count, 0)
 	req.Respond()
 }
 
@@ -115,15 +174,16 @@ func toError(err error) *go9p.Error {
 }
 
 func (s *NopSrv) ConnOpened(conn *go9p.Conn) {
-	if conn.Srv.Debuglevel > 0 {
-		log.Println("connected")
-	}
+	ci := connOpened(conn)
+	Log.Info("connected", "conn", ci.Id, "remote", ci.Remote)
 	s.Debuglevel = conn.Srv.Debuglevel
 }
 
 func (*NopSrv) ConnClosed(conn *go9p.Conn) {
-	if conn.Srv.Debuglevel > 0 {
-		log.Println("disconnected")
+	ci := connClosed(conn)
+	if ci != nil {
+		Log.Info("disconnected", "conn", ci.Id, "remote", ci.Remote,
+			"user", ci.User, "duration", time.Since(ci.Opened))
 	}
 }
 
@@ -132,38 +192,45 @@ func (sfs *NopSrv) FidDestroy(sfid *go9p.SrvFid) {
 		return
 	}
 	fid := sfid.Aux.(Dispatcher)
-	if sfs.Debuglevel > 0 {
-		log.Printf("destroy %s", fid)
-	}
+	Log.Debug("destroy", "path", fid)
+	connFids(sfid.Fconn, -1)
 	fid.Close()
 }
 
 func (sfs *NopSrv) Flush(req *go9p.SrvReq) {
 	fid := req.Fid.Aux.(Dispatcher)
-	if sfs.Debuglevel > 0 {
-		log.Printf("flush %s", fid)
-	}
+	Log.Debug("flush", append(ReqFields(req), "path", fid)...)
 	fid.Flush(req)
 }
 
 func (*NopSrv) Create(req *go9p.SrvReq) {
-	log.Printf("create: %p", req)
+	Log.Info("create", append(ReqFields(req), "path", fidPath(req.Fid),
+		"name", req.Tc.Name, "error", "not supported")...)
 	req.RespondError(errors.New("create: ..."))
 }
 
 func (sfs *NopSrv) Write(req *go9p.SrvReq) {
+	r, err := sfs.enter(req, "write")
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+	defer sfs.leave(r)
+
 	fid := req.Fid.Aux.(Dispatcher)
 	tc := req.Tc
-	if sfs.Debuglevel > 0 {
-		log.Printf("write: %f", fid)
-	}
 
+	// What was written is left out, as it may be a secret such as a
+	// key or an Authorization header
 	e := fid.Write(req, tc.Data)
+	Audit.Info("write", append(ReqFields(req), "path", r.path,
+		"bytes", len(tc.Data), "error", e)...)
 	if e != nil {
-		req.RespondError(toError(e))
+		r.fail(e)
 		return
 	}
 
+	connBytes(req.Conn, 0, len(tc.Data))
 	req.RespondRwrite(uint32(len(tc.Data)))
 }
 
@@ -172,7 +239,8 @@ func (*NopSrv) Clunk(req *go9p.SrvReq) {
 }
 
 func (*NopSrv) Remove(req *go9p.SrvReq) {
-	log.Printf("remove: %p", req)
+	Log.Info("remove", append(ReqFields(req), "path", fidPath(req.Fid),
+		"error", "not supported")...)
 	req.RespondError(errors.New("remove: ..."))
 }
 
@@ -0,0 +1,387 @@
+package notify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/rminnich/go9p"
+	"hubs.net.uk/sw/nopfs"
+	"hubs.net.uk/sw/nopfs/alerts"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var readme_notify = `
+Notifications
+=============
+
+This directory sends the changes of state of alerts to sinks, chosen
+by routes matching the path the rule watches and how severe the change
+is.
+
+  sinks       The sinks in force, one per line, with the paths of
+              webhook URLs left out
+  routes      Write routes, one per line, and read back those in force
+  test        Write the name of a sink to send it a test notification,
+              limited in the notify class
+  log         Each notification sent, or why it could not be, up to
+              the last 1000
+
+A sink is written as "name type target...", where the type is one of
+
+  webhook url        POST the change as JSON to the URL, trying again
+                     up to 5 times, waiting twice as long each time
+  exec program args  run the program with the change in NOPFS_RULE,
+                     NOPFS_PATH, NOPFS_METRIC, NOPFS_FROM, NOPFS_TO,
+                     NOPFS_VALUE, NOPFS_UNIT, NOPFS_SEVERITY and
+                     NOPFS_TIME
+  syslog [addr]      log to the local syslog, or to that at the address,
+                     as in udp!192.0.2.1!514
+  email to [server]  mail the addresses, separated by commas, through
+                     the SMTP server, by default localhost:25
+
+Sinks are given to the server with -sink, one flag for each, and not
+by clients, as they run programs and reach other hosts. For example
+
+  -sink 'ops webhook https://hooks.example.com/nopfs'
+  -sink 'noc email noc@example.com'
+
+A route is written as "name prefix severity sink,...". Changes of rules
+whose path begins with the prefix, / for all, at least as severe as
+warn or crit are sent to each of the sinks. The severity of a change is
+the worse of the states it is between, so that the recovery of a rule
+from crit is sent where its going to crit was. For example
+
+  % echo 'all / warn ops
+  core host/core crit noc,ops' > routes
+
+Routes written here may only name sinks the server was given. Writing
+a name alone removes the route. Routes may also be given to the server
+with -route.
+
+`
+var Readme nopfs.Dispatcher = nopfs.NewFile([]byte(readme_notify))
+
+// The notifications kept in the log
+var MaxLog = 1000
+
+// Time allowed at exit for notifications still being sent
+var FlushTimeout = 10 * time.Second
+
+// A sink is somewhere notifications are sent
+type sink interface {
+	send(alerts.Event) error
+	String() string
+}
+
+type route struct {
+	name     string
+	prefix   string
+	severity alerts.Level
+	sinks    []string
+}
+
+var config = struct {
+	sync.RWMutex
+	sinks  map[string]sink
+	routes map[string]*route
+}{sinks: make(map[string]sink), routes: make(map[string]*route)}
+
+var deliveries = struct {
+	sync.Mutex
+	lines []string
+}{}
+
+// Makers of each type of sink from the fields after the type
+var types = map[string]func([]string) (sink, error){
+	"webhook": newWebhook,
+	"exec":    newExec,
+	"syslog":  newSyslog,
+	"email":   newEmail,
+}
+
+func setSink(fields []string) error {
+	if len(fields) == 1 {
+		config.Lock()
+		delete(config.sinks, fields[0])
+		config.Unlock()
+		return nil
+	}
+	newSink, ok := types[fields[1]]
+	if !ok {
+		return fmt.Errorf("%s: unknown sink type", fields[1])
+	}
+	s, err := newSink(fields[2:])
+	if err != nil {
+		return fmt.Errorf("%s: %s", fields[0], err)
+	}
+	config.Lock()
+	defer config.Unlock()
+	config.sinks[fields[0]] = s
+	return nil
+}
+
+func setRoute(fields []string) error {
+	if len(fields) == 1 {
+		config.Lock()
+		delete(config.routes, fields[0])
+		config.Unlock()
+		return nil
+	}
+	if len(fields) != 4 {
+		return errors.New("expected name prefix severity sink,...")
+	}
+	severity, err := alerts.ParseLevel(fields[2])
+	if err != nil {
+		return err
+	}
+	r := &route{name: fields[0], prefix: strings.Trim(fields[1], "/"),
+		severity: severity, sinks: strings.Split(fields[3], ",")}
+	config.Lock()
+	defer config.Unlock()
+	config.routes[r.name] = r
+	return nil
+}
+
+// Sinks sets the sinks notifications may be sent to. It may be used as
+// a flag, each value being a sink as written to the sinks file.
+type Sinks struct{}
+
+func (Sinks) Set(v string) error {
+	return setSink(strings.Fields(v))
+}
+
+func (Sinks) String() string {
+	return ""
+}
+
+// Routes sets which sinks notifications are sent to. It may be used as
+// a flag, each value being a route as written to the routes file.
+type Routes struct{}
+
+func (Routes) Set(v string) error {
+	return setRoute(strings.Fields(v))
+}
+
+func (Routes) String() string {
+	return ""
+}
+
+func listSinks() []byte {
+	config.RLock()
+	defer config.RUnlock()
+	names := make([]string, 0, len(config.sinks))
+	for name := range config.sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := &bytes.Buffer{}
+	for _, name := range names {
+		fmt.Fprintf(buf, "%s %s\n", name, config.sinks[name])
+	}
+	return buf.Bytes()
+}
+
+func listRoutes() []byte {
+	config.RLock()
+	defer config.RUnlock()
+	names := make([]string, 0, len(config.routes))
+	for name := range config.routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := &bytes.Buffer{}
+	for _, name := range names {
+		r := config.routes[name]
+		prefix := r.prefix
+		if prefix == "" {
+			prefix = "/"
+		}
+		fmt.Fprintf(buf, "%s %s %s %s\n", name, prefix, r.severity, strings.Join(r.sinks, ","))
+	}
+	return buf.Bytes()
+}
+
+// lines applies the function to each line of the data that is not
+// empty
+func lines(data []byte, f func([]string) error) error {
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := f(fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sinksFile(path []string) ([]byte, error) {
+	return listSinks(), nil
+}
+
+// knownSinks checks a route names only sinks there are, as clients may
+// route changes between those but not add their own.
+func knownSinks(fields []string) error {
+	if len(fields) != 4 {
+		return nil
+	}
+	config.RLock()
+	defer config.RUnlock()
+	for _, name := range strings.Split(fields[3], ",") {
+		if _, ok := config.sinks[name]; !ok {
+			return fmt.Errorf("%s: no such sink", name)
+		}
+	}
+	return nil
+}
+
+func routesCtl(c *nopfs.Ctl, data []byte) (resp []byte, err error) {
+	err = lines(data, func(fields []string) error {
+		if err := knownSinks(fields); err != nil {
+			return err
+		}
+		return setRoute(fields)
+	})
+	if err != nil {
+		return
+	}
+	resp = listRoutes()
+	return
+}
+
+// matches says whether the route takes the event
+func (r *route) matches(ev alerts.Event) bool {
+	return ev.Severity() >= r.severity && strings.HasPrefix(ev.Path, r.prefix)
+}
+
+// record adds the outcome of sending to a sink to the log
+func record(name string, ev alerts.Event, err error) {
+	result := "sent"
+	if err != nil {
+		result = err.Error()
+		nopfs.Log.Error("notify", "sink", name, "rule", ev.Rule, "error", err)
+	}
+	line := fmt.Sprintf("%s  %s  %s  %s\n", time.Now().UTC().Format(time.RFC3339), name, ev, result)
+	deliveries.Lock()
+	defer deliveries.Unlock()
+	deliveries.lines = append(deliveries.lines, line)
+	if len(deliveries.lines) > MaxLog {
+		deliveries.lines = deliveries.lines[len(deliveries.lines)-MaxLog:]
+	}
+}
+
+// Notifications still being sent
+var sending sync.WaitGroup
+
+// send hands the event to the sink in the background
+func send(name string, s sink, ev alerts.Event) {
+	sending.Add(1)
+	go func() {
+		defer sending.Done()
+		record(name, ev, s.send(ev))
+	}()
+}
+
+// Flush waits up to FlushTimeout for the notifications still being
+// sent. It is run when the server shuts down.
+func Flush() {
+	done := make(chan bool)
+	go func() {
+		sending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(FlushTimeout):
+		nopfs.Log.Error("notify", "error", "notifications still being sent at exit")
+	}
+}
+
+// deliver sends the event to every sink of every route it matches, but
+// to each sink only once.
+func deliver(ev alerts.Event) {
+	config.RLock()
+	defer config.RUnlock()
+	sent := map[string]bool{}
+	for _, r := range config.routes {
+		if !r.matches(ev) {
+			continue
+		}
+		for _, name := range r.sinks {
+			if sent[name] {
+				continue
+			}
+			sent[name] = true
+			s, ok := config.sinks[name]
+			if !ok {
+				record(name, ev, errors.New("no such sink"))
+				continue
+			}
+			send(name, s, ev)
+		}
+	}
+}
+
+// testCtl sends a made up change of state to the sinks named
+func testCtl(c *nopfs.Ctl, data []byte) (resp []byte, err error) {
+	ev := alerts.Event{Time: time.Now(), Rule: "test", Path: "notify/test",
+		Metric: "value", From: alerts.OK, To: alerts.Warn}
+	for _, name := range strings.Fields(string(data)) {
+		config.RLock()
+		s, ok := config.sinks[name]
+		config.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("%s: no such sink", name)
+		}
+		send(name, s, ev)
+	}
+	return []byte("ok"), nil
+}
+
+// TestFile is the test file, whose writes are limited in the notify
+// class as each sends to the sinks named.
+type TestFile struct {
+	nopfs.Ctl
+}
+
+func (f *TestFile) Clone() nopfs.Dispatcher {
+	n := &TestFile{nopfs.Ctl{Writer: f.Writer}}
+	n.SetPath(f.GetPath())
+	n.SetParent(f.GetParent())
+	return n
+}
+
+func (f *TestFile) Write(req *go9p.SrvReq, data []byte) error {
+	if err := nopfs.Limits.Allow("notify", req); err != nil {
+		return err
+	}
+	return f.Ctl.Write(req, data)
+}
+
+func logFile(path []string) ([]byte, error) {
+	deliveries.Lock()
+	defer deliveries.Unlock()
+	return []byte(strings.Join(deliveries.lines, "")), nil
+}
+
+var SinksFile nopfs.Dispatcher = nopfs.NewFun(sinksFile)
+var RoutesFile nopfs.Dispatcher = &nopfs.Ctl{Writer: routesCtl}
+var Test nopfs.Dispatcher = &TestFile{nopfs.Ctl{Writer: testCtl}}
+var Log nopfs.Dispatcher = nopfs.NewFun(logFile)
+
+var Dir *nopfs.Dir
+
+func init() {
+	Dir = nopfs.NewDir()
+	Dir.Append("README.txt", Readme)
+	Dir.Append("sinks", SinksFile)
+	Dir.Append("routes", RoutesFile)
+	Dir.Append("test", Test)
+	Dir.Append("log", Log)
+
+	alerts.Listen(deliver)
+}
@@ -0,0 +1,137 @@
+package notify
+
+import (
+	"hubs.net.uk/sw/nopfs/alerts"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a sink keeping the events sent to it
+type recorder struct {
+	sync.Mutex
+	events []alerts.Event
+}
+
+func (r *recorder) send(ev alerts.Event) error {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, ev)
+	return nil
+}
+
+func (r *recorder) String() string {
+	return "recorder"
+}
+
+func (r *recorder) count() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.events)
+}
+
+// reset empties the sinks, routes and log until the test ends
+func reset(t *testing.T) {
+	config.Lock()
+	sinks, routes := config.sinks, config.routes
+	config.sinks, config.routes = make(map[string]sink), make(map[string]*route)
+	config.Unlock()
+	deliveries.Lock()
+	lines := deliveries.lines
+	deliveries.lines = nil
+	deliveries.Unlock()
+	t.Cleanup(func() {
+		config.Lock()
+		config.sinks, config.routes = sinks, routes
+		config.Unlock()
+		deliveries.Lock()
+		deliveries.lines = lines
+		deliveries.Unlock()
+	})
+}
+
+func TestRouting(t *testing.T) {
+	reset(t)
+	sinks := map[string]*recorder{"ops": {}, "noc": {}, "pager": {}}
+	config.Lock()
+	for name, r := range sinks {
+		config.sinks[name] = r
+	}
+	config.Unlock()
+	for _, r := range []string{
+		"all / warn ops",
+		"core host/core crit noc,ops",
+		"edge host/edge warn pager,gone",
+	} {
+		if err := (Routes{}).Set(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path     string
+		from, to alerts.Level
+		sent     []string
+	}{
+		{"host/core1/icmp/ping", alerts.OK, alerts.Warn, []string{"ops"}},
+		{"host/core1/icmp/ping", alerts.OK, alerts.Crit, []string{"noc", "ops"}},
+		// A recovery from crit is as severe as going to it
+		{"host/core1/icmp/ping", alerts.Crit, alerts.OK, []string{"noc", "ops"}},
+		{"host/edge1/icmp/ping", alerts.Warn, alerts.OK, []string{"ops", "pager"}},
+		{"aflist/rxpower0", alerts.OK, alerts.Crit, []string{"ops"}},
+	}
+	for _, test := range tests {
+		before := map[string]int{}
+		for name, r := range sinks {
+			before[name] = r.count()
+		}
+		deliver(alerts.Event{Time: time.Now(), Rule: "r", Path: test.path,
+			Metric: "rtt", From: test.from, To: test.to})
+		sending.Wait()
+		var sent []string
+		for name, r := range sinks {
+			// Each sink is sent an event once, however many routes
+			// lead to it
+			switch r.count() - before[name] {
+			case 0:
+			case 1:
+				sent = append(sent, name)
+			default:
+				t.Errorf("%s %s: sent to %s more than once", test.path, test.to, name)
+			}
+		}
+		sort.Strings(sent)
+		if !reflect.DeepEqual(sent, test.sent) {
+			t.Errorf("%s %s -> %s: sent to %v, want %v", test.path, test.from, test.to, sent, test.sent)
+		}
+	}
+
+	log, _ := logFile(nil)
+	if !strings.Contains(string(log), "  gone  ") || !strings.Contains(string(log), "no such sink") {
+		t.Errorf("missing sink not logged in\n%s", log)
+	}
+}
+
+func TestRoutesCtl(t *testing.T) {
+	reset(t)
+	if err := (Sinks{}).Set("ops webhook https://hooks.example.com/services/T0/B0/secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := routesCtl(nil, []byte("all / warn ops\n")); err != nil {
+		t.Fatal(err)
+	}
+	// Clients may route only to the sinks the server was given
+	if _, err := routesCtl(nil, []byte("all / warn ops,evil\n")); err == nil {
+		t.Error("route to an unknown sink accepted")
+	}
+	if data := listRoutes(); string(data) != "all / warn ops\n" {
+		t.Errorf("got routes %q", data)
+	}
+	data, _ := sinksFile(nil)
+	if string(data) != "ops webhook https://hooks.example.com/...\n" {
+		t.Errorf("got sinks %q", data)
+	}
+}
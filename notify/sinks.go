@@ -0,0 +1,278 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hubs.net.uk/sw/nopfs"
+	"hubs.net.uk/sw/nopfs/alerts"
+	"log/syslog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Tries at a webhook, the wait after the first failure, doubled after
+// each, and the time allowed for each
+var WebhookTries = 5
+var WebhookBackoff = time.Second
+var WebhookTimeout = 10 * time.Second
+
+// Time allowed for a program run by an exec sink
+var ExecTimeout = 30 * time.Second
+
+// The sender of notifications by email
+var From = "nopfs@localhost"
+
+func init() {
+	if name, err := os.Hostname(); err == nil {
+		From = "nopfs@" + name
+	}
+}
+
+// stamp gives the time as it is shown in notifications
+func stamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// summary describes the event in a line, as for a subject
+func summary(ev alerts.Event) string {
+	return fmt.Sprintf("%s: %s is %s, %s %.1f%s", ev.Severity(), ev.Rule, ev.To, ev.Metric, ev.Value, ev.Unit)
+}
+
+type webhook struct {
+	url string
+}
+
+func newWebhook(args []string) (sink, error) {
+	if len(args) != 1 {
+		return nil, errors.New("expected webhook url")
+	}
+	u, err := url.Parse(args[0])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("%s: not an http or https url", args[0])
+	}
+	return &webhook{url: args[0]}, nil
+}
+
+// redacted gives the URL without what may be secret, as webhooks are
+// often authorised by their path or query, so that it may be shown.
+func redacted(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "..."
+	}
+	shown := u.Scheme + "://" + u.Host + "/"
+	if u.Path != "" && u.Path != "/" || u.RawQuery != "" {
+		shown += "..."
+	}
+	return shown
+}
+
+func (w *webhook) String() string {
+	return "webhook " + redacted(w.url)
+}
+
+// The JSON posted to a webhook
+type payload struct {
+	Time     string  `json:"time"`
+	Rule     string  `json:"rule"`
+	Path     string  `json:"path"`
+	Metric   string  `json:"metric"`
+	From     string  `json:"from"`
+	To       string  `json:"to"`
+	Severity string  `json:"severity"`
+	Value    float64 `json:"value"`
+	Unit     string  `json:"unit"`
+	Summary  string  `json:"summary"`
+}
+
+func (w *webhook) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), WebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "nopfs/"+nopfs.Version)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if e, ok := err.(*url.Error); ok {
+			e.URL = redacted(e.URL)
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// send posts the event, trying again after a failure, with the wait
+// doubling each time, until WebhookTries have failed.
+func (w *webhook) send(ev alerts.Event) error {
+	body, err := json.Marshal(payload{
+		Time: stamp(ev.Time), Rule: ev.Rule, Path: ev.Path, Metric: ev.Metric,
+		From: ev.From.String(), To: ev.To.String(), Severity: ev.Severity().String(),
+		Value: ev.Value, Unit: ev.Unit, Summary: summary(ev),
+	})
+	if err != nil {
+		return err
+	}
+	wait := WebhookBackoff
+	for try := 1; ; try++ {
+		err = w.post(body)
+		if err == nil || try >= WebhookTries {
+			break
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+	if err != nil {
+		return fmt.Errorf("after %d tries: %s", WebhookTries, err)
+	}
+	return nil
+}
+
+type execSink struct {
+	args []string
+}
+
+func newExec(args []string) (sink, error) {
+	if len(args) == 0 {
+		return nil, errors.New("expected exec program [args]")
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return nil, err
+	}
+	return &execSink{args: args}, nil
+}
+
+func (e *execSink) String() string {
+	return "exec " + strings.Join(e.args, " ")
+}
+
+func (e *execSink) send(ev alerts.Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ExecTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, e.args[0], e.args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"NOPFS_RULE="+ev.Rule,
+		"NOPFS_PATH="+ev.Path,
+		"NOPFS_METRIC="+ev.Metric,
+		"NOPFS_FROM="+ev.From.String(),
+		"NOPFS_TO="+ev.To.String(),
+		"NOPFS_VALUE="+fmt.Sprintf("%g", ev.Value),
+		"NOPFS_UNIT="+ev.Unit,
+		"NOPFS_SEVERITY="+ev.Severity().String(),
+		"NOPFS_TIME="+stamp(ev.Time),
+	)
+	out, err := nopfs.RunCommand("notify/exec", cmd)
+	if err != nil {
+		if text := strings.TrimSpace(string(out)); text != "" {
+			return fmt.Errorf("%s: %s", err, text)
+		}
+		return err
+	}
+	return nil
+}
+
+type syslogSink struct {
+	network string
+	addr    string
+}
+
+func newSyslog(args []string) (sink, error) {
+	s := &syslogSink{}
+	switch len(args) {
+	case 0:
+	case 1:
+		network, addr, err := nopfs.SplitAddr(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if !strings.Contains(args[0], "!") || network == "unix" {
+			return nil, fmt.Errorf("%s: expected udp!host!port or tcp!host!port", args[0])
+		}
+		s.network, s.addr = network, addr
+	default:
+		return nil, errors.New("expected syslog [addr]")
+	}
+	return s, nil
+}
+
+func (s *syslogSink) String() string {
+	if s.addr == "" {
+		return "syslog"
+	}
+	host, port, _ := net.SplitHostPort(s.addr)
+	return "syslog " + s.network + "!" + host + "!" + port
+}
+
+func (s *syslogSink) send(ev alerts.Event) error {
+	w, err := syslog.Dial(s.network, s.addr, syslog.LOG_DAEMON|syslog.LOG_NOTICE, "nopfs")
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	msg := fmt.Sprintf("%s, %s", summary(ev), ev.Path)
+	switch ev.To {
+	case alerts.Crit:
+		return w.Crit(msg)
+	case alerts.Warn:
+		return w.Warning(msg)
+	}
+	return w.Notice(msg)
+}
+
+type email struct {
+	to     []string
+	server string
+}
+
+func newEmail(args []string) (sink, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("expected email to [server]")
+	}
+	e := &email{to: strings.Split(args[0], ","), server: "localhost:25"}
+	for _, to := range e.to {
+		if !strings.Contains(to, "@") {
+			return nil, fmt.Errorf("%s: not an address", to)
+		}
+	}
+	if len(args) == 2 {
+		e.server = args[1]
+		if _, _, err := net.SplitHostPort(e.server); err != nil {
+			e.server = net.JoinHostPort(e.server, "25")
+		}
+	}
+	return e, nil
+}
+
+func (e *email) String() string {
+	return "email " + strings.Join(e.to, ",") + " " + e.server
+}
+
+func (e *email) send(ev alerts.Event) error {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", From)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(e.to, ", "))
+	fmt.Fprintf(buf, "Subject: [nopfs] %s\r\n", summary(ev))
+	fmt.Fprintf(buf, "Date: %s\r\n", ev.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(buf, "rule      %s\r\n", ev.Rule)
+	fmt.Fprintf(buf, "path      %s\r\n", ev.Path)
+	fmt.Fprintf(buf, "state     %s -> %s\r\n", ev.From, ev.To)
+	fmt.Fprintf(buf, "value     %s %.1f%s\r\n", ev.Metric, ev.Value, ev.Unit)
+	fmt.Fprintf(buf, "time      %s\r\n", stamp(ev.Time))
+	return smtp.SendMail(e.server, nil, From, e.to, buf.Bytes())
+}
@@ -1,7 +1,10 @@
 package nopfs
 
 import (
+	"fmt"
+	"os"
 	"os/exec"
+	"strconv"
 )
 
 func HostF(f func(string) ([]byte, error)) func([]string) ([]byte, error) {
@@ -15,3 +18,16 @@ func HostC(f func(string) *exec.Cmd) func([]string) *exec.Cmd {
 		return f(path[1])
 	}
 }
+
+// HostPort gives the host and port from the path to a file within a
+// port's directory, as in host/h/tcp/443/banner.
+func HostPort(path []string) (host string, port int, err error) {
+	if len(path) < 4 {
+		return "", 0, os.ErrInvalid
+	}
+	port, err = strconv.Atoi(path[len(path)-2])
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("%s: not a port", path[len(path)-2])
+	}
+	return path[1], port, nil
+}
@@ -0,0 +1,107 @@
+package port
+
+import (
+	"errors"
+	"fmt"
+	"hubs.net.uk/sw/nopfs"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+var readme_tcp = `
+TCP ports
+=========
+
+Each port is a directory named after its number, which will not appear
+in a listing until it has been descended into, for example
+
+  % cat 443/connect
+
+  p/connect   Connects to the port on each of the host's addresses,
+              giving the time taken for the handshake, or why it
+              failed: refused, timed out or unreachable
+  p/banner    The first bytes the server sends once connected, as
+              SSH, SMTP and FTP servers do, up to 1024 bytes or
+              whatever arrives within 5 seconds
+
+Ports recently looked at appear as directories and may be forgotten by
+writing to the clear file.
+
+`
+var readme_udp = `
+UDP ports
+=========
+
+Each port is a directory named after its number, which will not appear
+in a listing until it has been descended into, for example
+
+  % cat 53/probe
+
+  p/probe     Sends a datagram to the port on each of the host's
+              addresses, giving whether it was answered, refused
+              with a port unreachable, or went unanswered, which
+              means the port is open or filtered
+
+Well known ports are sent a request their service will answer and the
+reply is summarised: dns (53), ntp (123), netbios (137), snmp (161,
+community public), ssdp (1900), stun (3478), sip (5060) and memcached
+(11211). Others are sent an empty datagram and the reply shown as it
+is. Each probe is sent twice before giving up.
+
+Ports recently looked at appear as directories and may be forgotten by
+writing to the clear file.
+
+`
+
+// Time allowed for connecting, and for each try at a UDP probe
+var Timeout = 5 * time.Second
+
+// addresses looks up every address of the host
+func addresses(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return ips, nil
+}
+
+// reason says why a connection failed, or a probe went unanswered
+func reason(err error) string {
+	var ne net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return "host unreachable"
+	case errors.Is(err, syscall.ENETUNREACH):
+		return "network unreachable"
+	case errors.As(err, &ne) && ne.Timeout():
+		return fmt.Sprintf("timed out after %s", Timeout)
+	}
+	return err.Error()
+}
+
+func ms(d time.Duration) string {
+	return fmt.Sprintf("%.3f ms", float64(d)/float64(time.Millisecond))
+}
+
+var TCP *nopfs.AnyDir
+var UDP *nopfs.AnyDir
+
+func init() {
+	TCP = nopfs.NewAnyDir()
+	TCP.Static("README.txt", nopfs.NewFile([]byte(readme_tcp)))
+	TCP.Static("clear", &nopfs.Ctl{Writer: nopfs.AnyDirCtlReset})
+	TCP.Append("connect", Connect)
+	TCP.Append("banner", Banner)
+
+	UDP = nopfs.NewAnyDir()
+	UDP.Static("README.txt", nopfs.NewFile([]byte(readme_udp)))
+	UDP.Static("clear", &nopfs.Ctl{Writer: nopfs.AnyDirCtlReset})
+	UDP.Append("probe", Probe)
+}
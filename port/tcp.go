@@ -0,0 +1,97 @@
+package port
+
+import (
+	"bytes"
+	"fmt"
+	"hubs.net.uk/sw/nopfs"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Time to wait for a banner, and the most of it read
+var BannerTimeout = 5 * time.Second
+var BannerSize = 1024
+
+// Once some of the banner has come, the time to wait for more
+var BannerQuiet = 500 * time.Millisecond
+
+// connect tries the port on every address of the host at once, giving
+// a line for each
+func connect(path []string) ([]byte, error) {
+	host, port, err := nopfs.HostPort(path)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := addresses(host)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]string, len(ips))
+	done := make(chan bool)
+	for i, ip := range ips {
+		go func(i int, addr string) {
+			start := time.Now()
+			conn, err := net.DialTimeout("tcp", addr, Timeout)
+			if err != nil {
+				lines[i] = fmt.Sprintf("%s  %s\n", addr, reason(err))
+			} else {
+				lines[i] = fmt.Sprintf("%s  connected in %s\n", addr, ms(time.Since(start)))
+				conn.Close()
+			}
+			done <- true
+		}(i, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	}
+	for range ips {
+		<-done
+	}
+	buf := &bytes.Buffer{}
+	for _, line := range lines {
+		buf.WriteString(line)
+	}
+	return buf.Bytes(), nil
+}
+
+// banner connects to the first of the host's addresses that accepts
+// and gives what the server sends before BannerTimeout.
+func banner(path []string) ([]byte, error) {
+	host, port, err := nopfs.HostPort(path)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := addresses(host)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		conn, err = net.DialTimeout("tcp", addr, Timeout)
+		if err == nil {
+			break
+		}
+		err = fmt.Errorf("%s: %s", addr, reason(err))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(BannerTimeout)
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, BannerSize)
+	n := 0
+	for n < len(buf) {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if err != nil {
+			break
+		}
+		if quiet := time.Now().Add(BannerQuiet); quiet.Before(deadline) {
+			conn.SetReadDeadline(quiet)
+		}
+	}
+	return buf[:n], nil
+}
+
+var Connect nopfs.Dispatcher = nopfs.NewFun(connect).Limit("port")
+var Banner nopfs.Dispatcher = nopfs.NewFun(banner).Limit("port")
@@ -0,0 +1,288 @@
+package port
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hubs.net.uk/sw/nopfs"
+	"hubs.net.uk/sw/nopfs/dns"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The times a UDP probe is sent before giving up
+var Tries = 2
+
+// A service says what to send to a UDP port and how to summarise the
+// reply
+type service struct {
+	name     string
+	request  func() []byte
+	describe func([]byte) string
+}
+
+var services = map[int]service{
+	53:    {"dns", dnsRequest, dnsReply},
+	123:   {"ntp", ntpRequest, ntpReply},
+	137:   {"netbios", netbiosRequest, netbiosReply},
+	161:   {"snmp", snmpRequest, raw},
+	1900:  {"ssdp", ssdpRequest, raw},
+	3478:  {"stun", stunRequest, stunReply},
+	5060:  {"sip", sipRequest, raw},
+	11211: {"memcached", memcachedRequest, memcachedReply},
+}
+
+// raw shows a reply as text if it is printable, otherwise as a hex dump
+// of its first 256 bytes
+func raw(b []byte) string {
+	text := true
+	for _, c := range b {
+		if (c < ' ' || c > '~') && c != '\r' && c != '\n' && c != '\t' {
+			text = false
+			break
+		}
+	}
+	if text {
+		return strings.TrimSpace(strings.Replace(string(b), "\r\n", "\n", -1))
+	}
+	if len(b) > 256 {
+		b = b[:256]
+	}
+	return strings.TrimSpace(hex.Dump(b))
+}
+
+func dnsRequest() []byte {
+	b, _ := dns.NewQuery(".", dns.TypeNS).Pack()
+	return b
+}
+
+func dnsReply(b []byte) string {
+	r, err := dns.Unpack(b)
+	if err != nil {
+		return fmt.Sprintf("bad reply: %s", err)
+	}
+	return fmt.Sprintf("%s, %d answers, %d authority, %d additional",
+		dns.RcodeName(r.ExtendedRcode()), len(r.Answer), len(r.Authority), len(r.Additional))
+}
+
+func ntpRequest() []byte {
+	b := make([]byte, 48)
+	// Version 4, client mode
+	b[0] = 4<<3 | 3
+	return b
+}
+
+// The seconds from the NTP epoch in 1900 to the Unix one
+const ntpEpoch = 2208988800
+
+func ntpReply(b []byte) string {
+	if len(b) < 48 {
+		return fmt.Sprintf("short reply of %d bytes", len(b))
+	}
+	stratum := int(b[1])
+	ref := net.IP(b[12:16]).String()
+	if stratum <= 1 {
+		ref = strings.TrimRight(string(b[12:16]), "\x00")
+	}
+	secs := int64(binary.BigEndian.Uint32(b[40:])) - ntpEpoch
+	frac := int64(binary.BigEndian.Uint32(b[44:]))
+	t := time.Unix(secs, frac*1e9>>32).UTC()
+	return fmt.Sprintf("version %d, stratum %d, reference %s, time %s", b[0]>>3&7, stratum, ref, t.Format(time.RFC3339Nano))
+}
+
+// netbiosRequest asks for the node status, the names a host has
+// registered
+func netbiosRequest() []byte {
+	b := make([]byte, 12, 50)
+	binary.BigEndian.PutUint16(b, uint16(rand.Intn(0x10000)))
+	binary.BigEndian.PutUint16(b[4:], 1)
+	// The name * encoded as in RFC 1001
+	b = append(b, 32, 'C', 'K')
+	for i := 0; i < 30; i++ {
+		b = append(b, 'A')
+	}
+	return append(b, 0, 0, 0x21, 0, 1)
+}
+
+func netbiosReply(b []byte) string {
+	// Header, name, type, class, TTL and length
+	off := 12 + 34 + 10
+	if len(b) < off+1 {
+		return raw(b)
+	}
+	count := int(b[off])
+	off++
+	var names []string
+	for i := 0; i < count && off+18 <= len(b); i++ {
+		name := strings.TrimRight(string(b[off:off+15]), " ")
+		group := ""
+		if b[off+16]&0x80 != 0 {
+			group = " group"
+		}
+		names = append(names, fmt.Sprintf("%-15s <%02x>%s", name, b[off+15], group))
+		off += 18
+	}
+	return strings.Join(names, "\n")
+}
+
+// snmpRequest asks for sysDescr.0 with SNMPv2c and the community public
+func snmpRequest() []byte {
+	b := []byte{
+		0x30, 0x29, 0x02, 0x01, 0x01,
+		0x04, 0x06, 'p', 'u', 'b', 'l', 'i', 'c',
+		0xa0, 0x1c, 0x02, 0x04, 0, 0, 0, 0, 0x02, 0x01, 0x00, 0x02, 0x01, 0x00,
+		0x30, 0x0e, 0x30, 0x0c, 0x06, 0x08, 0x2b, 0x06, 0x01, 0x02, 0x01, 0x01, 0x01, 0x00, 0x05, 0x00,
+	}
+	binary.BigEndian.PutUint32(b[17:], uint32(rand.Int31()))
+	return b
+}
+
+func ssdpRequest() []byte {
+	return []byte("M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 1\r\n" +
+		"ST: ssdp:all\r\n\r\n")
+}
+
+// The magic cookie of STUN messages
+const stunCookie = 0x2112a442
+
+// stunRequest is a binding request, asking the address the server
+// sees the probe come from
+func stunRequest() []byte {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint16(b, 1)
+	binary.BigEndian.PutUint32(b[4:], stunCookie)
+	rand.Read(b[8:])
+	return b
+}
+
+func stunReply(b []byte) string {
+	if len(b) < 20 || binary.BigEndian.Uint32(b[4:]) != stunCookie {
+		return raw(b)
+	}
+	for off := 20; off+4 <= len(b); {
+		typ, length := binary.BigEndian.Uint16(b[off:]), int(binary.BigEndian.Uint16(b[off+2:]))
+		v := b[off+4:]
+		if len(v) < length {
+			break
+		}
+		v = v[:length]
+		if (typ == 0x0001 || typ == 0x0020) && len(v) >= 8 {
+			port := int(binary.BigEndian.Uint16(v[2:]))
+			ip := append(net.IP{}, v[4:]...)
+			if typ == 0x0020 {
+				port ^= stunCookie >> 16
+				for i := range ip {
+					ip[i] ^= b[4+i]
+				}
+			}
+			return fmt.Sprintf("mapped address %s", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		}
+		off += 4 + (length+3)/4*4
+	}
+	return fmt.Sprintf("binding response of type %#04x", binary.BigEndian.Uint16(b))
+}
+
+func sipRequest() []byte {
+	tag := strconv.Itoa(rand.Int())
+	return []byte("OPTIONS sip:nm SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP nm;branch=z9hG4bK" + tag + ";rport\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"To: <sip:nm2@nm2>\r\n" +
+		"From: <sip:nm@nm>;tag=" + tag + "\r\n" +
+		"Call-ID: " + tag + "@nm\r\n" +
+		"CSeq: 42 OPTIONS\r\n" +
+		"Contact: <sip:nm@nm>\r\n" +
+		"Accept: application/sdp\r\n" +
+		"Content-Length: 0\r\n\r\n")
+}
+
+// memcachedRequest asks for the version, after the frame header that
+// memcached expects of UDP requests
+func memcachedRequest() []byte {
+	return append([]byte{0, 1, 0, 0, 0, 1, 0, 0}, "version\r\n"...)
+}
+
+func memcachedReply(b []byte) string {
+	if len(b) < 8 {
+		return raw(b)
+	}
+	return raw(b[8:])
+}
+
+// probeAddr sends the request to the address until it is answered or
+// refused, or Tries have gone unanswered.
+func probeAddr(addr string, svc service) string {
+	conn, err := net.DialTimeout("udp", addr, Timeout)
+	if err != nil {
+		return reason(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 65536)
+	for i := 0; i < Tries; i++ {
+		start := time.Now()
+		if _, err = conn.Write(svc.request()); err != nil {
+			return reason(err)
+		}
+		conn.SetReadDeadline(start.Add(Timeout))
+		n, err := conn.Read(buf)
+		if err == nil {
+			line := fmt.Sprintf("open, %d bytes in %s", n, ms(time.Since(start)))
+			if desc := svc.describe(buf[:n]); desc != "" {
+				line += "\n    " + strings.Replace(desc, "\n", "\n    ", -1)
+			}
+			return line
+		}
+		var ne net.Error
+		switch {
+		case errors.Is(err, syscall.ECONNREFUSED):
+			return "closed, port unreachable"
+		case !(errors.As(err, &ne) && ne.Timeout()):
+			return reason(err)
+		}
+	}
+	return "no reply, open or filtered"
+}
+
+// probe sends a request to the port on every address of the host at
+// once, giving what became of each
+func probe(path []string) ([]byte, error) {
+	host, port, err := nopfs.HostPort(path)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := addresses(host)
+	if err != nil {
+		return nil, err
+	}
+	svc, ok := services[port]
+	if !ok {
+		svc = service{"udp", func() []byte { return []byte{} }, raw}
+	}
+	lines := make([]string, len(ips))
+	done := make(chan bool)
+	for i, ip := range ips {
+		go func(i int, addr string) {
+			lines[i] = fmt.Sprintf("%s  %s  %s\n", addr, svc.name, probeAddr(addr, svc))
+			done <- true
+		}(i, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	}
+	for range ips {
+		<-done
+	}
+	buf := &bytes.Buffer{}
+	for _, line := range lines {
+		buf.WriteString(line)
+	}
+	return buf.Bytes(), nil
+}
+
+var Probe nopfs.Dispatcher = nopfs.NewFun(probe).Limit("port")
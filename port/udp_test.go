@@ -0,0 +1,186 @@
+package port
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNetbios(t *testing.T) {
+	q := netbiosRequest()
+	if len(q) != 50 || binary.BigEndian.Uint16(q[4:]) != 1 {
+		t.Fatalf("request % x", q)
+	}
+	if name := string(q[13:45]); q[12] != 32 || name != "CK"+strings.Repeat("A", 30) {
+		t.Errorf("request asks for %q", name)
+	}
+	if !bytes.Equal(q[45:], []byte{0, 0, 0x21, 0, 1}) {
+		t.Errorf("request ends % x", q[45:])
+	}
+
+	// The reply repeats the question's name, then gives the type,
+	// class, TTL and length before the names
+	r := append([]byte{}, q[:12]...)
+	r[2] = 0x84
+	r = append(r, q[12:46]...)
+	r = append(r, 0, 0x21, 0, 1, 0, 0, 0, 0, 0, 0, 2)
+	entry := func(name string, suffix byte, flags byte) {
+		r = append(r, []byte(name+strings.Repeat(" ", 15-len(name)))...)
+		r = append(r, suffix, flags, 0)
+	}
+	entry("FILESERVER", 0x20, 0x04)
+	entry("WORKGROUP", 0x00, 0x84)
+	want := "FILESERVER      <20>\nWORKGROUP       <00> group"
+	if got := netbiosReply(r); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// A name cut short is left out
+	if got := netbiosReply(r[:len(r)-1]); got != "FILESERVER      <20>" {
+		t.Errorf("short reply gave %q", got)
+	}
+}
+
+func TestSTUN(t *testing.T) {
+	q := stunRequest()
+	if len(q) != 20 || binary.BigEndian.Uint16(q) != 1 || binary.BigEndian.Uint32(q[4:]) != stunCookie {
+		t.Fatalf("request % x", q)
+	}
+
+	header := func(length int) []byte {
+		b := make([]byte, 20)
+		binary.BigEndian.PutUint16(b, 0x0101)
+		binary.BigEndian.PutUint16(b[2:], uint16(length))
+		binary.BigEndian.PutUint32(b[4:], stunCookie)
+		copy(b[8:], q[8:])
+		return b
+	}
+	// XOR-MAPPED-ADDRESS of 192.0.2.1:32853, after an attribute of an
+	// unknown type that is padded to four bytes
+	r := header(20)
+	r = append(r, 0x80, 0x22, 0, 3, 'a', 'b', 'c', 0)
+	r = append(r, 0, 0x20, 0, 8, 0, 1, 0, 0)
+	binary.BigEndian.PutUint16(r[len(r)-2:], 32853^stunCookie>>16)
+	for i, b := range []byte{192, 0, 2, 1} {
+		r = append(r, b^r[4+i])
+	}
+	if got := stunReply(r); got != "mapped address 192.0.2.1:32853" {
+		t.Errorf("xor mapped: got %q", got)
+	}
+	// MAPPED-ADDRESS, as older servers send
+	r = append(header(12), 0, 1, 0, 8, 0, 1, 0x0d, 0x96, 198, 51, 100, 7)
+	if got := stunReply(r); got != "mapped address 198.51.100.7:3478" {
+		t.Errorf("mapped: got %q", got)
+	}
+	if got := stunReply(header(0)); got != "binding response of type 0x0101" {
+		t.Errorf("no address: got %q", got)
+	}
+	if got := stunReply([]byte("not stun")); got != "not stun" {
+		t.Errorf("not stun: got %q", got)
+	}
+}
+
+func TestNTP(t *testing.T) {
+	q := ntpRequest()
+	if len(q) != 48 || q[0] != 0x23 {
+		t.Fatalf("request % x", q)
+	}
+	when := time.Date(2026, 3, 4, 5, 6, 7, 500000000, time.UTC)
+	r := make([]byte, 48)
+	r[0], r[1] = 4<<3|4, 1
+	copy(r[12:], "GPS")
+	binary.BigEndian.PutUint32(r[40:], uint32(when.Unix()+ntpEpoch))
+	binary.BigEndian.PutUint32(r[44:], 1<<31)
+	want := "version 4, stratum 1, reference GPS, time 2026-03-04T05:06:07.5Z"
+	if got := ntpReply(r); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// Below stratum 1 the reference is the address of the server's source
+	r[1] = 2
+	copy(r[12:], []byte{192, 0, 2, 123})
+	if got := ntpReply(r); !strings.HasPrefix(got, "version 4, stratum 2, reference 192.0.2.123,") {
+		t.Errorf("got %q", got)
+	}
+	if got := ntpReply(r[:47]); got != "short reply of 47 bytes" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestSNMP(t *testing.T) {
+	q := snmpRequest()
+	var msg struct {
+		Version   int
+		Community []byte
+		PDU       asn1.RawValue
+	}
+	if rest, err := asn1.Unmarshal(q, &msg); err != nil || len(rest) != 0 {
+		t.Fatalf("request % x: %v, %d bytes left", q, err, len(rest))
+	}
+	if msg.Version != 1 || string(msg.Community) != "public" {
+		t.Errorf("version %d, community %q", msg.Version, msg.Community)
+	}
+	if msg.PDU.Class != asn1.ClassContextSpecific || msg.PDU.Tag != 0 || !msg.PDU.IsCompound {
+		t.Fatalf("not a GetRequest: class %d tag %d", msg.PDU.Class, msg.PDU.Tag)
+	}
+	var id, status, index int
+	var bindings []struct {
+		Name  asn1.ObjectIdentifier
+		Value asn1.RawValue
+	}
+	b := msg.PDU.Bytes
+	for _, v := range []interface{}{&id, &status, &index, &bindings} {
+		var err error
+		if b, err = asn1.Unmarshal(b, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(b) != 0 || status != 0 || index != 0 || len(bindings) != 1 {
+		t.Fatalf("PDU % x", msg.PDU.Bytes)
+	}
+	if name := bindings[0].Name.String(); name != "1.3.6.1.2.1.1.1.0" || bindings[0].Value.Tag != asn1.TagNull {
+		t.Errorf("asks for %s", name)
+	}
+	// Each request has its own ID
+	if bytes.Equal(snmpRequest()[17:21], q[17:21]) && bytes.Equal(snmpRequest()[17:21], q[17:21]) {
+		t.Error("request IDs repeat")
+	}
+}
+
+func TestProbeAddr(t *testing.T) {
+	defer func(d time.Duration, n int) { Timeout, Tries = d, n }(Timeout, Tries)
+	Timeout, Tries = 200*time.Millisecond, 2
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for first := true; ; first = false {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// The first try goes unanswered
+			if !first {
+				pc.WriteTo(append([]byte("echo "), buf[:n]...), from)
+			}
+		}
+	}()
+	svc := service{"echo", func() []byte { return []byte("hello") }, raw}
+	got := probeAddr(pc.LocalAddr().String(), svc)
+	if !strings.HasPrefix(got, "open, 10 bytes in ") || !strings.HasSuffix(got, "\n    echo hello") {
+		t.Errorf("open: got %q", got)
+	}
+
+	// Nothing listens once it is closed
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	if got := probeAddr(addr, svc); got != "closed, port unreachable" {
+		t.Errorf("closed: got %q", got)
+	}
+}
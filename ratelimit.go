@@ -0,0 +1,230 @@
+package nopfs
+
+import (
+	"fmt"
+	"github.com/rminnich/go9p"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Returned when a client has used up its budget for a kind of probe
+var ErrRateLimited error = syscall.EAGAIN
+
+// A Rate allows Burst probes at once, refilled at Burst per Per
+type Rate struct {
+	Burst int
+	Per   time.Duration
+}
+
+func (r Rate) String() string {
+	return fmt.Sprintf("%d/%s", r.Burst, r.Per)
+}
+
+// ParseRate parses a rate written as count/duration, such as 6/1m
+func ParseRate(s string) (r Rate, err error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		err = fmt.Errorf("%s: expected count/duration", s)
+		return
+	}
+	r.Burst, err = strconv.Atoi(parts[0])
+	if err != nil || r.Burst <= 0 {
+		err = fmt.Errorf("%s: bad count", s)
+		return
+	}
+	r.Per, err = time.ParseDuration(parts[1])
+	if err != nil || r.Per <= 0 {
+		err = fmt.Errorf("%s: bad duration", s)
+	}
+	return
+}
+
+type bucketKey struct {
+	class  string
+	client string
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter keeps a token bucket for each client and class of probe.
+// Clients are identified by their address and the user they attached
+// as. Classes without a configured rate are not limited.
+type RateLimiter struct {
+	lock    sync.Mutex
+	rates   map[string]Rate
+	buckets map[bucketKey]*bucket
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		rates:   make(map[string]Rate),
+		buckets: make(map[bucketKey]*bucket),
+	}
+}
+
+// The rate limits applied to probes
+var Limits = NewRateLimiter()
+
+func (l *RateLimiter) SetRate(class string, r Rate) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rates[class] = r
+	for k := range l.buckets {
+		if k.class == class {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// Set parses class=count/duration so that a RateLimiter may be used as
+// a command line flag. A count of zero removes the limit.
+func (l *RateLimiter) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("%s: expected class=count/duration", s)
+	}
+	if parts[1] == "0" {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		delete(l.rates, parts[0])
+		return nil
+	}
+	r, err := ParseRate(parts[1])
+	if err != nil {
+		return err
+	}
+	l.SetRate(parts[0], r)
+	return nil
+}
+
+func (l *RateLimiter) String() string {
+	if l == nil {
+		return ""
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	classes := make([]string, 0, len(l.rates))
+	for class, r := range l.rates {
+		classes = append(classes, class+"="+r.String())
+	}
+	sort.Strings(classes)
+	return strings.Join(classes, ",")
+}
+
+// Identify the client by host address, without the port which changes
+// with every connection, and user name
+func clientKey(ci *ConnInfo) string {
+	host, _, err := net.SplitHostPort(ci.Remote)
+	if err != nil {
+		host = ci.Remote
+	}
+	return host + "/" + ci.User
+}
+
+// refill brings the bucket up to date, it must be called with the lock
+func (b *bucket) refill(r Rate, now time.Time) {
+	elapsed := now.Sub(b.last)
+	b.last = now
+	b.tokens += float64(r.Burst) * float64(elapsed) / float64(r.Per)
+	if b.tokens > float64(r.Burst) {
+		b.tokens = float64(r.Burst)
+	}
+}
+
+// Allow takes a token from the client's bucket for the class, returning
+// ErrRateLimited if there are none left. Requests made internally by
+// the server are not limited.
+func (l *RateLimiter) Allow(class string, req *go9p.SrvReq) error {
+	ci := Conn(req)
+	if ci == nil {
+		return nil
+	}
+	return l.AllowConn(class, ci)
+}
+
+// AllowConn takes a token from the bucket for the class of the client
+// of the connection, which need no longer be open, so that work done
+// for a client later on is charged to it.
+func (l *RateLimiter) AllowConn(class string, ci *ConnInfo) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	r, ok := l.rates[class]
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	key := bucketKey{class, clientKey(ci)}
+	b, ok := l.buckets[key]
+	if !ok {
+		l.prune(now)
+		b = &bucket{tokens: float64(r.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.refill(r, now)
+	if b.tokens < 1 {
+		Log.Info("rate limited", "conn", ci.Id, "remote", ci.Remote, "user", ci.User, "class", class)
+		return ErrRateLimited
+	}
+	b.tokens--
+	return nil
+}
+
+// prune forgets buckets that have refilled, being no different from new
+// ones, so that clients that have gone away do not accumulate.
+func (l *RateLimiter) prune(now time.Time) {
+	for k, b := range l.buckets {
+		r, ok := l.rates[k.class]
+		if !ok {
+			delete(l.buckets, k)
+			continue
+		}
+		b.refill(r, now)
+		if b.tokens >= float64(r.Burst) {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// Budgets describes the configured rates and the tokens each client has
+// remaining. Clients with a full budget are not listed.
+func (l *RateLimiter) Budgets(path []string) ([]byte, error) {
+	l.lock.Lock()
+	now := time.Now()
+	l.prune(now)
+	classes := make([]string, 0, len(l.rates))
+	for class := range l.rates {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	rows := make([][]string, 0, len(classes)+len(l.buckets))
+	for _, class := range classes {
+		r := l.rates[class]
+		rows = append(rows, []string{class, "*", fmt.Sprint(r.Burst), r.String()})
+	}
+	keys := make([]bucketKey, 0, len(l.buckets))
+	for k := range l.buckets {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].class != keys[j].class {
+			return keys[i].class < keys[j].class
+		}
+		return keys[i].client < keys[j].client
+	})
+	for _, k := range keys {
+		rows = append(rows, []string{k.class, k.client,
+			strconv.FormatFloat(l.buckets[k].tokens, 'f', 1, 64),
+			l.rates[k.class].String()})
+	}
+	l.lock.Unlock()
+	return table("class\tclient\ttokens\trate", rows), nil
+}
@@ -0,0 +1,245 @@
+package nopfs
+
+import (
+	"errors"
+	"github.com/rminnich/go9p"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var ErrShutdown = errors.New("server is shutting down")
+var ErrDrainTimeout = errors.New("timed out waiting for requests to finish")
+
+// Server lifecycle state, kept separately from the 9p handlers so that
+// the zero NopSrv remains usable.
+type lifecycle struct {
+	lock      sync.Mutex
+	closing   bool
+	active    map[*request]bool
+	idle      chan struct{}
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	atexit    []func()
+	stats     map[string]*OpStats
+}
+
+// Counters kept for each kind of 9p request
+type OpStats struct {
+	Count  uint64
+	Errors uint64
+	Time   time.Duration
+}
+
+type trackedListener struct {
+	net.Listener
+	srv *NopSrv
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.srv.trackConn(c), nil
+}
+
+type trackedConn struct {
+	net.Conn
+	srv  *NopSrv
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.srv.life.lock.Lock()
+		delete(c.srv.life.conns, c)
+		c.srv.life.lock.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+func (sfs *NopSrv) trackConn(c net.Conn) net.Conn {
+	tc := &trackedConn{Conn: c, srv: sfs}
+	sfs.life.lock.Lock()
+	defer sfs.life.lock.Unlock()
+	if sfs.life.conns == nil {
+		sfs.life.conns = make(map[net.Conn]bool)
+	}
+	sfs.life.conns[tc] = true
+	return tc
+}
+
+// Serve accepts connections on the listener until it is closed. It
+// returns nil if the listener was closed by Shutdown.
+func (sfs *NopSrv) Serve(l net.Listener) error {
+	sfs.life.lock.Lock()
+	if sfs.life.closing {
+		sfs.life.lock.Unlock()
+		l.Close()
+		return ErrShutdown
+	}
+	if sfs.life.listeners == nil {
+		sfs.life.listeners = make(map[net.Listener]bool)
+	}
+	sfs.life.listeners[l] = true
+	sfs.life.lock.Unlock()
+
+	err := sfs.StartListener(&trackedListener{l, sfs})
+
+	sfs.life.lock.Lock()
+	defer sfs.life.lock.Unlock()
+	delete(sfs.life.listeners, l)
+	if sfs.life.closing {
+		return nil
+	}
+	return err
+}
+
+// AtExit registers a function to be run, for example to flush state
+// to disk, once the server has shut down. Functions run in reverse
+// order of registration.
+func (sfs *NopSrv) AtExit(f func()) {
+	sfs.life.lock.Lock()
+	defer sfs.life.lock.Unlock()
+	sfs.life.atexit = append(sfs.life.atexit, f)
+}
+
+// enter marks the start of a request, refusing it if the server is
+// shutting down. Every successful enter must be matched by a leave.
+func (sfs *NopSrv) enter(req *go9p.SrvReq, op string) (*request, error) {
+	sfs.life.lock.Lock()
+	defer sfs.life.lock.Unlock()
+	if sfs.life.closing {
+		return nil, ErrShutdown
+	}
+	if sfs.life.active == nil {
+		sfs.life.active = make(map[*request]bool)
+	}
+	r := &request{req: req, op: op, path: fidPath(req.Fid), start: time.Now()}
+	sfs.life.active[r] = true
+	return r, nil
+}
+
+// leave marks the end of a request and writes it to the access log
+func (sfs *NopSrv) leave(r *request) {
+	elapsed := time.Since(r.start)
+	Log.Log(r.level(), r.op, append(ReqFields(r.req), "path", r.path,
+		"duration", elapsed, "error", r.err)...)
+
+	sfs.life.lock.Lock()
+	defer sfs.life.lock.Unlock()
+	if sfs.life.stats == nil {
+		sfs.life.stats = make(map[string]*OpStats)
+	}
+	st, ok := sfs.life.stats[r.op]
+	if !ok {
+		st = &OpStats{}
+		sfs.life.stats[r.op] = st
+	}
+	st.Count++
+	st.Time += elapsed
+	if r.err != nil {
+		st.Errors++
+	}
+
+	delete(sfs.life.active, r)
+	if len(sfs.life.active) == 0 && sfs.life.idle != nil {
+		close(sfs.life.idle)
+		sfs.life.idle = nil
+	}
+}
+
+// Shutdown stops accepting connections and waits up to timeout for
+// in-flight requests to finish. Any commands still running are then
+// killed, remaining connections closed and the AtExit functions run.
+func (sfs *NopSrv) Shutdown(timeout time.Duration) (err error) {
+	sfs.life.lock.Lock()
+	sfs.life.closing = true
+	for l := range sfs.life.listeners {
+		l.Close()
+	}
+	var idle chan struct{}
+	if len(sfs.life.active) > 0 {
+		if sfs.life.idle == nil {
+			sfs.life.idle = make(chan struct{})
+		}
+		idle = sfs.life.idle
+	}
+	sfs.life.lock.Unlock()
+
+	if idle != nil {
+		select {
+		case <-idle:
+		case <-time.After(timeout):
+			err = ErrDrainTimeout
+		}
+	}
+
+	KillCommands()
+
+	sfs.life.lock.Lock()
+	conns := make([]net.Conn, 0, len(sfs.life.conns))
+	for c := range sfs.life.conns {
+		conns = append(conns, c)
+	}
+	atexit := sfs.life.atexit
+	sfs.life.atexit = nil
+	sfs.life.lock.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+	for i := len(atexit) - 1; i >= 0; i-- {
+		atexit[i]()
+	}
+	return
+}
+
+// Run serves the listeners, notifying systemd when ready and feeding
+// its watchdog if one is configured, until SIGINT or SIGTERM is
+// received. It then shuts down allowing grace for requests to finish.
+func (sfs *NopSrv) Run(listeners []net.Listener, grace time.Duration) error {
+	if len(listeners) == 0 {
+		return errors.New("no listeners")
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- sfs.Serve(l)
+		}(l)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	SdNotify("READY=1")
+
+	var watchdog <-chan time.Time
+	if interval := SdWatchdog(); interval > 0 {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+
+	var err error
+	for err == nil {
+		select {
+		case s := <-sig:
+			Log.Info("shutting down", "signal", s)
+			SdNotify("STOPPING=1")
+			return sfs.Shutdown(grace)
+		case <-watchdog:
+			SdNotify("WATCHDOG=1")
+		case err = <-errs:
+		}
+	}
+	SdNotify("STOPPING=1")
+	sfs.Shutdown(grace)
+	return err
+}
@@ -0,0 +1,142 @@
+package nopfs
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Set at link time with -ldflags "-X hubs.net.uk/sw/nopfs.Version=..."
+var Version = "dev"
+
+var readme_server = `
+Server introspection
+====================
+
+This directory shows what the server itself is doing.
+
+  - connections   clients connected, with the user they attached as,
+                  the number of fids they hold and bytes transferred
+  - requests      requests currently being handled and their age
+  - commands      commands running on behalf of clients
+  - stats         number of requests of each kind, errors and the
+                  average time taken
+  - ratelimit     rate limits on probes and the budget remaining to
+                  each client that has used them recently
+  - version       server and Go runtime versions
+
+`
+
+// Round durations for display
+func age(since time.Time) time.Duration {
+	return time.Since(since).Round(time.Millisecond)
+}
+
+func table(header string, rows [][]string) []byte {
+	buf := &bytes.Buffer{}
+	w := tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+func (sfs *NopSrv) connectionsFile(path []string) ([]byte, error) {
+	conns := Connections()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Id < conns[j].Id })
+	rows := make([][]string, 0, len(conns))
+	for _, c := range conns {
+		rows = append(rows, []string{
+			fmt.Sprint(c.Id), c.Remote, c.User, fmt.Sprint(c.Fids),
+			fmt.Sprint(c.Read), fmt.Sprint(c.Written), age(c.Opened).String(),
+		})
+	}
+	return table("id\tremote\tuser\tfids\tread\twritten\tage", rows), nil
+}
+
+func (sfs *NopSrv) requestsFile(path []string) ([]byte, error) {
+	type active struct {
+		conn  string
+		op    string
+		path  string
+		start time.Time
+	}
+
+	sfs.life.lock.Lock()
+	reqs := make([]active, 0, len(sfs.life.active))
+	for r := range sfs.life.active {
+		reqs = append(reqs, active{op: r.op, path: r.path, start: r.start})
+		if ci := Conn(r.req); ci != nil {
+			reqs[len(reqs)-1].conn = fmt.Sprint(ci.Id)
+		}
+	}
+	sfs.life.lock.Unlock()
+
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].start.Before(reqs[j].start) })
+	rows := make([][]string, 0, len(reqs))
+	for _, r := range reqs {
+		rows = append(rows, []string{r.conn, r.op, r.path, age(r.start).String()})
+	}
+	return table("conn\top\tpath\tage", rows), nil
+}
+
+func (sfs *NopSrv) commandsFile(path []string) ([]byte, error) {
+	cmds := Commands()
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Started.Before(cmds[j].Started) })
+	rows := make([][]string, 0, len(cmds))
+	for _, c := range cmds {
+		rows = append(rows, []string{
+			fmt.Sprint(c.Pid), c.Path, age(c.Started).String(),
+			strings.Join(c.Args, " "),
+		})
+	}
+	return table("pid\tpath\tage\tcommand", rows), nil
+}
+
+func (sfs *NopSrv) statsFile(path []string) ([]byte, error) {
+	sfs.life.lock.Lock()
+	ops := make([]string, 0, len(sfs.life.stats))
+	stats := make(map[string]OpStats, len(sfs.life.stats))
+	for op, st := range sfs.life.stats {
+		ops = append(ops, op)
+		stats[op] = *st
+	}
+	sfs.life.lock.Unlock()
+
+	sort.Strings(ops)
+	rows := make([][]string, 0, len(ops))
+	for _, op := range ops {
+		st := stats[op]
+		mean := st.Time / time.Duration(st.Count)
+		rows = append(rows, []string{
+			op, fmt.Sprint(st.Count), fmt.Sprint(st.Errors),
+			mean.Round(time.Microsecond).String(),
+		})
+	}
+	return table("op\tcount\terrors\tmean", rows), nil
+}
+
+func versionFile(path []string) ([]byte, error) {
+	return []byte(fmt.Sprintf("nopfs %s %s %s/%s\n", Version,
+		runtime.Version(), runtime.GOOS, runtime.GOARCH)), nil
+}
+
+// ServerDir returns a directory of files describing the live state of
+// the server.
+func (sfs *NopSrv) ServerDir() *Dir {
+	d := NewDir()
+	d.Append("README.txt", NewFile([]byte(readme_server)))
+	d.Append("connections", NewFun(sfs.connectionsFile))
+	d.Append("requests", NewFun(sfs.requestsFile))
+	d.Append("commands", NewFun(sfs.commandsFile))
+	d.Append("stats", NewFun(sfs.statsFile))
+	d.Append("ratelimit", NewFun(Limits.Budgets))
+	d.Append("version", NewFun(versionFile))
+	return d
+}
@@ -0,0 +1,93 @@
+package nopfs
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// First file descriptor passed by systemd socket activation
+const sdListenFdsStart = 3
+
+// SdListeners returns the listening sockets passed to the process by
+// systemd socket activation, or nothing if there are none. The
+// environment variables are cleared so that children do not inherit
+// them.
+func SdListeners() (listeners []net.Listener, err error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		err = nil
+		return
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		err = nil
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < nfds; i++ {
+		fd := sdListenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		var l net.Listener
+		l, err = net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			listeners = nil
+			return
+		}
+		listeners = append(listeners, l)
+	}
+	return
+}
+
+// SdNotify sends a state notification such as READY=1 to systemd. It
+// does nothing when not running under systemd.
+func SdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	addr := &net.UnixAddr{Name: name, Net: "unixgram"}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// SdWatchdog returns the interval within which systemd expects to
+// receive WATCHDOG=1 notifications, or zero if the watchdog is not
+// enabled for this process.
+func SdWatchdog() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" {
+		if p, err := strconv.Atoi(pid); err != nil || p != os.Getpid() {
+			return 0
+		}
+	}
+	return time.Duration(usec) * time.Microsecond
+}
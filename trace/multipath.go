@@ -0,0 +1,344 @@
+package trace
+
+import (
+	"bytes"
+	"fmt"
+	"hubs.net.uk/sw/nopfs"
+	"net"
+	"strings"
+	"time"
+)
+
+// The probes sent to a hop where k next hops have been found before
+// ruling out one more with 95% confidence, up to 16, as given for the
+// Multipath Detection Algorithm by Veitch et al.
+var mdaProbes = []int{1: 6, 11, 16, 21, 27, 33, 38, 44, 51, 57, 63, 70, 76, 83, 90, 96}
+
+// A Node is an address replying at a hop of a multipath trace
+type Node struct {
+	From net.IP
+	// The quickest reply
+	RTT time.Duration
+	// The flows whose probes it answered
+	Flows []int
+	// The addresses at the hop before that these flows went through
+	Prev    []net.IP
+	Reached bool
+	Note    string
+}
+
+// A Level gives the addresses found at a hop and the probes sent to it
+type Level struct {
+	TTL   int
+	Nodes []*Node
+	Sent  int
+	flows map[int]*Node
+	tried map[int]bool
+}
+
+// Paths gives every path found to a host
+type Paths struct {
+	Target  net.IP
+	Method  string
+	Levels  []*Level
+	Reached bool
+	Sent    int
+}
+
+// mdaProbe is a probe sent along a flow
+type mdaProbe struct {
+	flow     int
+	ttl      int
+	sent     time.Time
+	answered bool
+}
+
+// mda finds the paths to the session's target by sending probes along
+// more flows at each hop until no more next hops are likely to be
+// found.
+type mda struct {
+	s      *session
+	p      flowProber
+	res    *Paths
+	probes []mdaProbe
+	flows  int
+}
+
+// record adds the reply to the level its probe was sent to
+func (m *mda) record(r reply) bool {
+	if r.probe < 0 || r.probe >= len(m.probes) || m.probes[r.probe].answered {
+		return false
+	}
+	pr := &m.probes[r.probe]
+	pr.answered = true
+	l := m.res.Levels[pr.ttl-1]
+	var n *Node
+	for _, o := range l.Nodes {
+		if o.From.Equal(r.from) {
+			n = o
+			break
+		}
+	}
+	rtt := r.at.Sub(pr.sent)
+	if n == nil {
+		n = &Node{From: r.from, RTT: rtt, Reached: r.reached, Note: r.note}
+		l.Nodes = append(l.Nodes, n)
+	}
+	if rtt < n.RTT {
+		n.RTT = rtt
+	}
+	if _, ok := l.flows[pr.flow]; !ok {
+		n.Flows = append(n.Flows, pr.flow)
+		l.flows[pr.flow] = n
+	}
+	m.res.Reached = m.res.Reached || r.reached
+	return true
+}
+
+// send sends a probe along each of the flows with the TTL, waiting for
+// the replies
+func (m *mda) send(ttl int, flows []int) error {
+	l := m.res.Levels[ttl-1]
+	first := len(m.probes)
+	for _, f := range flows {
+		probe := len(m.probes)
+		m.probes = append(m.probes, mdaProbe{flow: f, ttl: ttl, sent: time.Now()})
+		if err := m.p.sendFlow(probe, f, ttl); err != nil {
+			return err
+		}
+		l.tried[f] = true
+		l.Sent++
+		m.res.Sent++
+	}
+	deadline := time.After(Timeout)
+	for waiting := len(flows); waiting > 0; {
+		select {
+		case r := <-m.s.replies:
+			if m.record(r) && r.probe >= first {
+				waiting--
+			}
+		case <-deadline:
+			return nil
+		}
+	}
+	return nil
+}
+
+// ended reports whether a node is at the end of its paths
+func (n *Node) ended() bool {
+	return n.Reached || n.Note != ""
+}
+
+// candidates gives the flows to probe a hop with next, taking turns
+// among the nodes found at the hop before so that the branches of each
+// are looked for, then making new flows.
+func (m *mda) candidates(ttl, count int) []int {
+	l := m.res.Levels[ttl-1]
+	var flows []int
+	var prev []*Node
+	for i := ttl - 2; i >= 0 && len(prev) == 0; i-- {
+		prev = m.res.Levels[i].Nodes
+	}
+	for i := 0; len(flows) < count; i++ {
+		more := false
+		for _, n := range prev {
+			if n.ended() || i >= len(n.Flows) {
+				continue
+			}
+			more = true
+			if f := n.Flows[i]; !l.tried[f] && len(flows) < count {
+				flows = append(flows, f)
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	for len(flows) < count {
+		flows = append(flows, m.flows)
+		m.flows++
+	}
+	return flows
+}
+
+// link probes the hop before with the flows answered at this hop but
+// not there, to learn the nodes they went through.
+func (m *mda) link(ttl int) error {
+	if ttl < 2 || len(m.res.Levels[ttl-2].Nodes) == 0 {
+		return nil
+	}
+	prev := m.res.Levels[ttl-2]
+	var flows []int
+	for f := range m.res.Levels[ttl-1].flows {
+		if !prev.tried[f] {
+			flows = append(flows, f)
+		}
+	}
+	if len(flows) == 0 {
+		return nil
+	}
+	return m.send(ttl-1, flows)
+}
+
+func (m *mda) run() error {
+	go m.s.listen(m.p)
+	for ttl := 1; ttl <= MaxHops; ttl++ {
+		l := &Level{TTL: ttl, flows: map[int]*Node{}, tried: map[int]bool{}}
+		m.res.Levels = append(m.res.Levels, l)
+		for {
+			k := len(l.Nodes)
+			if k >= len(mdaProbes)-1 {
+				break
+			}
+			need := Probes
+			if k > 0 {
+				need = mdaProbes[k]
+			}
+			if l.Sent >= need {
+				break
+			}
+			if err := m.send(ttl, m.candidates(ttl, need-l.Sent)); err != nil {
+				return err
+			}
+		}
+		if err := m.link(ttl); err != nil {
+			return err
+		}
+		ended := len(l.Nodes) > 0
+		for _, n := range l.Nodes {
+			ended = ended && n.ended()
+		}
+		if ended {
+			break
+		}
+	}
+	for i := 1; i < len(m.res.Levels); i++ {
+		prev := m.res.Levels[i-1]
+		for _, n := range m.res.Levels[i].Nodes {
+			for _, f := range n.Flows {
+				p, ok := prev.flows[f]
+				if !ok {
+					continue
+				}
+				seen := false
+				for _, ip := range n.Prev {
+					seen = seen || ip.Equal(p.From)
+				}
+				if !seen {
+					n.Prev = append(n.Prev, p.From)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Count gives the number of distinct paths through the nodes found.
+// Nodes whose predecessors are unknown are taken to follow every path
+// to the hop before.
+func (res *Paths) Count() int {
+	counts := map[string]int{}
+	total, ended := 1, 0
+	for _, l := range res.Levels {
+		if len(l.Nodes) == 0 {
+			continue
+		}
+		next := map[string]int{}
+		sum := 0
+		for _, n := range l.Nodes {
+			c := 0
+			for _, ip := range n.Prev {
+				c += counts[ip.String()]
+			}
+			if c == 0 {
+				c = total
+			}
+			if n.ended() {
+				ended += c
+				continue
+			}
+			next[n.From.String()] = c
+			sum += c
+		}
+		counts, total = next, sum
+	}
+	return total + ended
+}
+
+// Format writes the nodes found at each hop, with the addresses they
+// were reached through where the path branches or joins.
+func (res *Paths) Format(host string) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "multipath to %s (%s), %d hops max, %s probes\n", host, res.Target, MaxHops, res.Method)
+	var addrs []net.IP
+	for _, l := range res.Levels {
+		for _, n := range l.Nodes {
+			addrs = append(addrs, n.From)
+		}
+	}
+	found := names(addrs)
+	before := 0
+	for _, l := range res.Levels {
+		if len(l.Nodes) == 0 {
+			fmt.Fprintf(buf, "%2d  *\n", l.TTL)
+			before = 0
+			continue
+		}
+		branching := len(l.Nodes) > 1 || before > 1
+		for i, n := range l.Nodes {
+			if i == 0 {
+				fmt.Fprintf(buf, "%2d ", l.TTL)
+			} else {
+				buf.WriteString("   ")
+			}
+			fmt.Fprintf(buf, " %s (%s)  %.3f ms", found[n.From.String()], n.From, float64(n.RTT)/float64(time.Millisecond))
+			if n.Note != "" {
+				fmt.Fprintf(buf, " %s", n.Note)
+			}
+			if branching {
+				fmt.Fprintf(buf, "  %d/%d flows", len(n.Flows), len(l.flows))
+				if len(n.Prev) > 0 {
+					from := make([]string, len(n.Prev))
+					for j, ip := range n.Prev {
+						from[j] = ip.String()
+					}
+					fmt.Fprintf(buf, "  from %s", strings.Join(from, ", "))
+				}
+			}
+			buf.WriteByte('\n')
+		}
+		before = len(l.Nodes)
+	}
+	fmt.Fprintf(buf, "%d paths, %d probes\n", res.Count(), res.Sent)
+	return buf.Bytes()
+}
+
+// multipathF gives the function for a file finding the paths to the
+// host over IPv4 or IPv6
+func multipathF(v6 bool) func(string) ([]byte, error) {
+	return func(host string) ([]byte, error) {
+		target, err := resolve(host, v6)
+		if err != nil {
+			return nil, err
+		}
+		s, err := newSession(target)
+		if err != nil {
+			return nil, err
+		}
+		defer s.close()
+		p, err := newParisUDP(s)
+		if err != nil {
+			return nil, err
+		}
+		defer p.close()
+		m := &mda{s: s, p: p, res: &Paths{Target: target, Method: "paris udp"}}
+		if err := m.run(); err != nil {
+			return nil, err
+		}
+		return m.res.Format(host), nil
+	}
+}
+
+func multipathFile(v6 bool) *nopfs.Fun {
+	return nopfs.NewFun(nopfs.HostF(multipathF(v6))).Limit("traceroute")
+}
@@ -0,0 +1,128 @@
+package trace
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+// The destination port of Paris probes, the same for every probe
+const parisPort = basePort
+
+// A flowProber sends probes along a chosen flow, keeping the fields
+// that load balancers hash on the same for every probe of the flow.
+type flowProber interface {
+	prober
+	// sendFlow sends the numbered probe along the flow with the TTL
+	sendFlow(probe, flow, ttl int) error
+}
+
+// parisUDP sends UDP probes whose ports stay the same for each flow,
+// the flow choosing the source port. As in Paris traceroute the probes
+// are numbered in the UDP checksum, which the last two bytes of the
+// data are set to give. The datagrams are written to a raw socket so
+// that the checksum is made here rather than left to the network card.
+type parisUDP struct {
+	s    *session
+	src  net.IP
+	conn *net.IPConn
+	// The source port of the first flow
+	port  int
+	lock  sync.Mutex
+	flows int
+}
+
+func newParis(s *session) (prober, error) {
+	return newParisUDP(s)
+}
+
+func newParisUDP(s *session) (*parisUDP, error) {
+	udp, network := "udp4", "ip4:udp"
+	if s.v6 {
+		udp, network = "udp6", "ip6:udp"
+	}
+	// Connecting a socket finds the source address, which the
+	// checksum covers
+	c, err := net.DialUDP(udp, nil, &net.UDPAddr{IP: s.target, Port: parisPort})
+	if err != nil {
+		return nil, err
+	}
+	src := c.LocalAddr().(*net.UDPAddr).IP
+	c.Close()
+	conn, err := net.ListenIP(network, &net.IPAddr{IP: src})
+	if err != nil {
+		return nil, err
+	}
+	return &parisUDP{s: s, src: src, conn: conn, port: 32768 + rand.Intn(16384)}, nil
+}
+
+// flowData gives the data of a UDP datagram between the addresses and
+// ports whose checksum comes out as the one wanted.
+func flowData(src, dst net.IP, sport, dport int, want uint16) []byte {
+	data := make([]byte, len(payload))
+	copy(data, payload)
+	length := 8 + len(data)
+	var b []byte
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		b = append(b, src4...)
+		b = append(b, dst4...)
+		b = append(b, 0, protoUDP, byte(length>>8), byte(length))
+	} else {
+		b = append(b, src.To16()...)
+		b = append(b, dst.To16()...)
+		b = append(b, 0, 0, byte(length>>8), byte(length), 0, 0, 0, protoUDP)
+	}
+	b = append(b, byte(sport>>8), byte(sport), byte(dport>>8), byte(dport), byte(length>>8), byte(length), 0, 0)
+	b = append(b, data...)
+	w := uint32(^want) + uint32(^onesSum(b))
+	w = w>>16 + w&0xffff
+	binary.BigEndian.PutUint16(data[len(data)-2:], uint16(w))
+	return data
+}
+
+func (p *parisUDP) sendFlow(probe, flow, ttl int) error {
+	p.lock.Lock()
+	if flow >= p.flows {
+		p.flows = flow + 1
+	}
+	p.lock.Unlock()
+	if err := setConnTTL(p.conn, p.s.v6, ttl); err != nil {
+		return err
+	}
+	sport := p.port + flow%16384
+	data := flowData(p.src, p.s.target, sport, parisPort, uint16(probe+1))
+	b := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint16(b, uint16(sport))
+	binary.BigEndian.PutUint16(b[2:], parisPort)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(b)))
+	binary.BigEndian.PutUint16(b[6:], uint16(probe+1))
+	copy(b[8:], data)
+	_, err := p.conn.WriteToIP(b, &net.IPAddr{IP: p.s.target})
+	return err
+}
+
+func (p *parisUDP) send(probe, ttl int) error {
+	return p.sendFlow(probe, 0, ttl)
+}
+
+func (p *parisUDP) match(proto int, t []byte) int {
+	if proto != protoUDP || len(t) < 8 || int(binary.BigEndian.Uint16(t[2:])) != parisPort {
+		return -1
+	}
+	p.lock.Lock()
+	flows := p.flows
+	p.lock.Unlock()
+	flow := int(binary.BigEndian.Uint16(t)) - p.port
+	sum := int(binary.BigEndian.Uint16(t[6:]))
+	if flow < 0 || flow >= flows || sum == 0 {
+		return -1
+	}
+	return sum - 1
+}
+
+func (p *parisUDP) echo(id, seq int) int { return -1 }
+
+func (p *parisUDP) close() {
+	p.conn.Close()
+}
@@ -0,0 +1,350 @@
+package trace
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// The smallest MTUs allowed, which every path is taken to carry
+const (
+	minMTU4 = 68
+	minMTU6 = 1280
+)
+
+// The largest packet sent, as lengths in IP headers are 16 bits. The
+// loopback interface has a larger MTU than any packet may be.
+const maxPacket = 0xffff
+
+// Not given by the syscall package
+const ipv6DontFrag = 62
+
+// The times each size is sent before the probe is taken to be lost
+var MTURetries = 2
+
+// An MTUProbe is an echo request of a size sent without fragmentation
+// and what became of it
+type MTUProbe struct {
+	Size int
+	// Set when a router sent back fragmentation needed or packet too
+	// big, with the MTU it gave, if any
+	TooBig bool
+	MTU    int
+	From   net.IP
+	Lost   bool
+}
+
+// MTU gives the path MTU to a host and the hop where larger packets
+// stop
+type MTU struct {
+	Target net.IP
+	// The MTU of the interface the host is reached through
+	Local   int
+	PathMTU int
+	Probes  []MTUProbe
+	// Set when no router said the packets were too big and the path
+	// MTU was found by which probes were lost
+	Searched bool
+	// The last hop reached by larger packets, if found, and the next
+	// hop reached by smaller ones, if it answered
+	Hop     int
+	HopFrom net.IP
+	Next    net.IP
+}
+
+// localMTU gives the MTU of the interface the packets to the target
+// leave by
+func localMTU(target net.IP, v6 bool) (int, error) {
+	network := "udp4"
+	if v6 {
+		network = "udp6"
+	}
+	c, err := net.DialUDP(network, nil, &net.UDPAddr{IP: target, Port: basePort})
+	if err != nil {
+		return 0, err
+	}
+	src := c.LocalAddr().(*net.UDPAddr).IP
+	c.Close()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return 0, err
+	}
+	for _, ifi := range ifaces {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(src) {
+				return ifi.MTU, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no interface has address %s", src)
+}
+
+// limit gives the largest packet that may be sent through the interface
+func (res *MTU) limit() int {
+	if res.Local > maxPacket {
+		return maxPacket
+	}
+	return res.Local
+}
+
+// setDontFrag makes the socket set the DF bit, or not fragment IPv6
+// packets itself, and send packets larger than the path MTU it has
+// learned so that they may be probed again.
+func setDontFrag(c syscall.Conn, v6 bool) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	err2 := rc.Control(func(fd uintptr) {
+		if v6 {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+			if err == nil {
+				err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6DontFrag, 1)
+			}
+			return
+		}
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+	})
+	if err2 != nil {
+		return err2
+	}
+	return err
+}
+
+// mtuSearch sends echo requests of different sizes to the session's
+// target
+type mtuSearch struct {
+	s    *session
+	p    *icmpProber
+	next int
+	res  *MTU
+}
+
+// data gives the data of an echo request making a packet of the size
+func (m *mtuSearch) data(size int) []byte {
+	header := 20 + 8
+	if m.s.v6 {
+		header = 40 + 8
+	}
+	return make([]byte, size-header)
+}
+
+// try sends an echo request of the size until it is answered, or a
+// router says it is too big, or it has been lost MTURetries times.
+func (m *mtuSearch) try(size int) (pr MTUProbe, err error) {
+	pr = MTUProbe{Size: size, Lost: true}
+	for i := 0; i < MTURetries; i++ {
+		probe := m.next
+		m.next++
+		if err = m.p.sendData(probe, MaxHops, m.data(size)); err != nil {
+			return
+		}
+		deadline := time.After(Timeout)
+	wait:
+		for {
+			select {
+			case r := <-m.s.replies:
+				if r.probe != probe {
+					continue
+				}
+				switch {
+				case r.tooBig:
+					pr.TooBig, pr.MTU, pr.From, pr.Lost = true, r.mtu, r.from, false
+					return
+				case r.reached:
+					pr.Lost = false
+					return
+				case r.note != "":
+					err = fmt.Errorf("%s replied %s", r.from, r.note)
+					return
+				}
+			case <-deadline:
+				break wait
+			}
+		}
+	}
+	return
+}
+
+// search finds the largest size answered, trying the MTU given by any
+// router that says a probe is too big and otherwise halving the range
+// between the sizes answered and lost, so that paths whose routers'
+// messages are filtered are measured too.
+func (m *mtuSearch) search() error {
+	least := minMTU4
+	if m.s.v6 {
+		least = minMTU6
+	}
+	good, bad, told := 0, m.res.limit()+1, 0
+	size := m.res.limit()
+	for good < bad-1 {
+		pr, err := m.try(size)
+		if err != nil {
+			return err
+		}
+		m.res.Probes = append(m.res.Probes, pr)
+		switch {
+		case pr.TooBig:
+			bad = size
+		case pr.Lost:
+			bad = size
+			m.res.Searched = true
+		default:
+			good = size
+			if size == told {
+				bad = size + 1
+			}
+		}
+		if good == 0 && size != least {
+			// Make sure the host answers at all before looking
+			// for the size lost
+			if pr.TooBig && pr.MTU >= least && pr.MTU < size {
+				size, told = pr.MTU, pr.MTU
+			} else {
+				size = least
+			}
+			continue
+		}
+		if good == 0 {
+			return fmt.Errorf("no echo replies from %s", m.res.Target)
+		}
+		if pr.TooBig && pr.MTU > good && pr.MTU < size {
+			size, told = pr.MTU, pr.MTU
+			continue
+		}
+		size = (good + bad) / 2
+	}
+	m.res.PathMTU = good
+	return nil
+}
+
+// locate sends packets of the size lost and the size answered with
+// each TTL to find the last hop the larger ones reach.
+func (m *mtuSearch) locate() error {
+	small, big := m.res.PathMTU, m.res.PathMTU+1
+	for _, pr := range m.res.Probes {
+		if (pr.Lost || pr.TooBig) && pr.Size < big {
+			big = pr.Size
+		}
+	}
+	first := m.next
+	for ttl := 1; ttl <= MaxHops; ttl++ {
+		if err := m.p.sendData(first+2*(ttl-1), ttl, m.data(small)); err != nil {
+			return err
+		}
+		if err := m.p.sendData(first+2*(ttl-1)+1, ttl, m.data(big)); err != nil {
+			return err
+		}
+	}
+	m.next += 2 * MaxHops
+	replies := map[int]reply{}
+	deadline := time.After(Timeout)
+wait:
+	for {
+		select {
+		case r := <-m.s.replies:
+			if r.probe >= first && r.probe < m.next {
+				replies[r.probe-first] = r
+			}
+		case <-deadline:
+			break wait
+		}
+	}
+	for ttl := 1; ttl <= MaxHops; ttl++ {
+		if r, ok := replies[2*(ttl-1)+1]; ok && !r.reached && r.note == "" {
+			m.res.Hop, m.res.HopFrom = ttl, r.from
+		}
+		if r, ok := replies[2*(ttl-1)]; ok && r.reached {
+			break
+		}
+	}
+	if r, ok := replies[2*m.res.Hop]; ok {
+		m.res.Next = r.from
+	}
+	return nil
+}
+
+// PathMTU finds the path MTU to the host over IPv4 or IPv6 with echo
+// requests that may not be fragmented, and the hop where larger
+// packets stop if it is less than that of the interface. It is no more
+// than the largest packet IP allows.
+func PathMTU(host string, v6 bool) (res *MTU, err error) {
+	target, err := resolve(host, v6)
+	if err != nil {
+		return
+	}
+	res = &MTU{Target: target}
+	if res.Local, err = localMTU(target, v6); err != nil {
+		return
+	}
+	s, err := newSession(target)
+	if err != nil {
+		return
+	}
+	defer s.close()
+	if err = setDontFrag(s.conn, s.v6); err != nil {
+		return
+	}
+	p, err := newICMP(s)
+	if err != nil {
+		return
+	}
+	defer p.close()
+	go s.listen(p)
+	m := &mtuSearch{s: s, p: p.(*icmpProber), res: res}
+	if err = m.search(); err != nil {
+		return
+	}
+	if res.PathMTU < res.limit() {
+		err = m.locate()
+	}
+	return
+}
+
+// Format writes the path MTU, where larger packets stop, and each of
+// the probes sent to find it.
+func (res *MTU) Format(host string) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "path mtu to %s (%s) is %d bytes, %d locally\n", host, res.Target, res.PathMTU, res.Local)
+	var addrs []net.IP
+	for _, ip := range []net.IP{res.HopFrom, res.Next} {
+		if ip != nil {
+			addrs = append(addrs, ip)
+		}
+	}
+	found := names(addrs)
+	name := func(ip net.IP) string {
+		return fmt.Sprintf("%s (%s)", found[ip.String()], ip)
+	}
+	if res.PathMTU < res.limit() {
+		next := "the hop after"
+		if res.Next != nil {
+			next = fmt.Sprintf("hop %d, %s", res.Hop+1, name(res.Next))
+		}
+		if res.HopFrom == nil {
+			fmt.Fprintf(buf, "larger packets do not reach %s\n", next)
+		} else {
+			fmt.Fprintf(buf, "larger packets reach hop %d, %s, but not %s\n", res.Hop, name(res.HopFrom), next)
+		}
+		if res.Searched {
+			buf.WriteString("no router said they were too big, they are silently dropped\n")
+		}
+	}
+	for _, pr := range res.Probes {
+		switch {
+		case pr.TooBig:
+			fmt.Fprintf(buf, "%6d  too big, mtu %d, from %s\n", pr.Size, pr.MTU, pr.From)
+		case pr.Lost:
+			fmt.Fprintf(buf, "%6d  lost\n", pr.Size)
+		default:
+			fmt.Fprintf(buf, "%6d  ok\n", pr.Size)
+		}
+	}
+	return buf.Bytes()
+}
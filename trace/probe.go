@@ -0,0 +1,236 @@
+package trace
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The first destination port of UDP probes, as for traceroute
+const basePort = 33434
+
+// The data carried by each probe
+var payload = make([]byte, 32)
+
+// onesSum adds up the data as 16 bit words in ones' complement
+func onesSum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
+
+// checksum is the Internet checksum of RFC 1071
+func checksum(b []byte) uint16 {
+	return ^onesSum(b)
+}
+
+// echoRequest makes an ICMP echo request. The kernel fills in the
+// checksum of ICMPv6 messages.
+func echoRequest(v6 bool, id, seq int, data []byte) []byte {
+	b := make([]byte, 8+len(data))
+	b[0] = echoRequest4
+	if v6 {
+		b[0] = echoRequest6
+	}
+	binary.BigEndian.PutUint16(b[4:], uint16(id))
+	binary.BigEndian.PutUint16(b[6:], uint16(seq))
+	copy(b[8:], data)
+	if !v6 {
+		binary.BigEndian.PutUint16(b[2:], checksum(b))
+	}
+	return b
+}
+
+// icmpProber sends echo requests numbered by their sequence number
+// from the session's own socket
+type icmpProber struct {
+	s  *session
+	id int
+}
+
+func newICMP(s *session) (prober, error) {
+	return &icmpProber{s: s, id: rand.Intn(0x10000)}, nil
+}
+
+func (p *icmpProber) send(probe, ttl int) error {
+	return p.sendData(probe, ttl, payload)
+}
+
+// sendData sends the numbered probe carrying the data
+func (p *icmpProber) sendData(probe, ttl int, data []byte) error {
+	if err := setConnTTL(p.s.conn, p.s.v6, ttl); err != nil {
+		return err
+	}
+	_, err := p.s.conn.WriteToIP(echoRequest(p.s.v6, p.id, probe, data), &net.IPAddr{IP: p.s.target})
+	return err
+}
+
+func (p *icmpProber) match(proto int, t []byte) int {
+	if (proto != protoICMP && proto != protoICMPv6) || len(t) < 8 {
+		return -1
+	}
+	if (t[0] != echoRequest4 && t[0] != echoRequest6) || int(binary.BigEndian.Uint16(t[4:])) != p.id {
+		return -1
+	}
+	return int(binary.BigEndian.Uint16(t[6:]))
+}
+
+func (p *icmpProber) echo(id, seq int) int {
+	if id != p.id {
+		return -1
+	}
+	return seq
+}
+
+func (p *icmpProber) close() {}
+
+// udpProber sends datagrams from one socket to a destination port
+// numbered after the probe
+type udpProber struct {
+	s    *session
+	conn *net.UDPConn
+	port int
+}
+
+func newUDP(s *session) (prober, error) {
+	network := "udp4"
+	if s.v6 {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &udpProber{s: s, conn: conn, port: conn.LocalAddr().(*net.UDPAddr).Port}, nil
+}
+
+func (p *udpProber) send(probe, ttl int) error {
+	if err := setConnTTL(p.conn, p.s.v6, ttl); err != nil {
+		return err
+	}
+	_, err := p.conn.WriteToUDP(payload, &net.UDPAddr{IP: p.s.target, Port: basePort + probe})
+	return err
+}
+
+func (p *udpProber) match(proto int, t []byte) int {
+	if proto != protoUDP || len(t) < 4 || int(binary.BigEndian.Uint16(t)) != p.port {
+		return -1
+	}
+	probe := int(binary.BigEndian.Uint16(t[2:])) - basePort
+	if probe < 0 {
+		return -1
+	}
+	return probe
+}
+
+func (p *udpProber) echo(id, seq int) int { return -1 }
+
+func (p *udpProber) close() {
+	p.conn.Close()
+}
+
+// tcpProber connects to the port from a new socket for each probe,
+// telling them apart by their source ports. A connection made or
+// refused means the host was reached.
+type tcpProber struct {
+	s     *session
+	port  int
+	lock  sync.Mutex
+	ports map[int]int
+}
+
+func newTCP(port int) func(s *session) (prober, error) {
+	return func(s *session) (prober, error) {
+		return &tcpProber{s: s, port: port, ports: map[int]int{}}, nil
+	}
+}
+
+// control sets the TTL and binds the socket before it connects so that
+// its source port is known.
+func (p *tcpProber) control(probe, ttl int) func(string, string, syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		err2 := c.Control(func(fd uintptr) {
+			if err = setTTL(int(fd), p.s.v6, ttl); err != nil {
+				return
+			}
+			var sa syscall.Sockaddr = &syscall.SockaddrInet4{}
+			if p.s.v6 {
+				sa = &syscall.SockaddrInet6{}
+			}
+			if err = syscall.Bind(int(fd), sa); err != nil {
+				return
+			}
+			if sa, err = syscall.Getsockname(int(fd)); err != nil {
+				return
+			}
+			port := 0
+			switch sa := sa.(type) {
+			case *syscall.SockaddrInet4:
+				port = sa.Port
+			case *syscall.SockaddrInet6:
+				port = sa.Port
+			}
+			p.lock.Lock()
+			p.ports[port] = probe
+			p.lock.Unlock()
+		})
+		if err2 != nil {
+			return err2
+		}
+		return err
+	}
+}
+
+func (p *tcpProber) send(probe, ttl int) error {
+	network := "tcp4"
+	if p.s.v6 {
+		network = "tcp6"
+	}
+	d := &net.Dialer{Timeout: Timeout, Control: p.control(probe, ttl)}
+	addr := (&net.TCPAddr{IP: p.s.target, Port: p.port}).String()
+	go func() {
+		conn, err := d.Dial(network, addr)
+		r := reply{probe: probe, from: p.s.target, at: time.Now(), reached: true}
+		switch {
+		case err == nil:
+			conn.Close()
+			r.note = "[open]"
+		case errors.Is(err, syscall.ECONNREFUSED):
+			r.note = "[closed]"
+		default:
+			return
+		}
+		p.s.deliver(r)
+	}()
+	return nil
+}
+
+func (p *tcpProber) match(proto int, t []byte) int {
+	if proto != protoTCP || len(t) < 4 || int(binary.BigEndian.Uint16(t[2:])) != p.port {
+		return -1
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	probe, ok := p.ports[int(binary.BigEndian.Uint16(t))]
+	if !ok {
+		return -1
+	}
+	return probe
+}
+
+func (p *tcpProber) echo(id, seq int) int { return -1 }
+
+func (p *tcpProber) close() {}
@@ -0,0 +1,220 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		data []byte
+		sum  uint16
+	}{
+		// The example in RFC 1071 section 3
+		{[]byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, 0xddf2},
+		// An odd byte is padded with zero
+		{[]byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6}, 0xdcfb},
+		// Carries wrap around more than once
+		{[]byte{0xff, 0xff, 0xff, 0xff, 0x00, 0x02}, 0x0002},
+		{nil, 0},
+	}
+	for _, test := range tests {
+		if sum := onesSum(test.data); sum != test.sum {
+			t.Errorf("% x: got sum %04x, want %04x", test.data, sum, test.sum)
+		}
+		if c := checksum(test.data); c != ^test.sum {
+			t.Errorf("% x: got checksum %04x, want %04x", test.data, c, ^test.sum)
+		}
+	}
+}
+
+func TestEchoRequest(t *testing.T) {
+	data := []byte("voice")
+	tests := []struct {
+		v6  bool
+		typ byte
+	}{
+		{false, echoRequest4},
+		{true, echoRequest6},
+	}
+	for _, test := range tests {
+		b := echoRequest(test.v6, 0xbeef, 0x1234, data)
+		if len(b) != 8+len(data) || b[0] != test.typ || b[1] != 0 ||
+			binary.BigEndian.Uint16(b[4:]) != 0xbeef || binary.BigEndian.Uint16(b[6:]) != 0x1234 ||
+			!bytes.Equal(b[8:], data) {
+			t.Errorf("v6 %v: got % x", test.v6, b)
+		}
+		sum := binary.BigEndian.Uint16(b[2:])
+		switch {
+		case test.v6 && sum != 0:
+			t.Errorf("v6: checksum %04x set, the kernel sets it", sum)
+		case !test.v6 && checksum(b) != 0:
+			t.Errorf("v4: checksum %04x does not check", sum)
+		}
+	}
+}
+
+func TestUnreachableNote(t *testing.T) {
+	tests := []struct {
+		v6   bool
+		code int
+		note string
+	}{
+		{false, 0, "!N"},
+		{false, 1, "!H"},
+		{false, 2, "!P"},
+		{false, 3, ""},
+		{false, 4, "!F"},
+		{false, 5, "!S"},
+		{false, 13, "!X"},
+		{false, 7, "!<7>"},
+		{true, 0, "!N"},
+		{true, 1, "!X"},
+		{true, 3, "!H"},
+		{true, 4, ""},
+		{true, 5, "!<5>"},
+	}
+	for _, test := range tests {
+		if note := unreachableNote(test.v6, test.code); note != test.note {
+			t.Errorf("v6 %v code %d: got %q, want %q", test.v6, test.code, note, test.note)
+		}
+	}
+}
+
+var (
+	target4 = net.ParseIP("192.0.2.1")
+	target6 = net.ParseIP("2001:db8::1")
+	router4 = net.ParseIP("198.51.100.1")
+	router6 = net.ParseIP("2001:db8:1::1")
+)
+
+// packet gives an IP header for a packet of the protocol sent to the
+// destination, with options of the length given for IPv4, followed by
+// the transport header.
+func packet(proto int, dst net.IP, options int, transport []byte) []byte {
+	if dst.To4() == nil {
+		b := make([]byte, 40)
+		b[0], b[6], b[7] = 0x60, byte(proto), 1
+		copy(b[24:], dst.To16())
+		return append(b, transport...)
+	}
+	b := make([]byte, 20+options)
+	b[0], b[8], b[9] = 0x40|byte(len(b)/4), 1, byte(proto)
+	copy(b[16:], dst.To4())
+	return append(b, transport...)
+}
+
+// icmp gives an ICMP message with the second word of its header and
+// its data
+func icmp(typ, code int, word uint32, data []byte) []byte {
+	b := make([]byte, 8)
+	b[0], b[1] = byte(typ), byte(code)
+	binary.BigEndian.PutUint32(b[4:], word)
+	return append(b, data...)
+}
+
+// ports gives the first bytes of a UDP or TCP header
+func ports(src, dst int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint16(b, uint16(src))
+	binary.BigEndian.PutUint16(b[2:], uint16(dst))
+	return b
+}
+
+func TestQuoted(t *testing.T) {
+	udp := ports(40000, basePort)
+	tests := []struct {
+		name  string
+		b     []byte
+		v6    bool
+		proto int
+		dst   net.IP
+		ok    bool
+	}{
+		{"v4", packet(protoUDP, target4, 0, udp), false, protoUDP, target4, true},
+		{"v4 with options", packet(protoUDP, target4, 8, udp), false, protoUDP, target4, true},
+		{"v6", packet(protoUDP, target6, 0, udp), true, protoUDP, target6, true},
+		{"v4 short", packet(protoUDP, target4, 0, nil)[:19], false, 0, nil, false},
+		{"v4 options cut", packet(protoUDP, target4, 8, nil)[:24], false, 0, nil, false},
+		{"v4 bad length", append([]byte{0x44}, make([]byte, 19)...), false, 0, nil, false},
+		{"v6 short", packet(protoUDP, target6, 0, nil)[:39], true, 0, nil, false},
+	}
+	for _, test := range tests {
+		proto, dst, transport, ok := quoted(test.b, test.v6)
+		if ok != test.ok {
+			t.Errorf("%s: got ok %v", test.name, ok)
+			continue
+		}
+		if ok && (proto != test.proto || !dst.Equal(test.dst) || !bytes.Equal(transport, udp)) {
+			t.Errorf("%s: got %d %s % x", test.name, proto, dst, transport)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	icmp4 := &icmpProber{id: 0xbeef}
+	udp := &udpProber{port: 40000}
+	tcp := &tcpProber{port: 443, ports: map[int]int{50000: 2}}
+	request4 := func(id, seq int) []byte { return packet(protoICMP, target4, 0, echoRequest(false, id, seq, payload)) }
+	request6 := func(id, seq int) []byte { return packet(protoICMPv6, target6, 0, echoRequest(true, id, seq, payload)) }
+
+	tests := []struct {
+		name    string
+		target  net.IP
+		p       prober
+		b       []byte
+		ok      bool
+		probe   int
+		reached bool
+		note    string
+		mtu     int
+	}{
+		{"time exceeded", target4, icmp4, icmp(timeExceeded4, 0, 0, request4(0xbeef, 7)), true, 7, false, "", 0},
+		{"another's request", target4, icmp4, icmp(timeExceeded4, 0, 0, request4(0xcafe, 7)), false, 0, false, "", 0},
+		{"another target", target4, icmp4, icmp(timeExceeded4, 0, 0,
+			packet(protoICMP, router4, 0, echoRequest(false, 0xbeef, 7, nil))), false, 0, false, "", 0},
+		{"echo reply", target4, icmp4, icmp(echoReply4, 0, 0xbeef0005, nil), true, 5, true, "", 0},
+		{"another's reply", target4, icmp4, icmp(echoReply4, 0, 0xcafe0005, nil), false, 0, false, "", 0},
+		{"v6 reply to v4", target4, icmp4, icmp(echoReply6, 0, 0xbeef0005, nil), false, 0, false, "", 0},
+		{"host unreachable", target4, icmp4, icmp(unreachable4, 1, 0, request4(0xbeef, 3)), true, 3, false, "!H", 0},
+		{"fragmentation needed", target4, icmp4, icmp(unreachable4, 4, 1400, request4(0xbeef, 3)), true, 3, false, "!F", 1400},
+		{"port unreachable", target4, udp, icmp(unreachable4, 3, 0,
+			packet(protoUDP, target4, 0, ports(40000, basePort+4))), true, 4, true, "", 0},
+		{"another's datagram", target4, udp, icmp(unreachable4, 3, 0,
+			packet(protoUDP, target4, 0, ports(40001, basePort+4))), false, 0, false, "", 0},
+		{"below the base port", target4, udp, icmp(timeExceeded4, 0, 0,
+			packet(protoUDP, target4, 0, ports(40000, 53))), false, 0, false, "", 0},
+		{"tcp time exceeded", target4, tcp, icmp(timeExceeded4, 0, 0,
+			packet(protoTCP, target4, 0, ports(50000, 443))), true, 2, false, "", 0},
+		{"unknown source port", target4, tcp, icmp(timeExceeded4, 0, 0,
+			packet(protoTCP, target4, 0, ports(50001, 443))), false, 0, false, "", 0},
+		{"other protocol", target4, tcp, icmp(timeExceeded4, 0, 0,
+			packet(protoUDP, target4, 0, ports(50000, 443))), false, 0, false, "", 0},
+		{"short", target4, icmp4, icmp(timeExceeded4, 0, 0, nil)[:7], false, 0, false, "", 0},
+		{"v6 time exceeded", target6, icmp4, icmp(timeExceeded6, 0, 0, request6(0xbeef, 9)), true, 9, false, "", 0},
+		{"v6 echo reply", target6, icmp4, icmp(echoReply6, 0, 0xbeef0009, nil), true, 9, true, "", 0},
+		{"v6 packet too big", target6, icmp4, icmp(packetTooBig6, 0, 1280, request6(0xbeef, 9)), true, 9, false, "!F", 1280},
+		{"v6 port unreachable", target6, udp, icmp(unreachable6, 4, 0,
+			packet(protoUDP, target6, 0, ports(40000, basePort+1))), true, 1, true, "", 0},
+		{"v6 admin prohibited", target6, icmp4, icmp(unreachable6, 1, 0, request6(0xbeef, 9)), true, 9, false, "!X", 0},
+	}
+	for _, test := range tests {
+		s := &session{target: test.target, v6: test.target.To4() == nil}
+		at := time.Now()
+		r, ok := s.parse(test.p, test.b, router4, at)
+		if ok != test.ok {
+			t.Errorf("%s: got ok %v", test.name, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if r.probe != test.probe || r.reached != test.reached || r.note != test.note ||
+			r.tooBig != (test.mtu != 0) || r.mtu != test.mtu || !r.from.Equal(router4) || !r.at.Equal(at) {
+			t.Errorf("%s: got %+v", test.name, r)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package trace
+
+import (
+	"net"
+	"time"
+)
+
+// The most echo requests sent in a stream, as sequence numbers are 16
+// bits
+const MaxStream = 0xffff
+
+// An Echo is one of the requests of a stream and its reply
+type Echo struct {
+	Seq  int
+	Sent time.Time
+	// Zero if the request went unanswered
+	Received time.Time
+	// The place of the reply among those received, from 1, or 0 if
+	// there was none
+	Arrival int
+	// Replies received beyond the first
+	Dups int
+}
+
+// RTT gives the round trip time of the request, 0 if it was lost
+func (e *Echo) RTT() time.Duration {
+	if e.Received.IsZero() {
+		return 0
+	}
+	return e.Received.Sub(e.Sent)
+}
+
+// A Stream gives the echo requests sent to a target in order of their
+// sequence numbers.
+type Stream struct {
+	Target   net.IP
+	Size     int
+	Interval time.Duration
+	Echoes   []Echo
+}
+
+// EchoStream sends count echo requests carrying size bytes of data to
+// the host over IPv4 or IPv6, one every interval, as a stream of voice
+// packets would be, and waits Timeout after the last for replies.
+func EchoStream(host string, v6 bool, count int, interval time.Duration, size int) (res *Stream, err error) {
+	if count > MaxStream {
+		count = MaxStream
+	}
+	target, err := resolve(host, v6)
+	if err != nil {
+		return
+	}
+	s, err := newSession(target)
+	if err != nil {
+		return
+	}
+	defer s.close()
+	pr, err := newICMP(s)
+	if err != nil {
+		return
+	}
+	defer pr.close()
+	go s.listen(pr)
+	p := pr.(*icmpProber)
+
+	res = &Stream{Target: target, Size: size, Interval: interval, Echoes: make([]Echo, count)}
+	data := make([]byte, size)
+	// The replies are taken as they come while requests are sent, so
+	// that their times are those they arrived at. Each request is
+	// numbered on sent before it goes, so that its reply is never
+	// taken before it.
+	collected := make(chan bool)
+	stop := make(chan bool)
+	sent := make(chan int, count)
+	go func() {
+		defer close(collected)
+		arrivals, last, in := 0, -1, sent
+		var deadline <-chan time.Time
+		take := func(i int, ok bool) {
+			if !ok {
+				in = nil
+				deadline = time.After(Timeout)
+				return
+			}
+			last = i
+		}
+		for {
+			select {
+			case i, ok := <-in:
+				take(i, ok)
+			case r := <-s.replies:
+				for in != nil && r.probe > last {
+					i, ok := <-in
+					take(i, ok)
+				}
+				if r.probe > last || !r.reached {
+					continue
+				}
+				e := &res.Echoes[r.probe]
+				if !e.Received.IsZero() {
+					e.Dups++
+					continue
+				}
+				arrivals++
+				e.Received, e.Arrival = r.at, arrivals
+			case <-deadline:
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			<-tick.C
+		}
+		res.Echoes[i] = Echo{Seq: i, Sent: time.Now()}
+		sent <- i
+		if err = p.sendData(i, MaxHops, data); err != nil {
+			close(stop)
+			<-collected
+			return
+		}
+	}
+	close(sent)
+	<-collected
+	return
+}
@@ -0,0 +1,526 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/rminnich/go9p"
+	"hubs.net.uk/sw/nopfs"
+	"hubs.net.uk/sw/nopfs/dns"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var readme_trace = `
+Traceroute
+==========
+
+This directory traces the path to the host, sending probes with
+increasing TTLs and listening for the ICMP time exceeded messages sent
+back by each router along the way, without needing traceroute(8) or
+mtr(8) to be installed.
+
+  icmp        Probe with ICMP echo requests, as traceroute -I does
+  udp         Probe with UDP datagrams to high ports, as traceroute
+              does by default
+  tcp/p       Probe with TCP SYNs to port p, as in tcp/443, which
+              reach hosts behind firewalls that allow the service.
+              These files are not listed.
+
+  paris       Probe with UDP datagrams whose addresses and ports stay
+              the same, as Paris traceroute does, so that routers
+              balancing load over several links send every probe the
+              same way instead of mixing the hops of different paths
+  multipath   Find every path the load balancers along the way may
+              send a flow down, probing each hop along more flows until
+              no further branch is likely to be found, as in the
+              Multipath Detection Algorithm. Where paths branch or join
+              each address is shown with the share of flows reaching it
+              and the addresses at the hop before they came through.
+
+Each has a counterpart over IPv6, icmp6, udp6, tcp6/p, paris6 and
+multipath6, while the others use IPv4. Every hop is sent 3 probes, waiting a second for
+replies, up to 30 hops. As with traceroute, !H, !N, !P, !X and so on
+mark unreachables and [open] or [closed] the state of a TCP port.
+
+The server needs CAP_NET_RAW to listen for ICMP.
+
+`
+var Readme nopfs.Dispatcher = nopfs.NewFile([]byte(readme_trace))
+
+// The most hops traced
+var MaxHops = 30
+
+// The number of probes sent to each hop
+var Probes = 3
+
+// Time to wait for the replies to the probes of a hop
+var Timeout = time.Second
+
+// Time allowed for looking up the names of the hops
+var NameTimeout = 2 * time.Second
+
+// A Reply to a probe
+type Reply struct {
+	From net.IP
+	RTT  time.Duration
+	// Set when the reply came from the host itself
+	Reached bool
+	// An unreachable as traceroute marks it, such as !H, or the state
+	// of a TCP port
+	Note string
+}
+
+// A Hop gives the replies to each of the probes sent with its TTL,
+// nil for those that went unanswered.
+type Hop struct {
+	TTL     int
+	Replies []*Reply
+}
+
+type Result struct {
+	Target  net.IP
+	Method  string
+	Hops    []Hop
+	Reached bool
+}
+
+// reply is a reply to a probe as it is received
+type reply struct {
+	probe   int
+	from    net.IP
+	at      time.Time
+	reached bool
+	note    string
+	// Set for fragmentation needed and packet too big messages, with
+	// the MTU they give
+	tooBig bool
+	mtu    int
+}
+
+// A prober sends one kind of probe and recognises the replies to them
+type prober interface {
+	// send sends the numbered probe with the TTL
+	send(probe, ttl int) error
+	// match gives the number of the probe quoted in an ICMP error, by
+	// its protocol and transport header, or -1 if it is not one
+	match(proto int, transport []byte) int
+	// echo gives the number of the probe answered by an echo reply, or
+	// -1 if it is not one
+	echo(id, seq int) int
+	close()
+}
+
+// A session listens for the ICMP messages sent back in reply to the
+// probes sent to a target.
+type session struct {
+	target  net.IP
+	v6      bool
+	conn    *net.IPConn
+	replies chan reply
+	done    chan bool
+}
+
+func newSession(target net.IP) (s *session, err error) {
+	s = &session{target: target, v6: target.To4() == nil}
+	s.replies = make(chan reply, 256)
+	s.done = make(chan bool)
+	if s.v6 {
+		s.conn, err = net.ListenIP("ip6:ipv6-icmp", &net.IPAddr{IP: net.IPv6unspecified})
+	} else {
+		s.conn, err = net.ListenIP("ip4:icmp", &net.IPAddr{IP: net.IPv4zero})
+	}
+	if err != nil {
+		err = fmt.Errorf("listening for ICMP: %s", err)
+	}
+	return
+}
+
+func (s *session) close() {
+	close(s.done)
+	s.conn.Close()
+}
+
+// deliver passes on a reply unless the trace is over
+func (s *session) deliver(r reply) {
+	select {
+	case s.replies <- r:
+	case <-s.done:
+	}
+}
+
+// setTTL sets the TTL, or hop limit, of the packets sent on a socket
+func setTTL(fd int, v6 bool, ttl int) error {
+	if v6 {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+}
+
+func setConnTTL(c syscall.Conn, v6 bool, ttl int) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	err2 := rc.Control(func(fd uintptr) {
+		err = setTTL(int(fd), v6, ttl)
+	})
+	if err2 != nil {
+		return err2
+	}
+	return err
+}
+
+// ICMP types
+const (
+	echoReply4    = 0
+	unreachable4  = 3
+	echoRequest4  = 8
+	timeExceeded4 = 11
+	unreachable6  = 1
+	packetTooBig6 = 2
+	timeExceeded6 = 3
+	echoRequest6  = 128
+	echoReply6    = 129
+)
+
+// Transport protocols
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+// unreachableNote gives the mark traceroute uses for an unreachable
+// code, or the empty string for a port unreachable, which is taken to
+// come from the host itself.
+func unreachableNote(v6 bool, code int) string {
+	if v6 {
+		switch code {
+		case 0:
+			return "!N"
+		case 1:
+			return "!X"
+		case 3:
+			return "!H"
+		case 4:
+			return ""
+		}
+		return fmt.Sprintf("!<%d>", code)
+	}
+	switch code {
+	case 0:
+		return "!N"
+	case 1:
+		return "!H"
+	case 2:
+		return "!P"
+	case 3:
+		return ""
+	case 4:
+		return "!F"
+	case 5:
+		return "!S"
+	case 9, 10, 13:
+		return "!X"
+	}
+	return fmt.Sprintf("!<%d>", code)
+}
+
+// quoted picks out the protocol, destination and transport header of
+// the packet quoted in an ICMP error.
+func quoted(b []byte, v6 bool) (proto int, dst net.IP, transport []byte, ok bool) {
+	if v6 {
+		if len(b) < 40 {
+			return
+		}
+		return int(b[6]), net.IP(b[24:40]), b[40:], true
+	}
+	if len(b) < 20 {
+		return
+	}
+	ihl := int(b[0]&0x0f) * 4
+	if ihl < 20 || len(b) < ihl {
+		return
+	}
+	return int(b[9]), net.IP(b[16:20]), b[ihl:], true
+}
+
+// parse recognises an ICMP message sent in reply to one of the probes
+func (s *session) parse(p prober, b []byte, from net.IP, at time.Time) (r reply, ok bool) {
+	if len(b) < 8 {
+		return
+	}
+	typ, code := int(b[0]), int(b[1])
+	r = reply{from: from, at: at}
+	switch {
+	case (!s.v6 && typ == echoReply4) || (s.v6 && typ == echoReply6):
+		r.probe = p.echo(int(binary.BigEndian.Uint16(b[4:])), int(binary.BigEndian.Uint16(b[6:])))
+		r.reached = true
+		return r, r.probe >= 0
+	case (!s.v6 && typ == timeExceeded4) || (s.v6 && typ == timeExceeded6):
+	case (!s.v6 && typ == unreachable4) || (s.v6 && typ == unreachable6):
+		r.note = unreachableNote(s.v6, code)
+		r.reached = r.note == ""
+		if !s.v6 && code == 4 {
+			r.tooBig = true
+			r.mtu = int(binary.BigEndian.Uint16(b[6:]))
+		}
+	case s.v6 && typ == packetTooBig6:
+		r.note = "!F"
+		r.tooBig = true
+		r.mtu = int(binary.BigEndian.Uint32(b[4:]))
+	default:
+		return
+	}
+	proto, dst, transport, ok := quoted(b[8:], s.v6)
+	if !ok || !dst.Equal(s.target) {
+		return r, false
+	}
+	r.probe = p.match(proto, transport)
+	return r, r.probe >= 0
+}
+
+// listen passes on the replies to the probes until the session ends
+func (s *session) listen(p prober) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.conn.ReadFromIP(buf)
+		if err != nil {
+			return
+		}
+		if r, ok := s.parse(p, buf[:n], addr.IP, time.Now()); ok {
+			s.deliver(r)
+		}
+	}
+}
+
+// run traces the path to the session's target with the probes
+func (s *session) run(p prober, method string) (res *Result, err error) {
+	res = &Result{Target: s.target, Method: method}
+	go s.listen(p)
+	for ttl := 1; ttl <= MaxHops && !res.Reached; ttl++ {
+		hop := Hop{TTL: ttl, Replies: make([]*Reply, Probes)}
+		first := (ttl - 1) * Probes
+		sent := make([]time.Time, Probes)
+		for i := range sent {
+			sent[i] = time.Now()
+			if err = p.send(first+i, ttl); err != nil {
+				return
+			}
+		}
+		deadline := time.After(Timeout)
+		stop := false
+	wait:
+		for answered := 0; answered < Probes; {
+			select {
+			case r := <-s.replies:
+				i := r.probe - first
+				if i < 0 || i >= Probes || hop.Replies[i] != nil {
+					continue
+				}
+				hop.Replies[i] = &Reply{From: r.from, RTT: r.at.Sub(sent[i]), Reached: r.reached, Note: r.note}
+				answered++
+				res.Reached = res.Reached || r.reached
+				stop = stop || r.note != ""
+			case <-deadline:
+				break wait
+			}
+		}
+		res.Hops = append(res.Hops, hop)
+		if stop {
+			break
+		}
+	}
+	return
+}
+
+// names looks up the names of the addresses, giving up on those that
+// take longer than NameTimeout.
+func names(addrs []net.IP) map[string]string {
+	found := map[string]string{}
+	type named struct{ addr, name string }
+	ch := make(chan named, len(addrs))
+	n := 0
+	for _, ip := range addrs {
+		addr := ip.String()
+		if _, ok := found[addr]; ok {
+			continue
+		}
+		found[addr] = addr
+		n++
+		go func() {
+			name := addr
+			if names, err := dns.LookupAddr(addr, ""); err == nil && len(names) > 0 {
+				name = strings.TrimSuffix(names[0], ".")
+			}
+			ch <- named{addr, name}
+		}()
+	}
+	deadline := time.After(NameTimeout)
+	for ; n > 0; n-- {
+		select {
+		case r := <-ch:
+			found[r.addr] = r.name
+		case <-deadline:
+			return found
+		}
+	}
+	return found
+}
+
+// Format writes the result as traceroute does, naming the address of
+// each hop again only when it changes.
+func (res *Result) Format(host string) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "traceroute to %s (%s), %d hops max, %s probes\n", host, res.Target, MaxHops, res.Method)
+	var addrs []net.IP
+	for _, hop := range res.Hops {
+		for _, r := range hop.Replies {
+			if r != nil {
+				addrs = append(addrs, r.From)
+			}
+		}
+	}
+	found := names(addrs)
+	for _, hop := range res.Hops {
+		fmt.Fprintf(buf, "%2d ", hop.TTL)
+		var last net.IP
+		for _, r := range hop.Replies {
+			if r == nil {
+				buf.WriteString(" *")
+				continue
+			}
+			if !r.From.Equal(last) {
+				name := found[r.From.String()]
+				fmt.Fprintf(buf, " %s (%s)", name, r.From)
+				last = r.From
+			}
+			fmt.Fprintf(buf, "  %.3f ms", float64(r.RTT)/float64(time.Millisecond))
+			if r.Note != "" {
+				fmt.Fprintf(buf, " %s", r.Note)
+			}
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// resolve finds the address of the host in the family asked for
+func resolve(host string, v6 bool) (net.IP, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	for _, ip := range ips {
+		if (ip.To4() == nil) == v6 {
+			return ip, nil
+		}
+	}
+	if v6 {
+		return nil, fmt.Errorf("%s has no IPv6 address", host)
+	}
+	return nil, fmt.Errorf("%s has no IPv4 address", host)
+}
+
+// traceHost traces the path to the host over IPv4 or IPv6 with probes made
+// by the function, which is given the session they belong to.
+func traceHost(host string, v6 bool, method string, newProber func(s *session) (prober, error)) (res *Result, err error) {
+	target, err := resolve(host, v6)
+	if err != nil {
+		return
+	}
+	s, err := newSession(target)
+	if err != nil {
+		return
+	}
+	defer s.close()
+	p, err := newProber(s)
+	if err != nil {
+		return
+	}
+	defer p.close()
+	return s.run(p, method)
+}
+
+// traceF gives the function for a file tracing the path to the host
+// with the probes
+func traceF(v6 bool, method string, newProber func(s *session) (prober, error)) func(string) ([]byte, error) {
+	return func(host string) ([]byte, error) {
+		res, err := traceHost(host, v6, method, newProber)
+		if err != nil {
+			return nil, err
+		}
+		return res.Format(host), nil
+	}
+}
+
+func traceFile(v6 bool, method string, newProber func(s *session) (prober, error)) *nopfs.Fun {
+	return nopfs.NewFun(nopfs.HostF(traceF(v6, method, newProber))).Limit("traceroute")
+}
+
+// portDir contains a file for each TCP port tracing the path with
+// probes to that port. These are not listed.
+type portDir struct {
+	nopfs.Path
+	v6 bool
+}
+
+func (d *portDir) IsDir() bool                       { return true }
+func (d *portDir) Perms() uint32                     { return 0555 }
+func (d *portDir) Size() uint64                      { return uint64(0) }
+func (d *portDir) Write(*go9p.SrvReq, []byte) error  { return os.ErrInvalid }
+func (d *portDir) Read(*go9p.SrvReq) ([]byte, error) { return []byte{}, nil }
+func (d *portDir) Close()                            {}
+func (d *portDir) Flush(*go9p.SrvReq)                {}
+
+func (d *portDir) Clone() nopfs.Dispatcher {
+	n := &portDir{v6: d.v6}
+	n.SetPath(d.GetPath())
+	n.SetParent(d.GetParent())
+	return n
+}
+
+func (d *portDir) Walk(req *go9p.SrvReq, name string) (nopfs.Dispatcher, error) {
+	port, err := strconv.Atoi(name)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, os.ErrNotExist
+	}
+	f := traceFile(d.v6, "tcp/"+name, newTCP(port))
+	f.SetPath(append(append([]string{}, d.GetPath()...), name))
+	f.SetParent(d)
+	return f, nil
+}
+
+var ICMP nopfs.Dispatcher = traceFile(false, "icmp", newICMP)
+var ICMP6 nopfs.Dispatcher = traceFile(true, "icmp", newICMP)
+var UDP nopfs.Dispatcher = traceFile(false, "udp", newUDP)
+var UDP6 nopfs.Dispatcher = traceFile(true, "udp", newUDP)
+var TCP nopfs.Dispatcher = &portDir{}
+var TCP6 nopfs.Dispatcher = &portDir{v6: true}
+var Paris nopfs.Dispatcher = traceFile(false, "paris udp", newParis)
+var Paris6 nopfs.Dispatcher = traceFile(true, "paris udp", newParis)
+var Multipath nopfs.Dispatcher = multipathFile(false)
+var Multipath6 nopfs.Dispatcher = multipathFile(true)
+
+var Dir *nopfs.Dir
+
+func init() {
+	Dir = nopfs.NewDir()
+	Dir.Append("README.txt", Readme)
+	Dir.Append("icmp", ICMP)
+	Dir.Append("icmp6", ICMP6)
+	Dir.Append("udp", UDP)
+	Dir.Append("udp6", UDP6)
+	Dir.Append("tcp", TCP)
+	Dir.Append("tcp6", TCP6)
+	Dir.Append("paris", Paris)
+	Dir.Append("paris6", Paris6)
+	Dir.Append("multipath", Multipath)
+	Dir.Append("multipath6", Multipath6)
+}
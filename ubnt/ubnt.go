@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"hubs.net.uk/sw/nopfs"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"regexp"
@@ -48,10 +47,9 @@ func aflist_update(data []byte) {
 
 func aflist(tick *time.Ticker) {
 	for _ = range tick.C {
-		cmd := exec.Command(aflist_prog)
-		data, err := cmd.CombinedOutput()
+		data, err := nopfs.RunCommand("aflist", exec.Command(aflist_prog))
 		if err != nil {
-			log.Printf("aflist: %s", err)
+			nopfs.Log.Error("aflist", "error", err)
 		} else {
 			aflist_update(data)
 		}
@@ -0,0 +1,476 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hubs.net.uk/sw/nopfs"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var readme_http = `
+HTTP and HTTPS
+==============
+
+This directory makes a request of the host's web server, by default
+GET http://host/, following any redirects. The files all describe the
+same request, which is made again once it is more than 5 seconds old.
+
+  status      The protocol and status of the final response
+  headers     The headers of the final response
+  timing      How long the final request spent looking up the host,
+              connecting, in the TLS handshake, waiting for the first
+              byte of the response and in all
+  redirects   Each request made, with its status, method and URL
+  body        The first megabyte of the final response body
+  params      Write to change the request, one setting per line,
+              giving back the settings in force
+
+The settings are
+
+  method m         the request method, as in HEAD or POST
+  path p           the path and query requested, as in /health?full
+  scheme s         http or https
+  port n           the port to connect to, if not the usual one
+  header h: v      a request header, which may be repeated; with no
+                   value the header is removed
+  body text        the request body
+  follow yes|no    whether redirects are followed, up to 10
+  insecure yes|no  whether to accept any TLS certificate
+  timeout d        time allowed for the whole request, as in 10s
+  reset            go back to the defaults
+
+for example
+
+  % echo 'scheme https
+  path /status' > params
+  % cat status timing
+
+`
+var Readme nopfs.Dispatcher = nopfs.NewFile([]byte(readme_http))
+
+// Time for which the result of a request is given again rather than
+// making it again
+var Reuse = 5 * time.Second
+
+// The most redirects followed, and the most of a body read
+var MaxRedirects = 10
+var MaxBody int64 = 1 << 20
+
+// params describe the request to make of a host
+type params struct {
+	method   string
+	path     string
+	scheme   string
+	port     int
+	header   http.Header
+	body     string
+	follow   bool
+	insecure bool
+	timeout  time.Duration
+}
+
+func defaults() params {
+	return params{
+		method:  "GET",
+		path:    "/",
+		scheme:  "http",
+		header:  http.Header{},
+		follow:  true,
+		timeout: 10 * time.Second,
+	}
+}
+
+func yesNo(s string) (bool, error) {
+	switch s {
+	case "yes", "true", "on":
+		return true, nil
+	case "no", "false", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected yes or no: %s", s)
+}
+
+// set changes the setting named on the line
+func (p *params) set(line string) (err error) {
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+	name, value := fields[0], ""
+	if len(fields) > 1 {
+		value = strings.TrimSpace(fields[1])
+	}
+	switch name {
+	case "method":
+		if value == "" || strings.ContainsAny(value, " \t") {
+			return fmt.Errorf("bad method: %s", value)
+		}
+		p.method = strings.ToUpper(value)
+	case "path":
+		if !strings.HasPrefix(value, "/") {
+			value = "/" + value
+		}
+		p.path = value
+	case "scheme":
+		if value != "http" && value != "https" {
+			return fmt.Errorf("expected http or https: %s", value)
+		}
+		p.scheme = value
+	case "port":
+		p.port, err = strconv.Atoi(value)
+		if err != nil || p.port < 0 || p.port > 65535 {
+			return fmt.Errorf("bad port: %s", value)
+		}
+	case "header":
+		kv := strings.SplitN(value, ":", 2)
+		key := http.CanonicalHeaderKey(strings.TrimSpace(kv[0]))
+		if key == "" {
+			return fmt.Errorf("bad header: %s", value)
+		}
+		if len(kv) < 2 || strings.TrimSpace(kv[1]) == "" {
+			p.header.Del(key)
+		} else {
+			p.header.Add(key, strings.TrimSpace(kv[1]))
+		}
+	case "body":
+		p.body = value
+	case "follow":
+		p.follow, err = yesNo(value)
+	case "insecure":
+		p.insecure, err = yesNo(value)
+	case "timeout":
+		p.timeout, err = time.ParseDuration(value)
+		if err == nil && p.timeout <= 0 {
+			err = fmt.Errorf("bad timeout: %s", value)
+		}
+	case "reset":
+		*p = defaults()
+	default:
+		err = fmt.Errorf("unknown setting: %s", line)
+	}
+	return
+}
+
+func (p *params) text() []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "method %s\npath %s\nscheme %s\n", p.method, p.path, p.scheme)
+	if p.port != 0 {
+		fmt.Fprintf(buf, "port %d\n", p.port)
+	}
+	keys := make([]string, 0, len(p.header))
+	for k := range p.header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range p.header[k] {
+			fmt.Fprintf(buf, "header %s: %s\n", k, v)
+		}
+	}
+	if p.body != "" {
+		fmt.Fprintf(buf, "body %s\n", p.body)
+	}
+	yn := map[bool]string{true: "yes", false: "no"}
+	fmt.Fprintf(buf, "follow %s\ninsecure %s\ntimeout %s\n", yn[p.follow], yn[p.insecure], p.timeout)
+	return buf.Bytes()
+}
+
+// url gives the URL first requested of the host
+func (p *params) url(host string) string {
+	if p.port != 0 {
+		host = net.JoinHostPort(host, strconv.Itoa(p.port))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return p.scheme + "://" + host + p.path
+}
+
+// Timing gives how long each part of a request took. Parts that were
+// not needed are zero.
+type Timing struct {
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+	TTFB    time.Duration
+	Total   time.Duration
+}
+
+// A Hop is one of the requests made in following redirects
+type Hop struct {
+	Method string
+	URL    string
+	Proto  string
+	Status string
+	Code   int
+	Header http.Header
+	Timing Timing
+}
+
+// A Result is what came of the requests made of a host
+type Result struct {
+	Hops []Hop
+	Body []byte
+	made time.Time
+}
+
+// A site holds the request to make of a host and its last result
+type site struct {
+	sync.Mutex
+	params params
+	result *Result
+}
+
+var sites = struct {
+	sync.Mutex
+	m map[string]*site
+}{m: make(map[string]*site)}
+
+func siteOf(host string) *site {
+	host = strings.ToLower(host)
+	sites.Lock()
+	defer sites.Unlock()
+	s, ok := sites.m[host]
+	if !ok {
+		s = &site{params: defaults()}
+		sites.m[host] = s
+	}
+	return s
+}
+
+// fetch makes one request, timing each part of it, and reads the body
+func fetch(ctx context.Context, client *http.Client, p *params, method, u string, body string) (hop Hop, resp *http.Response, data []byte, err error) {
+	hop = Hop{Method: method, URL: u}
+	var t0, dnsStart, connStart, tlsStart time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:           func(httptrace.DNSDoneInfo) { hop.Timing.DNS = time.Since(dnsStart) },
+		ConnectStart:      func(string, string) { connStart = time.Now() },
+		ConnectDone:       func(string, string, error) { hop.Timing.Connect = time.Since(connStart) },
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			hop.Timing.TLS = time.Since(tlsStart)
+		},
+		GotFirstResponseByte: func() { hop.Timing.TTFB = time.Since(t0) },
+	}
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), method, u, r)
+	if err != nil {
+		return
+	}
+	for k, v := range p.header {
+		req.Header[k] = v
+	}
+	if h := p.header.Get("Host"); h != "" {
+		req.Host = h
+	}
+	t0 = time.Now()
+	resp, err = client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	data, err = ioutil.ReadAll(io.LimitReader(resp.Body, MaxBody))
+	hop.Timing.Total = time.Since(t0)
+	hop.Proto, hop.Status, hop.Code, hop.Header = resp.Proto, resp.Status, resp.StatusCode, resp.Header
+	return
+}
+
+// request makes the request described by the parameters, following
+// redirects if asked to.
+func request(host string, p params) (res *Result, err error) {
+	transport := &http.Transport{
+		DialContext:         (&net.Dialer{}).DialContext,
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: p.insecure},
+		TLSHandshakeTimeout: p.timeout,
+		DisableKeepAlives:   true,
+		ForceAttemptHTTP2:   true,
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	// The timeout bounds the whole chain of redirects
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	res = &Result{made: time.Now()}
+	method, u, body := p.method, p.url(host), p.body
+	for {
+		hop, resp, data, err := fetch(ctx, client, &p, method, u, body)
+		if err != nil {
+			return res, err
+		}
+		res.Hops = append(res.Hops, hop)
+		res.Body = data
+		loc, lerr := resp.Location()
+		if !p.follow || lerr != nil || hop.Code < 300 || hop.Code > 399 {
+			return res, nil
+		}
+		if len(res.Hops) > MaxRedirects {
+			return res, fmt.Errorf("more than %d redirects", MaxRedirects)
+		}
+		switch hop.Code {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+			if hop.Code == http.StatusSeeOther || method == "POST" {
+				method, body = "GET", ""
+			}
+		}
+		u = loc.String()
+	}
+}
+
+// get gives the result of the host's request, making it if there is no
+// result yet or it is more than Reuse old
+func get(host string) (*Result, error) {
+	s := siteOf(host)
+	s.Lock()
+	defer s.Unlock()
+	if s.result != nil && time.Since(s.result.made) < Reuse {
+		return s.result, nil
+	}
+	res, err := request(host, s.params)
+	if err != nil {
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
+		nopfs.Log.Info("http", "host", host, "url", s.params.url(host), "error", err)
+		return nil, err
+	}
+	s.result = res
+	return res, nil
+}
+
+func final(res *Result) *Hop {
+	return &res.Hops[len(res.Hops)-1]
+}
+
+func status(host string) ([]byte, error) {
+	res, err := get(host)
+	if err != nil {
+		return nil, err
+	}
+	h := final(res)
+	return []byte(fmt.Sprintf("%s %s\n", h.Proto, h.Status)), nil
+}
+
+func headers(host string) ([]byte, error) {
+	res, err := get(host)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	final(res).Header.Write(buf)
+	return bytes.Replace(buf.Bytes(), []byte("\r\n"), []byte("\n"), -1), nil
+}
+
+func ms(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.3f ms", float64(d)/float64(time.Millisecond))
+}
+
+func timing(host string) ([]byte, error) {
+	res, err := get(host)
+	if err != nil {
+		return nil, err
+	}
+	t := final(res).Timing
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "dns      %s\n", ms(t.DNS))
+	fmt.Fprintf(buf, "connect  %s\n", ms(t.Connect))
+	fmt.Fprintf(buf, "tls      %s\n", ms(t.TLS))
+	fmt.Fprintf(buf, "ttfb     %s\n", ms(t.TTFB))
+	fmt.Fprintf(buf, "total    %s\n", ms(t.Total))
+	if len(res.Hops) > 1 {
+		var all time.Duration
+		for _, h := range res.Hops {
+			all += h.Timing.Total
+		}
+		fmt.Fprintf(buf, "%d redirects, %s in all\n", len(res.Hops)-1, ms(all))
+	}
+	return buf.Bytes(), nil
+}
+
+func redirects(host string) ([]byte, error) {
+	res, err := get(host)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	for _, h := range res.Hops {
+		fmt.Fprintf(buf, "%d %s %s\n", h.Code, h.Method, h.URL)
+	}
+	return buf.Bytes(), nil
+}
+
+func body(host string) ([]byte, error) {
+	res, err := get(host)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// paramsCtl changes the host's request, one setting per line
+func paramsCtl(c *nopfs.Ctl, data []byte) (resp []byte, err error) {
+	path := c.GetPath()
+	if len(path) < 2 {
+		err = os.ErrInvalid
+		return
+	}
+	s := siteOf(path[1])
+	s.Lock()
+	defer s.Unlock()
+	p := s.params
+	p.header = p.header.Clone()
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if err = p.set(line); err != nil {
+			return
+		}
+	}
+	s.params = p
+	s.result = nil
+	return p.text(), nil
+}
+
+var Status nopfs.Dispatcher = nopfs.NewFun(nopfs.HostF(status)).Limit("http")
+var Headers nopfs.Dispatcher = nopfs.NewFun(nopfs.HostF(headers)).Limit("http")
+var Timings nopfs.Dispatcher = nopfs.NewFun(nopfs.HostF(timing)).Limit("http")
+var Redirects nopfs.Dispatcher = nopfs.NewFun(nopfs.HostF(redirects)).Limit("http")
+var Body nopfs.Dispatcher = nopfs.NewFun(nopfs.HostF(body)).Limit("http")
+var Params nopfs.Dispatcher = &nopfs.Ctl{Writer: paramsCtl}
+
+var Dir *nopfs.Dir
+
+func init() {
+	Dir = nopfs.NewDir()
+	Dir.Append("README.txt", Readme)
+	Dir.Append("status", Status)
+	Dir.Append("headers", Headers)
+	Dir.Append("timing", Timings)
+	Dir.Append("redirects", Redirects)
+	Dir.Append("body", Body)
+	Dir.Append("params", Params)
+}
@@ -0,0 +1,273 @@
+package web
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParamsSet(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		text  string
+		ok    bool
+	}{
+		{"defaults", nil,
+			"method GET\npath /\nscheme http\nfollow yes\ninsecure no\ntimeout 10s\n", true},
+		{"all", []string{
+			"method post",
+			"path health?full",
+			"scheme https",
+			"port 8443",
+			"header x-probe: nopfs",
+			"header Accept: text/plain",
+			"header X-Probe: again",
+			"body a=1",
+			"follow no",
+			"insecure yes",
+			"timeout 2.5s",
+		}, "method POST\npath /health?full\nscheme https\nport 8443\n" +
+			"header Accept: text/plain\nheader X-Probe: nopfs\nheader X-Probe: again\n" +
+			"body a=1\nfollow no\ninsecure yes\ntimeout 2.5s\n", true},
+		{"header removed", []string{"header X-Probe: nopfs", "header x-probe"},
+			"method GET\npath /\nscheme http\nfollow yes\ninsecure no\ntimeout 10s\n", true},
+		{"reset", []string{"method HEAD", "port 81", "reset"},
+			"method GET\npath /\nscheme http\nfollow yes\ninsecure no\ntimeout 10s\n", true},
+		{"no method", []string{"method"}, "", false},
+		{"method with space", []string{"method GET /"}, "", false},
+		{"scheme", []string{"scheme ftp"}, "", false},
+		{"port", []string{"port 65536"}, "", false},
+		{"port not a number", []string{"port http"}, "", false},
+		{"header without name", []string{"header : x"}, "", false},
+		{"follow", []string{"follow maybe"}, "", false},
+		{"timeout", []string{"timeout 0s"}, "", false},
+		{"timeout without unit", []string{"timeout 10"}, "", false},
+		{"unknown", []string{"cookie x=1"}, "", false},
+	}
+	for _, test := range tests {
+		p := defaults()
+		var err error
+		for _, line := range test.lines {
+			if err = p.set(line); err != nil {
+				break
+			}
+		}
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if test.ok && string(p.text()) != test.text {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, p.text(), test.text)
+		}
+	}
+}
+
+func TestParamsURL(t *testing.T) {
+	tests := []struct {
+		host  string
+		lines []string
+		url   string
+	}{
+		{"www.example.com", nil, "http://www.example.com/"},
+		{"www.example.com", []string{"scheme https", "path status"}, "https://www.example.com/status"},
+		{"www.example.com", []string{"port 8080"}, "http://www.example.com:8080/"},
+		{"192.0.2.1", []string{"port 8080"}, "http://192.0.2.1:8080/"},
+		{"2001:db8::1", nil, "http://[2001:db8::1]/"},
+		{"2001:db8::1", []string{"port 8080", "path /a?b=c"}, "http://[2001:db8::1]:8080/a?b=c"},
+	}
+	for _, test := range tests {
+		p := defaults()
+		for _, line := range test.lines {
+			if err := p.set(line); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if u := p.url(test.host); u != test.url {
+			t.Errorf("%s %v: got %s, want %s", test.host, test.lines, u, test.url)
+		}
+	}
+}
+
+func TestMs(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "-"},
+		{1500 * time.Microsecond, "1.500 ms"},
+		{2 * time.Second, "2000.000 ms"},
+	}
+	for _, test := range tests {
+		if s := ms(test.d); s != test.want {
+			t.Errorf("%s: got %q, want %q", test.d, s, test.want)
+		}
+	}
+}
+
+// testSite is a web server to make requests of, redirecting some paths
+// and echoing what was asked of it at /echo
+func testSite(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	redirect := func(path, to string, code int) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, to, code)
+		})
+	}
+	redirect("/found", "/see-other", http.StatusFound)
+	redirect("/see-other", "/echo", http.StatusSeeOther)
+	redirect("/moved", "/echo", http.StatusMovedPermanently)
+	redirect("/temporary", "/echo", http.StatusTemporaryRedirect)
+	redirect("/loop", "/loop", http.StatusFound)
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Host", r.Host)
+		w.Header().Set("X-Probe", r.Header.Get("X-Probe"))
+		w.Write(body)
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	})
+	s := httptest.NewUnstartedServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// target gives the host and the settings to reach the server
+func target(t *testing.T, s *httptest.Server, lines ...string) (string, params) {
+	u, _ := url.Parse(s.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	p := defaults()
+	for _, line := range append([]string{"scheme " + u.Scheme, "port " + port}, lines...) {
+		if err := p.set(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return host, p
+}
+
+func TestRequest(t *testing.T) {
+	s := testSite(t)
+	s.Start()
+	tests := []struct {
+		name   string
+		lines  []string
+		codes  []int
+		method string
+		body   string
+		ok     bool
+	}{
+		{"get", []string{"path /echo"}, []int{200}, "GET", "", true},
+		{"redirects", []string{"path /found"}, []int{302, 303, 200}, "GET", "", true},
+		{"not followed", []string{"path /found", "follow no"}, []int{302}, "", "", true},
+		{"post moved", []string{"method POST", "path /moved", "body a=1"}, []int{301, 200}, "GET", "", true},
+		{"post temporary", []string{"method POST", "path /temporary", "body a=1"}, []int{307, 200}, "POST", "a=1", true},
+		{"put moved", []string{"method PUT", "path /moved", "body a=1"}, []int{301, 200}, "PUT", "a=1", true},
+		{"header", []string{"path /echo", "header X-Probe: nopfs"}, []int{200}, "GET", "", true},
+		{"loop", []string{"path /loop"}, nil, "", "", false},
+		{"timeout", []string{"path /slow", "timeout 100ms"}, nil, "", "", false},
+	}
+	for _, test := range tests {
+		host, p := target(t, s, test.lines...)
+		res, err := request(host, p)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		var codes []int
+		for _, h := range res.Hops {
+			codes = append(codes, h.Code)
+		}
+		if !reflect.DeepEqual(codes, test.codes) {
+			t.Errorf("%s: got codes %v, want %v", test.name, codes, test.codes)
+			continue
+		}
+		h := final(res)
+		if test.method != "" && (h.Header.Get("X-Method") != test.method || string(res.Body) != test.body) {
+			t.Errorf("%s: got %s %q", test.name, h.Header.Get("X-Method"), res.Body)
+		}
+		if test.name == "header" && h.Header.Get("X-Probe") != "nopfs" {
+			t.Errorf("%s: header not sent", test.name)
+		}
+		if h.Timing.Connect <= 0 || h.Timing.TTFB <= 0 || h.Timing.Total < h.Timing.TTFB ||
+			h.Timing.DNS != 0 || h.Timing.TLS != 0 {
+			t.Errorf("%s: got timing %+v", test.name, h.Timing)
+		}
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	s := testSite(t)
+	s.Start()
+	defer func(n int64) { MaxBody = n }(MaxBody)
+	MaxBody = 100
+
+	host, p := target(t, s, "path /big")
+	res, err := request(host, p)
+	if err != nil || len(res.Body) != 100 {
+		t.Errorf("got %v, %d bytes", err, len(res.Body))
+	}
+
+	host, p = target(t, s, "path /echo", "header Host: www.example.com")
+	res, err = request(host, p)
+	if err != nil || final(res).Header.Get("X-Host") != "www.example.com" {
+		t.Errorf("got %v, host %s", err, final(res).Header.Get("X-Host"))
+	}
+}
+
+func TestRequestTLS(t *testing.T) {
+	s := testSite(t)
+	s.StartTLS()
+
+	// The test certificate is trusted only when asked to be
+	host, p := target(t, s, "path /echo")
+	if _, err := request(host, p); err == nil {
+		t.Error("untrusted certificate accepted")
+	}
+	host, p = target(t, s, "path /echo", "insecure yes")
+	res, err := request(host, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := final(res); h.Code != 200 || h.Timing.TLS <= 0 {
+		t.Errorf("got %d, timing %+v", h.Code, h.Timing)
+	}
+}
+
+func TestTiming(t *testing.T) {
+	s := testSite(t)
+	s.Start()
+	host, p := target(t, s, "path /found")
+	site := siteOf(host)
+	site.Lock()
+	site.params, site.result = p, nil
+	site.Unlock()
+
+	data, err := timing(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	want := []string{"dns      -", "connect  ", "tls      -", "ttfb     ", "total    ", "2 redirects, "}
+	if len(lines) != len(want) {
+		t.Fatalf("got\n%s", data)
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, want[i]) {
+			t.Errorf("got %q, want %q...", line, want[i])
+		}
+	}
+}
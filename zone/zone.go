@@ -0,0 +1,558 @@
+package zone
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/rminnich/go9p"
+	"hubs.net.uk/sw/nopfs"
+	"hubs.net.uk/sw/nopfs/dns"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var readme_zone = `
+Zone transfers
+==============
+
+This directory contains a subdirectory for each zone that may be
+transferred. These are not listed until they have been used. For
+example,
+
+  % cat example.com/serial
+  % cat example.com/all
+  % ls example.com/www
+  % cat example.com/www/a
+
+  z/all       The whole zone in zone file format
+  z/serial    The serial number of the zone
+  z/update    Write changes to the zone, as for dns/update, to send
+              them to the primary as a signed dynamic update, then
+              read back the response code
+  z/o/t       The records of type t, as in a or mx, owned by o, a
+              name relative to the zone or @ for the zone itself
+
+The zone is fetched with AXFR from its primary, by default the server
+named in its SOA record. Whenever the zone is used, and at most every
+30 seconds, the serial on the primary is checked and any changes
+fetched with IXFR.
+
+The primary and the TSIG key used to sign transfers and updates, by
+default the key named after the zone, are given to the server for a
+zone with -zone zone=primary[,key], where the primary may be a dial
+string such as tls!192.0.2.53 for transfers over TLS and keys are
+given with -tsig. Reading zones gives them as "zone primary [key]".
+Clients may not change them, as the zone every client sees would then
+come from wherever one of them chose. Updates are only signed with a
+key named after the zone or given it with -tsigzones.
+
+`
+var Readme nopfs.Dispatcher = nopfs.NewFile([]byte(readme_zone))
+
+// Time between checks of the serial on the primary
+var RefreshInterval = 30 * time.Second
+
+// Where to transfer a zone from
+type source struct {
+	primary string
+	key     string
+}
+
+// A zone as it was last transferred
+type zoneData struct {
+	sync.Mutex
+	zone    string
+	serial  uint32
+	rrs     []dns.RR
+	checked time.Time
+}
+
+var zones = struct {
+	sync.RWMutex
+	sources map[string]source
+	data    map[string]*zoneData
+}{sources: make(map[string]source), data: make(map[string]*zoneData)}
+
+func zoneName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+// Sources sets where zones are transferred from. It may be used as a
+// flag, each value being zone=primary[,key].
+type Sources struct{}
+
+func (s Sources) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("zone: expected zone=primary[,key]: %s", v)
+	}
+	return setSource(parts[0], strings.Split(parts[1], ","))
+}
+
+func (s Sources) String() string {
+	return ""
+}
+
+func setSource(zone string, fields []string) error {
+	src := source{}
+	if len(fields) > 0 {
+		src.primary = fields[0]
+		if _, _, err := dns.ParseServer(src.primary); err != nil {
+			return err
+		}
+	}
+	if len(fields) > 1 {
+		src.key = fields[1]
+		if dns.Keys.Get(src.key) == nil {
+			return fmt.Errorf("zone: unknown key %s", src.key)
+		}
+	}
+	if len(fields) > 2 {
+		return errors.New("zone: expected zone=primary[,key]")
+	}
+	zones.Lock()
+	defer zones.Unlock()
+	if src == (source{}) {
+		delete(zones.sources, zoneName(zone))
+	} else {
+		zones.sources[zoneName(zone)] = src
+	}
+	// Transfer again from the new source
+	delete(zones.data, zoneName(zone))
+	return nil
+}
+
+func listSources() []byte {
+	zones.RLock()
+	defer zones.RUnlock()
+	names := make([]string, 0, len(zones.sources))
+	for name := range zones.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := &bytes.Buffer{}
+	for _, name := range names {
+		src := zones.sources[name]
+		fmt.Fprintf(buf, "%s %s", name, src.primary)
+		if src.key != "" {
+			fmt.Fprintf(buf, " %s", src.key)
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func sourcesFile(path []string) ([]byte, error) {
+	return listSources(), nil
+}
+
+// primaryOf returns the server to transfer the zone from and the key to
+// sign the request with.
+func primaryOf(zone string) (primary string, key *dns.TSIGKey, err error) {
+	zones.RLock()
+	src := zones.sources[zone]
+	zones.RUnlock()
+	if src.key != "" {
+		key = dns.Keys.Get(src.key)
+	} else {
+		key = dns.Keys.Get(zone)
+	}
+	if src.primary != "" {
+		return src.primary, key, nil
+	}
+	primary, err = dns.PrimaryOf("", zone)
+	return
+}
+
+// serialOf asks the primary for the current serial of the zone
+func serialOf(primary, zone string) (serial uint32, err error) {
+	r, _, err := dns.Send(primary, dns.NewQuery(zone, dns.TypeSOA))
+	if err != nil {
+		return
+	}
+	for i := range r.Answer {
+		if r.Answer[i].Type == dns.TypeSOA {
+			soa, e := r.Answer[i].SOA()
+			if e == nil {
+				return soa.Serial, nil
+			}
+		}
+	}
+	err = fmt.Errorf("zone: no SOA for %s on %s", zone, primary)
+	return
+}
+
+func sameRR(a, b *dns.RR) bool {
+	return a.Type == b.Type && a.Class == b.Class && strings.EqualFold(a.Name, b.Name) &&
+		bytes.Equal(a.Data, b.Data)
+}
+
+// apply makes the changes in the deltas to a copy of the records
+func apply(rrs []dns.RR, deltas []dns.Delta) []dns.RR {
+	for _, d := range deltas {
+		kept := make([]dns.RR, 0, len(rrs)+len(d.Add))
+		for i := range rrs {
+			deleted := false
+			for j := range d.Del {
+				if sameRR(&rrs[i], &d.Del[j]) {
+					deleted = true
+					break
+				}
+			}
+			if !deleted {
+				kept = append(kept, rrs[i])
+			}
+		}
+		rrs = append(kept, d.Add...)
+	}
+	// Keep the SOA first, as in a whole transfer
+	for i := range rrs {
+		if rrs[i].Type == dns.TypeSOA {
+			rrs[0], rrs[i] = rrs[i], rrs[0]
+			break
+		}
+	}
+	return rrs
+}
+
+// refresh brings the zone up to date if it has not been checked
+// recently, transferring it if it has changed. The request is charged
+// to the client's budget for zone transfers.
+func (z *zoneData) refresh(req *go9p.SrvReq) error {
+	z.Lock()
+	defer z.Unlock()
+	if z.rrs != nil && time.Since(z.checked) < RefreshInterval {
+		return nil
+	}
+	primary, key, err := primaryOf(z.zone)
+	if err != nil {
+		return err
+	}
+	if z.rrs != nil {
+		serial, err := serialOf(primary, z.zone)
+		if err != nil {
+			return err
+		}
+		if serial == z.serial {
+			z.checked = time.Now()
+			return nil
+		}
+	}
+	if err = nopfs.Limits.Allow("axfr", req); err != nil {
+		return err
+	}
+
+	var serial uint32
+	if z.rrs != nil {
+		serial = z.serial
+	}
+	start := time.Now()
+	rrs, deltas, err := dns.Transfer(primary, z.zone, serial, key)
+	if err != nil {
+		nopfs.Log.Error("transfer", "zone", z.zone, "primary", primary, "error", err)
+		return err
+	}
+	switch {
+	case rrs != nil:
+		z.rrs = rrs
+	case deltas != nil:
+		z.rrs = apply(z.rrs, deltas)
+	}
+	for i := range z.rrs {
+		if z.rrs[i].Type == dns.TypeSOA {
+			z.serial, _ = dns.SOASerial(&z.rrs[i])
+			break
+		}
+	}
+	z.checked = time.Now()
+	nopfs.Log.Info("transfer", "zone", z.zone, "primary", primary, "serial", z.serial,
+		"records", len(z.rrs), "incremental", deltas != nil, "duration", time.Since(start))
+	return nil
+}
+
+// get returns the zone's data, transferring it first if need be
+func get(zone string, req *go9p.SrvReq) (serial uint32, rrs []dns.RR, err error) {
+	zone = zoneName(zone)
+	zones.Lock()
+	z, ok := zones.data[zone]
+	if !ok {
+		z = &zoneData{zone: zone}
+		zones.data[zone] = z
+	}
+	zones.Unlock()
+	if err = z.refresh(req); err != nil {
+		// Only zones that have been transferred are listed
+		zones.Lock()
+		if z.rrs == nil && zones.data[zone] == z {
+			delete(zones.data, zone)
+		}
+		zones.Unlock()
+		return
+	}
+	z.Lock()
+	defer z.Unlock()
+	return z.serial, z.rrs, nil
+}
+
+// relName gives the owner name relative to the zone, @ for the apex
+func relName(name, zone string) string {
+	name = strings.ToLower(name)
+	if name == zone {
+		return "@"
+	}
+	return strings.TrimSuffix(name, "."+zone)
+}
+
+// owner picks out the records owned by the relative name, or all of
+// them for an empty name, of the type, or any type if it is zero.
+func owner(rrs []dns.RR, zone, rel string, qtype uint16) (found []dns.RR) {
+	for i := range rrs {
+		if rel != "" && relName(rrs[i].Name, zone) != rel {
+			continue
+		}
+		if qtype != 0 && rrs[i].Type != qtype {
+			continue
+		}
+		found = append(found, rrs[i])
+	}
+	return
+}
+
+func zoneFormat(rrs []dns.RR) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, len(rrs)*64))
+	for i := range rrs {
+		buf.WriteString(rrs[i].String())
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func all(path []string) (data []byte, err error) {
+	_, rrs, err := get(path[1], nil)
+	if err != nil {
+		return
+	}
+	data = zoneFormat(rrs)
+	return
+}
+
+func serial(path []string) (data []byte, err error) {
+	serial, _, err := get(path[1], nil)
+	if err != nil {
+		return
+	}
+	data = []byte(fmt.Sprintf("%d\n", serial))
+	return
+}
+
+func records(path []string) (data []byte, err error) {
+	zone := zoneName(path[1])
+	qtype, ok := dns.TypeValue(path[3])
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	_, rrs, err := get(zone, nil)
+	if err != nil {
+		return
+	}
+	found := owner(rrs, zone, path[2], qtype)
+	if len(found) == 0 {
+		return nil, os.ErrNotExist
+	}
+	data = zoneFormat(found)
+	return
+}
+
+// updateCtl sends the changes written to it to the zone's primary as a
+// dynamic update, after which the zone is checked again when next used.
+func updateCtl(c *nopfs.Ctl, data []byte) (resp []byte, err error) {
+	zone := zoneName(c.GetPath()[1])
+	rcode, err := dns.Update(zone, zone, data)
+	if err == nil && rcode == dns.RcodeSuccess {
+		zones.RLock()
+		z, ok := zones.data[zone]
+		zones.RUnlock()
+		if ok {
+			z.Lock()
+			z.checked = time.Time{}
+			z.Unlock()
+		}
+	}
+	return dns.UpdateResult(rcode, err)
+}
+
+var All nopfs.Dispatcher = nopfs.NewFun(all)
+var Serial nopfs.Dispatcher = nopfs.NewFun(serial)
+var Records nopfs.Dispatcher = nopfs.NewFun(records)
+var Update nopfs.Dispatcher = &nopfs.Ctl{Writer: updateCtl}
+
+// ZonesDir contains a directory for every zone, transferring the zone
+// when it is walked into, besides its own entries. Zones are listed
+// once they have been used.
+type ZonesDir struct {
+	*nopfs.Dir
+}
+
+func (d *ZonesDir) Clone() nopfs.Dispatcher {
+	return &ZonesDir{d.Dir.Clone().(*nopfs.Dir)}
+}
+
+func (d *ZonesDir) Walk(req *go9p.SrvReq, name string) (nopfs.Dispatcher, error) {
+	if n, err := d.Dir.Walk(req, name); err == nil {
+		return n, nil
+	}
+	if _, _, err := get(name, req); err != nil {
+		return nil, err
+	}
+	n := &zoneDir{}
+	n.SetPath(append(append([]string{}, d.GetPath()...), name))
+	n.SetParent(d)
+	return n, nil
+}
+
+func (d *ZonesDir) Read(req *go9p.SrvReq) ([]byte, error) {
+	listing, err := d.Dir.Read(req)
+	if err != nil {
+		return nil, err
+	}
+	zones.RLock()
+	names := make([]string, 0, len(zones.data))
+	for name := range zones.data {
+		names = append(names, strings.TrimSuffix(name, "."))
+	}
+	zones.RUnlock()
+	sort.Strings(names)
+	entries := make([]nopfs.Dispatcher, 0, len(names))
+	for _, name := range names {
+		n := &zoneDir{}
+		n.SetPath(append(append([]string{}, d.GetPath()...), name))
+		entries = append(entries, n)
+	}
+	return append(append([]byte{}, listing...), nopfs.PackEntries(req, entries)...), nil
+}
+
+// zoneDir holds the all and serial files and a directory for each
+// owner name in the zone
+type zoneDir struct {
+	nopfs.ListDir
+}
+
+func (d *zoneDir) Clone() nopfs.Dispatcher {
+	n := &zoneDir{}
+	n.SetPath(d.GetPath())
+	n.SetParent(d.GetParent())
+	return n
+}
+
+func (d *zoneDir) Walk(req *go9p.SrvReq, name string) (nopfs.Dispatcher, error) {
+	switch name {
+	case "all":
+		return nopfs.Entry(d, All, name), nil
+	case "serial":
+		return nopfs.Entry(d, Serial, name), nil
+	case "update":
+		return nopfs.Entry(d, Update, name), nil
+	}
+	zone := zoneName(d.GetPath()[1])
+	_, rrs, err := get(zone, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(owner(rrs, zone, name, 0)) == 0 {
+		return nil, os.ErrNotExist
+	}
+	n := &ownerDir{}
+	n.SetPath(append(append([]string{}, d.GetPath()...), name))
+	n.SetParent(d)
+	return n, nil
+}
+
+func (d *zoneDir) Read(req *go9p.SrvReq) ([]byte, error) {
+	zone := zoneName(d.GetPath()[1])
+	_, rrs, err := get(zone, req)
+	if err != nil {
+		return nil, err
+	}
+	entries := []nopfs.Dispatcher{nopfs.Entry(d, All, "all"), nopfs.Entry(d, Serial, "serial"), nopfs.Entry(d, Update, "update")}
+	seen := map[string]bool{}
+	for i := range rrs {
+		rel := relName(rrs[i].Name, zone)
+		if seen[rel] {
+			continue
+		}
+		seen[rel] = true
+		n := &ownerDir{}
+		n.SetPath(append(append([]string{}, d.GetPath()...), rel))
+		entries = append(entries, n)
+	}
+	return nopfs.PackEntries(req, entries), nil
+}
+
+// ownerDir holds a file for each type of record owned by a name
+type ownerDir struct {
+	nopfs.ListDir
+}
+
+func (d *ownerDir) Clone() nopfs.Dispatcher {
+	n := &ownerDir{}
+	n.SetPath(d.GetPath())
+	n.SetParent(d.GetParent())
+	return n
+}
+
+func (d *ownerDir) types(req *go9p.SrvReq) (types []uint16, err error) {
+	path := d.GetPath()
+	zone := zoneName(path[1])
+	_, rrs, err := get(zone, req)
+	if err != nil {
+		return
+	}
+	seen := map[uint16]bool{}
+	for _, rr := range owner(rrs, zone, path[2], 0) {
+		if !seen[rr.Type] {
+			seen[rr.Type] = true
+			types = append(types, rr.Type)
+		}
+	}
+	return
+}
+
+func (d *ownerDir) Walk(req *go9p.SrvReq, name string) (nopfs.Dispatcher, error) {
+	types, err := d.types(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range types {
+		if strings.ToLower(dns.TypeName(t)) == strings.ToLower(name) {
+			return nopfs.Entry(d, Records, name), nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func (d *ownerDir) Read(req *go9p.SrvReq) ([]byte, error) {
+	types, err := d.types(req)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]nopfs.Dispatcher, 0, len(types))
+	for _, t := range types {
+		entries = append(entries, nopfs.Entry(d, Records, strings.ToLower(dns.TypeName(t))))
+	}
+	return nopfs.PackEntries(req, entries), nil
+}
+
+var Dir *ZonesDir
+
+func init() {
+	Dir = &ZonesDir{nopfs.NewDir()}
+	Dir.Append("README.txt", Readme)
+	Dir.Append("zones", nopfs.NewFun(sourcesFile))
+
+	dns.UpdateSource = func(zone string) (string, *dns.TSIGKey, error) {
+		return primaryOf(zoneName(zone))
+	}
+}
@@ -0,0 +1,301 @@
+package zone
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hubs.net.uk/sw/nopfs/dns"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func mustRR(t *testing.T, line string) dns.RR {
+	t.Helper()
+	rr, err := dns.ParseRR(line, ".", 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// A primary serves a zone, answering SOA queries over UDP and transfers
+// over TCP, incrementally from the version before the current one.
+type primary struct {
+	sync.Mutex
+	versions  [][]dns.RR
+	transfers []uint16
+}
+
+func soaOf(rrs []dns.RR) dns.RR {
+	for _, rr := range rrs {
+		if rr.Type == dns.TypeSOA {
+			return rr
+		}
+	}
+	return dns.RR{}
+}
+
+// answer gives the records of the reply to the query
+func (p *primary) answer(q *dns.Msg) []dns.RR {
+	p.Lock()
+	defer p.Unlock()
+	cur := p.versions[len(p.versions)-1]
+	soa := soaOf(cur)
+	switch q.Question[0].Type {
+	case dns.TypeSOA:
+		return []dns.RR{soa}
+	case dns.TypeIXFR:
+		p.transfers = append(p.transfers, dns.TypeIXFR)
+		have, _ := dns.SOASerial(&q.Authority[0])
+		for i := 0; i < len(p.versions)-1; i++ {
+			old := p.versions[i]
+			oldSOA := soaOf(old)
+			if serial, _ := dns.SOASerial(&oldSOA); serial != have || i != len(p.versions)-2 {
+				continue
+			}
+			rrs := []dns.RR{soa, oldSOA}
+			rrs = append(rrs, missing(old, cur)...)
+			rrs = append(rrs, soa)
+			rrs = append(rrs, missing(cur, old)...)
+			return append(rrs, soa)
+		}
+	default:
+		p.transfers = append(p.transfers, dns.TypeAXFR)
+	}
+	rrs := []dns.RR{}
+	for _, rr := range cur {
+		if rr.Type != dns.TypeSOA {
+			rrs = append(rrs, rr)
+		}
+	}
+	return append(append([]dns.RR{soa}, rrs...), soa)
+}
+
+// missing gives the records of a, but the SOA, that are not in b
+func missing(a, b []dns.RR) (rrs []dns.RR) {
+	for i := range a {
+		found := a[i].Type == dns.TypeSOA
+		for j := range b {
+			found = found || sameRR(&a[i], &b[j])
+		}
+		if !found {
+			rrs = append(rrs, a[i])
+		}
+	}
+	return
+}
+
+func (p *primary) reply(query []byte) []byte {
+	q, err := dns.Unpack(query)
+	if err != nil || len(q.Question) != 1 {
+		return nil
+	}
+	r := &dns.Msg{Header: dns.Header{Id: q.Id, Response: true, Authoritative: true},
+		Question: q.Question, Answer: p.answer(q)}
+	wire, _ := r.Pack()
+	return wire
+}
+
+// standIn starts the primary on a port of the loopback address
+func (p *primary) standIn(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		l.Close()
+	})
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if wire := p.reply(buf[:n]); wire != nil {
+				pc.WriteTo(wire, from)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var n uint16
+				if binary.Read(conn, binary.BigEndian, &n) != nil {
+					return
+				}
+				query := make([]byte, n)
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				if wire := p.reply(query); wire != nil {
+					binary.Write(conn, binary.BigEndian, uint16(len(wire)))
+					conn.Write(wire)
+				}
+			}()
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// version makes the zone of the serial with the addresses for www
+func version(t *testing.T, serial int, addrs ...string) []dns.RR {
+	rrs := []dns.RR{
+		mustRR(t, fmt.Sprintf("example.com. 3600 IN SOA ns.example.com. admin.example.com. %d 3600 600 86400 300", serial)),
+		mustRR(t, "example.com. 3600 IN NS ns.example.com."),
+		mustRR(t, "ns.example.com. 3600 IN A 192.0.2.53"),
+	}
+	for _, addr := range addrs {
+		rrs = append(rrs, mustRR(t, "www.example.com. 300 IN A "+addr))
+	}
+	return rrs
+}
+
+// reset forgets the zones and their sources
+func reset() {
+	zones.Lock()
+	zones.sources = make(map[string]source)
+	zones.data = make(map[string]*zoneData)
+	zones.Unlock()
+}
+
+func TestSources(t *testing.T) {
+	defer reset()
+	reset()
+	tests := []struct {
+		v   string
+		err bool
+	}{
+		{"Example.COM=192.0.2.53", false},
+		{"example.net=tls!192.0.2.54", false},
+		{"example.org=192.0.2.55,nokey", true},
+		{"example.org=192.0.2.55,a,b", true},
+		{"example.org", true},
+	}
+	for _, test := range tests {
+		if err := (Sources{}).Set(test.v); (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.v, err)
+		}
+	}
+	want := "example.com. 192.0.2.53\nexample.net. tls!192.0.2.54\n"
+	if got := string(listSources()); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// An empty primary removes the source
+	if err := (Sources{}).Set("example.net="); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(listSources()); got != "example.com. 192.0.2.53\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	defer reset()
+	reset()
+	defer func(d time.Duration) { RefreshInterval = d }(RefreshInterval)
+	RefreshInterval = time.Hour
+
+	p := &primary{versions: [][]dns.RR{version(t, 1, "192.0.2.1")}}
+	if err := (Sources{}).Set("example.com=" + p.standIn(t)); err != nil {
+		t.Fatal(err)
+	}
+	www := func() (uint32, string) {
+		t.Helper()
+		s, rrs, err := get("Example.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var addrs []string
+		for _, rr := range owner(rrs, "example.com.", "www", dns.TypeA) {
+			addrs = append(addrs, rr.IP().String())
+		}
+		return s, strings.Join(addrs, " ")
+	}
+	tests := []struct {
+		name      string
+		version   []dns.RR
+		expire    bool
+		serial    uint32
+		addrs     string
+		transfers string
+	}{
+		{"first use", nil, false, 1, "192.0.2.1", "AXFR"},
+		{"checked recently", version(t, 2, "192.0.2.2"), false, 1, "192.0.2.1", "AXFR"},
+		{"serial changed", nil, true, 2, "192.0.2.2", "AXFR IXFR"},
+		{"serial unchanged", nil, true, 2, "192.0.2.2", "AXFR IXFR"},
+		{"serial changed again", version(t, 3, "192.0.2.2", "192.0.2.3"), true, 3, "192.0.2.2 192.0.2.3", "AXFR IXFR IXFR"},
+	}
+	for _, test := range tests {
+		p.Lock()
+		if test.version != nil {
+			p.versions = append(p.versions, test.version)
+		}
+		p.Unlock()
+		if test.expire {
+			zones.RLock()
+			z := zones.data["example.com."]
+			zones.RUnlock()
+			z.Lock()
+			z.checked = time.Time{}
+			z.Unlock()
+		}
+		s, addrs := www()
+		p.Lock()
+		var transfers []string
+		for _, qtype := range p.transfers {
+			transfers = append(transfers, dns.TypeName(qtype))
+		}
+		p.Unlock()
+		if s != test.serial || addrs != test.addrs || strings.Join(transfers, " ") != test.transfers {
+			t.Errorf("%s: got serial %d, www %s after %v", test.name, s, addrs, transfers)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	v1, v2 := version(t, 1, "192.0.2.1", "192.0.2.2"), version(t, 2, "192.0.2.2", "192.0.2.3")
+	deltas := []dns.Delta{{From: 1, To: 2,
+		Del: append([]dns.RR{v1[0]}, missing(v1, v2)...),
+		Add: append([]dns.RR{v2[0]}, missing(v2, v1)...)}}
+	rrs := apply(append([]dns.RR{}, v1...), deltas)
+	if len(rrs) != len(v2) || rrs[0].Type != dns.TypeSOA {
+		t.Fatalf("got %v", rrs)
+	}
+	if serial, _ := dns.SOASerial(&rrs[0]); serial != 2 {
+		t.Errorf("got serial %d", serial)
+	}
+	for i := range v2 {
+		if len(missing(v2[i:i+1], rrs)) != 0 {
+			t.Errorf("no %s", v2[i].String())
+		}
+	}
+}
+
+func TestRelName(t *testing.T) {
+	tests := []struct{ name, rel string }{
+		{"example.com.", "@"},
+		{"WWW.Example.com.", "www"},
+		{"a.b.example.com.", "a.b"},
+	}
+	for _, test := range tests {
+		if rel := relName(test.name, "example.com."); rel != test.rel {
+			t.Errorf("%s: got %q, want %q", test.name, rel, test.rel)
+		}
+	}
+}